@@ -74,26 +74,49 @@ func setupOutputs(ctx context.Context, resultChannel *chan util.DNSResult) error
 	} else {
 		log.Infof("allowDomains refresh interval is %s", util.GeneralFlags.AllowDomainsRefreshInterval)
 	}
+	// the rate limiter is nil when disabled. in that case the ticker is stopped
+	// right away and its channel never fires
+	rateLimiter := util.NewRateLimiter()
+	rateLimitTicker := time.NewTicker(time.Hour)
+	if rateLimiter != nil {
+		log.Infof("per-client rate limiting is enabled")
+		rateLimitTicker.Reset(rateLimiter.SummaryInterval())
+	} else {
+		rateLimitTicker.Stop()
+	}
+	defer rateLimitTicker.Stop()
+
 	g, gCtx := errgroup.WithContext(ctx)
 	dispatchedPackets := metrics.GetOrRegisterCounter("dispatchedPackets", metrics.DefaultRegistry)
 	droppedPackets := metrics.GetOrRegisterCounter("droppedPackets", metrics.DefaultRegistry)
 
+	dispatch := func(data util.DNSResult) {
+		for _, o := range util.GlobalDispatchList {
+			// Non-blocking send to prevent blocking on full channels
+			select {
+			case o.OutputChannel() <- data:
+				dispatchedPackets.Inc(1)
+			default:
+				// Channel is full, drop packet
+				droppedPackets.Inc(1)
+			}
+		}
+	}
+
 	g.Go(func() error {
 		// blocking loop
 		for {
 			select {
 			case data := <-*resultChannel:
-				for _, o := range util.GlobalDispatchList {
-					// Non-blocking send to prevent blocking on full channels
-					select {
-					case o.OutputChannel() <- data:
-						dispatchedPackets.Inc(1)
-					default:
-						// Channel is full, drop packet
-						droppedPackets.Inc(1)
-					}
+				if rateLimiter != nil && !rateLimiter.Allow(&data) {
+					continue
 				}
+				dispatch(data)
 
+			case <-rateLimitTicker.C:
+				for _, summary := range rateLimiter.Summaries() {
+					dispatch(summary)
+				}
 			case <-skipDomainsFileTickerChan:
 				util.GeneralFlags.LoadSkipDomain()
 			case <-allowDomainsFileTickerChan:
@@ -11,12 +11,14 @@ require (
 	github.com/hashicorp/go-syslog v1.0.0
 	github.com/influxdata/influxdb-client-go/v2 v2.14.0
 	github.com/jackc/pgx/v4 v4.18.3
-	github.com/packetcap/go-pcap v0.0.0-20251215121130-f2cf9f991e7c
+	github.com/nats-io/nats.go v1.49.0
 	github.com/parquet-go/parquet-go v0.28.0
 	github.com/prometheus/client_golang v1.23.2
 	github.com/rcrowley/go-metrics v0.0.0-20250401214520-65e299d6c5c9
 	github.com/syntaqx/go-metrics-datadog v0.1.3
+	github.com/ulikunitz/xz v0.5.12
 	golang.org/x/sync v0.19.0
+	golang.org/x/sys v0.41.0
 )
 
 require (
@@ -49,7 +51,6 @@ require (
 	github.com/josharian/intern v1.0.0 // indirect
 	github.com/klauspost/cpuid/v2 v2.3.0 // indirect
 	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
-	github.com/nats-io/nats.go v1.49.0 // indirect
 	github.com/nats-io/nkeys v0.4.12 // indirect
 	github.com/nats-io/nuid v1.0.1 // indirect
 	github.com/oapi-codegen/runtime v1.2.0 // indirect
@@ -80,7 +81,7 @@ require (
 	github.com/bytedance/sonic v1.15.0
 	github.com/dnstap/golang-dnstap v0.4.0
 	github.com/jessevdk/go-flags v1.6.1
-	github.com/klauspost/compress v1.18.4 // indirect
+	github.com/klauspost/compress v1.18.4
 	github.com/mailru/easyjson v0.9.1 // indirect
 	github.com/miekg/dns v1.1.72
 	github.com/mosajjal/Go-Splunk-HTTP/splunk/v2 v2.0.7
@@ -92,6 +93,5 @@ require (
 	github.com/sirupsen/logrus v1.9.4
 	golang.org/x/crypto v0.48.0 // indirect
 	golang.org/x/net v0.51.0
-	golang.org/x/sys v0.41.0 // indirect
 	google.golang.org/protobuf v1.36.11
 )
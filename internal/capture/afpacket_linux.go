@@ -18,9 +18,12 @@
 package capture
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"time"
 
+	"github.com/mosajjal/dnsmonster/internal/util"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/gopacket/gopacket"
@@ -28,6 +31,67 @@ import (
 	"github.com/gopacket/gopacket/layers"
 )
 
+// afpacketConfig holds the fanout options of the afpacket inputs
+type afpacketConfig struct {
+	AfpacketFanout      string `long:"afpacketfanout"      ini-name:"afpacketfanout"      env:"DNSMONSTER_AFPACKETFANOUT"      default:"none" description:"PACKET_FANOUT mode of the AFpacket sockets. hash keeps both directions of a flow on the same socket, cpu follows the CPU that received the packet and lb spreads the packets round-robin" choice:"none" choice:"hash" choice:"cpu" choice:"lb"`
+	AfpacketSockets     uint   `long:"afpacketsockets"     ini-name:"afpacketsockets"     env:"DNSMONSTER_AFPACKETSOCKETS"     default:"1"    description:"Number of AFpacket sockets in the fanout group, each with its own reader and --packetHandlerCount decode workers"`
+	AfpacketFanoutGroup uint16 `long:"afpacketfanoutgroup" ini-name:"afpacketfanoutgroup" env:"DNSMONSTER_AFPACKETFANOUTGROUP" default:"0"    description:"ID of the fanout group. dnsmonster processes using the same ID and mode on an interface share its packets. 0 picks an ID from the process ID"`
+}
+
+func init() {
+	source := &afpacketSource{}
+	if _, err := util.GlobalParser.AddGroup("afpacket", "Options of the afpacket inputs", &source.config); err != nil {
+		log.Fatalf("error adding afpacket input options")
+	}
+	registerCaptureSource(inputAfpacket, source)
+}
+
+// the PACKET_FANOUT modes of --afpacketFanout. The kernel defragments the
+// packets before hashing them so the fragments of a packet stay together,
+// even across processes.
+var afpacketFanoutTypes = map[string]afpacket.FanoutType{
+	"hash": afpacket.FanoutHash | afpacket.FanoutHashWithDefrag,
+	"cpu":  afpacket.FanoutCPU,
+	"lb":   afpacket.FanoutLoadBalance,
+}
+
+// afpacketSource captures with one or more TPACKET_V3 sockets. With
+// --afpacketFanout, the sockets join a fanout group the kernel spreads the
+// packets over, each socket with its own reader and decode workers.
+type afpacketSource struct {
+	config afpacketConfig
+}
+
+func (*afpacketSource) name(target string) (string, error) { return target, nil }
+
+func (s *afpacketSource) start(ctx context.Context, config *captureConfig, in *captureInput) error {
+	fanout, hasFanout := afpacketFanoutTypes[s.config.AfpacketFanout]
+	sockets := max(1, s.config.AfpacketSockets)
+	if sockets > 1 && !hasFanout {
+		return fmt.Errorf("--afpacketSockets needs an --afpacketFanout mode, every socket would get all the packets otherwise")
+	}
+	group := s.config.AfpacketFanoutGroup
+	if group == 0 {
+		group = uint16(os.Getpid())
+	}
+
+	handlers := make([]genericPacketHandler, 0, sockets)
+	for range sockets {
+		handle := config.initializeLiveAFpacket(in.target, in.filter)
+		defer handle.Close()
+		if hasFanout {
+			if err := handle.TPacket.SetFanout(fanout, group); err != nil {
+				return fmt.Errorf("error joining fanout group %d on %s: %w", group, in.target, err)
+			}
+		}
+		handlers = append(handlers, handle)
+	}
+	if hasFanout {
+		log.Infof("%d AFpacket sockets joined %s fanout group %d on %s", sockets, s.config.AfpacketFanout, group, in.target)
+	}
+	return config.runPacketHandlers(ctx, in, handlers, liveCaptureInterface(in.target))
+}
+
 type afpacketHandle struct {
 	TPacket *afpacket.TPacket
 }
@@ -0,0 +1,50 @@
+//go:build linux && !android && !nocgo
+
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import "testing"
+
+func TestParseAfpacketInput(t *testing.T) {
+	got, err := parseInput("AFPACKET:eth1;filter=udp port 53;sample=1:10;label=uplink", "default", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.source != captureSources[inputAfpacket] {
+		t.Error("input has no source")
+	}
+	got.source = nil
+	if want := (captureInput{kind: "afpacket", target: "eth1", filter: "udp port 53", filterSet: true, label: "uplink", name: "uplink", ratioA: 1, ratioB: 10}); *got != want {
+		t.Errorf("got %+v, want %+v", *got, want)
+	}
+
+	// --useAfpacket turns --devName into an afpacket input
+	config := captureConfig{DevName: "eth0", UseAfpacket: true, Input: []string{"live:eth0;label=eth0-live"}, ratioA: 1, ratioB: 1}
+	inputs, err := config.parseInputs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) != 2 || inputs[0].kind != inputAfpacket || inputs[0].target != "eth0" {
+		t.Errorf("unexpected inputs %+v", inputs)
+	}
+	config = captureConfig{Input: []string{"live:eth0", "afpacket:eth0"}}
+	if _, err := config.parseInputs(); err == nil {
+		t.Error("two inputs with the same name were accepted")
+	}
+}
+
+// vim: foldmethod=marker
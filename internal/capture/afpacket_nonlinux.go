@@ -19,6 +19,7 @@ package capture
 
 // This entire file is a dummy one to make sure all our cross platform builds work even if the underlying OS doesn't suppot some of the functionality
 // afpacket is a Linux-only feature, so we want the relevant function to technically "translate" to something here, which basically returns an error
+// The afpacket capture source is not registered here, --input afpacket:DEVICE is refused as an unknown kind.
 
 import (
 	"fmt"
@@ -59,8 +60,4 @@ func (afhandle *afpacketHandle) Stat() (uint, uint, error) {
 	return 0, 0, fmt.Errorf("Dnsmonster has been compiled without afpacket support for this platform")
 }
 
-func (config *captureConfig) initializeLiveAFpacket(devName, filter string) *afpacketHandle {
-	return nil
-}
-
 // vim: foldmethod=marker
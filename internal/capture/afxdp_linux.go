@@ -0,0 +1,381 @@
+//go:build linux && !android
+
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/gopacket/gopacket"
+	"github.com/mosajjal/dnsmonster/internal/util"
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// afxdpConfig holds the socket and XDP options of the afxdp inputs
+type afxdpConfig struct {
+	AfxdpMode        string `long:"afxdpmode"        ini-name:"afxdpmode"        env:"DNSMONSTER_AFXDPMODE"        default:"auto" description:"Mode of the afxdp inputs. auto tries the zero-copy sockets and the driver XDP mode, falling back to copying and to the generic XDP mode. zerocopy fails rather than falling back, copy always copies and generic uses the generic XDP mode" choice:"auto" choice:"zerocopy" choice:"copy" choice:"generic"`
+	AfxdpQueues      uint   `long:"afxdpqueues"      ini-name:"afxdpqueues"      env:"DNSMONSTER_AFXDPQUEUES"      default:"0"    description:"Number of rx queues of the interface captured by the afxdp inputs, starting from queue 0, each with its own socket and --packetHandlerCount decode workers. 0 captures every queue"`
+	AfxdpFrameCount  uint   `long:"afxdpframecount"  ini-name:"afxdpframecount"  env:"DNSMONSTER_AFXDPFRAMECOUNT"  default:"4096" description:"Number of 4KB frames in the UMEM of each afxdp socket, a power of two"`
+	AfxdpRedirectAll bool   `long:"afxdpredirectall" ini-name:"afxdpredirectall" env:"DNSMONSTER_AFXDPREDIRECTALL" description:"Redirect every packet to the afxdp sockets rather than the packets of the DNS ports and the IP fragments. Needed for tunnelled traffic"`
+}
+
+func init() {
+	source := &afxdpSource{}
+	if _, err := util.GlobalParser.AddGroup("afxdp", "Options of the afxdp inputs", &source.config); err != nil {
+		log.Fatalf("error adding afxdp input options")
+	}
+	registerCaptureSource("afxdp", source)
+}
+
+// the UMEM frames are a page each, the largest size the kernel allows. The
+// packets larger than that are dropped by the kernel.
+const xdpFrameSize = 4096
+
+// afxdpSource captures with AF_XDP sockets, one per rx queue of the
+// interface. An XDP program attached to the interface redirects the DNS
+// packets to the sockets and passes everything else to the kernel, so the
+// packets dnsmonster doesn't need never leave the driver.
+type afxdpSource struct {
+	config afxdpConfig
+}
+
+func (*afxdpSource) name(target string) (string, error) { return target, nil }
+
+func (s *afxdpSource) start(ctx context.Context, config *captureConfig, in *captureInput) error {
+	frames := s.config.AfxdpFrameCount
+	if frames == 0 || frames&(frames-1) != 0 {
+		return fmt.Errorf("--afxdpFrameCount must be a power of two")
+	}
+	iface, err := net.InterfaceByName(in.target)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %w", in.target, err)
+	}
+	queues := int(s.config.AfxdpQueues)
+	if queues == 0 {
+		queues = interfaceRxQueues(in.target)
+	}
+	log.Infof("The XDP program of %s replaces the BPF filter %q", in.target, in.filter)
+
+	// --detectnonstandardports needs all TCP and UDP packets
+	var ranges [][2]uint16
+	if !config.DetectNonstandardPorts {
+		if ranges = config.ports.ranges(); len(ranges) > xdpMaxPortRanges {
+			log.Warnf("Too many port ranges for the XDP program, redirecting all TCP and UDP packets of %s", in.target)
+			ranges = nil
+		}
+	}
+	prog, err := loadXDPProgram(queues, ranges, s.config.AfxdpRedirectAll)
+	if err != nil {
+		return fmt.Errorf("unable to load the XDP program: %w", err)
+	}
+	defer prog.Close()
+	if err := prog.attach(iface.Index, s.config.AfxdpMode == "generic", s.config.AfxdpMode != "zerocopy"); err != nil {
+		return fmt.Errorf("unable to attach the XDP program to %s: %w", in.target, err)
+	}
+	if prog.generic && s.config.AfxdpMode != "generic" {
+		log.Warnf("The driver of %s doesn't support XDP, falling back to the generic mode", in.target)
+	}
+
+	if !config.NoPromiscuous {
+		promisc, err := setPromiscuous(iface.Index)
+		if err != nil {
+			return fmt.Errorf("error setting %s to promiscuous: %w", in.target, err)
+		}
+		defer unix.Close(promisc)
+	}
+	log.Infof("Promiscuous mode: %v", !config.NoPromiscuous)
+
+	handlers := make([]genericPacketHandler, 0, queues)
+	for queue := range queues {
+		// zero-copy needs the driver mode, the copy mode works everywhere
+		zeroCopy := !prog.generic && s.config.AfxdpMode != "copy"
+		handle, err := newAfxdpHandle(ctx, in.name, iface.Index, queue, uint32(frames), zeroCopy)
+		if err != nil && zeroCopy && s.config.AfxdpMode == "auto" {
+			log.Warnf("The driver of %s doesn't support zero-copy AF_XDP, falling back to the copy mode", in.target)
+			handle, err = newAfxdpHandle(ctx, in.name, iface.Index, queue, uint32(frames), false)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to open the AF_XDP socket of queue %d of %s: %w", queue, in.target, err)
+		}
+		defer handle.Close()
+		if err := prog.register(queue, handle.fd); err != nil {
+			return fmt.Errorf("unable to register the AF_XDP socket of queue %d of %s: %w", queue, in.target, err)
+		}
+		handlers = append(handlers, handle)
+	}
+	log.Infof("Opened %d AF_XDP sockets on %s", queues, in.target)
+	return config.runPacketHandlers(ctx, in, handlers, liveCaptureInterface(in.target))
+}
+
+// interfaceRxQueues returns the number of rx queues of an interface
+func interfaceRxQueues(name string) int {
+	queues, _ := filepath.Glob(filepath.Join("/sys/class/net", name, "queues", "rx-*"))
+	return max(1, len(queues))
+}
+
+// setPromiscuous puts an interface in promiscuous mode for as long as the
+// returned socket is open
+func setPromiscuous(ifindex int) (int, error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+	if err != nil {
+		return -1, err
+	}
+	mreq := unix.PacketMreq{Ifindex: int32(ifindex), Type: unix.PACKET_MR_PROMISC}
+	if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &mreq); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// xdpRing is a ring shared with the kernel. The producer and consumer
+// indexes are free running, the entries are at index & mask.
+type xdpRing struct {
+	mem      []byte
+	producer *uint32
+	consumer *uint32
+	mask     uint32
+	entries  unsafe.Pointer
+}
+
+func newXDPRing(mem []byte, off unix.XDPRingOffset, size uint32) xdpRing {
+	return xdpRing{
+		mem:      mem,
+		producer: (*uint32)(unsafe.Pointer(&mem[off.Producer])),
+		consumer: (*uint32)(unsafe.Pointer(&mem[off.Consumer])),
+		mask:     size - 1,
+		entries:  unsafe.Pointer(&mem[off.Desc]),
+	}
+}
+
+// afxdpHandle reads the packets of an AF_XDP socket bound to a single rx
+// queue. The socket has its own UMEM, holding a frame per entry of the rings.
+// The frames go from the fill ring to the kernel, which hands them back with
+// a packet in the rx ring, and are put back in the fill ring once read.
+type afxdpHandle struct {
+	ctx     context.Context
+	fd      int
+	ifindex int
+	umem    []byte
+	rx      xdpRing
+	fill    xdpRing
+	// the completion ring is only needed by the kernel to bind the socket
+	completion []byte
+	rxDescs    []unix.XDPDesc
+	fillAddrs  []uint64
+	// the frame of the last packet of ZeroCopyReadPacketData, valid until
+	// the next read
+	pending    uint64
+	hasPending bool
+	received   atomic.Uint64
+
+	rxRingFull    metrics.Gauge
+	fillRingEmpty metrics.Gauge
+	invalidDescs  metrics.Gauge
+}
+
+func setsockoptXDP(fd, opt int, value unsafe.Pointer, size uintptr) error {
+	_, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, uintptr(fd), unix.SOL_XDP, uintptr(opt), uintptr(value), size, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func getsockoptXDP(fd, opt int, value unsafe.Pointer, size uintptr) error {
+	socklen := uint32(size)
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.SOL_XDP, uintptr(opt), uintptr(value), uintptr(unsafe.Pointer(&socklen)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func newAfxdpHandle(ctx context.Context, input string, ifindex, queue int, frames uint32, zeroCopy bool) (*afxdpHandle, error) {
+	fd, err := unix.Socket(unix.AF_XDP, unix.SOCK_RAW, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the socket: %w", err)
+	}
+	prefix := fmt.Sprintf("input.%s.afxdp.queue%d.", input, queue)
+	h := &afxdpHandle{
+		ctx:           ctx,
+		fd:            fd,
+		ifindex:       ifindex,
+		rxRingFull:    metrics.GetOrRegisterGauge(prefix+"rxRingFull", metrics.DefaultRegistry),
+		fillRingEmpty: metrics.GetOrRegisterGauge(prefix+"fillRingEmpty", metrics.DefaultRegistry),
+		invalidDescs:  metrics.GetOrRegisterGauge(prefix+"rxInvalidDescs", metrics.DefaultRegistry),
+	}
+	if err := h.setup(queue, frames, zeroCopy); err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *afxdpHandle) setup(queue int, frames uint32, zeroCopy bool) error {
+	var err error
+	h.umem, err = unix.Mmap(-1, 0, int(frames)*xdpFrameSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_POPULATE)
+	if err != nil {
+		return fmt.Errorf("failed to allocate the UMEM: %w", err)
+	}
+	reg := unix.XDPUmemReg{
+		Addr: uint64(uintptr(unsafe.Pointer(&h.umem[0]))),
+		Len:  uint64(len(h.umem)),
+		Size: xdpFrameSize,
+	}
+	if err := setsockoptXDP(h.fd, unix.XDP_UMEM_REG, unsafe.Pointer(&reg), unsafe.Sizeof(reg)); err != nil {
+		return fmt.Errorf("failed to register the UMEM: %w", err)
+	}
+	completionSize := uint32(64)
+	rings := []struct {
+		opt  int
+		size *uint32
+	}{{unix.XDP_UMEM_FILL_RING, &frames}, {unix.XDP_RX_RING, &frames}, {unix.XDP_UMEM_COMPLETION_RING, &completionSize}}
+	for _, ring := range rings {
+		if err := setsockoptXDP(h.fd, ring.opt, unsafe.Pointer(ring.size), 4); err != nil {
+			return fmt.Errorf("failed to size the rings: %w", err)
+		}
+	}
+	var off unix.XDPMmapOffsets
+	if err := getsockoptXDP(h.fd, unix.XDP_MMAP_OFFSETS, unsafe.Pointer(&off), unsafe.Sizeof(off)); err != nil {
+		return fmt.Errorf("failed to read the ring offsets: %w", err)
+	}
+
+	mmap := func(offset int64, ring unix.XDPRingOffset, size uint32, entrySize uintptr) ([]byte, error) {
+		return unix.Mmap(h.fd, offset, int(ring.Desc)+int(size)*int(entrySize), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	}
+	rxMem, err := mmap(unix.XDP_PGOFF_RX_RING, off.Rx, frames, unsafe.Sizeof(unix.XDPDesc{}))
+	if err != nil {
+		return fmt.Errorf("failed to map the rx ring: %w", err)
+	}
+	h.rx = newXDPRing(rxMem, off.Rx, frames)
+	fillMem, err := mmap(unix.XDP_UMEM_PGOFF_FILL_RING, off.Fr, frames, 8)
+	if err != nil {
+		return fmt.Errorf("failed to map the fill ring: %w", err)
+	}
+	h.fill = newXDPRing(fillMem, off.Fr, frames)
+	if h.completion, err = mmap(unix.XDP_UMEM_PGOFF_COMPLETION_RING, off.Cr, completionSize, 8); err != nil {
+		return fmt.Errorf("failed to map the completion ring: %w", err)
+	}
+	h.initRings(frames)
+
+	// the kernel is woken up by poll when it runs out of frames
+	flags := uint16(unix.XDP_USE_NEED_WAKEUP | unix.XDP_COPY)
+	if zeroCopy {
+		flags = unix.XDP_USE_NEED_WAKEUP | unix.XDP_ZEROCOPY
+	}
+	if err := unix.Bind(h.fd, &unix.SockaddrXDP{Flags: flags, Ifindex: uint32(h.ifindex), QueueID: uint32(queue)}); err != nil {
+		return fmt.Errorf("failed to bind: %w", err)
+	}
+	return nil
+}
+
+// initRings gives all the frames of the UMEM to the kernel
+func (h *afxdpHandle) initRings(frames uint32) {
+	h.rxDescs = unsafe.Slice((*unix.XDPDesc)(h.rx.entries), frames)
+	h.fillAddrs = unsafe.Slice((*uint64)(h.fill.entries), frames)
+	for i := range frames {
+		h.fillAddrs[i] = uint64(i) * xdpFrameSize
+	}
+	atomic.StoreUint32(h.fill.producer, frames)
+}
+
+// recycle puts the frame of the last packet back in the fill ring. The ring
+// has room for every frame, so it's never full.
+func (h *afxdpHandle) recycle() {
+	if !h.hasPending {
+		return
+	}
+	producer := atomic.LoadUint32(h.fill.producer)
+	h.fillAddrs[producer&h.fill.mask] = h.pending &^ (xdpFrameSize - 1)
+	atomic.StoreUint32(h.fill.producer, producer+1)
+	h.hasPending = false
+}
+
+// ZeroCopyReadPacketData returns the next packet of the rx ring, waiting for
+// one if the ring is empty. The data is in the UMEM and valid until the next
+// call. It returns an error once the input is stopped.
+func (h *afxdpHandle) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	h.recycle()
+	for {
+		consumer := atomic.LoadUint32(h.rx.consumer)
+		if consumer != atomic.LoadUint32(h.rx.producer) {
+			desc := h.rxDescs[consumer&h.rx.mask]
+			atomic.StoreUint32(h.rx.consumer, consumer+1)
+			h.pending, h.hasPending = desc.Addr, true
+			h.received.Add(1)
+			data := h.umem[desc.Addr : desc.Addr+uint64(desc.Len)]
+			return data, gopacket.CaptureInfo{
+				Timestamp:      time.Now(),
+				CaptureLength:  len(data),
+				Length:         len(data),
+				InterfaceIndex: h.ifindex,
+			}, nil
+		}
+		if err := h.ctx.Err(); err != nil {
+			return nil, gopacket.CaptureInfo{}, err
+		}
+		fds := []unix.PollFd{{Fd: int32(h.fd), Events: unix.POLLIN}}
+		if _, err := unix.Poll(fds, 100); err != nil && err != unix.EINTR {
+			return nil, gopacket.CaptureInfo{}, err
+		}
+	}
+}
+
+func (h *afxdpHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := h.ZeroCopyReadPacketData()
+	if err != nil {
+		return nil, ci, err
+	}
+	data = append([]byte(nil), data...)
+	h.recycle()
+	return data, ci, nil
+}
+
+// Stat returns the packets received and dropped by the socket. The drops
+// are the packets the kernel couldn't put in the rx ring, either because it
+// was full or because the fill ring had no frame left.
+func (h *afxdpHandle) Stat() (uint, uint, error) {
+	var stats unix.XDPStatistics
+	if err := getsockoptXDP(h.fd, unix.XDP_STATISTICS, unsafe.Pointer(&stats), unsafe.Sizeof(stats)); err != nil {
+		return 0, 0, err
+	}
+	h.rxRingFull.Update(int64(stats.Rx_ring_full))
+	h.fillRingEmpty.Update(int64(stats.Rx_fill_ring_empty_descs))
+	h.invalidDescs.Update(int64(stats.Rx_invalid_descs))
+	dropped := stats.Rx_dropped + stats.Rx_ring_full
+	return uint(h.received.Load() + dropped), uint(dropped), nil
+}
+
+func (h *afxdpHandle) Close() {
+	unix.Close(h.fd)
+	for _, mem := range [][]byte{h.rx.mem, h.fill.mem, h.completion, h.umem} {
+		if mem != nil {
+			unix.Munmap(mem)
+		}
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,275 @@
+//go:build linux && !android
+
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math/bits"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	testXDPMapFD   = 42
+	testXDPQueue   = 3
+	xdpRedirect    = 4 // XDP_REDIRECT, returned by bpf_redirect_map
+	testXDPCtxBase = 1 << 32
+	testXDPPktBase = 2 << 32
+)
+
+// runXDP interprets the XDP program on a packet received on testXDPQueue.
+// It fails the test on any access outside of the packet, which the verifier
+// would have refused.
+func runXDP(t *testing.T, code []byte, packet []byte) uint64 {
+	var regs [11]uint64
+	regs[1] = testXDPCtxBase
+	load := func(addr uint64, size int) uint64 {
+		switch addr {
+		case testXDPCtxBase + xdpMdData:
+			return testXDPPktBase
+		case testXDPCtxBase + xdpMdDataEnd:
+			return testXDPPktBase + uint64(len(packet))
+		case testXDPCtxBase + xdpMdRxQueueIndex:
+			return testXDPQueue
+		}
+		off := addr - testXDPPktBase
+		if addr < testXDPPktBase || off+uint64(size) > uint64(len(packet)) {
+			t.Fatalf("out of bounds access at %d of a %d bytes packet", off, len(packet))
+		}
+		b := packet[off : off+uint64(size)]
+		switch size {
+		case 1:
+			return uint64(b[0])
+		case 2:
+			return uint64(binary.LittleEndian.Uint16(b))
+		}
+		return uint64(binary.LittleEndian.Uint32(b))
+	}
+
+	for pc, steps := 0, 0; steps < 10000; pc, steps = pc+1, steps+1 {
+		insn := code[pc*8 : pc*8+8]
+		dst, src := insn[1]&0xf, insn[1]>>4
+		off := int16(binary.LittleEndian.Uint16(insn[2:]))
+		imm := int32(binary.LittleEndian.Uint32(insn[4:]))
+		jump := func(cond bool) {
+			if cond {
+				pc += int(off)
+			}
+		}
+		switch insn[0] {
+		case ebpfLdxW:
+			regs[dst] = load(regs[src]+uint64(off), 4)
+		case ebpfLdxH:
+			regs[dst] = load(regs[src]+uint64(off), 2)
+		case ebpfLdxB:
+			regs[dst] = load(regs[src]+uint64(off), 1)
+		case ebpfLdImm64:
+			regs[dst] = uint64(uint32(imm))
+			pc++
+		case ebpfAddK:
+			regs[dst] += uint64(int64(imm))
+		case ebpfAddX:
+			regs[dst] += regs[src]
+		case ebpfAndK:
+			regs[dst] &= uint64(int64(imm))
+		case ebpfLshK:
+			regs[dst] <<= imm
+		case ebpfMovK:
+			regs[dst] = uint64(int64(imm))
+		case ebpfMovX:
+			regs[dst] = regs[src]
+		case ebpfToBE:
+			regs[dst] = uint64(bits.ReverseBytes16(uint16(regs[dst])))
+		case ebpfJa:
+			jump(true)
+		case ebpfJeqK:
+			jump(regs[dst] == uint64(int64(imm)))
+		case ebpfJneK:
+			jump(regs[dst] != uint64(int64(imm)))
+		case ebpfJgtX:
+			jump(regs[dst] > regs[src])
+		case ebpfJltK:
+			jump(regs[dst] < uint64(int64(imm)))
+		case ebpfJleK:
+			jump(regs[dst] <= uint64(int64(imm)))
+		case ebpfCall:
+			if imm != bpfFuncRedirectMap || regs[1] != testXDPMapFD || regs[2] != testXDPQueue || regs[3] != xdpActionPass {
+				t.Fatalf("unexpected call %d(%d, %d, %d)", imm, regs[1], regs[2], regs[3])
+			}
+			regs[0] = xdpRedirect
+		case ebpfExit:
+			return regs[0]
+		default:
+			t.Fatalf("unknown opcode %#x", insn[0])
+		}
+	}
+	t.Fatal("the program doesn't end")
+	return 0
+}
+
+// testXDPPacket serializes an Ethernet frame
+func testXDPPacket(t *testing.T, toSerialize ...gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, toSerialize...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestXDPFilterProgram(t *testing.T) {
+	if binary.NativeEndian.Uint16([]byte{0, 1}) == 1 {
+		t.Skip("the interpreter assumes a little endian host")
+	}
+	eth := func(etherType layers.EthernetType) *layers.Ethernet {
+		return &layers.Ethernet{SrcMAC: net.HardwareAddr{2, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{2, 0, 0, 0, 0, 2}, EthernetType: etherType}
+	}
+	ipv4 := func(protocol layers.IPProtocol) *layers.IPv4 {
+		return &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: protocol, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+	}
+	ipv6 := func(next layers.IPProtocol) *layers.IPv6 {
+		return &layers.IPv6{Version: 6, NextHeader: next, HopLimit: 64, SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::2")}
+	}
+	udp := func(src, dst layers.UDPPort) *layers.UDP { return &layers.UDP{SrcPort: src, DstPort: dst} }
+	// ext is an 8 bytes IPv6 extension header holding a PadN option
+	ext := func(next layers.IPProtocol) gopacket.Payload {
+		return gopacket.Payload{byte(next), 0, 1, 4, 0, 0, 0, 0}
+	}
+	payload := gopacket.Payload("dns")
+
+	fragment := ipv4(layers.IPProtocolUDP)
+	fragment.FragOffset = 185
+	withOptions := ipv4(layers.IPProtocolUDP)
+	withOptions.Options = []layers.IPv4Option{{OptionType: 1}, {OptionType: 1}, {OptionType: 1}, {OptionType: 0}}
+	packets := map[string][]byte{
+		"udp":        testXDPPacket(t, eth(layers.EthernetTypeIPv4), ipv4(layers.IPProtocolUDP), udp(40000, 53), payload),
+		"response":   testXDPPacket(t, eth(layers.EthernetTypeIPv4), ipv4(layers.IPProtocolTCP), &layers.TCP{SrcPort: 53, DstPort: 40000, DataOffset: 5}, payload),
+		"http":       testXDPPacket(t, eth(layers.EthernetTypeIPv4), ipv4(layers.IPProtocolTCP), &layers.TCP{SrcPort: 40000, DstPort: 80, DataOffset: 5}, payload),
+		"options":    testXDPPacket(t, eth(layers.EthernetTypeIPv4), withOptions, udp(40000, 53), payload),
+		"range":      testXDPPacket(t, eth(layers.EthernetTypeIPv4), ipv4(layers.IPProtocolUDP), udp(40000, 8050), payload),
+		"past range": testXDPPacket(t, eth(layers.EthernetTypeIPv4), ipv4(layers.IPProtocolUDP), udp(40000, 8101), payload),
+		"vlan":       testXDPPacket(t, eth(layers.EthernetTypeDot1Q), &layers.Dot1Q{VLANIdentifier: 10, Type: layers.EthernetTypeIPv4}, ipv4(layers.IPProtocolUDP), udp(40000, 53), payload),
+		"qinq": testXDPPacket(t, eth(layers.EthernetTypeQinQ), &layers.Dot1Q{VLANIdentifier: 10, Type: layers.EthernetTypeDot1Q},
+			&layers.Dot1Q{VLANIdentifier: 20, Type: layers.EthernetTypeIPv4}, ipv4(layers.IPProtocolUDP), udp(40000, 53), payload),
+		"fragment":      testXDPPacket(t, eth(layers.EthernetTypeIPv4), fragment, payload),
+		"ipv6":          testXDPPacket(t, eth(layers.EthernetTypeIPv6), ipv6(layers.IPProtocolUDP), udp(40000, 53), payload),
+		"ipv6 fragment": testXDPPacket(t, eth(layers.EthernetTypeIPv6), ipv6(layers.IPProtocolIPv6Fragment), payload),
+		"ipv6 options":  testXDPPacket(t, eth(layers.EthernetTypeIPv6), ipv6(layers.IPProtocolIPv6Destination), ext(layers.IPProtocolUDP), udp(40000, 53), payload),
+		"ipv6 chain http": testXDPPacket(t, eth(layers.EthernetTypeIPv6), ipv6(layers.IPProtocolIPv6HopByHop), ext(layers.IPProtocolIPv6Routing), ext(layers.IPProtocolTCP),
+			&layers.TCP{SrcPort: 40000, DstPort: 80, DataOffset: 5}, payload),
+		"ipv6 long chain": testXDPPacket(t, eth(layers.EthernetTypeIPv6), ipv6(layers.IPProtocolIPv6HopByHop), ext(layers.IPProtocolIPv6Destination), ext(layers.IPProtocolIPv6Destination),
+			ext(layers.IPProtocolIPv6Destination), ext(layers.IPProtocolIPv6Destination), ext(layers.IPProtocolUDP), udp(40000, 80), payload),
+		"icmpv6": testXDPPacket(t, eth(layers.EthernetTypeIPv6), ipv6(layers.IPProtocolICMPv6), payload),
+		"icmp":   testXDPPacket(t, eth(layers.EthernetTypeIPv4), ipv4(layers.IPProtocolICMPv4), payload),
+		"arp":    testXDPPacket(t, eth(layers.EthernetTypeARP), payload),
+	}
+	packets["truncated"] = packets["udp"][:36]
+
+	tests := []struct {
+		name        string
+		ranges      [][2]uint16
+		redirectAll bool
+		redirected  []string
+	}{
+		{"ports", [][2]uint16{{53, 53}, {8000, 8100}}, false, []string{"udp", "response", "options", "range", "vlan", "qinq", "fragment", "ipv6", "ipv6 fragment", "ipv6 options", "ipv6 long chain"}},
+		{"all ports", nil, false, []string{"udp", "response", "http", "options", "range", "past range", "vlan", "qinq", "fragment", "ipv6", "ipv6 fragment", "ipv6 options", "ipv6 chain http", "ipv6 long chain", "truncated"}},
+		{"everything", nil, true, []string{"udp", "response", "http", "options", "range", "past range", "vlan", "qinq", "fragment", "ipv6", "ipv6 fragment", "ipv6 options", "ipv6 chain http", "ipv6 long chain", "icmpv6", "icmp", "arp", "truncated"}},
+	}
+	for _, tt := range tests {
+		code, err := assembleBPF(xdpFilterProgram(tt.ranges, tt.redirectAll, testXDPMapFD))
+		if err != nil {
+			t.Fatal(err)
+		}
+		redirected := make(map[string]bool)
+		for _, name := range tt.redirected {
+			redirected[name] = true
+		}
+		for name, packet := range packets {
+			want := uint64(xdpActionPass)
+			if redirected[name] {
+				want = xdpRedirect
+			}
+			if got := runXDP(t, code, packet); got != want {
+				t.Errorf("%s: %s packet got action %d, want %d", tt.name, name, got, want)
+			}
+		}
+	}
+}
+
+// the handle reads the packets of the rx ring and gives their frames back
+// through the fill ring
+func TestAfxdpHandleRings(t *testing.T) {
+	const frames = 4
+	off := unix.XDPRingOffset{Producer: 0, Consumer: 64, Desc: 128}
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &afxdpHandle{
+		ctx:     ctx,
+		fd:      -1,
+		ifindex: 7,
+		umem:    make([]byte, frames*xdpFrameSize),
+		rx:      newXDPRing(make([]byte, 128+frames*16), off, frames),
+		fill:    newXDPRing(make([]byte, 128+frames*8), off, frames),
+	}
+	h.initRings(frames)
+	if *h.fill.producer != frames || h.fillAddrs[3] != 3*xdpFrameSize {
+		t.Fatalf("the frames were not given to the kernel: %d %v", *h.fill.producer, h.fillAddrs)
+	}
+
+	// the kernel takes two frames and hands them back with a packet each,
+	// after the headroom
+	atomic.StoreUint32(h.fill.consumer, 2)
+	packets := [][]byte{[]byte("first packet"), []byte("second packet")}
+	for i, packet := range packets {
+		addr := h.fillAddrs[i] + unix.XDP_PACKET_HEADROOM
+		copy(h.umem[addr:], packet)
+		h.rxDescs[i] = unix.XDPDesc{Addr: addr, Len: uint32(len(packet))}
+	}
+	atomic.StoreUint32(h.rx.producer, 2)
+
+	data, ci, err := h.ReadPacketData()
+	if err != nil || !bytes.Equal(data, packets[0]) || ci.InterfaceIndex != 7 || ci.CaptureLength != len(packets[0]) {
+		t.Fatalf("unexpected packet %q, %+v, %v", data, ci, err)
+	}
+	if *h.fill.producer != frames+1 || h.fillAddrs[0] != 0 {
+		t.Errorf("the frame of a copied packet was not recycled")
+	}
+	data, _, err = h.ZeroCopyReadPacketData()
+	if err != nil || !bytes.Equal(data, packets[1]) || *h.rx.consumer != 2 {
+		t.Fatalf("unexpected packet %q, %v", data, err)
+	}
+	if *h.fill.producer != frames+1 {
+		t.Errorf("the frame of a zero-copy packet was recycled before the next read")
+	}
+
+	// the ring is empty, the read returns once the input is stopped
+	cancel()
+	if _, _, err := h.ZeroCopyReadPacketData(); err == nil {
+		t.Error("read didn't stop with the input")
+	}
+	if *h.fill.producer != frames+2 || h.fillAddrs[1] != xdpFrameSize || h.received.Load() != 2 {
+		t.Errorf("unexpected fill ring %d %v after %d packets", *h.fill.producer, h.fillAddrs, h.received.Load())
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,134 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/mosajjal/dnsmonster/internal/util"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/bpf"
+)
+
+// bpfFilter runs a BPF filter in userspace with x/net/bpf, for the handlers
+// the kernel doesn't filter like the pcap and pcapng files. The filter is
+// compiled for the link type of the packets, on the first packet of each
+// link type.
+type bpfFilter struct {
+	filter string
+	// a nil VM lets the packets of the link type through, the filter
+	// couldn't be compiled for it
+	vms map[layers.LinkType]*bpf.VM
+}
+
+// defaultFilter is the default of --filter
+var defaultFilter = func() string {
+	field, _ := reflect.TypeFor[captureConfig]().FieldByName("Filter")
+	return field.Tag.Get("default")
+}()
+
+// filterSetByUser tells if --filter was set rather than left to its default.
+// go-flags applies the environment and the config file like defaults, so the
+// former is looked up and the latter only counts if it changes the value.
+func filterSetByUser(filter string) bool {
+	opt := util.GlobalParser.FindOptionByLongName("filter")
+	if opt == nil {
+		return filter != defaultFilter
+	}
+	if _, ok := os.LookupEnv(opt.EnvKeyWithNamespace()); ok {
+		return true
+	}
+	return (opt.IsSet() && !opt.IsSetDefault()) || filter != defaultFilter
+}
+
+// offlineFilter returns the filter of the files of an input. The default
+// filter only matches untagged IP packets, the files captured on trunk ports
+// or tunnels would come out empty, so only a filter set by the user is run on
+// them.
+func offlineFilter(in *captureInput) string {
+	if !in.filterSet {
+		log.Infof("input %s: the default --filter is not run on capture files, set --filter or filter= to filter them", in.name)
+		return ""
+	}
+	return in.filter
+}
+
+// newBPFFilter returns nil if filter is empty, which lets every packet
+// through
+func newBPFFilter(filter string) *bpfFilter {
+	if filter == "" {
+		return nil
+	}
+	return &bpfFilter{filter: filter, vms: make(map[layers.LinkType]*bpf.VM)}
+}
+
+// newBPFVM compiles a filter into a VM
+func newBPFVM(filter string, linkType layers.LinkType) (*bpf.VM, error) {
+	raw, err := compileBPF(filter, linkType)
+	if err != nil {
+		return nil, err
+	}
+	instructions, ok := bpf.Disassemble(raw)
+	if !ok {
+		return nil, fmt.Errorf("unsupported BPF instructions in %q", filter)
+	}
+	return bpf.NewVM(instructions)
+}
+
+// vm returns the VM of a link type, compiling the filter if needed
+func (f *bpfFilter) vm(linkType layers.LinkType) *bpf.VM {
+	vm, ok := f.vms[linkType]
+	if !ok {
+		var err error
+		if vm, err = newBPFVM(f.filter, linkType); err != nil {
+			log.Errorf("Unable to compile the BPF filter %q for %s packets, they won't be filtered: %v", f.filter, linkType, err)
+		} else {
+			log.Infof("Filter: %s", f.filter)
+		}
+		f.vms[linkType] = vm
+	}
+	return vm
+}
+
+// match tells if the filter accepts a packet
+func (f *bpfFilter) match(linkType layers.LinkType, data []byte) bool {
+	if f == nil {
+		return true
+	}
+	vm := f.vm(linkType)
+	if vm == nil {
+		return true
+	}
+	keep, err := vm.Run(data)
+	return err == nil && keep > 0
+}
+
+// read calls read until it returns a packet accepted by the filter, or an
+// error
+func (f *bpfFilter) read(read func() ([]byte, gopacket.CaptureInfo, error), linkType func(gopacket.CaptureInfo) layers.LinkType) ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := read()
+		if err != nil || f.match(linkType(ci), data) {
+			return data, ci, err
+		}
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,134 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+)
+
+// testMixedPackets returns DNS queries interleaved with HTTP packets
+func testMixedPackets(t *testing.T) [][]byte {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 80, DataOffset: 5}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, ip, tcp, gopacket.Payload("GET /")); err != nil {
+		t.Fatal(err)
+	}
+	http := testEthernet(0x0800, buf.Bytes())
+	dns := testEthernet(0x0800, testIPv4DNSPacket(t, "filter.example."))
+	return [][]byte{dns, http, http, dns, http, dns}
+}
+
+func TestOfflineBPFFilter(t *testing.T) {
+	packets := testMixedPackets(t)
+	var pcapFile, pcapngFile bytes.Buffer
+	w := pcapgo.NewWriter(&pcapFile)
+	if err := w.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	ngw, err := pcapgo.NewNgWriter(&pcapngFile, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, packet := range packets {
+		ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(packet), Length: len(packet)}
+		if err := w.WritePacket(ci, packet); err != nil {
+			t.Fatal(err)
+		}
+		if err := ngw.WritePacket(ci, packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ngw.Flush()
+
+	tests := []struct {
+		name   string
+		filter string
+		want   uint
+		packet []byte // the packet every read returns, if they're all the same
+	}{
+		{"no filter", "", 6, nil},
+		{"dns", "udp port 53", 3, packets[0]},
+		{"http", "tcp port 80", 3, packets[1]},
+		{"nothing", "udp port 5353", 0, nil},
+	}
+	for _, tt := range tests {
+		pcapHandle, err := initializeOfflinePcap(bytes.NewReader(pcapFile.Bytes()), tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pcapngHandle, err := initializeOfflinePcapNg(bytes.NewReader(pcapngFile.Bytes()), tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handles := map[string]genericPacketHandler{"pcap": pcapHandle, "pcapng": pcapngHandle}
+		for format, handle := range handles {
+			for {
+				data, _, err := handle.ReadPacketData()
+				if err != nil {
+					break
+				}
+				if tt.packet != nil && !bytes.Equal(data, tt.packet) {
+					t.Errorf("%s %s: unexpected packet", format, tt.name)
+				}
+			}
+			if read, _, _ := handle.Stat(); read != tt.want {
+				t.Errorf("%s %s: %d packets read, want %d", format, tt.name, read, tt.want)
+			}
+		}
+	}
+}
+
+func TestOfflineFilter(t *testing.T) {
+	if !strings.HasPrefix(defaultFilter, "((ip and") {
+		t.Fatalf("the default filter is %q", defaultFilter)
+	}
+	tests := []struct {
+		name   string
+		filter string
+		env    bool
+		spec   string
+		want   string
+	}{
+		{"default", defaultFilter, false, "pcap:a.pcap", ""},
+		{"set flag", "udp port 53", false, "pcap:a.pcap", "udp port 53"},
+		{"default from the environment", defaultFilter, true, "pcap:a.pcap", defaultFilter},
+		{"input filter", defaultFilter, false, "pcap:a.pcap;filter=" + defaultFilter, defaultFilter},
+	}
+	for _, tt := range tests {
+		if tt.env {
+			t.Setenv("DNSMONSTER_FILTER", tt.filter)
+		}
+		config := captureConfig{Filter: tt.filter, Input: []string{tt.spec}, ratioA: 1, ratioB: 1}
+		inputs, err := config.parseInputs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := offlineFilter(inputs[0]); got != tt.want {
+			t.Errorf("%s: the filter run on the files is %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// vim: foldmethod=marker
@@ -23,7 +23,6 @@ import (
 	"container/list"
 	"context"
 	"net"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -33,43 +32,79 @@ import (
 
 	"github.com/gopacket/gopacket"
 	"github.com/gopacket/gopacket/layers"
-	"github.com/gopacket/gopacket/tcpassembly/tcpreader"
 	"github.com/mosajjal/dnsmonster/internal/util"
+	"github.com/rcrowley/go-metrics"
 )
 
 type captureConfig struct {
 	DevName                    string        `long:"devname"                    ini-name:"devname"                    env:"DNSMONSTER_DEVNAME"                    default:""                                                                                                  description:"Device used to capture"`
-	PcapFile                   string        `long:"pcapfile"                   ini-name:"pcapfile"                   env:"DNSMONSTER_PCAPFILE"                   default:""                                                                                                  description:"Pcap filename to run"`
+	PcapFile                   string        `long:"pcapfile"                   ini-name:"pcapfile"                   env:"DNSMONSTER_PCAPFILE"                   default:""                                                                                                  description:"Pcap or pcapng file to read, - for stdin. A directory or a glob reads every capture file in it in the order of their first packet. gzip, zstd and xz files are decompressed"`
+	PcapWatch                  bool          `long:"pcapwatch"                  ini-name:"pcapwatch"                  env:"DNSMONSTER_PCAPWATCH"                  description:"Keep watching the directory or glob of the pcap inputs for new files once all of them are read. A file is read once its size stops changing"`
+	PcapWatchInterval          time.Duration `long:"pcapwatchinterval"          ini-name:"pcapwatchinterval"          env:"DNSMONSTER_PCAPWATCHINTERVAL"          default:"5s"                                                                                                description:"Interval between the scans of the directories and globs watched by --pcapWatch"`
+	PcapStateFile              string        `long:"pcapstatefile"              ini-name:"pcapstatefile"              env:"DNSMONSTER_PCAPSTATEFILE"              default:""                                                                                                  description:"File recording the progress of the pcap inputs reading a directory or a glob, so a restart resumes where the previous run left off. The packets still queued when dnsmonster stops are not read again"`
+	PcapReplaySpeed            float64       `long:"pcapreplayspeed"            ini-name:"pcapreplayspeed"            env:"DNSMONSTER_PCAPREPLAYSPEED"            default:"0"                                                                                                 description:"Replay the pcap inputs at the pace of their capture timestamps multiplied by this speed, eg 1 for the original speed or 10 for ten times faster. 0 reads them as fast as possible"`
+	PcapRebaseTimestamps       bool          `long:"pcaprebasetimestamps"       ini-name:"pcaprebasetimestamps"       env:"DNSMONSTER_PCAPREBASETIMESTAMPS"       description:"Shift the timestamps of the pcap inputs so their first packet happened when it was read, scaled by --pcapReplaySpeed"`
+	Input                      []string      `long:"input"                      ini-name:"input"                      env:"DNSMONSTER_INPUT"                      description:"Input to capture from, can be specified multiple times to combine inputs of any kind. KIND:TARGET with optional ;filter=BPF, ;sample=A:B and ;label=NAME. KIND is live, afpacket, pcap or dnstap. eg afpacket:eth1;filter=udp port 53;label=uplink or dnstap:unix:///run/dnstap.sock"`
 	DnstapSocket               string        `long:"dnstapsocket"               ini-name:"dnstapsocket"               env:"DNSMONSTER_DNSTAPSOCKET"               default:""                                                                                                  description:"dnstap socket path. Example: unix:///tmp/dnstap.sock, tcp://127.0.0.1:8080"`
-	Port                       uint          `long:"port"                       ini-name:"port"                       env:"DNSMONSTER_PORT"                       default:"53"                                                                                                description:"Port selected to filter packets"`
+	Port                       []string      `long:"port"                       ini-name:"port"                       env:"DNSMONSTER_PORT"                       default:"53"                                                                                                description:"Ports selected to filter packets. Accepts PORT or FIRST-LAST with an optional :LABEL, comma separated or specified multiple times. eg 53,5353:mdns,8000-8100:internal"`
+	DetectNonstandardPorts     bool          `long:"detectnonstandardports"     ini-name:"detectnonstandardports"     env:"DNSMONSTER_DETECTNONSTANDARDPORTS"     description:"Detect and decode DNS on the ports not selected by --port. These records are tagged nonstandard_port"`
+	MalformedRecords           bool          `long:"malformedrecords"           ini-name:"malformedrecords"           env:"DNSMONSTER_MALFORMEDRECORDS"           description:"Emit a record tagged malformed for the DNS payloads that fail to decode, with the payload, the error and the header and questions recovered from it"`
+	LocalNameProtocols         bool          `long:"localnameprotocols"         ini-name:"localnameprotocols"         env:"DNSMONSTER_LOCALNAMEPROTOCOLS"         description:"Decode mDNS (5353), LLMNR (5355) and NBNS (137) regardless of --port"`
+	PoisoningNameThreshold     uint          `long:"poisoningnamethreshold"     ini-name:"poisoningnamethreshold"     env:"DNSMONSTER_POISONINGNAMETHRESHOLD"     default:"3"                                                                                                 description:"Number of distinct names a host can answer for over LLMNR or NBNS within --poisoningWindow before its responses are tagged poisoning_suspect. 0 disables the detection"`
+	PoisoningWindow            time.Duration `long:"poisoningwindow"            ini-name:"poisoningwindow"            env:"DNSMONSTER_POISONINGWINDOW"            default:"10m"                                                                                               description:"Window used to count the names answered by each host for poisoning detection"`
+	EncryptedDNS               bool          `long:"encrypteddns"               ini-name:"encrypteddns"               env:"DNSMONSTER_ENCRYPTEDDNS"               description:"Detect DoT, DoH, DoQ and DoH3 connections from the TLS ClientHello sent to TCP and UDP 853 and 443"`
+	EncryptedDNSResolvers      string        `long:"encrypteddnsresolvers"      ini-name:"encrypteddnsresolvers"      env:"DNSMONSTER_ENCRYPTEDDNSRESOLVERS"      default:""                                                                                                  description:"File listing the known DoH/DoT resolvers, one hostname, *.domain, IP or CIDR per line. A built-in list of public resolvers is used if empty"`
 	SampleRatio                string        `long:"sampleratio"                ini-name:"sampleratio"                env:"DNSMONSTER_SAMPLERATIO"                default:"1:1"                                                                                               description:"Capture Sampling by a:b. eg sampleRatio of 1:100 will process 1 percent of the incoming packets"`
-	DedupCleanupInterval       time.Duration `long:"dedupcleanupinterval"       ini-name:"dedupcleanupinterval"       env:"DNSMONSTER_DEDUPCLEANUPINTERVAL"       default:"60s"                                                                                               description:"Cleans up packet hash table used for deduplication"`
+	SamplingMode               string        `long:"samplingmode"               ini-name:"samplingmode"               env:"DNSMONSTER_SAMPLINGMODE"               default:"ratio"                                                                                             description:"Sampling method. ratio: process packets based on --sampleRatio. adaptive: keep every query of rarely seen domains and sample the frequent ones. flowhash: keep the fraction set by --sampleRatio based on a hash of --flowHashKey, consistent across sensors" choice:"ratio"  choice:"adaptive" choice:"flowhash"`
+	AdaptiveSampleThreshold    uint          `long:"adaptivesamplethreshold"    ini-name:"adaptivesamplethreshold"    env:"DNSMONSTER_ADAPTIVESAMPLETHRESHOLD"    default:"100"                                                                                               description:"Number of records a domain can have in each --adaptiveSampleWindow before adaptive sampling kicks in"`
+	AdaptiveSampleWindow       time.Duration `long:"adaptivesamplewindow"       ini-name:"adaptivesamplewindow"       env:"DNSMONSTER_ADAPTIVESAMPLEWINDOW"       default:"60s"                                                                                               description:"Window used to count domain frequency for adaptive sampling"`
+	FlowHashKey                string        `long:"flowhashkey"                ini-name:"flowhashkey"                env:"DNSMONSTER_FLOWHASHKEY"                default:"5tuple"                                                                                            description:"Fields hashed by flowhash sampling. 5tuple keeps or drops each transaction as a whole, clientip keeps or drops everything from a client"                                                                                                                      choice:"5tuple" choice:"clientip"`
+	DedupCleanupInterval       time.Duration `long:"dedupcleanupinterval"       ini-name:"dedupcleanupinterval"       env:"DNSMONSTER_DEDUPCLEANUPINTERVAL"       default:"60s"                                                                                               description:"Deprecated, replaced by --dedupWindow"`
+	DedupWindow                time.Duration `long:"dedupwindow"                ini-name:"dedupwindow"                env:"DNSMONSTER_DEDUPWINDOW"                default:"1s"                                                                                                description:"Time window in which a packet with the same content is considered a duplicate"`
+	DedupMaxEntries            uint          `long:"dedupmaxentries"            ini-name:"dedupmaxentries"            env:"DNSMONSTER_DEDUPMAXENTRIES"            default:"1000000"                                                                                           description:"Maximum number of packet hashes held for deduplication. Packets over the limit are not deduplicated"`
 	DnstapPermission           string        `long:"dnstappermission"           ini-name:"dnstappermission"           env:"DNSMONSTER_DNSTAPPERMISSION"           default:"755"                                                                                               description:"Set the dnstap socket permission, only applicable when unix:// is used"`
 	PacketHandlerCount         uint          `long:"packethandlercount"         ini-name:"packethandlercount"         env:"DNSMONSTER_PACKETHANDLERCOUNT"         default:"2"                                                                                                 description:"Number of routines used to handle received packets"`
-	TCPAssemblyChannelSize     uint          `long:"tcpassemblychannelsize"     ini-name:"tcpassemblychannelsize"     env:"DNSMONSTER_TCPASSEMBLYCHANNELSIZE"     default:"10000"                                                                                             description:"Size of the tcp assembler"`
+	TCPAssemblyChannelSize     uint          `long:"tcpassemblychannelsize"     ini-name:"tcpassemblychannelsize"     env:"DNSMONSTER_TCPASSEMBLYCHANNELSIZE"     default:"10000"                                                                                             description:"Size of the channel of each tcp assembly routine"`
 	TCPResultChannelSize       uint          `long:"tcpresultchannelsize"       ini-name:"tcpresultchannelsize"       env:"DNSMONSTER_TCPRESULTCHANNELSIZE"       default:"10000"                                                                                             description:"Size of the tcp result channel"`
-	TCPHandlerCount            uint          `long:"tcphandlercount"            ini-name:"tcphandlercount"            env:"DNSMONSTER_TCPHANDLERCOUNT"            default:"1"                                                                                                 description:"Number of routines used to handle tcp packets"`
+	TCPHandlerCount            uint          `long:"tcphandlercount"            ini-name:"tcphandlercount"            env:"DNSMONSTER_TCPHANDLERCOUNT"            default:"1"                                                                                                 description:"Number of routines used to handle tcp packets. The connections are spread over them, both directions of a connection going to the same routine"`
+	TCPMaxConnections          uint          `long:"tcpmaxconnections"          ini-name:"tcpmaxconnections"          env:"DNSMONSTER_TCPMAXCONNECTIONS"          default:"100000"                                                                                            description:"Maximum number of tcp connections being reassembled. The connections idle the longest are evicted over the limit"`
+	TCPMaxBufferedBytes        uint          `long:"tcpmaxbufferedbytes"        ini-name:"tcpmaxbufferedbytes"        env:"DNSMONSTER_TCPMAXBUFFEREDBYTES"        default:"67108864"                                                                                          description:"Maximum number of bytes of out of order tcp segments buffered for reassembly. Over the limit, the oldest gaps are given up on"`
 	DefraggerChannelSize       uint          `long:"defraggerchannelsize"       ini-name:"defraggerchannelsize"       env:"DNSMONSTER_DEFRAGGERCHANNELSIZE"       default:"10000"                                                                                             description:"Size of the channel to send packets to be defragged"`
 	DefraggerChannelReturnSize uint          `long:"defraggerchannelreturnsize" ini-name:"defraggerchannelreturnsize" env:"DNSMONSTER_DEFRAGGERCHANNELRETURNSIZE" default:"10000"                                                                                             description:"Size of the channel where the defragged packets are returned"`
 	PacketChannelSize          uint          `long:"packetchannelsize"          ini-name:"packetchannelsize"          env:"DNSMONSTER_PACKETCHANNELSIZE"          default:"1000"                                                                                              description:"Size of the packet handler channel"`
 	AfpacketBuffersizeMb       uint          `long:"afpacketbuffersizemb"       ini-name:"afpacketbuffersizemb"       env:"DNSMONSTER_AFPACKETBUFFERSIZEMB"       default:"64"                                                                                                description:"Afpacket Buffersize in MB"`
 	Filter                     string        `long:"filter"                     ini-name:"filter"                     env:"DNSMONSTER_FILTER"                     default:"((ip and (ip[9] == 6 or ip[9] == 17)) or (ip6 and (ip6[6] == 17 or ip6[6] == 6 or ip6[6] == 44)))" description:"BPF filter applied to the packet stream. If port is selected, the packets will not be defragged."`
 	UseAfpacket                bool          `long:"useafpacket"                ini-name:"useafpacket"                env:"DNSMONSTER_USEAFPACKET"                description:"Use AFPacket for live captures. Supported on Linux 3.0+ only"`
-	NoEthernetframe            bool          `long:"noetherframe"               ini-name:"noetherframe"               env:"DNSMONSTER_NOETHERFRAME"               description:"The PCAP capture does not contain ethernet frames"`
-	Dedup                      bool          `long:"dedup"                      ini-name:"dedup"                      env:"DNSMONSTER_DEDUP"                      description:"Deduplicate incoming packets, Only supported with --devName and --pcapFile. Experimental "`
+	NoEthernetframe            bool          `long:"noetherframe"               ini-name:"noetherframe"               env:"DNSMONSTER_NOETHERFRAME"               description:"The capture does not contain ethernet frames. Only needed for live captures, the link type of pcap and pcapng files is detected automatically"`
+	Dedup                      bool          `long:"dedup"                      ini-name:"dedup"                      env:"DNSMONSTER_DEDUP"                      description:"Deduplicate incoming packets and dnstap messages based on their IP, port and DNS content"`
 	NoPromiscuous              bool          `long:"nopromiscuous"              ini-name:"nopromiscuous"              env:"DNSMONSTER_NOPROMISCUOUS"              description:"Do not put the interface in promiscuous mode"`
+	UpstreamMonitor            bool          `long:"upstreammonitor"            ini-name:"upstreammonitor"            env:"DNSMONSTER_UPSTREAMMONITOR"            description:"Pair queries and responses to track latency, timeouts and SERVFAIL rates per destination IP. Useful on a recursive resolver's egress traffic"`
+	UpstreamTimeout            time.Duration `long:"upstreamtimeout"            ini-name:"upstreamtimeout"            env:"DNSMONSTER_UPSTREAMTIMEOUT"            default:"5s"                                                                                                description:"Time after which an unanswered query is counted as a timeout by the upstream monitor"`
+	UpstreamMaxTracked         uint          `long:"upstreammaxtracked"         ini-name:"upstreammaxtracked"         env:"DNSMONSTER_UPSTREAMMAXTRACKED"         default:"1000"                                                                                              description:"Maximum number of upstreams with their own metrics. The ones past it are counted in the upstream*.other metrics"`
+	UpstreamSummaryInterval    time.Duration `long:"upstreamsummaryinterval"    ini-name:"upstreamsummaryinterval"    env:"DNSMONSTER_UPSTREAMSUMMARYINTERVAL"    default:"60s"                                                                                               description:"Interval between upstream summary records sent to the outputs"`
+	inputs                     []*captureInput
 	processingChannel          chan *rawPacketBytes
 	ip4Defrgger                chan ipv4ToDefrag
 	ip6Defrgger                chan ipv6FragmentInfo
 	ip4DefrggerReturn          chan ipv4Defragged
 	ip6DefrggerReturn          chan ipv6Defragged
-	tcpAssembly                chan tcpPacket
+	tcpAssembly                []chan tcpPacket
 	tcpReturnChannel           chan tcpData
 	resultChannel              chan util.DNSResult
 	ratioA                     int
 	ratioB                     int
-	dedupHashTable             map[uint64]bool
-	dedupMu                    sync.RWMutex
+	flowHashA                  uint64
+	flowHashB                  uint64
+	dedup                      *dedupWindow
+	ports                      *portMatcher
+	poisoning                  *poisoningDetector
+	encryptedDNS               *encryptedDNSDetector
+	upstream                   *upstreamMonitor
+	pcapState                  *pcapState
+	sampler                    *adaptiveSampler
+	sampledOut                 metrics.Counter
+	nonstandardPortRecords     metrics.Counter
+	malformedPayloads          metrics.Counter
 }
 
 // GlobalCaptureConfig is accessible globally
@@ -89,72 +124,96 @@ func (config *captureConfig) GetResultChannel() chan util.DNSResult {
 	return config.resultChannel
 }
 
+// sendResult is the single exit point of capture. every DNSResult goes
+// through here before hitting the result channel
+func (config *captureConfig) sendResult(res util.DNSResult) {
+	if config.upstream != nil {
+		config.upstream.observe(&res)
+	}
+	if !config.sampleResult(&res) {
+		return
+	}
+	config.resultChannel <- res
+}
+
 func (config *captureConfig) cleanExit(ctx context.Context) {
 	ctx.Done()
 	log.Infof("Stopping capture...")
 }
 
 func (config *captureConfig) CheckFlagsAndStart(ctx context.Context) {
-	if config.Port > 65535 {
-		log.Fatal("--port must be between 1 and 65535")
+	var err error
+	if config.ports, err = parsePorts(config.Port); err != nil {
+		log.Fatalf("invalid --port: %v", err)
 	}
-	if config.DevName == "" && config.PcapFile == "" && config.DnstapSocket == "" {
-		log.Fatal("one of --devName, --pcapFile or --dnstapSocket is required")
+	if config.ratioA, config.ratioB, err = parseSampleRatio(config.SampleRatio); err != nil {
+		log.Fatal("wrong --sampleRatio syntax")
 	}
-
-	if config.DevName != "" {
-		if config.PcapFile != "" || config.DnstapSocket != "" {
-			log.Fatal("You must set only --devName, --pcapFile or --dnstapSocket")
+	switch config.SamplingMode {
+	case "adaptive":
+		if config.ratioA != config.ratioB {
+			log.Warnf("--sampleRatio is ignored when --samplingMode is %s", config.SamplingMode)
 		}
-	} else {
-		if config.PcapFile != "" && config.DnstapSocket != "" {
-			log.Fatal("You must set only --devName, --pcapFile or --dnstapSocket")
+		config.ratioA, config.ratioB = 1, 1
+	case "flowhash":
+		// the ratio is applied on decoded records instead of raw packets
+		config.flowHashA, config.flowHashB = uint64(config.ratioA), uint64(config.ratioB)
+		config.ratioA, config.ratioB = 1, 1
+	}
+	// the inputs get the ratio left over by the sampling mode
+	if config.inputs, err = config.parseInputs(); err != nil {
+		log.Fatal(err)
+	}
+	if config.PcapWatch && config.PcapWatchInterval <= 0 {
+		log.Fatal("--pcapWatchInterval must be greater than zero")
+	}
+	if config.PcapReplaySpeed < 0 {
+		log.Fatal("--pcapReplaySpeed can't be negative")
+	}
+	if config.PcapStateFile != "" {
+		if config.pcapState, err = loadPcapState(config.PcapStateFile); err != nil {
+			log.Fatalf("invalid --pcapStateFile: %v", err)
 		}
 	}
+	if config.SamplingMode == "adaptive" && (config.AdaptiveSampleThreshold == 0 || config.AdaptiveSampleWindow <= 0) {
+		log.Fatal("--adaptiveSampleThreshold and --adaptiveSampleWindow must be greater than zero")
+	}
 
-	if config.DnstapSocket != "" {
-		if !strings.HasPrefix(config.DnstapSocket, "unix://") && !strings.HasPrefix(config.DnstapSocket, "tcp://") {
-			log.Fatal("You must provide a unix:// or tcp:// socket for dnstap")
-		}
+	if config.TCPHandlerCount == 0 || config.TCPMaxConnections == 0 || config.TCPMaxBufferedBytes == 0 {
+		log.Fatal("--tcpHandlerCount, --tcpMaxConnections and --tcpMaxBufferedBytes must be greater than zero")
 	}
-	ratioNumbers := strings.Split(config.SampleRatio, ":")
-	if len(ratioNumbers) != 2 {
-		log.Fatal("wrong --sampleRatio syntax")
+
+	if config.UpstreamMonitor && (config.UpstreamSummaryInterval <= 0 || config.UpstreamTimeout <= 0) {
+		log.Fatal("--upstreamSummaryInterval and --upstreamTimeout must be greater than zero")
 	}
-	var errA error
-	var errB error
-	config.ratioA, errA = strconv.Atoi(ratioNumbers[0])
-	config.ratioB, errB = strconv.Atoi(ratioNumbers[1])
-	if errA != nil || errB != nil || config.ratioA > config.ratioB {
-		log.Fatal("wrong --sampleRatio syntax")
+	if config.MalformedRecords {
+		if outputs := outputsWithoutMalformed(); len(outputs) > 0 {
+			log.Warnf("--malformedRecords is only fully supported by the JSON-like and gob outputs, the records written by %s don't carry the malformed payload and error", strings.Join(outputs, ", "))
+		}
+	}
+
+	if config.UpstreamMonitor && (util.GeneralFlags.MaskSize4 < 32 || util.GeneralFlags.MaskSize6 < 128) {
+		log.Fatal("--upstreamMonitor pairs queries and responses on the full IPs, it can't be used with --maskSize4 or --maskSize6")
 	}
 
-	// set up dedup hash table
-	config.dedupHashTable = make(map[uint64]bool)
 	g, gCtx := errgroup.WithContext(ctx)
 	if config.Dedup {
-		log.Infof("Packet deduplication is enabled")
-
-		g.Go(func() error {
-			ticker := time.NewTicker(config.DedupCleanupInterval)
-			defer ticker.Stop()
-			for {
-				select {
-				case <-ticker.C:
-					log.Infof("cleaning up dedup hash table")
-					config.dedupMu.Lock()
-					config.dedupHashTable = make(map[uint64]bool)
-					config.dedupMu.Unlock()
-				case <-gCtx.Done():
-					return nil
-				}
-			}
-		})
+		if config.DedupWindow <= 0 || config.DedupMaxEntries == 0 {
+			log.Fatal("--dedupWindow and --dedupMaxEntries must be greater than zero")
+		}
+		if config.DedupCleanupInterval != 60*time.Second {
+			log.Warn("--dedupCleanupInterval is deprecated and ignored, use --dedupWindow instead")
+		}
+		log.Infof("Packet deduplication is enabled with a window of %s", config.DedupWindow)
+		config.dedup = newDedupWindow(config.DedupWindow, config.DedupMaxEntries)
 	}
 
 	// NOTE: there is a race condition when resultchannel created here, and when outputs.go expects it to be available
 	config.resultChannel = make(chan util.DNSResult, util.GeneralFlags.ResultChannelSize)
-	config.tcpAssembly = make(chan tcpPacket, config.TCPAssemblyChannelSize)
+	config.tcpAssembly = make([]chan tcpPacket, config.TCPHandlerCount)
+	for i := range config.tcpAssembly {
+		config.tcpAssembly[i] = make(chan tcpPacket, config.TCPAssemblyChannelSize)
+	}
 	config.tcpReturnChannel = make(chan tcpData, config.TCPResultChannelSize)
 	config.processingChannel = make(chan *rawPacketBytes, config.PacketChannelSize)
 	config.ip4Defrgger = make(chan ipv4ToDefrag, config.DefraggerChannelSize)
@@ -163,10 +222,41 @@ func (config *captureConfig) CheckFlagsAndStart(ctx context.Context) {
 	config.ip6DefrggerReturn = make(chan ipv6Defragged, config.DefraggerChannelReturnSize)
 	log.Debugln("Created defrag and assembly channels")
 
+	if config.UpstreamMonitor {
+		config.upstream = newUpstreamMonitor(config.UpstreamTimeout, int(config.UpstreamMaxTracked))
+		g.Go(func() error {
+			return config.upstream.run(gCtx, config.UpstreamSummaryInterval, config.resultChannel)
+		})
+	}
+
+	config.sampledOut = metrics.GetOrRegisterCounter("recordsSampledOut", metrics.DefaultRegistry)
+	config.nonstandardPortRecords = metrics.GetOrRegisterCounter("nonstandardPortRecords", metrics.DefaultRegistry)
+	config.malformedPayloads = metrics.GetOrRegisterCounter("malformedDNSPayloads", metrics.DefaultRegistry)
+	if config.PoisoningNameThreshold > 0 {
+		if config.PoisoningWindow <= 0 {
+			log.Fatal("--poisoningWindow must be greater than zero")
+		}
+		config.poisoning = newPoisoningDetector(config.PoisoningNameThreshold, config.PoisoningWindow)
+	}
+	if config.EncryptedDNS {
+		resolvers, err := loadResolverList(config.EncryptedDNSResolvers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.encryptedDNS = newEncryptedDNSDetector(resolvers)
+	}
+	if config.SamplingMode == "adaptive" {
+		config.sampler = newAdaptiveSampler(config.AdaptiveSampleThreshold)
+		g.Go(func() error { return config.sampler.run(gCtx, config.AdaptiveSampleWindow) })
+	}
+
 	// start the defrag goroutines
-	for i := uint(0); i < config.TCPHandlerCount; i++ {
+	// each tcp worker has its share of the connections and of the limits
+	maxConnections := config.TCPMaxConnections / config.TCPHandlerCount
+	maxBufferedPages := config.TCPMaxBufferedBytes / tcpPageBytes / config.TCPHandlerCount
+	for _, tcpchannel := range config.tcpAssembly {
 		g.Go(func() error {
-			return tcpAssembler(gCtx, config.tcpAssembly, config.tcpReturnChannel, util.GeneralFlags.GcTime)
+			return tcpAssembler(gCtx, tcpchannel, config.tcpReturnChannel, util.GeneralFlags.GcTime, max(maxConnections, 1), max(maxBufferedPages, 1))
 		})
 	}
 	g.Go(func() error {
@@ -179,13 +269,8 @@ func (config *captureConfig) CheckFlagsAndStart(ctx context.Context) {
 	// start the packet decoder goroutines
 	g.Go(func() error { return config.StartPacketDecoder(gCtx) })
 
-	// Start listening if we're not using DNSTap
-	if config.DnstapSocket == "" {
-		g.Go(func() error { return config.StartNonDNSTap(gCtx) })
-	} else {
-		// dnstap is totally different, hence only the result channel is being pushed to it
-		g.Go(func() error { return config.StartDNSTap(gCtx) })
-	}
+	// start reading the inputs
+	g.Go(func() error { return config.startInputs(gCtx) })
 	<-gCtx.Done()
 
 }
@@ -193,52 +278,74 @@ func (config *captureConfig) CheckFlagsAndStart(ctx context.Context) {
 type ipv4ToDefrag struct {
 	ip        layers.IPv4
 	timestamp time.Time
+	meta      *packetMeta
 }
 
 type ipv4Defragged struct {
 	ip        layers.IPv4
 	timestamp time.Time
+	meta      *packetMeta
 }
 
 type ipv6FragmentInfo struct {
 	ip         layers.IPv6
 	ipFragment layers.IPv6Fragment
 	timestamp  time.Time
+	meta       *packetMeta
 }
 
 type ipv6Defragged struct {
 	ip        layers.IPv6
 	timestamp time.Time
+	meta      *packetMeta
 }
 
 type tcpPacket struct {
-	IPVersion uint8
-	tcp       layers.TCP
-	timestamp time.Time
-	flow      gopacket.Flow
+	IPVersion   uint8
+	tcp         layers.TCP
+	timestamp   time.Time
+	flow        gopacket.Flow
+	matchedPort uint16
+	appProtocol string
+	meta        *packetMeta
 }
 
 type tcpData struct {
-	IPVersion uint8
-	data      []byte
-	SrcIP     net.IP
-	DstIP     net.IP
-	timestamp time.Time
+	IPVersion   uint8
+	data        []byte
+	SrcIP       net.IP
+	DstIP       net.IP
+	SrcPort     uint16
+	DstPort     uint16
+	timestamp   time.Time
+	matchedPort uint16
+	appProtocol string
+	meta        *packetMeta
 }
 
 type dnsStreamFactory struct {
 	tcpReturnChannel chan tcpData
-	IPVersion        uint8
-	currentTimestamp time.Time
 	ctx              context.Context
+	// the connections being reassembled, to evict the idle ones
+	streams    map[*dnsStream]struct{}
+	active     metrics.Counter
+	evicted    metrics.Counter
+	outOfOrder metrics.Counter
 }
 
 type dnsStream struct {
-	Net              gopacket.Flow
-	reader           tcpreader.ReaderStream
-	tcpReturnChannel chan tcpData
-	IPVersion        uint8
-	timestamp        time.Time
+	Net         gopacket.Flow
+	SrcPort     uint16
+	DstPort     uint16
+	IPVersion   uint8
+	matchedPort uint16
+	appProtocol string
+	meta        *packetMeta
+	factory     *dnsStreamFactory
+	lastSeen    time.Time
+	// the bytes of the message being reassembled, from the client and from
+	// the server
+	data [2][]byte
 }
 
 // ipv6 is a struct to be used as a key.
@@ -284,9 +391,34 @@ type genericPacketHandler interface {
 	Stat() (uint, uint, error)
 }
 
+// linkTypeHandler is implemented by the packet handlers that know the link
+// type of each packet, like the pcap and pcapng files. The other handlers
+// deliver Ethernet frames.
+type linkTypeHandler interface {
+	linkType(ci gopacket.CaptureInfo) layers.LinkType
+}
+
+// interfaceHandler is implemented by the packet handlers that know which
+// interface each packet was captured on, like the pcapng files
+type interfaceHandler interface {
+	captureInterface(ci gopacket.CaptureInfo) *util.CaptureInterface
+}
+
+// liveCaptureInterface describes the interface of a live capture
+func liveCaptureInterface(name string) *util.CaptureInterface {
+	iface := &util.CaptureInterface{Name: name}
+	if netIface, err := net.InterfaceByName(name); err == nil {
+		iface.Index = netIface.Index
+	}
+	return iface
+}
+
 type rawPacketBytes struct {
-	bytes []byte
-	info  gopacket.CaptureInfo
+	bytes    []byte
+	info     gopacket.CaptureInfo
+	linkType layers.LinkType
+	iface    *util.CaptureInterface
+	input    *captureInput
 }
 
 // FNV1A is a very fast hashing function, mainly used for de-duplication
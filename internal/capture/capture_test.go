@@ -16,13 +16,26 @@
 package capture
 
 import (
+	"net"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/mosajjal/dnsmonster/internal/util"
 )
 
+// TestMain sets the general flags the tests rely on once, before any of the
+// goroutines started by the tests can read them
+func TestMain(m *testing.M) {
+	util.GeneralFlags.MaskSize4 = 32
+	util.GeneralFlags.MaskSize6 = 128
+	util.GeneralFlags.CaptureStatsDelay = time.Second
+	os.Exit(m.Run())
+}
+
 func TestSampleRatioParsing(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -238,106 +251,82 @@ func TestPortValidation(t *testing.T) {
 	}
 }
 
-// TestDedupHashTableConcurrency verifies that concurrent reads and writes
-// to the dedup hash table are safe when protected by the mutex.
-// Must pass with -race.
-func TestDedupHashTableConcurrency(t *testing.T) {
+// TestDedupWindowConcurrency verifies that concurrent lookups of the dedup
+// window are safe. Must pass with -race.
+func TestDedupWindowConcurrency(t *testing.T) {
 	config := &captureConfig{
-		dedupHashTable: make(map[uint64]bool),
+		dedup: newDedupWindow(time.Millisecond, 1<<20),
 	}
 
 	const goroutines = 10
 	const iterations = 1000
 
 	var wg sync.WaitGroup
-
-	// Launch writer goroutines
+	start := time.Now()
 	for i := 0; i < goroutines; i++ {
 		wg.Add(1)
 		go func(id int) {
 			defer wg.Done()
 			for j := 0; j < iterations; j++ {
-				hash := FNV1A([]byte{byte(id), byte(j), byte(j >> 8)})
-				config.dedupMu.RLock()
-				_, exists := config.dedupHashTable[hash]
-				config.dedupMu.RUnlock()
-				if !exists {
-					config.dedupMu.Lock()
-					config.dedupHashTable[hash] = true
-					config.dedupMu.Unlock()
-				}
+				// the timestamps move forward so the buckets rotate as well
+				ts := start.Add(time.Duration(j) * 10 * time.Microsecond)
+				config.isDuplicate(ts, nil, nil, 0, 53, "udp", nil, []byte{byte(id), byte(j), byte(j >> 8)})
 			}
 		}(i)
 	}
-
-	// Launch a goroutine that clears the table (simulating the ticker)
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for j := 0; j < 10; j++ {
-			config.dedupMu.Lock()
-			config.dedupHashTable = make(map[uint64]bool)
-			config.dedupMu.Unlock()
-			time.Sleep(time.Millisecond)
-		}
-	}()
-
 	wg.Wait()
-
-	// If we got here without a race detector complaint, the test passes
-	config.dedupMu.RLock()
-	size := len(config.dedupHashTable)
-	config.dedupMu.RUnlock()
-	t.Logf("Final dedup table size: %d", size)
 }
 
-// TestDedupHashTableClearing verifies the clearing mechanism works:
-// entries are removed when the table is cleared.
-func TestDedupHashTableClearing(t *testing.T) {
-	config := &captureConfig{
-		dedupHashTable: make(map[uint64]bool),
-	}
+// TestDedupWindow verifies the duplicates are caught within the window,
+// including the ones straddling a bucket rotation, and forgotten after it.
+func TestDedupWindow(t *testing.T) {
+	d := newDedupWindow(time.Second, 100)
+	start := time.Unix(1700000000, 0)
 
-	// Add some entries
-	for i := uint64(0); i < 100; i++ {
-		config.dedupMu.Lock()
-		config.dedupHashTable[i] = true
-		config.dedupMu.Unlock()
+	if d.seen(1, start) {
+		t.Fatal("first packet taken as a duplicate")
 	}
-
-	config.dedupMu.RLock()
-	if len(config.dedupHashTable) != 100 {
-		config.dedupMu.RUnlock()
-		t.Fatalf("Expected 100 entries, got %d", len(config.dedupHashTable))
+	if !d.seen(1, start.Add(100*time.Millisecond)) {
+		t.Error("duplicate within the window was not caught")
 	}
-	config.dedupMu.RUnlock()
-
-	// Clear the table (simulating what the ticker does)
-	config.dedupMu.Lock()
-	config.dedupHashTable = make(map[uint64]bool)
-	config.dedupMu.Unlock()
-
-	config.dedupMu.RLock()
-	if len(config.dedupHashTable) != 0 {
-		config.dedupMu.RUnlock()
-		t.Fatalf("Expected 0 entries after clearing, got %d", len(config.dedupHashTable))
+	// rotates the buckets, the hash is still in the previous one
+	if d.seen(2, start.Add(900*time.Millisecond)) {
+		t.Fatal("new hash taken as a duplicate")
+	}
+	if !d.seen(2, start.Add(1100*time.Millisecond)) {
+		t.Error("duplicate straddling a rotation was not caught")
+	}
+	// long after the window, nothing is remembered
+	if d.seen(2, start.Add(10*time.Second)) {
+		t.Error("hash should have been forgotten after the window")
 	}
-	config.dedupMu.RUnlock()
 
-	// Verify we can add entries again after clearing
-	config.dedupMu.Lock()
-	config.dedupHashTable[42] = true
-	config.dedupMu.Unlock()
+	// memory is bounded, hashes over the limit are not tracked
+	small := newDedupWindow(time.Second, 2)
+	small.seen(1, start)
+	small.seen(2, start)
+	if small.seen(3, start) || small.seen(3, start) {
+		t.Error("hashes over the limit should not be deduplicated")
+	}
+	if len(small.current)+len(small.previous) != 2 {
+		t.Errorf("dedup window holds %d hashes, want 2", len(small.current)+len(small.previous))
+	}
+}
 
-	config.dedupMu.RLock()
-	if len(config.dedupHashTable) != 1 {
-		config.dedupMu.RUnlock()
-		t.Fatalf("Expected 1 entry after re-adding, got %d", len(config.dedupHashTable))
+// TestDedupHashNormalised verifies that only the L3/L4/DNS content is hashed
+func TestDedupHashNormalised(t *testing.T) {
+	src := net.ParseIP("10.0.0.1")
+	dst := net.ParseIP("10.0.0.53")
+	payload := []byte("dns payload")
+	h := dedupHash(src.To4(), dst.To4(), 1234, 53, "udp", nil, payload)
+	if h != dedupHash(src.To16(), dst.To16(), 1234, 53, "udp", nil, payload) {
+		t.Error("IPv4 address representation should not change the hash")
+	}
+	if h == dedupHash(src, dst, 1235, 53, "udp", nil, payload) {
+		t.Error("different ports should not hash the same")
 	}
-	_, exists := config.dedupHashTable[42]
-	config.dedupMu.RUnlock()
-	if !exists {
-		t.Fatal("Expected key 42 to exist")
+	if h == dedupHash(src, dst, 1234, 53, "tcp", nil, payload) {
+		t.Error("different protocols should not hash the same")
 	}
 }
 
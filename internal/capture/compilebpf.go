@@ -37,4 +37,18 @@ func tcpdumpToPcapgoBpf(filter string) []bpf.RawInstruction {
 	return returnByteCodes
 }
 
+// compileBPF compiles a filter for the packets of a link type, to be run in
+// userspace
+func compileBPF(filter string, linkType layers.LinkType) ([]bpf.RawInstruction, error) {
+	bytecodes, err := pcap.CompileBPFFilter(linkType, 65535, filter)
+	if err != nil {
+		return nil, err
+	}
+	rawInstructions := make([]bpf.RawInstruction, len(bytecodes))
+	for i, ins := range bytecodes {
+		rawInstructions[i] = bpf.RawInstruction{Op: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	return rawInstructions, nil
+}
+
 // vim: foldmethod=marker
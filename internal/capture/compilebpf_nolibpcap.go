@@ -20,24 +20,36 @@
 package capture
 
 import (
-	gopcap "github.com/packetcap/go-pcap/filter"
+	"github.com/gopacket/gopacket/layers"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/bpf"
 )
 
-func tcpdumpToPcapgoBpf(filter string) []bpf.RawInstruction {
-	log.Warnf("dnsmonster has been compiled without libpcap support. some advance bpf filters maybe unsupported.")
+// the length the filters of the live captures keep of the packets, which
+// the kernel truncates them to
+const liveFilterSnaplen = 262144
 
-	instructions, err := gopcap.NewExpression(filter).Compile().Compile()
+func tcpdumpToPcapgoBpf(filter string) []bpf.RawInstruction {
+	rawInstructions, err := assembleFilter(filter, layers.LinkTypeEthernet, liveFilterSnaplen)
 	if err != nil {
 		log.Errorf("failed to compile filter: %s", err)
 		return nil
 	}
-	rawInstructions := make([]bpf.RawInstruction, len(instructions))
-	for i, inst := range instructions {
-		rawInstructions[i], _ = inst.Assemble()
-	}
 	return rawInstructions
 }
 
+// compileBPF compiles a filter for the packets of a link type, to be run in
+// userspace
+func compileBPF(filter string, linkType layers.LinkType) ([]bpf.RawInstruction, error) {
+	return assembleFilter(filter, linkType, 65535)
+}
+
+func assembleFilter(filter string, linkType layers.LinkType, snaplen uint32) ([]bpf.RawInstruction, error) {
+	instructions, err := compileFilter(filter, linkType, snaplen)
+	if err != nil {
+		return nil, err
+	}
+	return bpf.Assemble(instructions)
+}
+
 // vim: foldmethod=marker
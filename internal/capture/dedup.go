@@ -0,0 +1,139 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+	"github.com/rcrowley/go-metrics"
+)
+
+// dedupWindow remembers the hashes seen in the last window using two time
+// buckets. the current bucket gets the new hashes and the previous one is
+// only looked up, so a hash is remembered for at least one full window and
+// at most two. the bucket start is driven by the packet timestamps which
+// makes it behave the same on live and offline captures.
+type dedupWindow struct {
+	mu         sync.Mutex
+	window     time.Duration
+	maxEntries int
+	start      time.Time
+	current    map[uint64]struct{}
+	previous   map[uint64]struct{}
+	duplicates metrics.Counter
+	untracked  metrics.Counter
+	entries    metrics.Gauge
+}
+
+func newDedupWindow(window time.Duration, maxEntries uint) *dedupWindow {
+	return &dedupWindow{
+		window:     window,
+		maxEntries: int(maxEntries),
+		current:    make(map[uint64]struct{}),
+		previous:   make(map[uint64]struct{}),
+		duplicates: metrics.GetOrRegisterCounter("packetsDuplicate", metrics.DefaultRegistry),
+		untracked:  metrics.GetOrRegisterCounter("dedupUntracked", metrics.DefaultRegistry),
+		entries:    metrics.GetOrRegisterGauge("dedupEntries", metrics.DefaultRegistry),
+	}
+}
+
+func (d *dedupWindow) rotate(ts time.Time) {
+	if d.start.IsZero() {
+		d.start = ts
+		return
+	}
+	elapsed := ts.Sub(d.start)
+	switch {
+	case elapsed >= 2*d.window:
+		// nothing seen in the last window, both buckets are stale
+		clear(d.previous)
+		clear(d.current)
+		d.start = ts
+	case elapsed >= d.window:
+		d.previous, d.current = d.current, d.previous
+		clear(d.current)
+		d.start = d.start.Add(d.window)
+	}
+}
+
+// seen records h and reports whether it has been seen within the window.
+// once maxEntries hashes are held, new hashes are let through without being
+// tracked so the memory stays bounded.
+func (d *dedupWindow) seen(h uint64, ts time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rotate(ts)
+	if _, ok := d.current[h]; ok {
+		d.duplicates.Inc(1)
+		return true
+	}
+	if _, ok := d.previous[h]; ok {
+		// keep it around for another window
+		d.current[h] = struct{}{}
+		d.duplicates.Inc(1)
+		return true
+	}
+	size := len(d.current) + len(d.previous)
+	if size >= d.maxEntries {
+		d.untracked.Inc(1)
+		return false
+	}
+	d.current[h] = struct{}{}
+	d.entries.Update(int64(size + 1))
+	return false
+}
+
+// dedupHash hashes the normalised content of a packet: the addresses, ports,
+// the transport specific header fields that tell packets of a flow apart, and
+// the payload. Link layer headers, TTL/hop limit, IP ID and checksums are left
+// out, so copies of the same packet taken at different points of the network
+// hash the same.
+func dedupHash(srcIP, dstIP net.IP, srcPort, dstPort uint16, protocol string, l4 []byte, payload []byte) uint64 {
+	buf := make([]byte, 0, 2*net.IPv6len+4+len(protocol)+len(l4)+len(payload))
+	buf = append(buf, srcIP.To16()...)
+	buf = append(buf, dstIP.To16()...)
+	buf = binary.BigEndian.AppendUint16(buf, srcPort)
+	buf = binary.BigEndian.AppendUint16(buf, dstPort)
+	buf = append(buf, protocol...)
+	buf = append(buf, l4...)
+	buf = append(buf, payload...)
+	return FNV1A(buf)
+}
+
+func tcpFlags(tcp *layers.TCP) byte {
+	var f byte
+	for i, set := range []bool{tcp.FIN, tcp.SYN, tcp.RST, tcp.PSH, tcp.ACK, tcp.URG, tcp.ECE, tcp.CWR} {
+		if set {
+			f |= 1 << i
+		}
+	}
+	return f
+}
+
+// isDuplicate reports whether dedup is enabled and the packet has been seen
+// within the dedup window
+func (config *captureConfig) isDuplicate(ts time.Time, srcIP, dstIP net.IP, srcPort, dstPort uint16, protocol string, l4 []byte, payload []byte) bool {
+	if config.dedup == nil {
+		return false
+	}
+	return config.dedup.seen(dedupHash(srcIP, dstIP, srcPort, dstPort, protocol, l4, payload), ts)
+}
+
+// vim: foldmethod=marker
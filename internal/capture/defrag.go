@@ -300,6 +300,7 @@ func ipv4Defragger(ctx context.Context, ipInput <-chan ipv4ToDefrag, ipOut chan
 				ipOut <- ipv4Defragged{
 					*result,
 					packet.timestamp,
+					packet.meta,
 				}
 			}
 		case <-ticker.C:
@@ -325,6 +326,7 @@ func ipv6Defragger(ctx context.Context, ipInput <-chan ipv6FragmentInfo, ipOut c
 				ipOut <- ipv6Defragged{
 					*result,
 					packet.timestamp,
+					packet.meta,
 				}
 			}
 		case <-ticker.C:
@@ -18,6 +18,7 @@ package capture
 import (
 	"context"
 	b64 "encoding/base64"
+	"fmt"
 	"net"
 	"net/url"
 	"os"
@@ -26,7 +27,6 @@ import (
 	"time"
 
 	"github.com/mosajjal/dnsmonster/internal/util"
-	"github.com/rcrowley/go-metrics"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 
@@ -34,6 +34,25 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
+func init() {
+	registerCaptureSource(inputDnstap, dnstapSource{})
+}
+
+// dnstapSource listens on a dnstap socket, the messages it receives are
+// turned into records right away
+type dnstapSource struct{}
+
+func (dnstapSource) name(target string) (string, error) {
+	if !strings.HasPrefix(target, "unix://") && !strings.HasPrefix(target, "tcp://") {
+		return "", fmt.Errorf("dnstap needs a unix:// or tcp:// socket")
+	}
+	return inputDnstap, nil
+}
+
+func (dnstapSource) start(ctx context.Context, config *captureConfig, in *captureInput) error {
+	return config.StartDNSTap(ctx, in)
+}
+
 func parseDnstapSocket(socketString, socketChmod string) *dnstap.FrameStreamSockInput {
 	var err error
 	var ln net.Listener
@@ -83,11 +102,13 @@ func parseDnstapSocket(socketString, socketChmod string) *dnstap.FrameStreamSock
 	return dSocket
 }
 
-func dnsTapMsgToDNSResult(msg []byte) (*util.DNSResult, error) {
+// dnsTapMsgToDNSResult decodes a dnstap frame. The raw DNS message is returned
+// alongside the result for deduplication.
+func dnsTapMsgToDNSResult(msg []byte) (*util.DNSResult, []byte, error) {
 	dnstapObject := &dnstap.Dnstap{}
 
 	if err := proto.Unmarshal(msg, dnstapObject); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var myDNSResult util.DNSResult
@@ -113,21 +134,18 @@ func dnsTapMsgToDNSResult(msg []byte) (*util.DNSResult, error) {
 
 	myDNSResult.PacketLength = uint16(len(message))
 	if err := myDNSResult.DNS.Unpack(message); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return &myDNSResult, nil
+	return &myDNSResult, message, nil
 }
 
-func (config *captureConfig) StartDNSTap(ctx context.Context) error {
-	log.Info("Starting DNStap capture")
-
-	packetsCaptured := metrics.GetOrRegisterGauge("packetsCaptured", metrics.DefaultRegistry)
-	packetsDropped := metrics.GetOrRegisterGauge("packetsDropped", metrics.DefaultRegistry)
-	packetsInvalid := metrics.GetOrRegisterGauge("packetsInvalid", metrics.DefaultRegistry)
-	packetLossPercent := metrics.GetOrRegisterGaugeFloat64("packetLossPercent", metrics.DefaultRegistry)
+// StartDNSTap listens on the dnstap socket of in and turns the messages into
+// records
+func (config *captureConfig) StartDNSTap(ctx context.Context, in *captureInput) error {
+	log.Infof("Starting DNStap capture on %s", in.target)
 
-	input := parseDnstapSocket(config.DnstapSocket, config.DnstapPermission)
+	input := parseDnstapSocket(in.target, config.DnstapPermission)
 	buf := make(chan []byte, 1024)
 	g, _ := errgroup.WithContext(ctx)
 	//todo: can't pass on the context to this function.
@@ -140,41 +158,43 @@ func (config *captureConfig) StartDNSTap(ctx context.Context) error {
 
 	// Set up various tickers for different tasks
 	captureStatsTicker := time.NewTicker(util.GeneralFlags.CaptureStatsDelay)
+	defer captureStatsTicker.Stop()
 
 	// blocking loop
 	for {
 		select {
 		case msg := <-buf:
-			ratioCnt++
 			totalCnt++
 
 			if msg == nil {
-				log.Info("dnstap socket is returning nil. exiting..")
-				time.Sleep(time.Second * 2)
-				//todo: commence clean exit
-				config.cleanExit(ctx)
+				log.Infof("dnstap socket %s is returning nil. exiting..", in.target)
 				return nil
 			}
-			if ratioCnt%config.ratioB < config.ratioA {
-				if ratioCnt > config.ratioB*config.ratioA {
-					ratioCnt = 0
-				}
-				res, err := dnsTapMsgToDNSResult(msg)
+			if keepRatio(&ratioCnt, in.ratioA, in.ratioB) {
+				res, dnsMsg, err := dnsTapMsgToDNSResult(msg)
 				if err != nil {
 					log.Errorf("could not unpack message: %v, content: %s", err, b64.StdEncoding.EncodeToString(msg))
 					invalidCnt++
 					continue
 				}
+				// the same message is often reported by more than one resolver
+				// or through more than one socket
+				if config.isDuplicate(res.Timestamp, res.SrcIP, res.DstIP, res.SrcPort, res.DstPort, res.Protocol, nil, dnsMsg) {
+					continue
+				}
+				res.Input = in.label
+				res.SampleWeight = in.sampleWeight()
 
-				config.resultChannel <- *res
+				config.sendResult(*res)
 			} else {
 				droppedCnt++
+				in.stats.overRatio.Inc(1)
 			}
 		case <-captureStatsTicker.C:
-			packetsCaptured.Update(totalCnt)
-			packetsDropped.Update(droppedCnt)
-			packetsInvalid.Update(invalidCnt)
-			packetLossPercent.Update(float64(packetsDropped.Value()) * 100.0 / float64(packetsCaptured.Value()))
+			in.stats.update(totalCnt, droppedCnt)
+			in.stats.invalid.Update(invalidCnt)
+		case <-ctx.Done():
+			return nil
 		}
 	}
 }
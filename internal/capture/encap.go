@@ -0,0 +1,315 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"slices"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/mosajjal/dnsmonster/internal/util"
+)
+
+// GRE protocol type of ERSPAN type III, which gopacket doesn't know about
+const greProtocolERSPANIII layers.EthernetType = 0x22eb
+
+// ERSPAN type II and III share a layer type, the version is in the header
+var layerTypeERSPAN = gopacket.RegisterLayerType(251, gopacket.LayerTypeMetadata{Name: "ERSPAN", Decoder: nil})
+
+// packetMeta holds what is known about a packet besides its IP and transport
+// layers. The decoders fill the one owned by each worker, which is handed to
+// the records made right away. The packets queued for the defraggers and the
+// TCP assembler get an immutable snapshot of it instead.
+type packetMeta struct {
+	encapsulation []util.Encapsulation
+	// the MACs are copied, the layers they come from are reused
+	srcMAC, dstMAC       [6]byte
+	hasSrcMAC, hasDstMAC bool
+	// iface is shared by all the packets of an interface
+	iface *util.CaptureInterface
+	// input is the input the packet was read from, for its label and its
+	// sample ratio
+	input *captureInput
+}
+
+func (m *packetMeta) reset(iface *util.CaptureInterface, input *captureInput) {
+	m.encapsulation = m.encapsulation[:0]
+	m.hasSrcMAC, m.hasDstMAC = false, false
+	m.iface = iface
+	m.input = input
+}
+
+func (m *packetMeta) add(encapType string, id uint32) {
+	m.encapsulation = append(m.encapsulation, util.Encapsulation{Type: encapType, ID: id})
+}
+
+// setMACs records the addresses of a link layer header. Anything but an
+// EUI-48 is ignored.
+func (m *packetMeta) setMACs(src, dst net.HardwareAddr) {
+	m.hasSrcMAC = len(src) == 6
+	copy(m.srcMAC[:], src)
+	m.hasDstMAC = len(dst) == 6
+	copy(m.dstMAC[:], dst)
+}
+
+// snapshot returns a copy of the metadata, or nil if there's nothing to
+// report so packets without a link layer header don't allocate
+func (m *packetMeta) snapshot() *packetMeta {
+	if m == nil || len(m.encapsulation) == 0 && !m.hasSrcMAC && !m.hasDstMAC && m.iface == nil && m.input == nil {
+		return nil
+	}
+	snapshot := *m
+	snapshot.encapsulation = nil
+	if len(m.encapsulation) > 0 {
+		snapshot.encapsulation = slices.Clone(m.encapsulation)
+	}
+	return &snapshot
+}
+
+// annotate copies the metadata into a record. m can be nil.
+func (m *packetMeta) annotate(res *util.DNSResult) {
+	if m == nil {
+		return
+	}
+	if len(m.encapsulation) > 0 {
+		res.Encapsulation = slices.Clone(m.encapsulation)
+	}
+	for _, e := range m.encapsulation {
+		if e.Type == "vlan" {
+			res.VLANs = append(res.VLANs, uint16(e.ID))
+		}
+	}
+	if m.hasSrcMAC {
+		res.SrcMAC = net.HardwareAddr(m.srcMAC[:]).String()
+	}
+	if m.hasDstMAC {
+		res.DstMAC = net.HardwareAddr(m.dstMAC[:]).String()
+	}
+	res.Interface = m.iface
+	if m.input != nil {
+		res.Input = m.input.label
+		res.SampleWeight = m.input.sampleWeight()
+	}
+}
+
+// recordingLayer wraps a gopacket decoding layer and records the identifier
+// of each header it decodes
+type recordingLayer struct {
+	gopacket.DecodingLayer
+	record func()
+}
+
+func (r *recordingLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if err := r.DecodingLayer.DecodeFromBytes(data, df); err != nil {
+		return err
+	}
+	r.record()
+	return nil
+}
+
+// decapGRE is layers.GRE with the ERSPAN variants routed to the right layer.
+// ERSPAN type I has no header of its own and is told apart from type II by
+// the absence of the sequence number.
+type decapGRE struct {
+	layers.GRE
+	meta *packetMeta
+}
+
+func (g *decapGRE) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 4 {
+		df.SetTruncated()
+		return errors.New("GRE packet too small")
+	}
+	if err := g.GRE.DecodeFromBytes(data, df); err != nil {
+		return err
+	}
+	// Key is left over from the previous packet if it's not present
+	var key uint32
+	if g.KeyPresent {
+		key = g.Key
+	}
+	g.meta.add("gre", key)
+	return nil
+}
+
+func (g *decapGRE) NextLayerType() gopacket.LayerType {
+	switch {
+	case g.Protocol == layers.EthernetTypeERSPAN && !g.SeqPresent:
+		return layers.LayerTypeEthernet
+	case g.Protocol == layers.EthernetTypeERSPAN, g.Protocol == greProtocolERSPANIII:
+		return layerTypeERSPAN
+	}
+	return g.GRE.NextLayerType()
+}
+
+// decapERSPAN decodes the ERSPAN type II and type III headers
+type decapERSPAN struct {
+	layers.BaseLayer
+	Version   uint8
+	SessionID uint16
+	meta      *packetMeta
+}
+
+func (e *decapERSPAN) LayerType() gopacket.LayerType     { return layerTypeERSPAN }
+func (e *decapERSPAN) CanDecode() gopacket.LayerClass    { return layerTypeERSPAN }
+func (e *decapERSPAN) NextLayerType() gopacket.LayerType { return layers.LayerTypeEthernet }
+func (e *decapERSPAN) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 8 {
+		df.SetTruncated()
+		return errors.New("ERSPAN packet too small")
+	}
+	e.Version = data[0] >> 4
+	e.SessionID = binary.BigEndian.Uint16(data[2:4]) & 0x03ff
+	headerLen := 8
+	if e.Version == 2 {
+		// type III, with an optional platform specific sub-header
+		headerLen = 12
+		if len(data) >= 12 && data[11]&0x01 != 0 {
+			headerLen += 8
+		}
+	}
+	if len(data) < headerLen {
+		df.SetTruncated()
+		return errors.New("ERSPAN packet too small")
+	}
+	e.BaseLayer = layers.BaseLayer{Contents: data[:headerLen], Payload: data[headerLen:]}
+	e.meta.add("erspan", uint32(e.SessionID))
+	return nil
+}
+
+// decapMPLS decodes one entry of an MPLS label stack. MPLS doesn't say what
+// it carries, so the payload under the bottom of the stack is guessed from
+// its first nibble: IP, or Ethernet over a pseudowire, with or without the
+// control word.
+type decapMPLS struct {
+	layers.BaseLayer
+	Label       uint32
+	StackBottom bool
+	meta        *packetMeta
+}
+
+func (m *decapMPLS) LayerType() gopacket.LayerType  { return layers.LayerTypeMPLS }
+func (m *decapMPLS) CanDecode() gopacket.LayerClass { return layers.LayerTypeMPLS }
+func (m *decapMPLS) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 4 {
+		df.SetTruncated()
+		return errors.New("MPLS packet too small")
+	}
+	entry := binary.BigEndian.Uint32(data)
+	m.Label = entry >> 12
+	m.StackBottom = entry&0x100 != 0
+	m.BaseLayer = layers.BaseLayer{Contents: data[:4], Payload: data[4:]}
+	if m.StackBottom && len(m.Payload) >= 4 && m.Payload[0]>>4 == 0 {
+		// pseudowire control word
+		m.Payload = m.Payload[4:]
+	}
+	m.meta.add("mpls", m.Label)
+	return nil
+}
+
+func (m *decapMPLS) NextLayerType() gopacket.LayerType {
+	switch {
+	case !m.StackBottom:
+		return layers.LayerTypeMPLS
+	case len(m.Payload) == 0:
+		return gopacket.LayerTypeZero
+	case m.Payload[0]>>4 == 4:
+		return layers.LayerTypeIPv4
+	case m.Payload[0]>>4 == 6:
+		return layers.LayerTypeIPv6
+	}
+	return layers.LayerTypeEthernet
+}
+
+// decapPPPoE decodes the PPPoE session header and the PPP header behind it
+type decapPPPoE struct {
+	layers.BaseLayer
+	SessionID uint16
+	Protocol  layers.PPPType
+	meta      *packetMeta
+}
+
+func (p *decapPPPoE) LayerType() gopacket.LayerType  { return layers.LayerTypePPPoE }
+func (p *decapPPPoE) CanDecode() gopacket.LayerClass { return layers.LayerTypePPPoE }
+func (p *decapPPPoE) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 8 {
+		df.SetTruncated()
+		return errors.New("PPPoE packet too small")
+	}
+	if data[0] != 0x11 || data[1] != 0 {
+		return errors.New("not a PPPoE session packet")
+	}
+	p.SessionID = binary.BigEndian.Uint16(data[2:4])
+	length := int(binary.BigEndian.Uint16(data[4:6]))
+	if length < 2 {
+		return errors.New("PPPoE packet too small")
+	}
+	if 6+length < len(data) {
+		data = data[:6+length]
+	}
+	headerLen := 8
+	if data[6]&0x01 != 0 {
+		// compressed protocol field
+		p.Protocol = layers.PPPType(data[6])
+		headerLen = 7
+	} else {
+		p.Protocol = layers.PPPType(binary.BigEndian.Uint16(data[6:8]))
+	}
+	p.BaseLayer = layers.BaseLayer{Contents: data[:headerLen], Payload: data[headerLen:]}
+	p.meta.add("pppoe", uint32(p.SessionID))
+	return nil
+}
+
+func (p *decapPPPoE) NextLayerType() gopacket.LayerType {
+	switch p.Protocol {
+	case layers.PPPTypeIPv4:
+		return layers.LayerTypeIPv4
+	case layers.PPPTypeIPv6:
+		return layers.LayerTypeIPv6
+	}
+	return gopacket.LayerTypePayload
+}
+
+// decapLayers returns the decoding layers of the VLAN tags and the tunnels,
+// recording their identifiers into meta
+func decapLayers(meta *packetMeta) []gopacket.DecodingLayer {
+	vlan := &layers.Dot1Q{}
+	vxlan := &layers.VXLAN{}
+	geneve := &layers.Geneve{}
+	gtpu := &layers.GTPv1U{}
+	return []gopacket.DecodingLayer{
+		&recordingLayer{vlan, func() { meta.add("vlan", uint32(vlan.VLANIdentifier)) }},
+		&recordingLayer{vxlan, func() { meta.add("vxlan", vxlan.VNI) }},
+		&recordingLayer{geneve, func() {
+			meta.add("geneve", geneve.VNI)
+			// the options are not needed and would grow forever
+			geneve.Options = geneve.Options[:0]
+		}},
+		&recordingLayer{gtpu, func() {
+			meta.add("gtpu", gtpu.TEID)
+			gtpu.GTPExtensionHeaders = gtpu.GTPExtensionHeaders[:0]
+		}},
+		&decapGRE{meta: meta},
+		&decapERSPAN{meta: meta},
+		&decapMPLS{meta: meta},
+		&decapPPPoE{meta: meta},
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,302 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+	"github.com/mosajjal/dnsmonster/internal/util"
+)
+
+func testEthernet(etherType uint16, payload []byte) []byte {
+	frame := []byte{0x02, 0, 0, 0, 0, 2, 0x02, 0, 0, 0, 0, 1, byte(etherType >> 8), byte(etherType)}
+	return append(frame, payload...)
+}
+
+// testOuterIPv4 wraps payload in the IPv4 header of a tunnel, and in a UDP
+// header too if dstPort is set
+func testOuterIPv4(t *testing.T, protocol layers.IPProtocol, dstPort layers.UDPPort, payload []byte) []byte {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: protocol, SrcIP: net.IP{192, 0, 2, 1}, DstIP: net.IP{192, 0, 2, 2}}
+	toSerialize := []gopacket.SerializableLayer{ip}
+	if dstPort != 0 {
+		ip.Protocol = layers.IPProtocolUDP
+		udp := &layers.UDP{SrcPort: 50000, DstPort: dstPort}
+		udp.SetNetworkLayerForChecksum(ip)
+		toSerialize = append(toSerialize, udp)
+	}
+	toSerialize = append(toSerialize, gopacket.Payload(payload))
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, toSerialize...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestInputHandlerEncapsulation(t *testing.T) {
+	inner := testIPv4DNSPacket(t, "tunnel.example.")
+	innerFrame := testEthernet(0x0800, inner)
+	pppoeLen := len(inner) + 2
+
+	tests := []struct {
+		name  string
+		frame []byte
+		want  []util.Encapsulation
+	}{
+		{
+			"qinq",
+			testEthernet(0x88a8, append([]byte{0x00, 0x64, 0x81, 0x00, 0x00, 0xc8, 0x08, 0x00}, inner...)),
+			[]util.Encapsulation{{Type: "vlan", ID: 100}, {Type: "vlan", ID: 200}},
+		},
+		{
+			"mpls",
+			testEthernet(0x8847, append([]byte{0x00, 0x01, 0x00, 0x40, 0x00, 0x01, 0x11, 0x40}, inner...)),
+			[]util.Encapsulation{{Type: "mpls", ID: 16}, {Type: "mpls", ID: 17}},
+		},
+		{
+			"mpls pseudowire",
+			testEthernet(0x8847, append([]byte{0x00, 0x01, 0x11, 0x40, 0, 0, 0, 0}, innerFrame...)),
+			[]util.Encapsulation{{Type: "mpls", ID: 17}},
+		},
+		{
+			"pppoe",
+			testEthernet(0x8864, append([]byte{0x11, 0x00, 0x12, 0x34, byte(pppoeLen >> 8), byte(pppoeLen), 0x00, 0x21}, inner...)),
+			[]util.Encapsulation{{Type: "pppoe", ID: 0x1234}},
+		},
+		{
+			"gre",
+			testEthernet(0x0800, testOuterIPv4(t, layers.IPProtocolGRE, 0, append([]byte{0x20, 0x00, 0x08, 0x00, 0, 0, 0, 9}, inner...))),
+			[]util.Encapsulation{{Type: "gre", ID: 9}},
+		},
+		{
+			"erspan type I",
+			testEthernet(0x0800, testOuterIPv4(t, layers.IPProtocolGRE, 0, append([]byte{0x00, 0x00, 0x88, 0xbe}, innerFrame...))),
+			[]util.Encapsulation{{Type: "gre"}},
+		},
+		{
+			"erspan type II",
+			testEthernet(0x0800, testOuterIPv4(t, layers.IPProtocolGRE, 0, append([]byte{0x10, 0x00, 0x88, 0xbe, 0, 0, 0, 1, 0x10, 0x00, 0x00, 0x2a, 0, 0, 0, 0}, innerFrame...))),
+			[]util.Encapsulation{{Type: "gre"}, {Type: "erspan", ID: 42}},
+		},
+		{
+			"erspan type III",
+			testEthernet(0x0800, testOuterIPv4(t, layers.IPProtocolGRE, 0, append([]byte{0x10, 0x00, 0x22, 0xeb, 0, 0, 0, 1, 0x20, 0x00, 0x00, 0x2b, 0, 0, 0, 0, 0, 0, 0, 0}, innerFrame...))),
+			[]util.Encapsulation{{Type: "gre"}, {Type: "erspan", ID: 43}},
+		},
+		{
+			"vxlan",
+			testEthernet(0x0800, testOuterIPv4(t, 0, 4789, append([]byte{0x08, 0, 0, 0, 0, 0, 0x05, 0}, innerFrame...))),
+			[]util.Encapsulation{{Type: "vxlan", ID: 5}},
+		},
+		{
+			"geneve",
+			testEthernet(0x0800, testOuterIPv4(t, 0, 6081, append([]byte{0x00, 0x00, 0x08, 0x00, 0, 0, 0x07, 0}, inner...))),
+			[]util.Encapsulation{{Type: "geneve", ID: 7}},
+		},
+		{
+			"gtpu",
+			testEthernet(0x0800, testOuterIPv4(t, 0, 2152, append([]byte{0x30, 0xff, byte(len(inner) >> 8), byte(len(inner)), 0x00, 0xab, 0xcd, 0xef}, inner...))),
+			[]util.Encapsulation{{Type: "gtpu", ID: 0xabcdef}},
+		},
+		{
+			"vlan in vxlan",
+			testEthernet(0x0800, testOuterIPv4(t, 0, 4789, append([]byte{0x08, 0, 0, 0, 0, 0, 0x05, 0}, testEthernet(0x8100, append([]byte{0x00, 0x0a, 0x08, 0x00}, inner...))...))),
+			[]util.Encapsulation{{Type: "vxlan", ID: 5}, {Type: "vlan", ID: 10}},
+		},
+		{
+			"plain",
+			innerFrame,
+			nil,
+		},
+	}
+
+	config := captureConfig{
+		ports:         mustParsePorts("53"),
+		resultChannel: make(chan util.DNSResult, 10),
+		tcpAssembly:   []chan tcpPacket{make(chan tcpPacket, 1)},
+	}
+	packets := startInputHandler(t, &config)
+
+	for _, tt := range tests {
+		packets <- &rawPacketBytes{tt.frame, gopacket.CaptureInfo{Timestamp: time.Now()}, layers.LinkTypeEthernet, nil, nil}
+		select {
+		case result := <-config.resultChannel:
+			if !result.SrcIP.Equal(net.IP{10, 0, 0, 1}) || result.DNS.Question[0].Name != "tunnel.example." {
+				t.Errorf("%s: the inner packet was not decoded, got %s %v", tt.name, result.SrcIP, result.DNS.Question)
+			}
+			if !reflect.DeepEqual(result.Encapsulation, tt.want) {
+				t.Errorf("%s: got encapsulation %v, want %v", tt.name, result.Encapsulation, tt.want)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: packet was not decoded", tt.name)
+		}
+		// the packet must only be reported once
+		select {
+		case result := <-config.resultChannel:
+			t.Errorf("%s: unexpected extra record %v", tt.name, result.Encapsulation)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestInputHandlerL2Metadata(t *testing.T) {
+	config := captureConfig{
+		ports:         mustParsePorts("53"),
+		resultChannel: make(chan util.DNSResult, 10),
+		tcpAssembly:   []chan tcpPacket{make(chan tcpPacket, 1)},
+	}
+	packets := startInputHandler(t, &config)
+	iface := &util.CaptureInterface{Name: "span0", Index: 3, Comment: "tenant port"}
+	inner := testIPv4DNSPacket(t, "l2.example.")
+
+	// QinQ on the SPAN port, the MACs come from the only Ethernet header
+	frame := testEthernet(0x88a8, append([]byte{0x00, 0x64, 0x81, 0x00, 0x00, 0xc8, 0x08, 0x00}, inner...))
+	packets <- &rawPacketBytes{frame, gopacket.CaptureInfo{Timestamp: time.Now()}, layers.LinkTypeEthernet, iface, nil}
+	select {
+	case result := <-config.resultChannel:
+		if !reflect.DeepEqual(result.VLANs, []uint16{100, 200}) {
+			t.Errorf("unexpected VLANs %v", result.VLANs)
+		}
+		if result.SrcMAC != "02:00:00:00:00:01" || result.DstMAC != "02:00:00:00:00:02" {
+			t.Errorf("unexpected MACs %s %s", result.SrcMAC, result.DstMAC)
+		}
+		if result.Interface != iface {
+			t.Errorf("unexpected interface %+v", result.Interface)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("packet was not decoded")
+	}
+
+	// the MACs of a VXLAN tunnel are the ones of the inner frame
+	innerFrame := []byte{0x02, 0, 0, 0, 0, 0x22, 0x02, 0, 0, 0, 0, 0x11, 0x08, 0x00}
+	frame = testEthernet(0x0800, testOuterIPv4(t, 0, 4789, append([]byte{0x08, 0, 0, 0, 0, 0, 0x05, 0}, append(innerFrame, inner...)...)))
+	packets <- &rawPacketBytes{frame, gopacket.CaptureInfo{Timestamp: time.Now()}, layers.LinkTypeEthernet, nil, nil}
+	select {
+	case result := <-config.resultChannel:
+		if result.SrcMAC != "02:00:00:00:00:11" || result.DstMAC != "02:00:00:00:00:22" || result.VLANs != nil || result.Interface != nil {
+			t.Errorf("unexpected metadata %s %s %v %v", result.SrcMAC, result.DstMAC, result.VLANs, result.Interface)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("packet was not decoded")
+	}
+
+	// a raw IP packet has no layer 2 metadata at all
+	packets <- &rawPacketBytes{inner, gopacket.CaptureInfo{Timestamp: time.Now()}, layers.LinkTypeRaw, nil, nil}
+	select {
+	case result := <-config.resultChannel:
+		if result.SrcMAC != "" || result.DstMAC != "" || result.Encapsulation != nil {
+			t.Errorf("unexpected metadata %s %s %v", result.SrcMAC, result.DstMAC, result.Encapsulation)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("packet was not decoded")
+	}
+}
+
+func TestPacketMetaCopies(t *testing.T) {
+	config := captureConfig{
+		ports:         mustParsePorts("53"),
+		resultChannel: make(chan util.DNSResult, 10),
+		tcpAssembly:   []chan tcpPacket{make(chan tcpPacket, 10)},
+	}
+	var meta packetMeta
+	meta.reset(&util.CaptureInterface{Name: "span0"}, nil)
+	meta.add("vlan", 100)
+	meta.setMACs(net.HardwareAddr{2, 0, 0, 0, 0, 1}, net.HardwareAddr{2, 0, 0, 0, 0, 2})
+	srcIP, dstIP := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	flow := gopacket.NewFlow(layers.EndpointIPv4, srcIP, dstIP)
+
+	// the packets that don't make a record don't copy the metadata
+	udp := &layers.UDP{SrcPort: 12345, DstPort: 8080}
+	udp.Payload = []byte("not dns")
+	foundLayers := []gopacket.LayerType{layers.LayerTypeUDP}
+	if allocs := testing.AllocsPerRun(100, func() {
+		config.processTransport(&foundLayers, udp, &layers.TCP{}, flow, time.Now(), 4, srcIP, dstIP, &meta)
+	}); allocs != 0 {
+		t.Errorf("%v allocations for a dropped packet", allocs)
+	}
+
+	// the records and the queued segments don't share the worker's metadata,
+	// which is reset for the next packet
+	var res util.DNSResult
+	meta.annotate(&res)
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 53, Seq: 1000}
+	tcp.Payload = testTCPDNSMessage(t, "meta.example.")
+	foundLayers = []gopacket.LayerType{layers.LayerTypeTCP}
+	config.processTransport(&foundLayers, &layers.UDP{}, tcp, flow, time.Now(), 4, srcIP, dstIP, &meta)
+	queued := <-config.tcpAssembly[0]
+	meta.reset(nil, nil)
+	meta.add("vlan", 200)
+	if !reflect.DeepEqual(res.Encapsulation, []util.Encapsulation{{Type: "vlan", ID: 100}}) {
+		t.Errorf("the record's encapsulation became %v", res.Encapsulation)
+	}
+	if queued.meta == &meta || queued.meta.iface == nil || queued.meta.encapsulation[0].ID != 100 {
+		t.Errorf("the queued segment has the metadata %+v", queued.meta)
+	}
+}
+
+func TestPcapngCaptureInterface(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := pcapgo.NewNgWriterInterface(&buf, pcapgo.NgInterface{Name: "eth0", LinkType: layers.LinkTypeEthernet}, pcapgo.DefaultNgWriterOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.AddInterface(pcapgo.NgInterface{Name: "span1", Comment: "tenant b", LinkType: layers.LinkTypeRaw}); err != nil {
+		t.Fatal(err)
+	}
+	packet := testIPv4DNSPacket(t, "pcapng.example.")
+	for _, index := range []int{1, 0, 1} {
+		data := packet
+		if index == 0 {
+			data = testEthernet(0x0800, packet)
+		}
+		if err = w.WritePacket(gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data), InterfaceIndex: index}, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	handle, err := initializeOfflinePcapNg(&buf, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seen []*util.CaptureInterface
+	for {
+		_, ci, err := handle.ReadPacketData()
+		if err != nil {
+			break
+		}
+		seen = append(seen, handle.captureInterface(ci))
+	}
+	if len(seen) != 3 {
+		t.Fatalf("read %d packets", len(seen))
+	}
+	if *seen[0] != (util.CaptureInterface{Name: "span1", Index: 1, Comment: "tenant b"}) || *seen[1] != (util.CaptureInterface{Name: "eth0"}) {
+		t.Errorf("unexpected interfaces %+v %+v", seen[0], seen[1])
+	}
+	if seen[0] != seen[2] {
+		t.Error("the interfaces should be shared between packets")
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,328 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+	mkdns "github.com/miekg/dns"
+	"github.com/mosajjal/dnsmonster/internal/util"
+	"github.com/rcrowley/go-metrics"
+)
+
+const (
+	dotPort   = 853
+	httpsPort = 443
+
+	// ClientHellos are around 2KB with the post-quantum key shares, anything
+	// larger than this is not worth buffering
+	maxHelloSize    = 8 << 10
+	maxHelloFlows   = 4096
+	helloFlowExpiry = 5 * time.Second
+)
+
+// the public resolvers used when --encryptedDNSResolvers is not set
+var defaultEncryptedDNSResolvers = []string{
+	"dns.google", "dns.google.com", "8.8.8.8", "8.8.4.4", "2001:4860:4860::8888", "2001:4860:4860::8844",
+	"cloudflare-dns.com", "*.cloudflare-dns.com", "one.one.one.one", "1.1.1.1", "1.0.0.1", "2606:4700:4700::1111", "2606:4700:4700::1001",
+	"dns.quad9.net", "*.quad9.net", "9.9.9.9", "149.112.112.112", "2620:fe::fe", "2620:fe::9",
+	"doh.opendns.com", "dns.opendns.com", "208.67.222.222", "208.67.220.220",
+	"dns.adguard-dns.com", "*.adguard-dns.com", "94.140.14.14", "94.140.15.15",
+	"dns.nextdns.io", "*.nextdns.io",
+	"doh.cleanbrowsing.org", "*.cleanbrowsing.org",
+	"doh.mullvad.net", "*.mullvad.net",
+}
+
+// resolverList matches server names and addresses against the known
+// encrypted DNS resolvers. Entries are exact hostnames, *.domain wildcards
+// matching any subdomain, IP addresses or CIDRs.
+type resolverList struct {
+	names    map[string]bool
+	suffixes []string
+	networks []*net.IPNet
+}
+
+func newResolverList(entries []string) (*resolverList, error) {
+	l := &resolverList{names: make(map[string]bool)}
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			l.networks = append(l.networks, network)
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			l.networks = append(l.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		entry = strings.TrimSuffix(entry, ".")
+		if suffix, ok := strings.CutPrefix(entry, "*."); ok {
+			l.suffixes = append(l.suffixes, "."+suffix)
+			continue
+		}
+		if strings.Trim(entry, "abcdefghijklmnopqrstuvwxyz0123456789-_.") != "" {
+			return nil, fmt.Errorf("invalid resolver entry %q", entry)
+		}
+		l.names[entry] = true
+	}
+	return l, nil
+}
+
+func loadResolverList(filename string) (*resolverList, error) {
+	if filename == "" {
+		return newResolverList(defaultEncryptedDNSResolvers)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open resolver list %s: %w", filename, err)
+	}
+	defer file.Close()
+	var entries []string
+	scanner := bufio.NewScanner(io.LimitReader(file, 1<<20))
+	for scanner.Scan() {
+		entries = append(entries, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading resolver list %s: %w", filename, err)
+	}
+	return newResolverList(entries)
+}
+
+// match returns the matching entry for the server name or address, or an
+// empty string if the server is not a known resolver
+func (l *resolverList) match(sni string, ip net.IP) string {
+	sni = strings.TrimSuffix(strings.ToLower(sni), ".")
+	if sni != "" {
+		if l.names[sni] {
+			return sni
+		}
+		for _, suffix := range l.suffixes {
+			if strings.HasSuffix(sni, suffix) {
+				return "*" + suffix
+			}
+		}
+	}
+	for _, network := range l.networks {
+		if network.Contains(ip) {
+			return network.String()
+		}
+	}
+	return ""
+}
+
+type helloFlowKey struct {
+	src, dst         [16]byte
+	srcPort, dstPort uint16
+}
+
+type helloFlow struct {
+	data     []byte
+	nextSeq  uint32
+	lastSeen time.Time
+}
+
+// encryptedDNSDetector looks at the first flight of TLS and QUIC connections
+// to 853 and 443. The ClientHello often doesn't fit in a single segment, so
+// the first few KB of each candidate connection are buffered until it can be
+// parsed.
+type encryptedDNSDetector struct {
+	mu        sync.Mutex
+	resolvers *resolverList
+	flows     map[helloFlowKey]*helloFlow
+	quicFlows map[quicFlowKey]*quicFlow
+	lastSweep time.Time
+	detected  metrics.Counter
+	untracked metrics.Counter
+}
+
+func newEncryptedDNSDetector(resolvers *resolverList) *encryptedDNSDetector {
+	return &encryptedDNSDetector{
+		resolvers: resolvers,
+		flows:     make(map[helloFlowKey]*helloFlow),
+		quicFlows: make(map[quicFlowKey]*quicFlow),
+		detected:  metrics.GetOrRegisterCounter("encryptedDNSConnections", metrics.DefaultRegistry),
+		untracked: metrics.GetOrRegisterCounter("encryptedDNSUntracked", metrics.DefaultRegistry),
+	}
+}
+
+// sweep forgets the connections that didn't complete a ClientHello in time
+func (e *encryptedDNSDetector) sweep(now time.Time) {
+	if now.Sub(e.lastSweep) < helloFlowExpiry {
+		return
+	}
+	e.lastSweep = now
+	for key, flow := range e.flows {
+		if now.Sub(flow.lastSeen) > helloFlowExpiry {
+			delete(e.flows, key)
+		}
+	}
+	for key, flow := range e.quicFlows {
+		if now.Sub(flow.lastSeen) > helloFlowExpiry {
+			delete(e.quicFlows, key)
+		}
+	}
+}
+
+// tcpHello feeds a TCP segment to the detector and returns the ClientHello
+// once it's complete
+func (e *encryptedDNSDetector) tcpHello(tcp *layers.TCP, timestamp time.Time, SrcIP, DstIP net.IP) *clientHello {
+	payload := tcp.Payload
+	key := helloFlowKey{src: ipToKey(SrcIP), dst: ipToKey(DstIP), srcPort: uint16(tcp.SrcPort), dstPort: uint16(tcp.DstPort)}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.sweep(timestamp)
+	flow, ok := e.flows[key]
+	switch {
+	case ok && tcp.Seq == flow.nextSeq:
+		flow.data = append(flow.data, payload...)
+	case ok:
+		// out of order or retransmitted, wait for the next one
+		return nil
+	case len(payload) >= 6 && payload[0] == tlsRecordHandshake && payload[5] == tlsHandshakeClientHello:
+		flow = &helloFlow{data: append([]byte{}, payload...)}
+	default:
+		return nil
+	}
+	flow.nextSeq = tcp.Seq + uint32(len(payload))
+	flow.lastSeen = timestamp
+
+	hello, err := tlsClientHello(flow.data)
+	if err == errTLSIncomplete && len(flow.data) < maxHelloSize {
+		if !ok {
+			if len(e.flows) >= maxHelloFlows {
+				e.untracked.Inc(1)
+				return nil
+			}
+			e.flows[key] = flow
+		}
+		return nil
+	}
+	delete(e.flows, key)
+	if err != nil {
+		return nil
+	}
+	return hello
+}
+
+// classify returns the encrypted DNS transport a ClientHello belongs to and
+// the matching resolver. Everything on 853 is DoT, while on 443 only the
+// connections to a known resolver are reported.
+func (e *encryptedDNSDetector) classify(hello *clientHello, DstIP net.IP, dstPort uint16, quic bool) (string, string, bool) {
+	resolver := e.resolvers.match(hello.sni, DstIP)
+	switch {
+	case dstPort == dotPort && quic:
+		return "doq", resolver, true
+	case dstPort == dotPort:
+		return "dot", resolver, true
+	case resolver == "":
+		return "", "", false
+	case quic:
+		return "doh3", resolver, true
+	}
+	return "doh", resolver, true
+}
+
+// encryptedDNSResult builds the connection record of an encrypted DNS
+// connection. The synthetic question holds the server name, or the reverse
+// name of the server address if there's no SNI, so the domain filters work as
+// usual. The outputs with a row per question skip these records.
+func encryptedDNSResult(hello *clientHello, transport, resolver string, timestamp time.Time, IPVersion uint8, SrcIP, DstIP net.IP, srcPort, dstPort uint16, protocol string) util.DNSResult {
+	qname := mkdns.Fqdn(strings.ToLower(hello.sni))
+	if hello.sni == "" {
+		qname, _ = mkdns.ReverseAddr(DstIP.String())
+	}
+	msg := mkdns.Msg{}
+	msg.SetQuestion(qname, mkdns.TypeA)
+	msg.Id = 0
+	msg.RecursionDesired = false
+
+	ja4Transport := byte('t')
+	if protocol == "udp" {
+		ja4Transport = 'q'
+	}
+	ja3, ja3Hash := hello.ja3()
+
+	MaskSize := util.GeneralFlags.MaskSize4
+	BitSize := 8 * net.IPv4len
+	if IPVersion == 6 {
+		MaskSize = util.GeneralFlags.MaskSize6
+		BitSize = 8 * net.IPv6len
+	}
+	return util.DNSResult{
+		Timestamp:   timestamp,
+		DNS:         msg,
+		IPVersion:   IPVersion,
+		SrcIP:       SrcIP.Mask(net.CIDRMask(MaskSize, BitSize)),
+		SrcPort:     srcPort,
+		DstIP:       DstIP.Mask(net.CIDRMask(MaskSize, BitSize)),
+		DstPort:     dstPort,
+		Protocol:    protocol,
+		MatchedPort: dstPort,
+		AppProtocol: transport,
+		EncryptedDNS: &util.EncryptedDNSConnection{
+			Transport: transport,
+			SNI:       hello.sni,
+			ALPN:      hello.alpn,
+			JA3:       ja3,
+			JA3Hash:   ja3Hash,
+			JA4:       hello.ja4(ja4Transport),
+			Resolver:  resolver,
+		},
+	}
+}
+
+// isEncryptedDNSPort tells if the packets sent to port may start an encrypted
+// DNS connection
+func isEncryptedDNSPort(port uint16) bool {
+	return port == dotPort || port == httpsPort
+}
+
+// processEncryptedDNSTCP looks for DoT and DoH connections in a TCP segment
+func (config *captureConfig) processEncryptedDNSTCP(tcp *layers.TCP, timestamp time.Time, IPVersion uint8, SrcIP, DstIP net.IP, meta *packetMeta) {
+	dstPort := uint16(tcp.DstPort)
+	if !isEncryptedDNSPort(dstPort) || len(tcp.Payload) == 0 {
+		return
+	}
+	hello := config.encryptedDNS.tcpHello(tcp, timestamp, SrcIP, DstIP)
+	if hello == nil {
+		return
+	}
+	transport, resolver, ok := config.encryptedDNS.classify(hello, DstIP, dstPort, false)
+	if !ok {
+		return
+	}
+	config.encryptedDNS.detected.Inc(1)
+	res := encryptedDNSResult(hello, transport, resolver, timestamp, IPVersion, SrcIP, DstIP, uint16(tcp.SrcPort), dstPort, "tcp")
+	meta.annotate(&res)
+	config.sendResult(res)
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,186 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"crypto/tls"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/mosajjal/dnsmonster/internal/util"
+)
+
+// testClientHello returns the first flight of a crypto/tls client
+func testClientHello(t *testing.T, serverName string, alpn ...string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		conn := tls.Client(client, &tls.Config{ServerName: serverName, NextProtos: alpn})
+		conn.Handshake()
+		client.Close()
+	}()
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 16<<10)
+	n := 0
+	for {
+		read, err := server.Read(buf[n:])
+		n += read
+		if _, helloErr := tlsClientHello(buf[:n]); helloErr != errTLSIncomplete || err != nil {
+			break
+		}
+	}
+	return buf[:n]
+}
+
+func TestParseClientHello(t *testing.T) {
+	hello, err := tlsClientHello(testClientHello(t, "dns.google", "h2", "http/1.1"))
+	if err != nil {
+		t.Fatalf("failed to parse ClientHello: %v", err)
+	}
+	if hello.sni != "dns.google" {
+		t.Errorf("unexpected SNI %q", hello.sni)
+	}
+	if len(hello.alpn) != 2 || hello.alpn[0] != "h2" {
+		t.Errorf("unexpected ALPN %v", hello.alpn)
+	}
+	ja3, ja3Hash := hello.ja3()
+	if !strings.HasPrefix(ja3, "771,") || len(ja3Hash) != 32 {
+		t.Errorf("unexpected JA3 %s %s", ja3, ja3Hash)
+	}
+	if ja4 := hello.ja4('t'); !regexp.MustCompile(`^t13d\d{4}h2_[0-9a-f]{12}_[0-9a-f]{12}$`).MatchString(ja4) {
+		t.Errorf("unexpected JA4 %s", ja4)
+	}
+	if _, err := tlsClientHello([]byte("GET / HTTP/1.1\r\n")); err != errTLSMalformed {
+		t.Errorf("expected a malformed error, got %v", err)
+	}
+}
+
+func TestJA4NoSNI(t *testing.T) {
+	hello := &clientHello{
+		version:    0x0303,
+		ciphers:    []uint16{0x0a0a, 0x1301, 0xc02b},
+		extensions: []uint16{0x0a0a, tlsExtALPN, tlsExtSignatureAlgorithms},
+		alpn:       []string{"\x01x"},
+		sigAlgs:    []uint16{0x0403},
+	}
+	if ja4 := hello.ja4('q'); !strings.HasPrefix(ja4, "q12i020208_") {
+		t.Errorf("unexpected JA4 %s", ja4)
+	}
+}
+
+func TestResolverList(t *testing.T) {
+	l, err := newResolverList([]string{"# comment", "dns.example", "*.doh.example", "192.0.2.0/24", "2001:db8::53"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		sni  string
+		ip   string
+		want string
+	}{
+		{"DNS.example.", "203.0.113.1", "dns.example"},
+		{"a.doh.example", "203.0.113.1", "*.doh.example"},
+		{"doh.example", "203.0.113.1", ""},
+		{"", "192.0.2.10", "192.0.2.0/24"},
+		{"www.example", "2001:db8::53", "2001:db8::53/128"},
+		{"www.example", "203.0.113.1", ""},
+	}
+	for _, tt := range tests {
+		if got := l.match(tt.sni, net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("match(%q, %s) = %q, want %q", tt.sni, tt.ip, got, tt.want)
+		}
+	}
+	if _, err := newResolverList([]string{"not a domain!"}); err == nil {
+		t.Error("expected an error for an invalid entry")
+	}
+}
+
+func TestProcessEncryptedDNSTCP(t *testing.T) {
+	resolvers, _ := newResolverList(defaultEncryptedDNSResolvers)
+	config := captureConfig{
+		ports:         mustParsePorts("53"),
+		encryptedDNS:  newEncryptedDNSDetector(resolvers),
+		resultChannel: make(chan util.DNSResult, 10),
+		tcpAssembly:   []chan tcpPacket{make(chan tcpPacket, 10)},
+	}
+	srcIP := net.ParseIP("10.0.0.1").To4()
+	dstIP := net.ParseIP("203.0.113.9").To4()
+	flow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(srcIP), layers.NewIPEndpoint(dstIP))
+	foundLayers := []gopacket.LayerType{layers.LayerTypeTCP}
+
+	send := func(payload []byte, dstPort layers.TCPPort) {
+		// split the ClientHello over two segments
+		half := len(payload) / 2
+		for i, segment := range [][]byte{payload[:half], payload[half:]} {
+			tcp := &layers.TCP{SrcPort: 40000, DstPort: dstPort, Seq: 1000 + uint32(i*half)}
+			tcp.Payload = segment
+			config.processTransport(&foundLayers, &layers.UDP{}, tcp, flow, time.Now(), 4, srcIP, dstIP, nil)
+		}
+	}
+
+	send(testClientHello(t, "cloudflare-dns.com", "h2"), httpsPort)
+	select {
+	case result := <-config.resultChannel:
+		e := result.EncryptedDNS
+		if e == nil || e.Transport != "doh" || e.SNI != "cloudflare-dns.com" || e.Resolver != "cloudflare-dns.com" {
+			t.Fatalf("unexpected encrypted DNS record %+v", e)
+		}
+		if result.AppProtocol != "doh" || result.DNS.Question[0].Name != "cloudflare-dns.com." {
+			t.Errorf("unexpected record %s %v", result.AppProtocol, result.DNS.Question)
+		}
+	default:
+		t.Fatal("DoH connection was not detected")
+	}
+
+	// HTTPS to anything else is not reported
+	send(testClientHello(t, "www.example.com", "h2"), httpsPort)
+	if len(config.resultChannel) != 0 {
+		t.Error("HTTPS to an unknown server should not be reported")
+	}
+
+	// everything on 853 is DoT
+	send(testClientHello(t, "resolver.example.net"), dotPort)
+	select {
+	case result := <-config.resultChannel:
+		if result.EncryptedDNS == nil || result.EncryptedDNS.Transport != "dot" || result.EncryptedDNS.Resolver != "" {
+			t.Errorf("unexpected DoT record %+v", result.EncryptedDNS)
+		}
+	default:
+		t.Fatal("DoT connection was not detected")
+	}
+	if len(config.encryptedDNS.flows) != 0 {
+		t.Errorf("%d flows left behind", len(config.encryptedDNS.flows))
+	}
+
+	// a SPAN port duplicating the segments reports the connection once
+	config.dedup = newDedupWindow(time.Second, 100)
+	hello := testClientHello(t, "dns.google", "h2")
+	tcp := &layers.TCP{SrcPort: 40001, DstPort: httpsPort, Seq: 5000}
+	tcp.Payload = hello
+	for range 2 {
+		config.processTransport(&foundLayers, &layers.UDP{}, tcp, flow, time.Now(), 4, srcIP, dstIP, nil)
+	}
+	if len(config.resultChannel) != 1 {
+		t.Errorf("%d records for a duplicated ClientHello", len(config.resultChannel))
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,152 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+	mkdns "github.com/miekg/dns"
+	"github.com/mosajjal/dnsmonster/internal/util"
+)
+
+const (
+	dnsHeaderLen = 12
+	// smallest possible question: root name, type and class
+	minQuestionLen = 5
+	// smallest possible resource record: root name, type, class, ttl and rdlength
+	minRRLen = 11
+)
+
+// looksLikeDNS runs a few cheap sanity checks on payload to tell whether
+// it's worth calling Unpack on it. It is used on ports not selected by
+// --port, where the vast majority of the payloads are not DNS.
+func looksLikeDNS(payload []byte) bool {
+	if len(payload) < dnsHeaderLen+minQuestionLen {
+		return false
+	}
+	// opcodes 0, 1, 2, 4 and 5 are assigned (query, iquery, status, notify, update)
+	switch (payload[2] >> 3) & 0x0f {
+	case 0, 1, 2, 4, 5:
+	default:
+		return false
+	}
+	// the Z bit must be zero and rcode must be one of the assigned ones
+	if payload[3]&0x40 != 0 || payload[3]&0x0f > 10 {
+		return false
+	}
+	qd := int(binary.BigEndian.Uint16(payload[4:]))
+	an := int(binary.BigEndian.Uint16(payload[6:]))
+	ns := int(binary.BigEndian.Uint16(payload[8:]))
+	ar := int(binary.BigEndian.Uint16(payload[10:]))
+	if qd == 0 || dnsHeaderLen+qd*minQuestionLen+(an+ns+ar)*minRRLen > len(payload) {
+		return false
+	}
+
+	// the first question name can't be compressed since there's nothing
+	// before it to point to
+	offset := dnsHeaderLen
+	nameLen := 0
+	for {
+		if offset >= len(payload) {
+			return false
+		}
+		labelLen := int(payload[offset])
+		offset++
+		if labelLen == 0 {
+			break
+		}
+		if labelLen > 63 {
+			return false
+		}
+		nameLen += labelLen + 1
+		if nameLen > 255 || offset+labelLen > len(payload) {
+			return false
+		}
+		for _, c := range payload[offset : offset+labelLen] {
+			if c < 0x20 || c > 0x7e {
+				return false
+			}
+		}
+		offset += labelLen
+	}
+	if offset+4 > len(payload) {
+		return false
+	}
+	// the top bit of the class is the unicast-response bit in mDNS
+	switch binary.BigEndian.Uint16(payload[offset+2:]) & 0x7fff {
+	case 1, 3, 4, 254, 255:
+		return true
+	}
+	return false
+}
+
+// splitTCPDNS returns the length prefixed DNS messages fully contained in a
+// single TCP segment, or nil if the segment doesn't look like DNS over TCP.
+func splitTCPDNS(payload []byte) [][]byte {
+	var msgs [][]byte
+	for len(payload) >= 2 {
+		msgLen := int(binary.BigEndian.Uint16(payload))
+		if msgLen == 0 || 2+msgLen > len(payload) || !looksLikeDNS(payload[2:2+msgLen]) {
+			return nil
+		}
+		msgs = append(msgs, payload[2:2+msgLen])
+		payload = payload[2+msgLen:]
+	}
+	if len(payload) != 0 {
+		return nil
+	}
+	return msgs
+}
+
+// processNonstandardTCP decodes the DNS messages msgs split by splitTCPDNS
+// from a TCP segment on a port not selected by --port. These segments are not
+// sent to the TCP assembler since that would mean tracking every TCP
+// connection, so only the messages fully contained in a single segment are
+// detected.
+func (config *captureConfig) processNonstandardTCP(tcp *layers.TCP, msgs [][]byte, timestamp time.Time, IPVersion uint8, SrcIP, DstIP net.IP, meta *packetMeta) {
+	MaskSize := util.GeneralFlags.MaskSize4
+	BitSize := 8 * net.IPv4len
+	if IPVersion == 6 {
+		MaskSize = util.GeneralFlags.MaskSize6
+		BitSize = 8 * net.IPv6len
+	}
+	for _, payload := range msgs {
+		msg := mkdns.Msg{}
+		if err := msg.Unpack(payload); err != nil {
+			continue
+		}
+		config.nonstandardPortRecords.Inc(1)
+		res := util.DNSResult{
+			Timestamp:    timestamp,
+			DNS:          msg,
+			IPVersion:    IPVersion,
+			SrcIP:        SrcIP.Mask(net.CIDRMask(MaskSize, BitSize)),
+			SrcPort:      uint16(tcp.SrcPort),
+			DstIP:        DstIP.Mask(net.CIDRMask(MaskSize, BitSize)),
+			DstPort:      uint16(tcp.DstPort),
+			Protocol:     "tcp",
+			PacketLength: uint16(len(payload)),
+			Tags:         []string{util.TagNonstandardPort},
+		}
+		meta.annotate(&res)
+		config.sendResult(res)
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,140 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	mkdns "github.com/miekg/dns"
+	"github.com/mosajjal/dnsmonster/internal/util"
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestLooksLikeDNS(t *testing.T) {
+	query := packTestQuery(t, "aGVsbG8.tunnel.example.")
+	if !looksLikeDNS(query) {
+		t.Error("a DNS query was not recognised")
+	}
+
+	response := mkdns.Msg{}
+	response.SetQuestion("example.com.", mkdns.TypeA)
+	response.Response = true
+	rr, _ := mkdns.NewRR("example.com. 300 IN A 192.0.2.1")
+	response.Answer = append(response.Answer, rr)
+	responseBytes, _ := response.Pack()
+	if !looksLikeDNS(responseBytes) {
+		t.Error("a DNS response was not recognised")
+	}
+
+	// an answer count that can't fit in the payload
+	bogus := append([]byte{}, query...)
+	binary.BigEndian.PutUint16(bogus[6:], 100)
+
+	notDNS := map[string][]byte{
+		"http":         []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+		"tls":          {0x16, 0x03, 0x01, 0x02, 0x00, 0x01, 0x00, 0x01, 0xfc, 0x03, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		"short":        query[:10],
+		"counts":       bogus,
+		"zero padding": make([]byte, 64),
+	}
+	for name, payload := range notDNS {
+		if looksLikeDNS(payload) {
+			t.Errorf("%s payload taken as DNS", name)
+		}
+	}
+}
+
+func TestSplitTCPDNS(t *testing.T) {
+	query := packTestQuery(t, "example.com.")
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	framed = append(framed, query...)
+	if msgs := splitTCPDNS(append(framed, framed...)); len(msgs) != 2 {
+		t.Errorf("expected 2 messages, got %d", len(msgs))
+	}
+	if msgs := splitTCPDNS(framed[:len(framed)-1]); msgs != nil {
+		t.Error("a partial message should not be detected")
+	}
+}
+
+func TestProcessTransportNonstandardPort(t *testing.T) {
+	config := captureConfig{
+		ports:                  mustParsePorts("53"),
+		DetectNonstandardPorts: true,
+		nonstandardPortRecords: metrics.NewCounter(),
+		resultChannel:          make(chan util.DNSResult, 10),
+		tcpAssembly:            []chan tcpPacket{make(chan tcpPacket, 10)},
+	}
+	udp := &layers.UDP{
+		BaseLayer: layers.BaseLayer{Payload: packTestQuery(t, "c2.example.")},
+	}
+	udp.SrcPort = 40000
+	udp.DstPort = 5300
+	tcp := &layers.TCP{}
+	foundLayers := []gopacket.LayerType{layers.LayerTypeUDP}
+	srcIP := net.ParseIP("10.0.0.1").To4()
+	dstIP := net.ParseIP("10.0.0.2").To4()
+	flow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(srcIP), layers.NewIPEndpoint(dstIP))
+
+	config.processTransport(&foundLayers, udp, tcp, flow, time.Now(), 4, srcIP, dstIP, nil)
+	select {
+	case result := <-config.resultChannel:
+		if len(result.Tags) != 1 || result.Tags[0] != util.TagNonstandardPort {
+			t.Errorf("expected the record to be tagged %s, got %v", util.TagNonstandardPort, result.Tags)
+		}
+		if result.MatchedPort != 0 {
+			t.Errorf("no port should have matched, got %d", result.MatchedPort)
+		}
+	default:
+		t.Fatal("DNS on a non-standard port was not detected")
+	}
+	if config.nonstandardPortRecords.Count() != 1 {
+		t.Errorf("nonstandard port counter is %d, want 1", config.nonstandardPortRecords.Count())
+	}
+
+	// TCP segments on non-standard ports are decoded without reassembly
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(udp.Payload)))
+	tcp.Payload = append(framed, udp.Payload...)
+	tcp.SrcPort = 40000
+	tcp.DstPort = 5300
+	foundLayers = []gopacket.LayerType{layers.LayerTypeTCP}
+	config.processTransport(&foundLayers, udp, tcp, flow, time.Now(), 4, srcIP, dstIP, nil)
+	select {
+	case result := <-config.resultChannel:
+		if result.Protocol != "tcp" || len(result.Tags) != 1 {
+			t.Errorf("unexpected TCP record %s %v", result.Protocol, result.Tags)
+		}
+	default:
+		t.Fatal("DNS over TCP on a non-standard port was not detected")
+	}
+	if len(config.tcpAssembly[0]) != 0 {
+		t.Error("non-standard port segments should not go to the assembler")
+	}
+
+	// with the detection off, nothing comes out
+	config.DetectNonstandardPorts = false
+	foundLayers = []gopacket.LayerType{layers.LayerTypeUDP}
+	config.processTransport(&foundLayers, udp, tcp, flow, time.Now(), 4, srcIP, dstIP, nil)
+	if len(config.resultChannel) != 0 {
+		t.Error("non-standard ports should be ignored unless enabled")
+	}
+}
+
+// vim: foldmethod=marker
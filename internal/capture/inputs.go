@@ -0,0 +1,259 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mosajjal/dnsmonster/internal/util"
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+// the kinds of the inputs set by --devName, --pcapFile and --dnstapSocket.
+// The other kinds are in captureSources.
+const (
+	inputLive     = "live"
+	inputAfpacket = "afpacket"
+	inputPcap     = "pcap"
+	inputDnstap   = "dnstap"
+)
+
+// captureInput is one of the sources the capture reads from. All of them feed
+// the same processing pipeline.
+type captureInput struct {
+	kind   string // live, afpacket, pcap, dnstap or any registered source
+	target string // the device, file or socket
+	source captureSource
+	filter string
+	// filterSet is false when filter is the default of --filter
+	filterSet bool
+	// label is set on the records of the input if given, name is used for
+	// the metrics and always set
+	label  string
+	name   string
+	ratioA int
+	ratioB int
+	stats  *inputStats
+}
+
+// inputStats are the metrics of each input, and the figures summed up into the
+// global packetsCaptured, packetsDropped and packetLossPercent
+type inputStats struct {
+	captured    metrics.Gauge
+	dropped     metrics.Gauge
+	overRatio   metrics.Counter
+	invalid     metrics.Gauge
+	lossPercent metrics.GaugeFloat64
+}
+
+func newInputStats(name string) *inputStats {
+	prefix := "input." + name + "."
+	return &inputStats{
+		captured:    metrics.GetOrRegisterGauge(prefix+"packetsCaptured", metrics.DefaultRegistry),
+		dropped:     metrics.GetOrRegisterGauge(prefix+"packetsDropped", metrics.DefaultRegistry),
+		overRatio:   metrics.GetOrRegisterCounter(prefix+"packetsOverRatio", metrics.DefaultRegistry),
+		invalid:     metrics.GetOrRegisterGauge(prefix+"packetsInvalid", metrics.DefaultRegistry),
+		lossPercent: metrics.GetOrRegisterGaugeFloat64(prefix+"packetLossPercent", metrics.DefaultRegistry),
+	}
+}
+
+func (s *inputStats) update(captured, dropped int64) {
+	s.captured.Update(captured)
+	s.dropped.Update(dropped)
+	if captured > 0 {
+		s.lossPercent.Update(float64(dropped) * 100.0 / float64(captured))
+	}
+}
+
+// sampleWeight is the number of packets each packet kept by the sample ratio
+// of the input stands for, 0 if the input isn't sampled
+func (in *captureInput) sampleWeight() float64 {
+	if in.ratioA == in.ratioB {
+		return 0
+	}
+	return float64(in.ratioB) / float64(in.ratioA)
+}
+
+// parseSampleRatio parses the a:b syntax of --sampleRatio
+func parseSampleRatio(ratio string) (int, int, error) {
+	ratioNumbers := strings.Split(ratio, ":")
+	if len(ratioNumbers) != 2 {
+		return 0, 0, fmt.Errorf("wrong sample ratio syntax %q", ratio)
+	}
+	a, errA := strconv.Atoi(ratioNumbers[0])
+	b, errB := strconv.Atoi(ratioNumbers[1])
+	if errA != nil || errB != nil || a <= 0 || b <= 0 || a > b {
+		return 0, 0, fmt.Errorf("wrong sample ratio syntax %q", ratio)
+	}
+	return a, b, nil
+}
+
+// parseInput parses an --input value: KIND:TARGET followed by optional
+// ;filter=BPF, ;sample=A:B and ;label=NAME. The filter and the sample ratio
+// default to --filter and --sampleRatio.
+func parseInput(spec, defaultFilter string, ratioA, ratioB int) (*captureInput, error) {
+	parts := strings.Split(spec, ";")
+	kind, target, ok := strings.Cut(parts[0], ":")
+	if !ok || target == "" {
+		return nil, fmt.Errorf("input %q is not KIND:TARGET", spec)
+	}
+	in := &captureInput{
+		kind:   strings.ToLower(kind),
+		target: target,
+		filter: defaultFilter,
+		ratioA: ratioA,
+		ratioB: ratioB,
+	}
+	for _, option := range parts[1:] {
+		key, value, ok := strings.Cut(option, "=")
+		if !ok {
+			return nil, fmt.Errorf("input %q: option %q is not KEY=VALUE", spec, option)
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "filter":
+			in.filter, in.filterSet = value, true
+		case "sample":
+			var err error
+			if in.ratioA, in.ratioB, err = parseSampleRatio(value); err != nil {
+				return nil, fmt.Errorf("input %q: %v", spec, err)
+			}
+		case "label":
+			in.label = value
+		default:
+			return nil, fmt.Errorf("input %q: unknown option %q", spec, key)
+		}
+	}
+
+	var err error
+	if in.source, ok = captureSources[in.kind]; !ok {
+		return nil, fmt.Errorf("input %q: unknown kind %q, expected %s", spec, kind, captureSourceKinds())
+	}
+	if in.name, err = in.source.name(in.target); err != nil {
+		return nil, fmt.Errorf("input %q: %v", spec, err)
+	}
+	if in.label != "" {
+		in.name = in.label
+	}
+	return in, nil
+}
+
+// parseInputs builds the list of inputs from --input and from the single
+// input flags --devName, --pcapFile and --dnstapSocket
+func (config *captureConfig) parseInputs() ([]*captureInput, error) {
+	var specs []string
+	if config.DevName != "" {
+		kind := inputLive
+		if config.UseAfpacket {
+			kind = inputAfpacket
+		}
+		specs = append(specs, kind+":"+config.DevName)
+	}
+	if config.PcapFile != "" {
+		specs = append(specs, inputPcap+":"+config.PcapFile)
+	}
+	if config.DnstapSocket != "" {
+		specs = append(specs, inputDnstap+":"+config.DnstapSocket)
+	}
+	specs = append(specs, config.Input...)
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("one of --input, --devName, --pcapFile or --dnstapSocket is required")
+	}
+
+	inputs := make([]*captureInput, 0, len(specs))
+	names := make(map[string]bool)
+	filterSet := filterSetByUser(config.Filter)
+	for _, spec := range specs {
+		in, err := parseInput(spec, config.Filter, config.ratioA, config.ratioB)
+		if err != nil {
+			return nil, err
+		}
+		in.filterSet = in.filterSet || filterSet
+		if names[in.name] {
+			return nil, fmt.Errorf("input %q: %s is already used by another input, set a label=", spec, in.name)
+		}
+		names[in.name] = true
+		inputs = append(inputs, in)
+	}
+	return inputs, nil
+}
+
+// startInputs runs every input until they're all done, and stops dnsmonster
+// after that. The live captures and dnstap sockets never end on their own.
+func (config *captureConfig) startInputs(ctx context.Context) error {
+	for _, in := range config.inputs {
+		in.stats = newInputStats(in.name)
+	}
+
+	g, gCtx := errgroup.WithContext(ctx)
+	for _, in := range config.inputs {
+		log.Infof("Starting %s input %s", in.kind, in.target)
+		g.Go(func() error {
+			// an input failing stops the others, and dnsmonster with them
+			err := in.source.start(gCtx, config, in)
+			if err != nil {
+				log.Errorf("%s input %s stopped: %v", in.kind, in.target, err)
+			}
+			return err
+		})
+	}
+
+	// the global metrics are the sum of all inputs
+	packetsCaptured := metrics.GetOrRegisterGauge("packetsCaptured", metrics.DefaultRegistry)
+	packetsDropped := metrics.GetOrRegisterGauge("packetsDropped", metrics.DefaultRegistry)
+	packetLossPercent := metrics.GetOrRegisterGaugeFloat64("packetLossPercent", metrics.DefaultRegistry)
+	packetsInvalid := metrics.GetOrRegisterGauge("packetsInvalid", metrics.DefaultRegistry)
+	statsDone := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(util.GeneralFlags.CaptureStatsDelay)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				var captured, dropped, invalid int64
+				for _, in := range config.inputs {
+					captured += in.stats.captured.Value()
+					dropped += in.stats.dropped.Value()
+					invalid += in.stats.invalid.Value()
+				}
+				packetsCaptured.Update(captured)
+				packetsDropped.Update(dropped)
+				packetsInvalid.Update(invalid)
+				if captured > 0 {
+					packetLossPercent.Update(float64(dropped) * 100.0 / float64(captured))
+				}
+			case <-statsDone:
+				return
+			}
+		}
+	}()
+
+	err := g.Wait()
+	close(statsDone)
+	log.Info("All inputs are done. Sleeping for a few seconds waiting for processing to finish")
+	time.Sleep(time.Second * 2)
+	//todo: commence clean exit from errorgroup
+	util.GlobalCancel()
+	config.cleanExit(ctx)
+	return err
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,279 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+	"github.com/mosajjal/dnsmonster/internal/util"
+)
+
+func TestParseInput(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    captureInput
+		wantErr bool
+	}{
+		{"live:eth0", captureInput{kind: "live", target: "eth0", filter: "default", name: "eth0", ratioA: 1, ratioB: 1}, false},
+		{"PCAP:/tmp/eth1.pcap;filter=udp port 53;sample=1:10;label=uplink", captureInput{kind: "pcap", target: "/tmp/eth1.pcap", filter: "udp port 53", filterSet: true, label: "uplink", name: "uplink", ratioA: 1, ratioB: 10}, false},
+		{"pcap:/tmp/dns.pcap", captureInput{kind: "pcap", target: "/tmp/dns.pcap", filter: "default", name: "dns.pcap", ratioA: 1, ratioB: 1}, false},
+		{"pcap:-", captureInput{kind: "pcap", target: "-", filter: "default", name: "stdin", ratioA: 1, ratioB: 1}, false},
+		{"dnstap:unix:///run/dnstap.sock;label=resolver", captureInput{kind: "dnstap", target: "unix:///run/dnstap.sock", filter: "default", label: "resolver", name: "resolver", ratioA: 1, ratioB: 1}, false},
+		{"dnstap:/run/dnstap.sock", captureInput{}, true},
+		{"eth0", captureInput{}, true},
+		{"usb:eth0", captureInput{}, true},
+		{"live:eth0;sample=10:1", captureInput{}, true},
+		{"live:eth0;snaplen=100", captureInput{}, true},
+		{"live:eth0;label", captureInput{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseInput(tt.spec, "default", 1, 1)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error %v", tt.spec, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got.source != captureSources[got.kind] {
+			t.Errorf("%s: input has no source", tt.spec)
+		}
+		got.source = nil
+		if *got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.spec, *got, tt.want)
+		}
+	}
+}
+
+func TestParseInputs(t *testing.T) {
+	config := captureConfig{
+		DevName:      "eth0",
+		DnstapSocket: "tcp://127.0.0.1:6000",
+		Input:        []string{"live:eth1", "pcap:/tmp/dns.pcap;sample=1:2"},
+		ratioA:       1,
+		ratioB:       5,
+	}
+	inputs, err := config.parseInputs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, in := range inputs {
+		kinds = append(kinds, in.kind+":"+in.target)
+	}
+	if len(inputs) != 4 || inputs[0].kind != inputLive || inputs[1].kind != inputDnstap || inputs[3].ratioB != 2 || inputs[2].ratioB != 5 {
+		t.Errorf("unexpected inputs %v", kinds)
+	}
+
+	config = captureConfig{Input: []string{"live:eth0", "pcap:/tmp/eth0"}}
+	if _, err := config.parseInputs(); err == nil {
+		t.Error("two inputs with the same name were accepted")
+	}
+	config.Input[1] += ";label=eth0-pcap"
+	if _, err := config.parseInputs(); err != nil {
+		t.Errorf("labelled input was refused: %v", err)
+	}
+	if _, err := (&captureConfig{}).parseInputs(); err == nil {
+		t.Error("no input was accepted")
+	}
+}
+
+// writeTestPcap writes count copies of a DNS query in a pcap file
+func writeTestPcap(t *testing.T, count int) string {
+	path := filepath.Join(t.TempDir(), "dns.pcap")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	frame := testEthernet(0x0800, testIPv4DNSPacket(t, "input.example."))
+	for range count {
+		ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(frame), Length: len(frame)}
+		if err := w.WritePacket(ci, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestPcapInput(t *testing.T) {
+	config := captureConfig{processingChannel: make(chan *rawPacketBytes, 100)}
+
+	in, err := parseInput("pcap:"+writeTestPcap(t, 20)+";label=tenant-a;sample=1:4", "", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in.stats = newInputStats(in.name)
+	if err := in.source.start(context.Background(), &config, in); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.processingChannel) != 5 {
+		t.Errorf("%d of 20 packets were kept with a 1:4 sample ratio", len(config.processingChannel))
+	}
+	if packet := <-config.processingChannel; packet.input != in || packet.linkType != layers.LinkTypeEthernet {
+		t.Errorf("unexpected packet from input %+v", packet.input)
+	}
+	if in.stats.captured.Value() != 20 || in.stats.overRatio.Count() == 0 {
+		t.Errorf("unexpected stats %d captured, %d over ratio", in.stats.captured.Value(), in.stats.overRatio.Count())
+	}
+}
+
+// testSource produces a record per word of its target
+type testSource struct{}
+
+func (testSource) name(target string) (string, error) { return "test", nil }
+
+func (testSource) start(ctx context.Context, config *captureConfig, in *captureInput) error {
+	for _, word := range strings.Fields(in.target) {
+		config.sendResult(util.DNSResult{Identity: word, Input: in.label})
+		in.stats.captured.Update(in.stats.captured.Value() + 1)
+	}
+	return nil
+}
+
+func TestRegisterCaptureSource(t *testing.T) {
+	registerCaptureSource("test", testSource{})
+	defer delete(captureSources, "test")
+	if !strings.Contains(captureSourceKinds(), "pcap, test") {
+		t.Errorf("unexpected kinds %s", captureSourceKinds())
+	}
+	if _, err := parseInput("usb:0", "", 1, 1); err == nil || !strings.Contains(err.Error(), "test") {
+		t.Errorf("unknown kind error does not list the sources: %v", err)
+	}
+
+	config := captureConfig{resultChannel: make(chan util.DNSResult, 10)}
+	in, err := parseInput("test:a b;label=words", "", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in.stats = newInputStats(in.name)
+	if err := in.source.start(context.Background(), &config, in); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.resultChannel) != 2 || in.stats.captured.Value() != 2 {
+		t.Fatalf("%d records, %d captured", len(config.resultChannel), in.stats.captured.Value())
+	}
+	if result := <-config.resultChannel; result.Identity != "a" || result.Input != "words" {
+		t.Errorf("unexpected record %s from %s", result.Identity, result.Input)
+	}
+}
+
+func TestPacketSourceOpenError(t *testing.T) {
+	in, err := parseInput("pcap:"+filepath.Join(t.TempDir(), "missing.pcap"), "", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the error is returned to the caller instead of exiting dnsmonster
+	err = in.source.start(context.Background(), &captureConfig{}, in)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestInputLabelOnRecords(t *testing.T) {
+	config := captureConfig{
+		ports:         mustParsePorts("53"),
+		resultChannel: make(chan util.DNSResult, 10),
+		tcpAssembly:   []chan tcpPacket{make(chan tcpPacket, 1)},
+	}
+	packets := startInputHandler(t, &config)
+	packets <- &rawPacketBytes{testIPv4DNSPacket(t, "label.example."), gopacket.CaptureInfo{Timestamp: time.Now()}, layers.LinkTypeRaw, nil, &captureInput{label: "resolver-b"}}
+	select {
+	case result := <-config.resultChannel:
+		if result.Input != "resolver-b" {
+			t.Errorf("unexpected input label %q", result.Input)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("packet was not decoded")
+	}
+}
+
+// sliceHandler is a genericPacketHandler handing out a fixed list of packets
+type sliceHandler struct {
+	packets [][]byte
+	read    uint
+}
+
+func (h *sliceHandler) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if int(h.read) == len(h.packets) {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	h.read++
+	return h.packets[h.read-1], gopacket.CaptureInfo{Timestamp: time.Now()}, nil
+}
+
+func (h *sliceHandler) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return h.ReadPacketData()
+}
+
+func (h *sliceHandler) Close()                    {}
+func (h *sliceHandler) Stat() (uint, uint, error) { return h.read, 1, nil }
+
+// the sockets of a fanout group each feed their own decode workers
+func TestRunPacketHandlers(t *testing.T) {
+	config := captureConfig{
+		ports:              mustParsePorts("53"),
+		resultChannel:      make(chan util.DNSResult, 10),
+		tcpAssembly:        []chan tcpPacket{make(chan tcpPacket, 1)},
+		PacketHandlerCount: 2,
+		PacketChannelSize:  10,
+	}
+	in, _ := parseInput("live:eth0;label=fanout", "", 1, 1)
+	in.stats = newInputStats("fanout-test")
+
+	var handlers []genericPacketHandler
+	for i := range 3 {
+		handlers = append(handlers, &sliceHandler{packets: [][]byte{testEthernet(0x0800, testIPv4DNSPacket(t, fmt.Sprintf("socket%d.example.", i)))}})
+	}
+	if err := config.runPacketHandlers(context.Background(), in, handlers, &util.CaptureInterface{Name: "eth0"}); err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for range 3 {
+		select {
+		case result := <-config.resultChannel:
+			names[result.DNS.Question[0].Name] = true
+			if result.Input != "fanout" || result.Interface.Name != "eth0" {
+				t.Errorf("unexpected input %s on %v", result.Input, result.Interface)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("only got %v", names)
+		}
+	}
+	if len(names) != 3 {
+		t.Errorf("unexpected records %v", names)
+	}
+	if in.stats.captured.Value() != 3 || in.stats.dropped.Value() != 3 {
+		t.Errorf("the stats of the sockets were not summed: %d captured, %d dropped", in.stats.captured.Value(), in.stats.dropped.Value())
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,135 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// a chain longer than this is not something a real stack sends
+const maxIPv6Extensions = 16
+
+var errIPv6ExtensionMalformed = errors.New("malformed IPv6 extension header")
+
+// the extension headers handled by ipv6Extensions. The hop-by-hop options
+// are decoded by layers.IPv6 itself, but can legally show up again further
+// down a tunnel.
+var ipv6ExtensionClass = gopacket.NewLayerClass([]gopacket.LayerType{
+	layers.LayerTypeIPv6HopByHop,
+	layers.LayerTypeIPv6Routing,
+	layers.LayerTypeIPv6Destination,
+	layers.LayerTypeIPv6Fragment,
+})
+
+// walkIPv6Extensions skips the extension headers at the beginning of data,
+// next being the type of the first one. It returns the upper layer protocol
+// and its offset in data. If a fragment header is found, the walk stops
+// there and frag is filled. Atomic fragments (RFC 6946) are not fragmented
+// at all and are walked through.
+func walkIPv6Extensions(next layers.IPProtocol, data []byte, frag *layers.IPv6Fragment) (layers.IPProtocol, int, bool, error) {
+	offset := 0
+	for range maxIPv6Extensions {
+		switch next {
+		case layers.IPProtocolIPv6Fragment:
+			if len(data) < offset+8 {
+				return next, offset, false, errIPv6ExtensionMalformed
+			}
+			header := data[offset : offset+8]
+			offsetFlags := binary.BigEndian.Uint16(header[2:4])
+			if offsetFlags&0xfff9 == 0 {
+				// atomic fragment
+				next = layers.IPProtocol(header[0])
+				offset += 8
+				continue
+			}
+			*frag = layers.IPv6Fragment{
+				BaseLayer:      layers.BaseLayer{Contents: header, Payload: data[offset+8:]},
+				NextHeader:     layers.IPProtocol(header[0]),
+				Reserved1:      header[1],
+				FragmentOffset: offsetFlags >> 3,
+				Reserved2:      uint8(offsetFlags&0x6) >> 1,
+				MoreFragments:  offsetFlags&0x1 != 0,
+				Identification: binary.BigEndian.Uint32(header[4:8]),
+			}
+			return next, offset, true, nil
+		case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing, layers.IPProtocolIPv6Destination:
+			if len(data) < offset+2 {
+				return next, offset, false, errIPv6ExtensionMalformed
+			}
+			length := (int(data[offset+1]) + 1) * 8
+			if len(data) < offset+length {
+				return next, offset, false, errIPv6ExtensionMalformed
+			}
+			next = layers.IPProtocol(data[offset])
+			offset += length
+		default:
+			return next, offset, false, nil
+		}
+	}
+	return next, offset, false, errIPv6ExtensionMalformed
+}
+
+// ipv6Extensions decodes the whole chain of IPv6 extension headers in one go
+// so fragmented and extension header packets stay on the DecodingLayerParser
+// path. The chain starts with the next header of ip6, which must be the last
+// decoded IPv6 layer.
+type ipv6Extensions struct {
+	layers.BaseLayer
+	NextHeader layers.IPProtocol
+	// Fragment is only valid if Fragmented is set
+	Fragment   layers.IPv6Fragment
+	Fragmented bool
+	ip6        *layers.IPv6
+}
+
+func (e *ipv6Extensions) LayerType() gopacket.LayerType  { return layers.LayerTypeIPv6Destination }
+func (e *ipv6Extensions) CanDecode() gopacket.LayerClass { return ipv6ExtensionClass }
+
+func (e *ipv6Extensions) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	first := e.ip6.NextHeader
+	if e.ip6.HopByHop != nil {
+		first = e.ip6.HopByHop.NextHeader
+	}
+	next, offset, fragmented, err := walkIPv6Extensions(first, data, &e.Fragment)
+	if err != nil {
+		df.SetTruncated()
+		return err
+	}
+	e.NextHeader = next
+	e.Fragmented = fragmented
+	e.BaseLayer = layers.BaseLayer{Contents: data[:offset], Payload: data[offset:]}
+	return nil
+}
+
+// NextLayerType stops the decoding at the fragments, they go to the defragger
+func (e *ipv6Extensions) NextLayerType() gopacket.LayerType {
+	if e.Fragmented {
+		return gopacket.LayerTypeZero
+	}
+	return e.NextHeader.LayerType()
+}
+
+// isIPv6Extension tells if a layer type found by the parser was decoded by
+// ipv6Extensions
+func isIPv6Extension(layerType gopacket.LayerType) bool {
+	return ipv6ExtensionClass.Contains(layerType)
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,155 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	mkdns "github.com/miekg/dns"
+	"github.com/mosajjal/dnsmonster/internal/util"
+)
+
+// testIPv6 builds an IPv6 packet with the given extension headers in front
+// of payload
+func testIPv6(next layers.IPProtocol, extensions, payload []byte) []byte {
+	packet := make([]byte, 40, 40+len(extensions)+len(payload))
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[4:], uint16(len(extensions)+len(payload)))
+	packet[6] = byte(next)
+	packet[7] = 64
+	copy(packet[8:], net.ParseIP("2001:db8::1"))
+	copy(packet[24:], net.ParseIP("2001:db8::2"))
+	return append(append(packet, extensions...), payload...)
+}
+
+// testUDPDNS returns a UDP datagram to port 53 carrying a query for name
+func testUDPDNS(t *testing.T, name string) []byte {
+	dns := packTestQuery(t, name)
+	udp := make([]byte, 8, 8+len(dns))
+	binary.BigEndian.PutUint16(udp[0:], 40000)
+	binary.BigEndian.PutUint16(udp[2:], 53)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(dns)))
+	return append(udp, dns...)
+}
+
+func ipv6Extension(next layers.IPProtocol) []byte {
+	return []byte{byte(next), 0, 1, 4, 0, 0, 0, 0}
+}
+
+func ipv6FragmentHeader(next layers.IPProtocol, offset uint16, more bool, id uint32) []byte {
+	header := []byte{byte(next), 0, 0, 0, 0, 0, 0, 0}
+	offsetFlags := offset << 3
+	if more {
+		offsetFlags |= 1
+	}
+	binary.BigEndian.PutUint16(header[2:], offsetFlags)
+	binary.BigEndian.PutUint32(header[4:], id)
+	return header
+}
+
+func TestWalkIPv6Extensions(t *testing.T) {
+	chain := append(ipv6Extension(layers.IPProtocolIPv6Routing), ipv6Extension(layers.IPProtocolUDP)...)
+	var frag layers.IPv6Fragment
+	next, offset, fragmented, err := walkIPv6Extensions(layers.IPProtocolIPv6Destination, append(chain, 1, 2, 3), &frag)
+	if err != nil || fragmented || next != layers.IPProtocolUDP || offset != 16 {
+		t.Errorf("unexpected walk result %v %d %v %v", next, offset, fragmented, err)
+	}
+
+	// atomic fragments are walked through
+	next, offset, fragmented, err = walkIPv6Extensions(layers.IPProtocolIPv6Fragment, ipv6FragmentHeader(layers.IPProtocolTCP, 0, false, 7), &frag)
+	if err != nil || fragmented || next != layers.IPProtocolTCP || offset != 8 {
+		t.Errorf("unexpected atomic fragment result %v %d %v %v", next, offset, fragmented, err)
+	}
+
+	data := append(ipv6Extension(layers.IPProtocolIPv6Fragment), ipv6FragmentHeader(layers.IPProtocolUDP, 10, true, 0xdeadbeef)...)
+	data = append(data, 1, 2, 3, 4)
+	_, offset, fragmented, err = walkIPv6Extensions(layers.IPProtocolIPv6HopByHop, data, &frag)
+	if err != nil || !fragmented || offset != 8 {
+		t.Fatalf("fragment not found: %d %v %v", offset, fragmented, err)
+	}
+	if frag.NextHeader != layers.IPProtocolUDP || frag.FragmentOffset != 10 || !frag.MoreFragments || frag.Identification != 0xdeadbeef || len(frag.Payload) != 4 {
+		t.Errorf("unexpected fragment %+v", frag)
+	}
+
+	if _, _, _, err = walkIPv6Extensions(layers.IPProtocolIPv6Routing, []byte{17, 4, 0, 0}, &frag); err == nil {
+		t.Error("truncated extension header was accepted")
+	}
+}
+
+func TestInputHandlerIPv6Extensions(t *testing.T) {
+	config := captureConfig{
+		ports:         mustParsePorts("53"),
+		resultChannel: make(chan util.DNSResult, 10),
+		tcpAssembly:   []chan tcpPacket{make(chan tcpPacket, 1)},
+		ip6Defrgger:   make(chan ipv6FragmentInfo, 10),
+	}
+	packets := startInputHandler(t, &config)
+
+	// hop-by-hop and destination options, behind a VLAN tag
+	extensions := append(ipv6Extension(layers.IPProtocolIPv6Destination), ipv6Extension(layers.IPProtocolUDP)...)
+	packet := testIPv6(layers.IPProtocolIPv6HopByHop, extensions, testUDPDNS(t, "extensions.example."))
+	frame := testEthernet(0x8100, append([]byte{0x00, 0x0a, 0x86, 0xdd}, packet...))
+	packets <- &rawPacketBytes{frame, gopacket.CaptureInfo{Timestamp: time.Now()}, layers.LinkTypeEthernet, nil, nil}
+	select {
+	case result := <-config.resultChannel:
+		if result.DNS.Question[0].Name != "extensions.example." || result.IPVersion != 6 {
+			t.Errorf("unexpected record %v", result.DNS.Question)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("packet with extension headers was not decoded")
+	}
+
+	// a query split in two fragments, on a raw IP link
+	datagram := testUDPDNS(t, "fragmented.example.")
+	fragments := [][]byte{
+		testIPv6(layers.IPProtocolIPv6Destination, append(ipv6Extension(layers.IPProtocolIPv6Fragment), ipv6FragmentHeader(layers.IPProtocolUDP, 0, true, 42)...), datagram[:16]),
+		testIPv6(layers.IPProtocolIPv6Fragment, ipv6FragmentHeader(layers.IPProtocolUDP, 2, false, 42), datagram[16:]),
+	}
+	defragger := NewIPv6Defragmenter()
+	var defragged *layers.IPv6
+	for _, fragment := range fragments {
+		packets <- &rawPacketBytes{fragment, gopacket.CaptureInfo{Timestamp: time.Now()}, layers.LinkTypeRaw, nil, nil}
+		select {
+		case info := <-config.ip6Defrgger:
+			out, err := defragger.DefragIPv6(&info.ip, &info.ipFragment)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out != nil {
+				defragged = out
+			}
+		case <-time.After(time.Second):
+			t.Fatal("fragment was not sent to the defragger")
+		}
+	}
+	if defragged == nil || defragged.NextHeader != layers.IPProtocolUDP {
+		t.Fatalf("fragments were not reassembled: %+v", defragged)
+	}
+	msg := mkdns.Msg{}
+	if err := msg.Unpack(defragged.Payload[8:]); err != nil || msg.Question[0].Name != "fragmented.example." {
+		t.Errorf("unexpected reassembled query %v %v", msg.Question, err)
+	}
+	if len(config.resultChannel) != 0 {
+		t.Error("fragments should not produce records before reassembly")
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,34 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+// the live capture of each platform is in livecap_*.go
+
+import "context"
+
+func init() {
+	registerCaptureSource(inputLive, &packetSource{open: openLivePcap, live: true})
+}
+
+func openLivePcap(_ context.Context, config *captureConfig, in *captureInput) (genericPacketHandler, error) {
+	handle, err := initializeLivePcap(in.target, in.filter)
+	if err != nil {
+		return nil, err
+	}
+	return handle, nil
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,286 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	mkdns "github.com/miekg/dns"
+	"github.com/rcrowley/go-metrics"
+)
+
+// local name resolution protocols. mDNS and LLMNR use the DNS wire format,
+// NBNS is DNS-like but encodes the names differently and has its own types.
+const (
+	mdnsPort  = 5353
+	llmnrPort = 5355
+	nbnsPort  = 137
+
+	nbnsTypeNB     = 0x20
+	nbnsTypeNBSTAT = 0x21
+)
+
+var errNBNSMalformed = errors.New("malformed NBNS packet")
+
+// localNameProtocol returns the port and name of the local name resolution
+// protocol a UDP packet belongs to
+func localNameProtocol(src, dst uint16) (uint16, string, bool) {
+	for _, port := range [...]uint16{dst, src} {
+		switch port {
+		case mdnsPort:
+			return port, "mdns", true
+		case llmnrPort:
+			return port, "llmnr", true
+		case nbnsPort:
+			return port, "nbns", true
+		}
+	}
+	return 0, "", false
+}
+
+// escapeNBName turns a NetBIOS name into a valid DNS label in presentation format
+func escapeNBName(name string) string {
+	var sb strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '.' || c == ' ' || c == '\\' || c == '(' || c == ')' || c == ';' || c == '@' || c == '"':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < 0x20 || c > 0x7e:
+			fmt.Fprintf(&sb, "\\%03d", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// formatNBName formats the 16 byte NetBIOS name the way most tools show it,
+// the name without the space padding followed by the suffix, eg WPAD<00>
+func formatNBName(raw []byte) string {
+	return escapeNBName(strings.TrimRight(string(raw[:15]), " ")) + fmt.Sprintf("<%02x>", raw[15])
+}
+
+// readNBNSName reads the name at offset and returns it in DNS presentation
+// format, with the first level encoding (RFC 1001 section 14.1) decoded and
+// the scope appended as the parent domain
+func readNBNSName(b []byte, offset int) (string, int, error) {
+	var labels []string
+	next := -1
+	for hops := 0; ; {
+		if offset >= len(b) {
+			return "", 0, errNBNSMalformed
+		}
+		labelLen := int(b[offset])
+		switch {
+		case labelLen == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			if len(labels) == 0 || len(labels[0]) != 32 {
+				return "", 0, errNBNSMalformed
+			}
+			var raw [16]byte
+			for i := range raw {
+				hi, lo := labels[0][2*i]-'A', labels[0][2*i+1]-'A'
+				if hi > 0x0f || lo > 0x0f {
+					return "", 0, errNBNSMalformed
+				}
+				raw[i] = hi<<4 | lo
+			}
+			name := formatNBName(raw[:])
+			for _, scope := range labels[1:] {
+				name += "." + escapeNBName(scope)
+			}
+			return name + ".", next, nil
+		case labelLen&0xc0 == 0xc0:
+			if offset+1 >= len(b) || hops > 8 {
+				return "", 0, errNBNSMalformed
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			hops++
+			offset = int(binary.BigEndian.Uint16(b[offset:]) & 0x3fff)
+		case labelLen > 63 || offset+1+labelLen > len(b):
+			return "", 0, errNBNSMalformed
+		default:
+			labels = append(labels, string(b[offset+1:offset+1+labelLen]))
+			offset += 1 + labelLen
+		}
+	}
+}
+
+// nbnsRR translates an NBNS resource record. NB records become one A record
+// per address, NBSTAT records a TXT record holding the node's names, and
+// anything else is kept as an unknown type.
+func nbnsRR(name string, rrType, class uint16, ttl uint32, rdata []byte) []mkdns.RR {
+	switch {
+	case rrType == nbnsTypeNB && len(rdata)%6 == 0:
+		var rrs []mkdns.RR
+		for ; len(rdata) > 0; rdata = rdata[6:] {
+			rrs = append(rrs, &mkdns.A{
+				Hdr: mkdns.RR_Header{Name: name, Rrtype: mkdns.TypeA, Class: class, Ttl: ttl},
+				A:   net.IP(append([]byte{}, rdata[2:6]...)),
+			})
+		}
+		return rrs
+	case rrType == nbnsTypeNBSTAT && len(rdata) > 0 && len(rdata) >= 1+int(rdata[0])*18:
+		txt := &mkdns.TXT{Hdr: mkdns.RR_Header{Name: name, Rrtype: mkdns.TypeTXT, Class: class, Ttl: ttl}}
+		for i := 0; i < int(rdata[0]); i++ {
+			txt.Txt = append(txt.Txt, formatNBName(rdata[1+i*18:]))
+		}
+		return []mkdns.RR{txt}
+	}
+	return []mkdns.RR{&mkdns.RFC3597{
+		Hdr:   mkdns.RR_Header{Name: name, Rrtype: rrType, Class: class, Ttl: ttl},
+		Rdata: hex.EncodeToString(rdata),
+	}}
+}
+
+// nbnsType maps the NBNS question types to the closest DNS type
+func nbnsType(t uint16) uint16 {
+	switch t {
+	case nbnsTypeNB:
+		return mkdns.TypeA
+	case nbnsTypeNBSTAT:
+		return mkdns.TypeTXT
+	}
+	return t
+}
+
+// decodeNBNS translates an NBNS packet (RFC 1002 section 4.2) into a DNS message
+func decodeNBNS(b []byte) (mkdns.Msg, error) {
+	msg := mkdns.Msg{}
+	if len(b) < dnsHeaderLen {
+		return msg, errNBNSMalformed
+	}
+	msg.Id = binary.BigEndian.Uint16(b)
+	msg.Response = b[2]&0x80 != 0
+	msg.Opcode = int(b[2]>>3) & 0x0f
+	msg.Authoritative = b[2]&0x04 != 0
+	msg.Truncated = b[2]&0x02 != 0
+	msg.RecursionDesired = b[2]&0x01 != 0
+	msg.RecursionAvailable = b[3]&0x80 != 0
+	msg.Rcode = int(b[3] & 0x0f)
+
+	var counts [4]int
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(b[4+2*i:]))
+	}
+	offset := dnsHeaderLen
+	for i := 0; i < counts[0]; i++ {
+		name, next, err := readNBNSName(b, offset)
+		if err != nil || next+4 > len(b) {
+			return msg, errNBNSMalformed
+		}
+		msg.Question = append(msg.Question, mkdns.Question{
+			Name:   name,
+			Qtype:  nbnsType(binary.BigEndian.Uint16(b[next:])),
+			Qclass: binary.BigEndian.Uint16(b[next+2:]),
+		})
+		offset = next + 4
+	}
+	sections := []*[]mkdns.RR{&msg.Answer, &msg.Ns, &msg.Extra}
+	for s, section := range sections {
+		for i := 0; i < counts[s+1]; i++ {
+			name, next, err := readNBNSName(b, offset)
+			if err != nil || next+10 > len(b) {
+				return msg, errNBNSMalformed
+			}
+			rdLen := int(binary.BigEndian.Uint16(b[next+8:]))
+			if next+10+rdLen > len(b) {
+				return msg, errNBNSMalformed
+			}
+			*section = append(*section, nbnsRR(name,
+				binary.BigEndian.Uint16(b[next:]),
+				binary.BigEndian.Uint16(b[next+2:]),
+				binary.BigEndian.Uint32(b[next+4:]),
+				b[next+10:next+10+rdLen])...)
+			offset = next + 10 + rdLen
+		}
+	}
+	return msg, nil
+}
+
+// poisoningDetector looks for responder-style LLMNR and NBNS poisoning. A
+// legitimate host only answers for its own few names, while a poisoner
+// answers every name that is asked for. Hosts answering for more than
+// threshold distinct names within a window are reported.
+type poisoningDetector struct {
+	mu            sync.Mutex
+	threshold     int
+	window        time.Duration
+	start         time.Time
+	maxResponders int
+	names         map[string]map[string]struct{}
+	suspects      metrics.Counter
+}
+
+func newPoisoningDetector(threshold uint, window time.Duration) *poisoningDetector {
+	return &poisoningDetector{
+		threshold:     int(threshold),
+		window:        window,
+		maxResponders: 10000,
+		names:         make(map[string]map[string]struct{}),
+		suspects:      metrics.GetOrRegisterCounter("poisoningSuspects", metrics.DefaultRegistry),
+	}
+}
+
+// observe records the names answered by responder and reports whether the
+// response looks like poisoning. responder must be the unmasked source IP.
+func (p *poisoningDetector) observe(responder net.IP, appProtocol string, msg *mkdns.Msg, ts time.Time) bool {
+	if (appProtocol != "llmnr" && appProtocol != "nbns") || !msg.Response || len(msg.Answer) == 0 {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.start.IsZero() || ts.Sub(p.start) >= p.window {
+		clear(p.names)
+		p.start = ts
+	}
+	key := string(responder.To16())
+	names, ok := p.names[key]
+	if !ok {
+		if len(p.names) >= p.maxResponders {
+			return false
+		}
+		names = make(map[string]struct{})
+		p.names[key] = names
+	}
+	for _, rr := range msg.Answer {
+		// no need to remember more names than it takes to be a suspect
+		if len(names) > p.threshold {
+			break
+		}
+		names[strings.ToLower(rr.Header().Name)] = struct{}{}
+	}
+	if len(names) > p.threshold {
+		p.suspects.Inc(1)
+		return true
+	}
+	return false
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,170 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	mkdns "github.com/miekg/dns"
+	"github.com/mosajjal/dnsmonster/internal/util"
+	"github.com/rcrowley/go-metrics"
+)
+
+// encodeNBName builds the first level encoded name of RFC 1001
+func encodeNBName(name string, suffix byte) []byte {
+	raw := []byte(fmt.Sprintf("%-15s", name))
+	raw = append(raw, suffix)
+	out := []byte{32}
+	for _, c := range raw {
+		out = append(out, 'A'+c>>4, 'A'+c&0x0f)
+	}
+	return append(out, 0)
+}
+
+func nbnsTestPacket(id uint16, response bool, name string, answerIP net.IP) []byte {
+	b := binary.BigEndian.AppendUint16(nil, id)
+	if response {
+		b = append(b, 0x85, 0x00) // response, authoritative, recursion desired
+		b = append(b, 0, 0, 0, 1, 0, 0, 0, 0)
+		b = append(b, encodeNBName(name, 0x20)...)
+		b = append(b, 0x00, nbnsTypeNB, 0x00, 0x01)
+		b = binary.BigEndian.AppendUint32(b, 300)
+		b = append(b, 0x00, 0x06, 0x00, 0x00)
+		return append(b, answerIP.To4()...)
+	}
+	b = append(b, 0x01, 0x10) // recursion desired, broadcast
+	b = append(b, 0, 1, 0, 0, 0, 0, 0, 0)
+	b = append(b, encodeNBName(name, 0x20)...)
+	return append(b, 0x00, nbnsTypeNB, 0x00, 0x01)
+}
+
+func TestDecodeNBNS(t *testing.T) {
+	query, err := decodeNBNS(nbnsTestPacket(42, false, "WPAD", nil))
+	if err != nil {
+		t.Fatalf("failed to decode NBNS query: %v", err)
+	}
+	if query.Id != 42 || query.Response || len(query.Question) != 1 {
+		t.Fatalf("unexpected NBNS query header: %+v", query.MsgHdr)
+	}
+	if q := query.Question[0]; q.Name != "WPAD<20>." || q.Qtype != mkdns.TypeA {
+		t.Errorf("unexpected question %s %d", q.Name, q.Qtype)
+	}
+
+	response, err := decodeNBNS(nbnsTestPacket(42, true, "FILESRV", net.ParseIP("192.0.2.7")))
+	if err != nil {
+		t.Fatalf("failed to decode NBNS response: %v", err)
+	}
+	if !response.Response || !response.Authoritative || len(response.Answer) != 1 {
+		t.Fatalf("unexpected NBNS response: %v", response)
+	}
+	a, ok := response.Answer[0].(*mkdns.A)
+	if !ok || !a.A.Equal(net.ParseIP("192.0.2.7")) || a.Hdr.Name != "FILESRV<20>." || a.Hdr.Ttl != 300 {
+		t.Errorf("unexpected NB answer %v", response.Answer[0])
+	}
+
+	for _, bad := range [][]byte{
+		nbnsTestPacket(1, false, "WPAD", nil)[:20],
+		append(nbnsTestPacket(1, false, "WPAD", nil)[:12], 3, 'a', 'b', 'c', 0, 0, 0x20, 0, 1),
+	} {
+		if _, err := decodeNBNS(bad); err == nil {
+			t.Errorf("expected an error decoding %x", bad)
+		}
+	}
+}
+
+func TestPoisoningDetector(t *testing.T) {
+	p := newPoisoningDetector(2, time.Minute)
+	p.suspects = metrics.NewCounter()
+	responder := net.ParseIP("10.0.0.66")
+	start := time.Unix(1700000000, 0)
+
+	answer := func(name string, ts time.Time, protocol string) bool {
+		msg := mkdns.Msg{}
+		msg.SetQuestion(name, mkdns.TypeA)
+		msg.Response = true
+		rr, _ := mkdns.NewRR(name + " 30 IN A 10.0.0.66")
+		msg.Answer = append(msg.Answer, rr)
+		return p.observe(responder, protocol, &msg, ts)
+	}
+	if answer("host1.", start, "llmnr") || answer("host2.", start, "llmnr") || answer("host1.", start, "llmnr") {
+		t.Fatal("a host answering for its own names should not be a suspect")
+	}
+	if !answer("wpad.", start, "llmnr") {
+		t.Error("a host answering for many names should be a suspect")
+	}
+	if answer("a.local.", start, "mdns") {
+		t.Error("mDNS responses should not be checked for poisoning")
+	}
+	if answer("host3.", start.Add(2*time.Minute), "nbns") {
+		t.Error("names should be forgotten after the window")
+	}
+	if p.suspects.Count() != 1 {
+		t.Errorf("suspect counter is %d, want 1", p.suspects.Count())
+	}
+}
+
+func TestProcessTransportLocalNames(t *testing.T) {
+	config := captureConfig{
+		ports:              mustParsePorts("53"),
+		LocalNameProtocols: true,
+		resultChannel:      make(chan util.DNSResult, 10),
+		tcpAssembly:        []chan tcpPacket{make(chan tcpPacket, 10)},
+	}
+	srcIP := net.ParseIP("10.0.0.1").To4()
+	dstIP := net.ParseIP("10.0.0.255").To4()
+	flow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(srcIP), layers.NewIPEndpoint(dstIP))
+	foundLayers := []gopacket.LayerType{layers.LayerTypeUDP}
+
+	mdns := mkdns.Msg{}
+	mdns.SetQuestion("printer.local.", mkdns.TypeA)
+	mdnsPayload, _ := mdns.Pack()
+
+	tests := []struct {
+		port     layers.UDPPort
+		payload  []byte
+		protocol string
+		qname    string
+	}{
+		{mdnsPort, mdnsPayload, "mdns", "printer.local."},
+		{llmnrPort, mdnsPayload, "llmnr", "printer.local."},
+		{nbnsPort, nbnsTestPacket(7, false, "WPAD", nil), "nbns", "WPAD<20>."},
+	}
+	for _, tt := range tests {
+		udp := &layers.UDP{BaseLayer: layers.BaseLayer{Payload: tt.payload}}
+		udp.SrcPort = tt.port
+		udp.DstPort = tt.port
+		config.processTransport(&foundLayers, udp, &layers.TCP{}, flow, time.Now(), 4, srcIP, dstIP, nil)
+		select {
+		case result := <-config.resultChannel:
+			if result.AppProtocol != tt.protocol || result.MatchedPort != uint16(tt.port) {
+				t.Errorf("expected %s on %d, got %s on %d", tt.protocol, tt.port, result.AppProtocol, result.MatchedPort)
+			}
+			if len(result.DNS.Question) != 1 || result.DNS.Question[0].Name != tt.qname {
+				t.Errorf("unexpected %s question %v", tt.protocol, result.DNS.Question)
+			}
+		default:
+			t.Errorf("no %s record", tt.protocol)
+		}
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,107 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	mkdns "github.com/miekg/dns"
+	"github.com/mosajjal/dnsmonster/internal/util"
+)
+
+// decodeMalformed recovers what it can of a DNS payload that failed to
+// decode: the header, and the questions up to the first one that doesn't
+// parse. The payload is copied since it may belong to a reused packet buffer.
+func decodeMalformed(payload []byte, err error) (mkdns.Msg, *util.MalformedDNS) {
+	msg := mkdns.Msg{}
+	malformed := &util.MalformedDNS{Payload: bytes.Clone(payload), Error: err.Error()}
+	if len(payload) < dnsHeaderLen {
+		return msg, malformed
+	}
+
+	flags := binary.BigEndian.Uint16(payload[2:])
+	msg.MsgHdr = mkdns.MsgHdr{
+		Id:                 binary.BigEndian.Uint16(payload),
+		Response:           flags&(1<<15) != 0,
+		Opcode:             int(flags>>11) & 0xf,
+		Authoritative:      flags&(1<<10) != 0,
+		Truncated:          flags&(1<<9) != 0,
+		RecursionDesired:   flags&(1<<8) != 0,
+		RecursionAvailable: flags&(1<<7) != 0,
+		Zero:               flags&(1<<6) != 0,
+		AuthenticatedData:  flags&(1<<5) != 0,
+		CheckingDisabled:   flags&(1<<4) != 0,
+		Rcode:              int(flags & 0xf),
+	}
+	malformed.QDCount = binary.BigEndian.Uint16(payload[4:])
+	malformed.ANCount = binary.BigEndian.Uint16(payload[6:])
+	malformed.NSCount = binary.BigEndian.Uint16(payload[8:])
+	malformed.ARCount = binary.BigEndian.Uint16(payload[10:])
+
+	offset := dnsHeaderLen
+	for range malformed.QDCount {
+		name, next, err := mkdns.UnpackDomainName(payload, offset)
+		if err != nil || next+4 > len(payload) {
+			break
+		}
+		msg.Question = append(msg.Question, mkdns.Question{
+			Name:   name,
+			Qtype:  binary.BigEndian.Uint16(payload[next:]),
+			Qclass: binary.BigEndian.Uint16(payload[next+2:]),
+		})
+		offset = next + 4
+	}
+	return msg, malformed
+}
+
+// markMalformed turns res into the record of a payload that failed to decode
+func markMalformed(res *util.DNSResult, payload []byte, err error) {
+	res.DNS, res.Malformed = decodeMalformed(payload, err)
+	res.Tags = append(res.Tags, util.TagMalformed)
+}
+
+// outputsWithoutMalformed returns the flags of the enabled outputs that have
+// no room for the Malformed object: the ones with a fixed row per question or
+// a fixed message
+func outputsWithoutMalformed() []string {
+	value := func(name string) string {
+		if opt := util.GlobalParser.FindOptionByLongName(strings.ToLower(name)); opt != nil {
+			return fmt.Sprint(opt.Value())
+		}
+		return ""
+	}
+	enabled := func(name string) bool {
+		v := value(name)
+		return v != "" && v != "0"
+	}
+	var outputs []string
+	for _, name := range []string{"clickhouseOutputType", "psqlOutputType", "influxOutputType", "parquetOutputType", "natsOutputType"} {
+		if enabled(name) {
+			outputs = append(outputs, "--"+name)
+		}
+	}
+	for _, output := range []string{"stdout", "file", "kafka"} {
+		if enabled(output+"OutputType") && strings.HasPrefix(value(output+"OutputFormat"), "csv") {
+			outputs = append(outputs, "--"+output+"OutputFormat")
+		}
+	}
+	return outputs
+}
+
+// vim: foldmethod=marker
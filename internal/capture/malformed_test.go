@@ -0,0 +1,136 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	mkdns "github.com/miekg/dns"
+	"github.com/mosajjal/dnsmonster/internal/util"
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestDecodeMalformed(t *testing.T) {
+	msg := new(mkdns.Msg)
+	msg.SetQuestion("first.example.", mkdns.TypeTXT)
+	msg.Question = append(msg.Question, mkdns.Question{Name: "second.example.", Qtype: mkdns.TypeA, Qclass: mkdns.ClassINET})
+	msg.Id, msg.RecursionDesired = 0x1234, true
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		payload   []byte
+		questions []string
+	}{
+		{"shorter than a header", packed[:5], nil},
+		{"header only", packed[:dnsHeaderLen], nil},
+		{"second question truncated", packed[:len(packed)-3], []string{"first.example."}},
+		// the second name points to itself
+		{"compression loop", append(slices.Clone(packed[:dnsHeaderLen+19]), 0xc0, dnsHeaderLen+19, 0, 1, 0, 1), []string{"first.example."}},
+	}
+	for _, tt := range tests {
+		got, malformed := decodeMalformed(tt.payload, errors.New("broken"))
+		if !bytes.Equal(malformed.Payload, tt.payload) || malformed.Error != "broken" {
+			t.Errorf("%s: wrong payload or error %q", tt.name, malformed.Error)
+		}
+		var names []string
+		for _, q := range got.Question {
+			names = append(names, q.Name)
+		}
+		if !slices.Equal(names, tt.questions) {
+			t.Errorf("%s: recovered %v, want %v", tt.name, names, tt.questions)
+		}
+		if len(tt.payload) < dnsHeaderLen {
+			if got.Id != 0 || malformed.QDCount != 0 {
+				t.Errorf("%s: recovered a header", tt.name)
+			}
+			continue
+		}
+		if got.Id != 0x1234 || !got.RecursionDesired || got.Response || malformed.QDCount != 2 {
+			t.Errorf("%s: recovered the header %+v with %d questions", tt.name, got.MsgHdr, malformed.QDCount)
+		}
+	}
+	if got, _ := decodeMalformed(packed[:len(packed)-3], errors.New("broken")); got.Question[0].Qtype != mkdns.TypeTXT {
+		t.Errorf("recovered the type %d", got.Question[0].Qtype)
+	}
+}
+
+func TestProcessTransportMalformed(t *testing.T) {
+	msg := new(mkdns.Msg)
+	msg.SetQuestion("tunnel.example.", mkdns.TypeTXT)
+	msg.Answer = []mkdns.RR{&mkdns.TXT{Hdr: mkdns.RR_Header{Name: "tunnel.example.", Rrtype: mkdns.TypeTXT, Class: mkdns.ClassINET}, Txt: []string{"payload"}}}
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the answer is cut by the snap length
+	truncated := packed[:len(packed)-2]
+
+	srcIP, dstIP := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	flow := gopacket.NewFlow(layers.EndpointIPv4, srcIP, dstIP)
+	udp := &layers.UDP{BaseLayer: layers.BaseLayer{Payload: truncated}, SrcPort: 12345, DstPort: 53}
+	for _, enabled := range []bool{false, true} {
+		config := captureConfig{
+			MalformedRecords:  enabled,
+			ports:             mustParsePorts("53"),
+			resultChannel:     make(chan util.DNSResult, 10),
+			malformedPayloads: metrics.NewCounter(),
+		}
+		config.processTransport(&[]gopacket.LayerType{layers.LayerTypeUDP}, udp, &layers.TCP{}, flow, time.Now(), 4, srcIP, dstIP, nil)
+		if config.malformedPayloads.Count() != 1 {
+			t.Errorf("counted %d malformed payloads", config.malformedPayloads.Count())
+		}
+		if !enabled {
+			if len(config.resultChannel) != 0 {
+				t.Error("a malformed record was sent while disabled")
+			}
+			continue
+		}
+		if len(config.resultChannel) != 1 {
+			t.Fatal("no malformed record")
+		}
+		res := <-config.resultChannel
+		if res.Malformed == nil || !slices.Contains(res.Tags, util.TagMalformed) || res.DstPort != 53 {
+			t.Fatalf("wrong record %+v", res)
+		}
+		if len(res.DNS.Question) != 1 || res.DNS.Question[0].Name != "tunnel.example." {
+			t.Errorf("recovered %v", res.DNS.Question)
+		}
+
+		// the payload is in base64 in JSON
+		out, err := json.Marshal(res.Malformed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded struct{ Payload []byte }
+		if err := json.Unmarshal(out, &decoded); err != nil || !bytes.Equal(decoded.Payload, truncated) {
+			t.Errorf("the payload is encoded as %s", out)
+		}
+	}
+}
+
+// vim: foldmethod=marker
@@ -17,121 +17,137 @@ package capture
 
 import (
 	"context"
+	"sync"
 	"time"
 
+	"github.com/gopacket/gopacket/layers"
 	"github.com/mosajjal/dnsmonster/internal/util"
 	"github.com/rcrowley/go-metrics"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 )
 
-func (config *captureConfig) StartNonDNSTap(ctx context.Context) error {
-	packetsCaptured := metrics.GetOrRegisterGauge("packetsCaptured", metrics.DefaultRegistry)
-	packetsDropped := metrics.GetOrRegisterGauge("packetsDropped", metrics.DefaultRegistry)
-	packetsDuplicate := metrics.GetOrRegisterCounter("packetsDuplicate", metrics.DefaultRegistry)
-	packetsOverRatio := metrics.GetOrRegisterCounter("packetsOverRatio", metrics.DefaultRegistry)
-	packetLossPercent := metrics.GetOrRegisterGaugeFloat64("packetLossPercent", metrics.DefaultRegistry)
-
-	var myHandler genericPacketHandler
-
-	if config.DevName != "" && !config.UseAfpacket {
-		var err error
-		myHandler, err = initializeLivePcap(config.DevName, config.Filter)
-		if err != nil {
-			log.Fatalf("Failed to initialize live pcap: %v", err)
+// runPacketHandlers reads the packets of an input, captured by one or more
+// handlers. A single handler feeds the shared processing channel. Several
+// handlers, like the sockets of an AF_PACKET fanout group, each feed their
+// own channel drained by their own --packetHandlerCount decode workers so
+// no single reader loop is in the way. The stats of the input are the sum of
+// the handlers.
+func (config *captureConfig) runPacketHandlers(ctx context.Context, in *captureInput, handlers []genericPacketHandler, iface *util.CaptureInterface) error {
+	stat := func() (uint, uint, error) {
+		var packets, drops uint
+		for _, handler := range handlers {
+			p, d, err := handler.Stat()
+			if err != nil {
+				return 0, 0, err
+			}
+			packets += p
+			drops += d
 		}
-		log.Info("Waiting for packets")
+		return packets, drops, nil
+	}
 
-	} else if config.DevName != "" && config.UseAfpacket {
-		myHandler = config.initializeLiveAFpacket(config.DevName, config.Filter)
-		log.Info("Waiting for packets using AFpacket")
+	// updating the metrics in a separate goroutine, until the input is done
+	statsCtx, stopStats := context.WithCancel(ctx)
+	var poller sync.WaitGroup
+	poller.Go(func() { config.pollInputStats(statsCtx, in, stat) })
+	defer poller.Wait()
+	defer stopStats()
 
+	var err error
+	if len(handlers) == 1 {
+		err = config.readPackets(in, handlers[0], iface, config.processingChannel)
 	} else {
-		myHandler = initializeOfflineCapture(config.PcapFile, config.Filter)
-		log.Info("Reading off Pcap file")
+		workers, wCtx := errgroup.WithContext(statsCtx)
+		readers := errgroup.Group{}
+		channels := make([]chan *rawPacketBytes, 0, len(handlers))
+		for _, handler := range handlers {
+			packets := make(chan *rawPacketBytes, config.PacketChannelSize)
+			channels = append(channels, packets)
+			for range max(1, config.PacketHandlerCount) {
+				workers.Go(func() error { return config.inputHandlerWorker(wCtx, packets) })
+			}
+			readers.Go(func() error { return config.readPackets(in, handler, iface, packets) })
+		}
+		err = readers.Wait()
+		// the workers finish the queued packets and stop once their channel
+		// is closed
+		for _, packets := range channels {
+			close(packets)
+		}
+		if wErr := workers.Wait(); err == nil {
+			err = wErr
+		}
 	}
 
-	if myHandler == nil {
-		log.Fatal("Unable to initialize packet handler")
+	// the final figures, the ticker may not have run at all
+	if packets, drop, err := stat(); err == nil {
+		in.stats.update(int64(packets), int64(drop))
 	}
+	return err
+}
 
-	defer myHandler.Close() // closes the packet handler and/or capture files. there might be a duplicate of this in pcapfile
-
-	// Set up various tickers for different tasks
+// pollInputStats updates the metrics of an input from stat until ctx is done
+func (config *captureConfig) pollInputStats(ctx context.Context, in *captureInput, stat func() (uint, uint, error)) {
 	captureStatsTicker := time.NewTicker(util.GeneralFlags.CaptureStatsDelay)
+	defer captureStatsTicker.Stop()
+	for {
+		select {
+		case <-captureStatsTicker.C:
+			packets, drop, err := stat()
+			if err != nil {
+				log.Warnf("Error reading stats of %s: %s", in.target, err)
+				continue
+			}
+			in.stats.update(int64(packets), int64(drop))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// readPackets reads the packets of a handler into out, until the handler runs
+// out of packets. iface is set on the packets if the handler can't tell their
+// interface.
+func (config *captureConfig) readPackets(in *captureInput, myHandler genericPacketHandler, iface *util.CaptureInterface, out chan<- *rawPacketBytes) error {
+	packetsOverRatio := metrics.GetOrRegisterCounter("packetsOverRatio", metrics.DefaultRegistry)
 
 	ratioCnt := 0
 
-	// updating the metrics in a separate goroutine
-
-	g, gCtx := errgroup.WithContext(ctx)
-	g.Go(func() error {
-		for {
-			select {
-			case <-captureStatsTicker.C:
-				packets, drop, err := myHandler.Stat()
-				if err != nil {
-					log.Warnf("Error reading stats: %s", err)
-					continue
-				}
-
-				packetsCaptured.Update(int64(packets))
-				packetsDropped.Update(int64(drop))
-
-				if packetsCaptured.Value() > 0 {
-					packetLossPercent.Update(float64(packetsDropped.Value()) * 100.0 / float64(packetsCaptured.Value()))
-				}
-			case <-gCtx.Done():
-				return nil
-			}
-		}
-	})
+	// the link type and interface of each packet, for the handlers that know
+	// them
+	linkTypes, hasLinkType := myHandler.(linkTypeHandler)
+	interfaces, hasInterface := myHandler.(interfaceHandler)
 
 	// blocking loop to capture packets and send them to processing channel
 	// todo: should this be blocking or have a gCtx.Done() listener somewhere
 	for {
 		data, ci, err := myHandler.ReadPacketData() // todo: ZeroCopyReadPacketData is slower than ReadPacketData. need to investigate why
 		if data == nil || err != nil {
-			log.Info("PacketSource returned nil, exiting (Possible end of pcap file?). Sleeping for a few seconds waiting for processing to finish")
-			time.Sleep(time.Second * 2)
-			//todo: commence clean exit from errorgroup
-			util.GlobalCancel()
-			config.cleanExit(ctx)
+			log.Infof("PacketSource of %s returned nil, exiting (Possible end of pcap file?)", in.target)
 			return nil
 		}
 
 		// ratio checks
 		skipForRatio := false
-		if config.ratioA != config.ratioB { // this confirms the ratio is in use
-			ratioCnt++
-			if ratioCnt%config.ratioB > config.ratioA {
-				if ratioCnt > config.ratioB*config.ratioA { // reset ratiocount before it goes to an absurdly high number
-					ratioCnt = 0
-				}
+		if in.ratioA != in.ratioB { // this confirms the ratio is in use
+			if !keepRatio(&ratioCnt, in.ratioA, in.ratioB) {
 				packetsOverRatio.Inc(1)
+				in.stats.overRatio.Inc(1)
 				skipForRatio = true
 			}
 		}
 
-		// dedup checks
-		skipForDudup := false
-		if config.Dedup {
-			hash := FNV1A(data)
-			config.dedupMu.RLock()
-			_, ok := config.dedupHashTable[hash] // check for existence
-			config.dedupMu.RUnlock()
-			if !ok {
-				config.dedupMu.Lock()
-				config.dedupHashTable[hash] = true
-				config.dedupMu.Unlock()
-			} else {
-				skipForDudup = true
-				packetsDuplicate.Inc(1)
+		// dedup happens after decoding, see processTransport
+		if !skipForRatio {
+			linkType := layers.LinkTypeEthernet
+			if hasLinkType {
+				linkType = linkTypes.linkType(ci)
 			}
-		}
-
-		if !skipForRatio && !skipForDudup {
-			config.processingChannel <- &rawPacketBytes{data, ci}
+			if hasInterface {
+				iface = interfaces.captureInterface(ci)
+			}
+			out <- &rawPacketBytes{data, ci, linkType, iface, in}
 		}
 
 	}
@@ -17,6 +17,7 @@ package capture
 
 import (
 	"context"
+	"encoding/binary"
 	"net"
 	"time"
 
@@ -29,116 +30,263 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-func (config *captureConfig) processTransport(foundLayerTypes *[]gopacket.LayerType, udp *layers.UDP, tcp *layers.TCP, flow gopacket.Flow, timestamp time.Time, IPVersion uint8, SrcIP, DstIP net.IP) {
+// processTransport makes the records of a UDP or TCP packet. meta may be the
+// one of the worker, reused for its next packet, so what's queued past the
+// call gets a snapshot of it.
+func (config *captureConfig) processTransport(foundLayerTypes *[]gopacket.LayerType, udp *layers.UDP, tcp *layers.TCP, flow gopacket.Flow, timestamp time.Time, IPVersion uint8, SrcIP, DstIP net.IP, meta *packetMeta) {
 	for _, layerType := range *foundLayerTypes {
 		switch layerType {
 		case layers.LayerTypeUDP:
-			if uint16(udp.DstPort) == uint16(config.Port) || uint16(udp.SrcPort) == uint16(config.Port) {
-				msg := mkdns.Msg{}
-				err := msg.Unpack(udp.Payload)
-				// Process if no error or truncated, as it will have most of the information it have available
-				if err == nil {
-					MaskSize := util.GeneralFlags.MaskSize4
-					BitSize := 8 * net.IPv4len
-					if IPVersion == 6 {
-						MaskSize = util.GeneralFlags.MaskSize6
-						BitSize = 8 * net.IPv6len
-					}
-					config.resultChannel <- util.DNSResult{
-						Timestamp: timestamp,
-						DNS:       msg, IPVersion: IPVersion, SrcIP: SrcIP.Mask(net.CIDRMask(MaskSize, BitSize)),
-						DstIP:        DstIP.Mask(net.CIDRMask(MaskSize, BitSize)),
-						DstPort:      uint16(udp.DstPort),
-						Protocol:     "udp",
-						PacketLength: uint16(len(udp.Payload)),
-						SrcPort:      uint16(udp.SrcPort),
-					}
+			matchedPort, appProtocol, ok := config.ports.match(uint16(udp.SrcPort), uint16(udp.DstPort))
+			if config.LocalNameProtocols {
+				if port, protocol, isLocal := localNameProtocol(uint16(udp.SrcPort), uint16(udp.DstPort)); isLocal {
+					matchedPort, appProtocol, ok = port, protocol, true
+				}
+			}
+			encrypted := config.encryptedDNS != nil && isEncryptedDNSPort(uint16(udp.DstPort))
+			var tags []string
+			if !ok {
+				// on the other ports, only the payloads that look like DNS are decoded
+				if config.DetectNonstandardPorts && looksLikeDNS(udp.Payload) {
+					tags = []string{util.TagNonstandardPort}
+				} else if !encrypted {
+					continue
 				}
 			}
+			// a datagram is deduplicated once, before any of the detections
+			if config.isDuplicate(timestamp, SrcIP, DstIP, uint16(udp.SrcPort), uint16(udp.DstPort), "udp", nil, udp.Payload) {
+				continue
+			}
+			if encrypted {
+				config.processEncryptedDNSQUIC(udp, timestamp, IPVersion, SrcIP, DstIP, meta)
+			}
+			if !ok && tags == nil {
+				continue
+			}
+			msg := mkdns.Msg{}
+			var err error
+			if appProtocol == "nbns" {
+				msg, err = decodeNBNS(udp.Payload)
+			} else {
+				err = msg.Unpack(udp.Payload)
+			}
+			if err != nil {
+				// on the other ports, a payload failing to decode isn't DNS
+				if tags != nil {
+					continue
+				}
+				config.malformedPayloads.Inc(1)
+			}
+			// Process if no error or truncated, as it will have most of the information it have available
+			if err == nil || config.MalformedRecords {
+				if tags != nil {
+					config.nonstandardPortRecords.Inc(1)
+				}
+				if err == nil && config.poisoning != nil && config.poisoning.observe(SrcIP, appProtocol, &msg, timestamp) {
+					tags = append(tags, util.TagPoisoningSuspect)
+				}
+				MaskSize := util.GeneralFlags.MaskSize4
+				BitSize := 8 * net.IPv4len
+				if IPVersion == 6 {
+					MaskSize = util.GeneralFlags.MaskSize6
+					BitSize = 8 * net.IPv6len
+				}
+				res := util.DNSResult{
+					Timestamp: timestamp,
+					DNS:       msg, IPVersion: IPVersion, SrcIP: SrcIP.Mask(net.CIDRMask(MaskSize, BitSize)),
+					DstIP:        DstIP.Mask(net.CIDRMask(MaskSize, BitSize)),
+					DstPort:      uint16(udp.DstPort),
+					Protocol:     "udp",
+					PacketLength: uint16(len(udp.Payload)),
+					SrcPort:      uint16(udp.SrcPort),
+					MatchedPort:  matchedPort,
+					AppProtocol:  appProtocol,
+					Tags:         tags,
+				}
+				if err != nil {
+					markMalformed(&res, udp.Payload, err)
+				}
+				meta.annotate(&res)
+				config.sendResult(res)
+			}
 		case layers.LayerTypeTCP:
-			if uint16(tcp.SrcPort) == uint16(config.Port) || uint16(tcp.DstPort) == uint16(config.Port) {
-				config.tcpAssembly <- tcpPacket{
-					IPVersion: IPVersion,
-					tcp:       *tcp,
-					timestamp: timestamp,
-					flow:      flow,
+			// sequence numbers and flags are part of the key so different segments
+			// with the same payload (e.g. empty ACKs) are not taken as duplicates
+			var l4 [9]byte
+			binary.BigEndian.PutUint32(l4[0:], tcp.Seq)
+			binary.BigEndian.PutUint32(l4[4:], tcp.Ack)
+			l4[8] = tcpFlags(tcp)
+			matchedPort, appProtocol, ok := config.ports.match(uint16(tcp.SrcPort), uint16(tcp.DstPort))
+			encrypted := config.encryptedDNS != nil && isEncryptedDNSPort(uint16(tcp.DstPort)) && len(tcp.Payload) > 0
+			var msgs [][]byte
+			if !ok && config.DetectNonstandardPorts {
+				msgs = splitTCPDNS(tcp.Payload)
+			}
+			if !ok && !encrypted && msgs == nil {
+				continue
+			}
+			// a segment is deduplicated once, before any of the detections
+			if config.isDuplicate(timestamp, SrcIP, DstIP, uint16(tcp.SrcPort), uint16(tcp.DstPort), "tcp", l4[:], tcp.Payload) {
+				continue
+			}
+			if encrypted {
+				config.processEncryptedDNSTCP(tcp, timestamp, IPVersion, SrcIP, DstIP, meta)
+			}
+			if !ok {
+				if msgs != nil {
+					config.processNonstandardTCP(tcp, msgs, timestamp, IPVersion, SrcIP, DstIP, meta)
 				}
+				continue
+			}
+			config.tcpAssembly[tcpShard(flow, tcp, len(config.tcpAssembly))] <- tcpPacket{
+				IPVersion:   IPVersion,
+				tcp:         *tcp,
+				timestamp:   timestamp,
+				flow:        flow,
+				matchedPort: matchedPort,
+				appProtocol: appProtocol,
+				meta:        meta.snapshot(),
 			}
 		}
 	}
 }
 
+// linkLayerType returns the first layer to decode for a link type
+func linkLayerType(linkType layers.LinkType) (gopacket.LayerType, bool) {
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		return layers.LayerTypeEthernet, true
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		return layers.LayerTypeLoopback, true
+	case layers.LinkTypeLinuxSLL:
+		return layers.LayerTypeLinuxSLL, true
+	case layers.LinkTypeLinuxSLL2:
+		return layers.LayerTypeLinuxSLL2, true
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6, linkTypeRawBSD, linkTypeRawOpenBSD:
+		return layerTypeDetectIP, true
+	}
+	return layers.LayerTypeEthernet, false
+}
+
+// DLT_RAW is 12 on most BSDs and 14 on OpenBSD, and some pcap files carry
+// these values instead of LINKTYPE_RAW
+const (
+	linkTypeRawBSD     layers.LinkType = 12
+	linkTypeRawOpenBSD layers.LinkType = 14
+)
+
 func (config *captureConfig) inputHandlerWorker(ctx context.Context, p chan *rawPacketBytes) error {
 	decodingErrors := metrics.GetOrRegisterCounter("decodingErrors", metrics.DefaultRegistry)
+	unsupportedLinkType := metrics.GetOrRegisterCounter("unsupportedLinkType", metrics.DefaultRegistry)
 
 	var detectIP detectIP
 	var ethLayer layers.Ethernet
-	var vlan layers.Dot1Q
-	var vxlan layers.VXLAN
+	var sll layers.LinuxSLL
+	var sll2 layers.LinuxSLL2
+	var loopback layers.Loopback
 	var ip4 layers.IPv4
 	var ip6 layers.IPv6
 	var udp layers.UDP
 	var tcp layers.TCP
+	var meta packetMeta
+	ip6ext := ipv6Extensions{ip6: &ip6}
 
-	startLayer := layers.LayerTypeEthernet
 	decodeLayers := []gopacket.DecodingLayer{
 		&ethLayer,
-		&vlan,
-		&vxlan,
+		&sll,
+		&sll2,
+		&loopback,
+		&detectIP,
 		&ip4,
 		&ip6,
+		&ip6ext,
 		&udp,
 		&tcp,
 	}
+	decodeLayers = append(decodeLayers, decapLayers(&meta)...)
+
+	// one parser per first layer, they all share the same decoding layers.
 	// Use the IP Family detector when no ethernet frame is present.
-	if config.NoEthernetframe {
-		decodeLayers[0] = &detectIP
-		startLayer = layerTypeDetectIP
+	parsers := make(map[gopacket.LayerType]*gopacket.DecodingLayerParser)
+	parserFor := func(linkType layers.LinkType) *gopacket.DecodingLayerParser {
+		startLayer, ok := linkLayerType(linkType)
+		if config.NoEthernetframe {
+			startLayer, ok = layerTypeDetectIP, true
+		}
+		if !ok {
+			unsupportedLinkType.Inc(1)
+		}
+		parser, ok := parsers[startLayer]
+		if !ok {
+			parser = gopacket.NewDecodingLayerParser(startLayer, decodeLayers...)
+			parsers[startLayer] = parser
+		}
+		return parser
 	}
 
-	parser := gopacket.NewDecodingLayerParser(startLayer, decodeLayers...)
 	foundLayerTypes := []gopacket.LayerType{}
 	for {
 		select {
-		case packet := <-p:
+		case packet, ok := <-p:
+			if !ok {
+				return nil
+			}
 			timestamp := packet.info.Timestamp
 			if timestamp.IsZero() {
 				timestamp = time.Now()
 			}
-			if err := parser.DecodeLayers(packet.bytes, &foundLayerTypes); err != nil {
+			meta.reset(packet.iface, packet.input)
+			if err := parserFor(packet.linkType).DecodeLayers(packet.bytes, &foundLayerTypes); err != nil {
 				log.Debugf("Error decoding layers: %v", err)
 				decodingErrors.Inc(1)
 			}
-			// first parse the ip layer, so we can find fragmented packets
-			for _, layerType := range foundLayerTypes {
+			// only the innermost IP layer is processed, the outer ones belong to
+			// the tunnels and their decoded values have been overwritten anyway
+			ipIndex := -1
+			for i, layerType := range foundLayerTypes {
 				switch layerType {
-				case layers.LayerTypeIPv4:
-					// Check for fragmentation
-					if ip4.Flags&layers.IPv4DontFragment == 0 && (ip4.Flags&layers.IPv4MoreFragments != 0 || ip4.FragOffset != 0) {
-						// Packet is fragmented, send it to the defragger
-						config.ip4Defrgger <- ipv4ToDefrag{
-							ip4,
-							timestamp,
-						}
-					} else {
-						// log.Infof("packet %v coming to %p\n", timestamp, &encoder)
-						config.processTransport(&foundLayerTypes, &udp, &tcp, ip4.NetworkFlow(), timestamp, 4, ip4.SrcIP, ip4.DstIP)
+				case layers.LayerTypeIPv4, layers.LayerTypeIPv6:
+					ipIndex = i
+				case layers.LayerTypeEthernet:
+					meta.setMACs(ethLayer.SrcMAC, ethLayer.DstMAC)
+				case layers.LayerTypeLinuxSLL:
+					meta.setMACs(sll.Addr, nil)
+				case layers.LayerTypeLinuxSLL2:
+					meta.setMACs(sll2.Addr, nil)
+				}
+			}
+			if ipIndex < 0 {
+				continue
+			}
+			transportLayers := foundLayerTypes[ipIndex+1:]
+			// first parse the ip layer, so we can find fragmented packets
+			switch foundLayerTypes[ipIndex] {
+			case layers.LayerTypeIPv4:
+				// Check for fragmentation
+				if ip4.Flags&layers.IPv4DontFragment == 0 && (ip4.Flags&layers.IPv4MoreFragments != 0 || ip4.FragOffset != 0) {
+					// Packet is fragmented, send it to the defragger
+					config.ip4Defrgger <- ipv4ToDefrag{
+						ip4,
+						timestamp,
+						meta.snapshot(),
 					}
-				case layers.LayerTypeIPv6:
-					// Store the packet metadata
-					if ip6.NextHeader == layers.IPProtocolIPv6Fragment {
-						// TODO: Move the parsing to DecodingLayer when gopacket support it. Currently we have to fully reconstruct the packet from eth layer which is super slow
-						reconstructedPacket := gopacket.NewPacket(packet.bytes, layers.LayerTypeEthernet, gopacket.Default)
-						if frag := reconstructedPacket.Layer(layers.LayerTypeIPv6Fragment).(*layers.IPv6Fragment); frag != nil {
-							config.ip6Defrgger <- ipv6FragmentInfo{
-								ip6,
-								*frag,
-								timestamp,
-							}
-						}
-					} else {
-						config.processTransport(&foundLayerTypes, &udp, &tcp, ip6.NetworkFlow(), timestamp, 6, ip6.SrcIP, ip6.DstIP)
+				} else {
+					config.processTransport(&transportLayers, &udp, &tcp, ip4.NetworkFlow(), timestamp, 4, ip4.SrcIP, ip4.DstIP, &meta)
+				}
+			case layers.LayerTypeIPv6:
+				// the extension headers, if any, are right after the IPv6 header
+				if len(transportLayers) > 0 && isIPv6Extension(transportLayers[0]) && ip6ext.Fragmented {
+					// HopByHop points into the layer, which is reused for the next packet
+					fragment := ip6
+					fragment.HopByHop = nil
+					config.ip6Defrgger <- ipv6FragmentInfo{
+						fragment,
+						ip6ext.Fragment,
+						timestamp,
+						meta.snapshot(),
 					}
+				} else {
+					config.processTransport(&transportLayers, &udp, &tcp, ip6.NetworkFlow(), timestamp, 6, ip6.SrcIP, ip6.DstIP, &meta)
 				}
 			}
 		case <-ctx.Done():
@@ -180,22 +328,35 @@ func (config *captureConfig) StartPacketDecoder(ctx context.Context) error {
 		select {
 		case data := <-config.tcpReturnChannel:
 			msg := mkdns.Msg{}
-			if err := msg.Unpack(data.data); err == nil {
+			err := msg.Unpack(data.data)
+			if err != nil {
+				config.malformedPayloads.Inc(1)
+			}
+			if err == nil || config.MalformedRecords {
 				MaskSize := util.GeneralFlags.MaskSize4
 				BitSize := 8 * net.IPv4len
 				if data.IPVersion == 6 {
 					MaskSize = util.GeneralFlags.MaskSize6
 					BitSize = 8 * net.IPv6len
 				}
-				config.resultChannel <- util.DNSResult{
+				res := util.DNSResult{
 					Timestamp:    data.timestamp,
 					DNS:          msg,
 					IPVersion:    data.IPVersion,
 					SrcIP:        data.SrcIP.Mask(net.CIDRMask(MaskSize, BitSize)),
 					DstIP:        data.DstIP.Mask(net.CIDRMask(MaskSize, BitSize)),
+					SrcPort:      data.SrcPort,
+					DstPort:      data.DstPort,
 					Protocol:     "tcp",
 					PacketLength: uint16(len(data.data)),
+					MatchedPort:  data.matchedPort,
+					AppProtocol:  data.appProtocol,
 				}
+				if err != nil {
+					markMalformed(&res, data.data, err)
+				}
+				data.meta.annotate(&res)
+				config.sendResult(res)
 			}
 		case packet := <-config.ip4DefrggerReturn:
 			// Packet was defragged, parse the remaining data
@@ -207,18 +368,24 @@ func (config *captureConfig) StartPacketDecoder(ctx context.Context) error {
 				// Protocol not supported
 				break
 			}
-			config.processTransport(&foundLayerTypes, &udp, &tcp, packet.ip.NetworkFlow(), packet.timestamp, 4, packet.ip.SrcIP, packet.ip.DstIP)
+			config.processTransport(&foundLayerTypes, &udp, &tcp, packet.ip.NetworkFlow(), packet.timestamp, 4, packet.ip.SrcIP, packet.ip.DstIP, packet.meta)
 		case packet := <-config.ip6DefrggerReturn:
-			// Packet was defragged, parse the remaining data
-			if packet.ip.NextHeader == layers.IPProtocolUDP {
-				parserOnlyUDP.DecodeLayers(packet.ip.Payload, &foundLayerTypes)
-			} else if packet.ip.NextHeader == layers.IPProtocolTCP {
-				parserOnlyTCP.DecodeLayers(packet.ip.Payload, &foundLayerTypes)
+			// Packet was defragged, parse the remaining data. There can be more
+			// extension headers after the fragment header.
+			var frag layers.IPv6Fragment
+			nextHeader, offset, fragmented, err := walkIPv6Extensions(packet.ip.NextHeader, packet.ip.Payload, &frag)
+			if err != nil || fragmented {
+				break
+			}
+			if nextHeader == layers.IPProtocolUDP {
+				parserOnlyUDP.DecodeLayers(packet.ip.Payload[offset:], &foundLayerTypes)
+			} else if nextHeader == layers.IPProtocolTCP {
+				parserOnlyTCP.DecodeLayers(packet.ip.Payload[offset:], &foundLayerTypes)
 			} else {
 				// Protocol not supported
 				break
 			}
-			config.processTransport(&foundLayerTypes, &udp, &tcp, packet.ip.NetworkFlow(), packet.timestamp, 6, packet.ip.SrcIP, packet.ip.DstIP)
+			config.processTransport(&foundLayerTypes, &udp, &tcp, packet.ip.NetworkFlow(), packet.timestamp, 6, packet.ip.SrcIP, packet.ip.DstIP, packet.meta)
 		case <-ctx.Done():
 			return nil
 		}
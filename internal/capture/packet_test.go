@@ -16,7 +16,9 @@
 package capture
 
 import (
+	"context"
 	"encoding/binary"
+	"fmt"
 	"net"
 	"testing"
 	"time"
@@ -315,9 +317,9 @@ func TestProcessTransportUDP(t *testing.T) {
 	}
 
 	config := captureConfig{
-		Port:          53,
+		ports:         mustParsePorts("53"),
 		resultChannel: make(chan util.DNSResult, 10),
-		tcpAssembly:   make(chan tcpPacket, 10),
+		tcpAssembly:   []chan tcpPacket{make(chan tcpPacket, 10)},
 	}
 
 	udp := &layers.UDP{
@@ -335,10 +337,7 @@ func TestProcessTransportUDP(t *testing.T) {
 		layers.NewIPEndpoint(dstIP),
 	)
 
-	// Set MaskSize so masking works
-	util.GeneralFlags.MaskSize4 = 32
-
-	config.processTransport(&foundLayers, udp, tcp, flow, time.Now(), 4, srcIP, dstIP)
+	config.processTransport(&foundLayers, udp, tcp, flow, time.Now(), 4, srcIP, dstIP, nil)
 
 	select {
 	case result := <-config.resultChannel:
@@ -348,6 +347,9 @@ func TestProcessTransportUDP(t *testing.T) {
 		if result.DstPort != 53 {
 			t.Errorf("Expected dst port 53, got %d", result.DstPort)
 		}
+		if result.MatchedPort != 53 || result.AppProtocol != "dns" {
+			t.Errorf("Expected matched port 53/dns, got %d/%s", result.MatchedPort, result.AppProtocol)
+		}
 		if len(result.DNS.Question) != 1 || result.DNS.Question[0].Name != "example.com." {
 			t.Errorf("DNS question mismatch")
 		}
@@ -359,9 +361,9 @@ func TestProcessTransportUDP(t *testing.T) {
 // TestProcessTransportTCP tests that a TCP packet on port 53 goes to the assembly channel.
 func TestProcessTransportTCP(t *testing.T) {
 	config := captureConfig{
-		Port:          53,
+		ports:         mustParsePorts("53"),
 		resultChannel: make(chan util.DNSResult, 10),
-		tcpAssembly:   make(chan tcpPacket, 10),
+		tcpAssembly:   []chan tcpPacket{make(chan tcpPacket, 10)},
 	}
 
 	udp := &layers.UDP{}
@@ -377,10 +379,10 @@ func TestProcessTransportTCP(t *testing.T) {
 		layers.NewIPEndpoint(dstIP),
 	)
 
-	config.processTransport(&foundLayers, udp, tcp, flow, time.Now(), 4, srcIP, dstIP)
+	config.processTransport(&foundLayers, udp, tcp, flow, time.Now(), 4, srcIP, dstIP, nil)
 
 	select {
-	case pkt := <-config.tcpAssembly:
+	case pkt := <-config.tcpAssembly[0]:
 		if pkt.IPVersion != 4 {
 			t.Errorf("Expected IPVersion 4, got %d", pkt.IPVersion)
 		}
@@ -395,9 +397,9 @@ func TestProcessTransportTCP(t *testing.T) {
 // TestProcessTransportNonDNS tests that packets on non-DNS ports are ignored.
 func TestProcessTransportNonDNS(t *testing.T) {
 	config := captureConfig{
-		Port:          53,
+		ports:         mustParsePorts("53"),
 		resultChannel: make(chan util.DNSResult, 10),
-		tcpAssembly:   make(chan tcpPacket, 10),
+		tcpAssembly:   []chan tcpPacket{make(chan tcpPacket, 10)},
 	}
 
 	// UDP on non-DNS port
@@ -418,7 +420,7 @@ func TestProcessTransportNonDNS(t *testing.T) {
 
 	// Test UDP on non-DNS port
 	foundLayers := []gopacket.LayerType{layers.LayerTypeUDP}
-	config.processTransport(&foundLayers, udp, tcp, flow, time.Now(), 4, srcIP, dstIP)
+	config.processTransport(&foundLayers, udp, tcp, flow, time.Now(), 4, srcIP, dstIP, nil)
 
 	select {
 	case <-config.resultChannel:
@@ -429,17 +431,109 @@ func TestProcessTransportNonDNS(t *testing.T) {
 
 	// Test TCP on non-DNS port
 	foundLayers = []gopacket.LayerType{layers.LayerTypeTCP}
-	config.processTransport(&foundLayers, udp, tcp, flow, time.Now(), 4, srcIP, dstIP)
+	config.processTransport(&foundLayers, udp, tcp, flow, time.Now(), 4, srcIP, dstIP, nil)
 
 	select {
-	case <-config.tcpAssembly:
+	case <-config.tcpAssembly[0]:
 		t.Fatal("Should not have received a TCP packet for non-DNS port")
 	case <-time.After(50 * time.Millisecond):
 		// Expected: no packet
 	}
 }
 
+// testQuery returns an A query for name
+func testQuery(name string) mkdns.Msg {
+	msg := mkdns.Msg{}
+	msg.SetQuestion(name, mkdns.TypeA)
+	return msg
+}
+
+// packTestQuery returns the wire format of an A query for name
+func packTestQuery(t *testing.T, name string) []byte {
+	msg := testQuery(name)
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("Failed to pack DNS: %v", err)
+	}
+	return packed
+}
+
+// testIPv4DNSPacket returns an IPv4 packet carrying a DNS query to port 53
+func testIPv4DNSPacket(t *testing.T, name string) []byte {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload(packTestQuery(t, name))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
 // Benchmark tests
+
+// startInputHandler runs an input handler worker until the end of the test
+func startInputHandler(t *testing.T, config *captureConfig) chan *rawPacketBytes {
+	packets := make(chan *rawPacketBytes)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		config.inputHandlerWorker(ctx, packets)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return packets
+}
+
+// TestInputHandlerLinkTypes feeds the same packet behind each supported link
+// layer header and checks the right decoder is picked from the link type
+func TestInputHandlerLinkTypes(t *testing.T) {
+	mac := []byte{0x02, 0, 0, 0, 0, 1}
+	ethernet := append(append(append([]byte{}, mac...), mac...), 0x08, 0x00)
+	sll := []byte{0, 0, 0, 1, 0, 6}
+	sll = append(append(sll, mac...), 0, 0, 0x08, 0x00)
+	sll2 := []byte{0x08, 0x00, 0, 0, 0, 0, 0, 1, 0, 1, 0, 6}
+	sll2 = append(append(sll2, mac...), 0, 0)
+
+	tests := []struct {
+		linkType layers.LinkType
+		header   []byte
+	}{
+		{layers.LinkTypeEthernet, ethernet},
+		{layers.LinkTypeLinuxSLL, sll},
+		{layers.LinkTypeLinuxSLL2, sll2},
+		{layers.LinkTypeNull, []byte{2, 0, 0, 0}},
+		{layers.LinkTypeLoop, []byte{0, 0, 0, 2}},
+		{layers.LinkTypeRaw, nil},
+		{layers.LinkTypeIPv4, nil},
+	}
+
+	config := captureConfig{
+		ports:         mustParsePorts("53"),
+		resultChannel: make(chan util.DNSResult, len(tests)),
+		tcpAssembly:   []chan tcpPacket{make(chan tcpPacket, 1)},
+	}
+	packets := startInputHandler(t, &config)
+
+	for _, tt := range tests {
+		name := fmt.Sprintf("linktype%d.example.", tt.linkType)
+		data := append(append([]byte{}, tt.header...), testIPv4DNSPacket(t, name)...)
+		packets <- &rawPacketBytes{data, gopacket.CaptureInfo{Timestamp: time.Now()}, tt.linkType, nil, nil}
+		select {
+		case result := <-config.resultChannel:
+			if result.DNS.Question[0].Name != name {
+				t.Errorf("%s: unexpected question %v", tt.linkType, result.DNS.Question)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: packet was not decoded", tt.linkType)
+		}
+	}
+}
+
 func BenchmarkDNSPacking(b *testing.B) {
 	msg := mkdns.Msg{}
 	msg.SetQuestion("example.com.", mkdns.TypeA)
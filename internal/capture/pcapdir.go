@@ -0,0 +1,427 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/mosajjal/dnsmonster/internal/util"
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// the characters making a pcap input a glob rather than a file
+const pcapPatternChars = "*?["
+
+// the progress of a file is saved every pcapStateInterval packets, and when
+// the file is done
+const pcapStateInterval = 10000
+
+// isPcapPattern tells if the target of a pcap input is a directory or a glob
+func isPcapPattern(target string) bool {
+	if target == "-" {
+		return false
+	}
+	if strings.ContainsAny(target, pcapPatternChars) {
+		return true
+	}
+	info, err := os.Stat(target)
+	return err == nil && info.IsDir()
+}
+
+// pcapState is the progress of the pcap inputs reading directories and
+// globs. With --pcapStateFile it's saved to the file, and a restart skips
+// the files done and the packets already read from the others.
+type pcapState struct {
+	sync.Mutex
+	// path is empty if the state isn't saved
+	path  string
+	Files map[string]*pcapStateFile `json:"files"`
+}
+
+// pcapStateFile is the progress of a file, see pcapState.progress for how
+// it's resumed once the file changes.
+type pcapStateFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Packets uint      `json:"packets"`
+	Done    bool      `json:"done"`
+}
+
+func newPcapState(path string) *pcapState {
+	return &pcapState{path: path, Files: make(map[string]*pcapStateFile)}
+}
+
+// loadPcapState reads the state saved in path, a missing file is an empty
+// state
+func loadPcapState(path string) (*pcapState, error) {
+	state := newPcapState(path)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]*pcapStateFile)
+	}
+	return state, nil
+}
+
+// progress returns the packets read from a file and whether it's done. A file
+// that grew since, like a capture still being written, is resumed after the
+// packets read. A file that shrank or was rewritten is read again.
+func (s *pcapState) progress(path string, info os.FileInfo) (uint, bool) {
+	s.Lock()
+	defer s.Unlock()
+	f, ok := s.Files[path]
+	switch {
+	case !ok || info.Size() < f.Size:
+		return 0, false
+	case info.Size() > f.Size:
+		return f.Packets, false
+	case !f.ModTime.Equal(info.ModTime()):
+		return 0, false
+	}
+	return f.Packets, f.Done
+}
+
+// update records the progress of a file and saves the state
+func (s *pcapState) update(path string, info os.FileInfo, packets uint, done bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.Files[path] = &pcapStateFile{Size: info.Size(), ModTime: info.ModTime(), Packets: packets, Done: done}
+	s.save()
+}
+
+// prune forgets the files matching pattern that are gone, like the old
+// captures deleted by a rotation
+func (s *pcapState) prune(pattern string, existing map[string]os.FileInfo) {
+	s.Lock()
+	defer s.Unlock()
+	for path := range s.Files {
+		if _, ok := existing[path]; !ok {
+			if matched, _ := filepath.Match(pattern, path); matched {
+				delete(s.Files, path)
+			}
+		}
+	}
+}
+
+// save writes the state to a temporary file renamed over the previous one,
+// so a crash never leaves a truncated state behind
+func (s *pcapState) save() {
+	if s.path == "" {
+		return
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		log.Errorf("Unable to encode the pcap state: %v", err)
+		return
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		log.Errorf("Unable to save the pcap state: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		log.Errorf("Unable to save the pcap state: %v", err)
+	}
+}
+
+// pcapDirHandle reads the capture files of a directory or a glob one after
+// the other, sorted by the timestamp of their first packet. With --pcapWatch
+// it keeps scanning for new files, which are read once their size and
+// modification time stop changing.
+type pcapDirHandle struct {
+	ctx     context.Context
+	pattern string
+	filter  *bpfFilter
+	watch   time.Duration
+	state   *pcapState
+	files   metrics.Counter
+
+	// the file being read and the packets read from it
+	current genericPacketHandler
+	path    string
+	info    os.FileInfo
+	read    uint
+
+	pktsRead uint
+	// the files found by the previous scan, to tell if they're still being
+	// written
+	previous map[string]os.FileInfo
+	// the timestamp of the first packet of the files, to sort them
+	firsts map[string]pcapFirstPacket
+	// the watched files that failed to read, left alone until they change
+	failed map[string]os.FileInfo
+}
+
+type pcapFirstPacket struct {
+	info      os.FileInfo
+	timestamp time.Time
+}
+
+func newPcapDirHandle(ctx context.Context, config *captureConfig, in *captureInput) (*pcapDirHandle, error) {
+	pattern := in.target
+	if !strings.ContainsAny(pattern, pcapPatternChars) {
+		pattern = filepath.Join(pattern, "*")
+	}
+	if _, err := filepath.Glob(pattern); err != nil {
+		return nil, err
+	}
+	state := config.pcapState
+	if state == nil {
+		state = newPcapState("")
+	}
+	var watch time.Duration
+	if config.PcapWatch {
+		watch = config.PcapWatchInterval
+	}
+	log.Infof("reading the capture files of %s", pattern)
+	return &pcapDirHandle{
+		ctx:      ctx,
+		pattern:  pattern,
+		filter:   newBPFFilter(offlineFilter(in)),
+		watch:    watch,
+		state:    state,
+		files:    metrics.GetOrRegisterCounter("input."+in.name+".pcapFilesRead", metrics.DefaultRegistry),
+		previous: make(map[string]os.FileInfo),
+		firsts:   make(map[string]pcapFirstPacket),
+		failed:   make(map[string]os.FileInfo),
+	}, nil
+}
+
+func (h *pcapDirHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return h.readPacket(false)
+}
+
+func (h *pcapDirHandle) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return h.readPacket(true)
+}
+
+func (h *pcapDirHandle) readPacket(zeroCopy bool) ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		if h.current == nil {
+			if err := h.openNext(); err != nil {
+				return nil, gopacket.CaptureInfo{}, err
+			}
+		}
+		read := h.current.ReadPacketData
+		if zeroCopy {
+			read = h.current.ZeroCopyReadPacketData
+		}
+		data, ci, err := read()
+		if err == nil {
+			// the position is counted before the filter, so it doesn't move
+			// if the filter changes between two runs
+			h.read++
+			if h.read%pcapStateInterval == 0 {
+				h.state.update(h.path, h.info, h.read, false)
+			}
+			if !h.filter.match(h.linkType(ci), data) {
+				continue
+			}
+			h.pktsRead++
+			return data, ci, nil
+		}
+		done := true
+		if !errors.Is(err, io.EOF) {
+			if h.watch > 0 {
+				// a truncated record may be one still being written, the
+				// file is resumed once it changes
+				log.Warnf("Error reading %s, resuming it once it changes: %v", h.path, err)
+				h.failed[h.path] = h.info
+				done = false
+			} else {
+				log.Warnf("Error reading %s, skipping the rest of it: %v", h.path, err)
+			}
+		}
+		h.current.Close()
+		h.current = nil
+		h.state.update(h.path, h.info, h.read, done)
+		if done {
+			h.files.Inc(1)
+		}
+	}
+}
+
+// openNext opens the next file, skipping the packets read by a previous run
+func (h *pcapDirHandle) openNext() error {
+	for {
+		path, info, err := h.next()
+		if err != nil {
+			return err
+		}
+		handle, err := initializeOfflineCapture(path, "")
+		if err != nil {
+			log.Errorf("Skipping %s: %v", path, err)
+			h.state.update(path, info, 0, true)
+			continue
+		}
+		skip, _ := h.state.progress(path, info)
+		if skip > 0 {
+			log.Infof("resuming %s after %d packets", path, skip)
+		}
+		for h.read = 0; h.read < skip; h.read++ {
+			if _, _, err := handle.ReadPacketData(); err != nil {
+				break
+			}
+		}
+		h.current, h.path, h.info = handle, path, info
+		return nil
+	}
+}
+
+// next waits for the next file to read. It returns io.EOF once every file is
+// read if the input isn't watched.
+func (h *pcapDirHandle) next() (string, os.FileInfo, error) {
+	for {
+		if path, info := h.scan(); path != "" {
+			return path, info, nil
+		}
+		if h.watch == 0 {
+			return "", nil, io.EOF
+		}
+		select {
+		case <-h.ctx.Done():
+			return "", nil, h.ctx.Err()
+		case <-time.After(h.watch):
+		}
+	}
+}
+
+// scan returns the file with the oldest first packet among the files left to
+// read, if any
+func (h *pcapDirHandle) scan() (string, os.FileInfo) {
+	matches, _ := filepath.Glob(h.pattern)
+	existing := make(map[string]os.FileInfo, len(matches))
+	var candidates []string
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() || h.isStateFile(path) {
+			continue
+		}
+		existing[path] = info
+		if _, done := h.state.progress(path, info); done {
+			continue
+		}
+		if failed, ok := h.failed[path]; ok && failed.Size() == info.Size() && failed.ModTime().Equal(info.ModTime()) {
+			continue
+		}
+		// a watched file is still being written until it stops changing,
+		// or until it's older than the interval
+		if prev, ok := h.previous[path]; h.watch > 0 && time.Since(info.ModTime()) < h.watch &&
+			(!ok || prev.Size() != info.Size() || !prev.ModTime().Equal(info.ModTime())) {
+			continue
+		}
+		candidates = append(candidates, path)
+	}
+	h.previous = existing
+	h.state.prune(h.pattern, existing)
+	for path := range h.firsts {
+		if _, ok := existing[path]; !ok {
+			delete(h.firsts, path)
+		}
+	}
+	for path := range h.failed {
+		if _, ok := existing[path]; !ok {
+			delete(h.failed, path)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", nil
+	}
+
+	slices.SortFunc(candidates, func(a, b string) int {
+		if c := h.firstPacket(a, existing[a]).Compare(h.firstPacket(b, existing[b])); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	})
+	return candidates[0], existing[candidates[0]]
+}
+
+func (h *pcapDirHandle) isStateFile(path string) bool {
+	if h.state.path == "" {
+		return false
+	}
+	statePath, _ := filepath.Abs(h.state.path)
+	path, _ = filepath.Abs(path)
+	return path == statePath || path == statePath+".tmp"
+}
+
+// firstPacket returns the timestamp of the first packet of a file, or its
+// modification time if it has none
+func (h *pcapDirHandle) firstPacket(path string, info os.FileInfo) time.Time {
+	if first, ok := h.firsts[path]; ok && first.info.Size() == info.Size() && first.info.ModTime().Equal(info.ModTime()) {
+		return first.timestamp
+	}
+	timestamp := info.ModTime()
+	if handle, err := initializeOfflineCapture(path, ""); err == nil {
+		if _, ci, err := handle.ReadPacketData(); err == nil {
+			timestamp = ci.Timestamp
+		}
+		handle.Close()
+	}
+	h.firsts[path] = pcapFirstPacket{info, timestamp}
+	return timestamp
+}
+
+func (h *pcapDirHandle) linkType(ci gopacket.CaptureInfo) layers.LinkType {
+	if handle, ok := h.current.(linkTypeHandler); ok {
+		return handle.linkType(ci)
+	}
+	return layers.LinkTypeEthernet
+}
+
+func (h *pcapDirHandle) captureInterface(ci gopacket.CaptureInfo) *util.CaptureInterface {
+	if handle, ok := h.current.(interfaceHandler); ok {
+		return handle.captureInterface(ci)
+	}
+	return nil
+}
+
+// Close saves the progress of the file being read
+func (h *pcapDirHandle) Close() {
+	if h.current != nil {
+		h.state.update(h.path, h.info, h.read, false)
+		h.current.Close()
+		h.current = nil
+	}
+}
+
+func (h *pcapDirHandle) Stat() (uint, uint, error) {
+	return h.pktsRead, 0, nil
+}
+
+// vim: foldmethod=marker
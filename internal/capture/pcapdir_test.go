@@ -0,0 +1,346 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// testWriteCapture writes a pcap file holding a DNS packet for each of the
+// timestamps, compressed with compression if it's gzip, zstd or xz
+func testWriteCapture(t *testing.T, path, compression string, timestamps ...time.Time) {
+	var buf bytes.Buffer
+	w := pcapgo.NewWriter(&buf)
+	if err := w.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	packet := testEthernet(0x0800, testIPv4DNSPacket(t, "rotated.example."))
+	for _, ts := range timestamps {
+		ci := gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(packet), Length: len(packet)}
+		if err := w.WritePacket(ci, packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	var cw io.WriteCloser
+	var err error
+	switch compression {
+	case "gzip":
+		cw = gzip.NewWriter(&out)
+	case "zstd":
+		cw, err = zstd.NewWriter(&out)
+	case "xz":
+		cw, err = xz.NewWriter(&out)
+	default:
+		out = buf
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cw != nil {
+		if _, err := cw.Write(buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		cw.Close()
+	}
+	if err := os.WriteFile(path, out.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testReadTimestamps reads the packets of a handler, n at most
+func testReadTimestamps(h genericPacketHandler, n int) []int64 {
+	var timestamps []int64
+	for len(timestamps) < n {
+		_, ci, err := h.ReadPacketData()
+		if err != nil {
+			break
+		}
+		timestamps = append(timestamps, ci.Timestamp.Unix())
+	}
+	return timestamps
+}
+
+func TestOpenCompressedCapture(t *testing.T) {
+	dir := t.TempDir()
+	for _, compression := range []string{"none", "gzip", "zstd", "xz"} {
+		path := filepath.Join(dir, "capture."+compression)
+		testWriteCapture(t, path, compression, time.Unix(100, 0), time.Unix(101, 0))
+		handle, err := initializeOfflineCapture(path, "")
+		if err != nil {
+			t.Fatalf("%s: %v", compression, err)
+		}
+		if got := testReadTimestamps(handle, 10); len(got) != 2 || got[0] != 100 || got[1] != 101 {
+			t.Errorf("%s: read %v", compression, got)
+		}
+		handle.Close()
+	}
+}
+
+func TestPcapDirHandle(t *testing.T) {
+	dir := t.TempDir()
+	// the names don't sort like the packets
+	testWriteCapture(t, filepath.Join(dir, "c.pcap.gz"), "gzip", time.Unix(1, 0), time.Unix(2, 0))
+	testWriteCapture(t, filepath.Join(dir, "a.pcap.zst"), "zstd", time.Unix(5, 0), time.Unix(6, 0))
+	testWriteCapture(t, filepath.Join(dir, "b.pcap.xz"), "xz", time.Unix(3, 0), time.Unix(4, 0))
+	if err := os.WriteFile(filepath.Join(dir, "README"), []byte("not a capture"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &captureConfig{pcapState: newPcapState(filepath.Join(dir, "state.json"))}
+	in := &captureInput{target: dir, name: "dir"}
+	if !isPcapPattern(dir) || isPcapPattern(filepath.Join(dir, "README")) || !isPcapPattern(dir+"/*.gz") {
+		t.Fatal("wrong pcap patterns")
+	}
+
+	// a first run stopped after 3 packets
+	h, err := newPcapDirHandle(context.Background(), config, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := testReadTimestamps(h, 3)
+	h.Close()
+	if len(first) != 3 || first[0] != 1 || first[2] != 3 {
+		t.Fatalf("first run read %v", first)
+	}
+
+	// a restart resumes after them, from the saved state
+	if config.pcapState, err = loadPcapState(filepath.Join(dir, "state.json")); err != nil {
+		t.Fatal(err)
+	}
+	if h, err = newPcapDirHandle(context.Background(), config, in); err != nil {
+		t.Fatal(err)
+	}
+	rest := testReadTimestamps(h, 10)
+	if len(rest) != 3 || rest[0] != 4 || rest[2] != 6 {
+		t.Fatalf("second run read %v", rest)
+	}
+	if packets, _, _ := h.Stat(); packets != 3 {
+		t.Errorf("%d packets counted", packets)
+	}
+	h.Close()
+
+	// everything is done, and a deleted file is forgotten
+	os.Remove(filepath.Join(dir, "c.pcap.gz"))
+	if h, err = newPcapDirHandle(context.Background(), config, in); err != nil {
+		t.Fatal(err)
+	}
+	if again := testReadTimestamps(h, 10); len(again) != 0 {
+		t.Errorf("third run read %v", again)
+	}
+	if _, ok := config.pcapState.Files[filepath.Join(dir, "c.pcap.gz")]; ok {
+		t.Error("the deleted file is still in the state")
+	}
+}
+
+func TestPcapDirHandleWatch(t *testing.T) {
+	dir := t.TempDir()
+	testWriteCapture(t, filepath.Join(dir, "1.pcap"), "none", time.Unix(1, 0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := &captureConfig{PcapWatch: true, PcapWatchInterval: 20 * time.Millisecond}
+	h, err := newPcapDirHandle(ctx, config, &captureInput{target: filepath.Join(dir, "*.pcap"), name: "watched"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan int64)
+	go func() {
+		for {
+			_, ci, err := h.ReadPacketData()
+			if err != nil {
+				close(read)
+				return
+			}
+			read <- ci.Timestamp.Unix()
+		}
+	}()
+
+	// the file present at start is read once it stops changing
+	if ts := <-read; ts != 1 {
+		t.Fatalf("read %d", ts)
+	}
+	testWriteCapture(t, filepath.Join(dir, "2.pcap"), "none", time.Unix(2, 0))
+	select {
+	case ts := <-read:
+		if ts != 2 {
+			t.Fatalf("read %d", ts)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the new file wasn't read")
+	}
+	cancel()
+	if _, ok := <-read; ok {
+		t.Fatal("read a packet after the input stopped")
+	}
+}
+
+func TestPcapDirHandleWatchGrowing(t *testing.T) {
+	dir := t.TempDir()
+	full := filepath.Join(t.TempDir(), "full.pcap")
+	testWriteCapture(t, full, "none", time.Unix(1, 0), time.Unix(2, 0), time.Unix(3, 0))
+	data, err := os.ReadFile(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the writer is in the middle of the third record
+	path := filepath.Join(dir, "growing.pcap")
+	if err := os.WriteFile(path, data[:len(data)-10], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := &captureConfig{PcapWatch: true, PcapWatchInterval: 20 * time.Millisecond}
+	h, err := newPcapDirHandle(ctx, config, &captureInput{target: dir, name: "growing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan int64, 10)
+	go func() {
+		for {
+			_, ci, err := h.ReadPacketData()
+			if err != nil {
+				close(read)
+				return
+			}
+			read <- ci.Timestamp.Unix()
+		}
+	}()
+	next := func() int64 {
+		select {
+		case ts := <-read:
+			return ts
+		case <-time.After(5 * time.Second):
+			t.Fatal("no packet read")
+		}
+		return 0
+	}
+
+	if first, second := next(), next(); first != 1 || second != 2 {
+		t.Fatalf("read %d and %d", first, second)
+	}
+	// the file isn't read again while it doesn't change
+	select {
+	case ts := <-read:
+		t.Fatalf("read %d from the truncated record", ts)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// once complete, it's resumed after the packets already read
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if ts := next(); ts != 3 {
+		t.Fatalf("read %d once the file grew", ts)
+	}
+	select {
+	case ts := <-read:
+		t.Fatalf("read %d again", ts)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPcapDirHandleFilteredResume(t *testing.T) {
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	w := pcapgo.NewWriter(&buf)
+	if err := w.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	// the odd packets are DNS, the even ones ARP
+	dns := testEthernet(0x0800, testIPv4DNSPacket(t, "filtered.example."))
+	arp := testEthernet(0x0806, make([]byte, 28))
+	for i := 1; i <= 5; i++ {
+		packet := dns
+		if i%2 == 0 {
+			packet = arp
+		}
+		ci := gopacket.CaptureInfo{Timestamp: time.Unix(int64(i), 0), CaptureLength: len(packet), Length: len(packet)}
+		if err := w.WritePacket(ci, packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a.pcap"), buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a first run with a filter stops after 2 packets, the ARP one in
+	// between was read as well
+	statePath := filepath.Join(dir, "state.json")
+	config := &captureConfig{pcapState: newPcapState(statePath)}
+	h, err := newPcapDirHandle(context.Background(), config, &captureInput{target: dir, name: "dir", filter: "ip", filterSet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first := testReadTimestamps(h, 2); len(first) != 2 || first[0] != 1 || first[1] != 3 {
+		t.Fatalf("first run read %v", first)
+	}
+	h.Close()
+
+	// the position doesn't depend on the filter, a restart without it
+	// resumes after the third packet of the file
+	if config.pcapState, err = loadPcapState(statePath); err != nil {
+		t.Fatal(err)
+	}
+	if h, err = newPcapDirHandle(context.Background(), config, &captureInput{target: dir, name: "dir"}); err != nil {
+		t.Fatal(err)
+	}
+	if rest := testReadTimestamps(h, 10); len(rest) != 2 || rest[0] != 4 || rest[1] != 5 {
+		t.Errorf("second run read %v", rest)
+	}
+	h.Close()
+}
+
+func TestPcapStateProgress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.pcap")
+	testWriteCapture(t, path, "none", time.Unix(1, 0), time.Unix(2, 0))
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := newPcapState("")
+	state.update(path, info, 2, true)
+	if packets, done := state.progress(path, info); packets != 2 || !done {
+		t.Errorf("unchanged file: %d packets, done %t", packets, done)
+	}
+
+	testWriteCapture(t, path, "none", time.Unix(1, 0), time.Unix(2, 0), time.Unix(3, 0))
+	grown, _ := os.Stat(path)
+	if packets, done := state.progress(path, grown); packets != 2 || done {
+		t.Errorf("grown file: %d packets, done %t", packets, done)
+	}
+	testWriteCapture(t, path, "none", time.Unix(1, 0))
+	shrunk, _ := os.Stat(path)
+	if packets, done := state.progress(path, shrunk); packets != 0 || done {
+		t.Errorf("shrunk file: %d packets, done %t", packets, done)
+	}
+}
+
+// vim: foldmethod=marker
@@ -17,60 +17,148 @@ package capture
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
 	"io"
 	"os"
 
 	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
 	"github.com/gopacket/gopacket/pcapgo"
+	"github.com/klauspost/compress/zstd"
 	log "github.com/sirupsen/logrus"
+	"github.com/ulikunitz/xz"
 )
 
+func init() {
+	registerCaptureSource(inputPcap, &packetSource{open: openOfflineCapture})
+}
+
+func openOfflineCapture(ctx context.Context, config *captureConfig, in *captureInput) (genericPacketHandler, error) {
+	var handle genericPacketHandler
+	var err error
+	if isPcapPattern(in.target) {
+		handle, err = newPcapDirHandle(ctx, config, in)
+	} else {
+		handle, err = initializeOfflineCapture(in.target, offlineFilter(in))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", in.target, err)
+	}
+	if config.PcapReplaySpeed > 0 || config.PcapRebaseTimestamps {
+		handle = newReplayHandle(ctx, handle, config.PcapReplaySpeed, config.PcapRebaseTimestamps)
+	}
+	return handle, nil
+}
+
 type pcapFileHandle struct {
 	reader   *pcapgo.Reader
 	file     io.Reader
+	filter   *bpfFilter
 	pktsRead uint
 }
 
-func initializeOfflineCapture(fileName string, filter string) genericPacketHandler {
-	var f *os.File
-	if fileName == "-" {
-		f = os.Stdin
-	} else {
+// captureFile is a capture file, decompressed if needed, and what needs to be
+// closed with it
+type captureFile struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (f *captureFile) Close() error {
+	for i := len(f.closers) - 1; i >= 0; i-- {
+		f.closers[i].Close()
+	}
+	return nil
+}
+
+// openCaptureFile opens a file, or stdin for "-", and decompresses it if it's
+// compressed with gzip, zstd or xz. The compression is detected from the
+// content rather than from the name of the file.
+func openCaptureFile(fileName string) (*captureFile, error) {
+	f := &captureFile{}
+	var file io.ReadCloser = os.Stdin
+	if fileName != "-" {
 		var err error
-		f, err = os.Open(fileName)
-		if err != nil {
-			return nil
+		if file, err = os.Open(fileName); err != nil {
+			return nil, err
 		}
+		f.closers = append(f.closers, file)
 	}
 
-	bufF := bufio.NewReader(f)
-	magic, err := bufF.Peek(4)
+	buffered := bufio.NewReader(file)
+	magic, _ := buffered.Peek(6)
+	var err error
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(buffered); err == nil {
+			f.closers = append(f.closers, gz)
+			f.Reader = gz
+		}
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		var zst *zstd.Decoder
+		if zst, err = zstd.NewReader(buffered, zstd.WithDecoderConcurrency(1)); err == nil {
+			f.closers = append(f.closers, zst.IOReadCloser())
+			f.Reader = zst
+		}
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		f.Reader, err = xz.NewReader(buffered)
+	default:
+		f.Reader = buffered
+	}
 	if err != nil {
-		return nil
+		f.Close()
+		return nil, err
 	}
+	if f.Reader != buffered {
+		f.Reader = bufio.NewReader(f.Reader)
+	}
+	return f, nil
+}
 
+func initializeOfflineCapture(fileName string, filter string) (genericPacketHandler, error) {
+	f, err := openCaptureFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	magic, err := f.Reader.(*bufio.Reader).Peek(4)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	var handle genericPacketHandler
 	if magic[0] == 0x0a && magic[1] == 0x0d && magic[2] == 0x0d && magic[3] == 0x0a {
 		log.Infof("using pcapng file: %s", fileName)
-		return initializeOfflinePcapNg(bufF, filter)
+		handle, err = initializeOfflinePcapNg(f, filter)
 	} else {
 		log.Infof("using pcap file: %s", fileName)
-		return initializeOfflinePcap(bufF, filter)
+		handle, err = initializeOfflinePcap(f, filter)
 	}
-
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return handle, nil
 }
 
-func initializeOfflinePcap(f io.Reader, filter string) *pcapFileHandle {
+func initializeOfflinePcap(f io.Reader, filter string) (*pcapFileHandle, error) {
 	handle, err := pcapgo.NewReader(f)
-	// Set Filter
-	log.Warnf("BPF Filter is not supported in offline mode.")
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return &pcapFileHandle{handle, f, 0}
+	if _, ok := linkLayerType(handle.LinkType()); !ok {
+		log.Warnf("unsupported link type %s, packets will be decoded as Ethernet", handle.LinkType())
+	}
+	// the filter is run in userspace, the packets it drops are not counted
+	return &pcapFileHandle{reader: handle, file: f, filter: newBPFFilter(filter)}, nil
 }
 
 func (h *pcapFileHandle) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
-	data, ci, err = h.reader.ReadPacketData()
+	data, ci, err = h.filter.read(h.reader.ReadPacketData, h.linkType)
 	if err == nil {
 		h.pktsRead++
 	}
@@ -78,13 +166,17 @@ func (h *pcapFileHandle) ReadPacketData() (data []byte, ci gopacket.CaptureInfo,
 }
 
 func (h *pcapFileHandle) ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
-	data, ci, err = h.reader.ZeroCopyReadPacketData()
+	data, ci, err = h.filter.read(h.reader.ZeroCopyReadPacketData, h.linkType)
 	if err == nil {
 		h.pktsRead++
 	}
 	return
 }
 
+func (h *pcapFileHandle) linkType(ci gopacket.CaptureInfo) layers.LinkType {
+	return h.reader.LinkType()
+}
+
 func (h *pcapFileHandle) Close() {
 	if c, ok := h.file.(io.Closer); ok {
 		c.Close()
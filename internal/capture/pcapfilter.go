@@ -0,0 +1,658 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+// this file parses the tcpdump filters for the builds without libpcap. It
+// supports the common subset of the pcap-filter syntax: ether, ip, ip6, arp,
+// tcp, udp and the other protocol names, [src|dst] host, net and port,
+// portrange, proto, vlan, greater, less and the relations between
+// arithmetic expressions on len and on the bytes of a header like ip[9] or
+// tcp[13] & 2. The semantics are the ones of libpcap, and so are its quirks:
+// "and" and "or" have the same precedence, "vlan" shifts the offsets of the
+// rest of the filter, and an address without a keyword uses the keywords of
+// the previous one, eg "port 53 or 5353". pcapfiltergen.go turns the result
+// into BPF.
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// filterNode is a test of the filter
+type filterNode interface{}
+
+type (
+	filterAnd struct{ left, right filterNode }
+	filterOr  struct{ left, right filterNode }
+	filterNot struct{ node filterNode }
+	// filterEtherType matches the packets of an ethertype, like ip or arp
+	filterEtherType struct{ etherType uint16 }
+	// filterIPProto matches the IPv4 or IPv6 packets of a protocol
+	filterIPProto struct {
+		ipv6  bool
+		proto uint8
+	}
+	// filterAddr matches an address or a network of the IPv4, IPv6, ARP or
+	// RARP packets. src and dst are the offsets of the addresses in the
+	// header.
+	filterAddr struct {
+		etherType  uint16
+		src, dst   uint32
+		addr, mask []byte
+		dir        string
+	}
+	filterEtherAddr struct {
+		mac []byte
+		dir string
+	}
+	// filterPort matches the TCP, UDP or SCTP ports of the IPv4 or IPv6
+	// packets that are not fragments
+	filterPort struct {
+		ipv6   bool
+		protos []uint8
+		lo, hi uint16
+		dir    string
+	}
+	// filterVLAN matches a VLAN tag, any if id is negative, and moves the
+	// rest of the filter past the tag
+	filterVLAN     struct{ id int }
+	filterRelation struct {
+		op          string
+		left, right filterArith
+	}
+)
+
+// filterArith is an arithmetic expression of a relation
+type filterArith interface{}
+
+type (
+	filterConst struct{ k uint32 }
+	filterLen   struct{}
+	// filterLoad loads size bytes at off from the start of a header
+	filterLoad struct {
+		proto string
+		off   filterArith
+		size  uint32
+	}
+	filterBinary struct {
+		op          string
+		left, right filterArith
+	}
+)
+
+var (
+	filterEtherTypes = map[string]uint16{"ip": 0x0800, "ip6": 0x86dd, "arp": 0x0806, "rarp": 0x8035}
+	// the protocols of the IP packets, and the IP versions they're matched on
+	filterIPProtos = map[string]struct {
+		proto    uint8
+		ipv4     bool
+		ipv6     bool
+		hasPorts bool
+	}{
+		"tcp":   {6, true, true, true},
+		"udp":   {17, true, true, true},
+		"sctp":  {132, true, true, true},
+		"icmp":  {1, true, false, false},
+		"igmp":  {2, true, false, false},
+		"icmp6": {58, false, true, false},
+	}
+	// the headers that can be indexed in a relation
+	filterHeaders = map[string]bool{"ether": true, "ip": true, "ip6": true, "arp": true, "rarp": true,
+		"tcp": true, "udp": true, "sctp": true, "icmp": true, "igmp": true, "icmp6": true}
+	// the named constants of the relations
+	filterConstants = map[string]uint32{
+		"tcpflags": 13, "tcp-fin": 0x01, "tcp-syn": 0x02, "tcp-rst": 0x04, "tcp-push": 0x08,
+		"tcp-ack": 0x10, "tcp-urg": 0x20, "icmptype": 0, "icmpcode": 1, "icmp-echoreply": 0, "icmp-echo": 8,
+		"icmp6type": 0, "icmp6code": 1,
+	}
+	filterPortNames = map[string]uint16{"domain": 53, "http": 80, "https": 443, "mdns": 5353, "llmnr": 5355}
+	// the precedence of the arithmetic operators, as in libpcap
+	filterArithOps = map[string]int{"|": 1, "&": 2, "<<": 3, ">>": 3, "+": 4, "-": 4, "*": 5, "/": 5, "%": 5, "^": 1}
+	filterRelOps   = map[string]bool{"=": true, "==": true, "!=": true, ">": true, ">=": true, "<": true, "<=": true}
+	filterKinds    = map[string]bool{"host": true, "net": true, "port": true, "portrange": true, "proto": true}
+)
+
+type filterToken struct {
+	text string
+	word bool
+}
+
+// lexFilter splits a filter into words and operators. Addresses are words,
+// so outside of the brackets the words can hold the ':', '.', '/' and '-'
+// of the IPv6 addresses, networks and port ranges.
+func lexFilter(filter string) ([]filterToken, error) {
+	var tokens []filterToken
+	depth := 0
+	isWordChar := func(c byte, start bool) bool {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_':
+			return true
+		case depth > 0:
+			return c == '.' && !start
+		case c == '\\' || c == ':':
+			return true
+		}
+		return !start && (c == '.' || c == '-' || c == '/')
+	}
+	for i := 0; i < len(filter); {
+		c := filter[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isWordChar(c, true):
+			j := i + 1
+			for j < len(filter) && isWordChar(filter[j], false) {
+				j++
+			}
+			tokens = append(tokens, filterToken{text: filter[i:j], word: true})
+			i = j
+		default:
+			op := string(c)
+			if i+1 < len(filter) {
+				switch two := filter[i : i+2]; two {
+				case "&&", "||", "==", "!=", ">=", "<=", "<<", ">>":
+					op = two
+				}
+			}
+			if !strings.Contains("()[]!<>=+-*/%&|:^", string(c)) && len(op) == 1 {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+			switch op {
+			case "[":
+				depth++
+			case "]":
+				depth--
+			}
+			tokens = append(tokens, filterToken{text: op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+// filterQualifiers are the keywords before an address, like "tcp dst port"
+type filterQualifiers struct {
+	proto string
+	dir   string
+	kind  string
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+	// the qualifiers of the previous primitive, used by the addresses
+	// without any
+	last *filterQualifiers
+}
+
+// parseFilter parses a filter, an empty filter returns nil
+func parseFilter(filter string) (filterNode, error) {
+	tokens, err := lexFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	p := &filterParser{tokens: tokens}
+	node, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return node, nil
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos].text
+	}
+	return ""
+}
+
+func (p *filterParser) peekWord() (string, bool) {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].word {
+		return p.tokens[p.pos].text, true
+	}
+	return "", false
+}
+
+func (p *filterParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *filterParser) expect(text string) error {
+	if t := p.peek(); t != text {
+		if t == "" {
+			return fmt.Errorf("expected %q at the end of the filter", text)
+		}
+		return fmt.Errorf("expected %q, got %q", text, t)
+	}
+	p.pos++
+	return nil
+}
+
+// expr parses the "and" and "or" of the filter, which have the same
+// precedence and are left associative
+func (p *filterParser) expr() (filterNode, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek() {
+		case "and", "&&":
+			p.pos++
+			right, err := p.factor()
+			if err != nil {
+				return nil, err
+			}
+			left = &filterAnd{left, right}
+		case "or", "||":
+			p.pos++
+			right, err := p.factor()
+			if err != nil {
+				return nil, err
+			}
+			left = &filterOr{left, right}
+		default:
+			return left, nil
+		}
+	}
+}
+
+func (p *filterParser) factor() (filterNode, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.pos++
+		node, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return &filterNot{node}, nil
+	case "":
+		return nil, fmt.Errorf("unexpected end of the filter")
+	}
+
+	// relations are tried first, backtracking if there's no relational
+	// operator, eg on a port number or a parenthesized expression
+	start, last := p.pos, p.last
+	if relation, err := p.relation(); err == nil {
+		return relation, nil
+	}
+	p.pos, p.last = start, last
+
+	if p.peek() == "(" {
+		p.pos++
+		node, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expect(")")
+	}
+	return p.primitive()
+}
+
+func (p *filterParser) relation() (filterNode, error) {
+	left, err := p.arith(1)
+	if err != nil {
+		return nil, err
+	}
+	op := p.next()
+	if !filterRelOps[op] {
+		return nil, fmt.Errorf("expected a relational operator")
+	}
+	right, err := p.arith(1)
+	if err != nil {
+		return nil, err
+	}
+	return &filterRelation{op, left, right}, nil
+}
+
+// arith parses an arithmetic expression with the operators of at least
+// precedence minPrec
+func (p *filterParser) arith(minPrec int) (filterArith, error) {
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		prec, ok := filterArithOps[op]
+		if !ok || prec < minPrec || p.tokens[p.pos].word {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.arith(prec + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &filterBinary{op, left, right}
+	}
+}
+
+func (p *filterParser) operand() (filterArith, error) {
+	t := p.next()
+	switch {
+	case t == "(":
+		a, err := p.arith(1)
+		if err != nil {
+			return nil, err
+		}
+		return a, p.expect(")")
+	case t == "len":
+		return &filterLen{}, nil
+	case filterHeaders[t] && p.peek() == "[":
+		p.pos++
+		off, err := p.arith(1)
+		if err != nil {
+			return nil, err
+		}
+		size := uint32(1)
+		if p.peek() == ":" {
+			p.pos++
+			n, err := strconv.ParseUint(p.next(), 10, 8)
+			if err != nil || (n != 1 && n != 2 && n != 4) {
+				return nil, fmt.Errorf("the size of a load is 1, 2 or 4")
+			}
+			size = uint32(n)
+		}
+		return &filterLoad{t, off, size}, p.expect("]")
+	}
+	if k, ok := filterConstants[t]; ok {
+		return &filterConst{k}, nil
+	}
+	k, err := strconv.ParseUint(t, 0, 32)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected %q in an expression", t)
+	}
+	return &filterConst{uint32(k)}, nil
+}
+
+// primitive parses [proto] [dir] [kind] ID and the keywords standing alone
+func (p *filterParser) primitive() (filterNode, error) {
+	switch t := p.peek(); t {
+	case "vlan":
+		p.pos++
+		id := -1
+		if w, ok := p.peekWord(); ok {
+			if n, err := strconv.ParseUint(w, 0, 12); err == nil {
+				id = int(n)
+				p.pos++
+			}
+		}
+		return &filterVLAN{id}, nil
+	case "greater", "less":
+		p.pos++
+		n, err := strconv.ParseUint(p.next(), 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s needs a length", t)
+		}
+		if t == "greater" {
+			return &filterRelation{">=", &filterLen{}, &filterConst{uint32(n)}}, nil
+		}
+		return &filterRelation{"<=", &filterLen{}, &filterConst{uint32(n)}}, nil
+	}
+
+	q := filterQualifiers{}
+	if _, ok := filterHeaders[p.peek()]; ok {
+		q.proto = p.next()
+	}
+	if t := p.peek(); t == "src" || t == "dst" {
+		q.dir = p.next()
+		// "src or dst" and "src and dst"
+		if op := p.peek(); (op == "or" || op == "and") && p.pos+1 < len(p.tokens) {
+			if other := p.tokens[p.pos+1].text; (other == "src" || other == "dst") && other != q.dir {
+				q.dir = "src " + op + " dst"
+				p.pos += 2
+			}
+		}
+	}
+	if filterKinds[p.peek()] {
+		q.kind = p.next()
+	}
+
+	if q == (filterQualifiers{}) {
+		if p.last == nil {
+			if _, ok := p.peekWord(); !ok {
+				return nil, fmt.Errorf("unexpected %q", p.peek())
+			}
+			q.kind = "host"
+		} else {
+			q = *p.last
+		}
+	} else if q.dir == "" && q.kind == "" {
+		// a protocol standing alone, unless it's followed by an address
+		// like in "ether 00:11:22:33:44:55"
+		if _, ok := p.peekWord(); !ok || filterReserved(p.peek()) {
+			return protocolFilter(q.proto)
+		}
+	}
+	if q.kind == "" {
+		q.kind = "host"
+	}
+	id, ok := p.peekWord()
+	if !ok || filterReserved(id) {
+		return nil, fmt.Errorf("%s needs a value", q.kind)
+	}
+	p.pos++
+	p.last = &q
+	node, err := p.qualified(q, id)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", q.kind, id, err)
+	}
+	return node, nil
+}
+
+// filterReserved tells if a word is a keyword rather than an address
+func filterReserved(w string) bool {
+	switch w {
+	case "and", "or", "not", "src", "dst", "vlan", "greater", "less", "len", "mask":
+		return true
+	}
+	return filterKinds[w] || filterHeaders[w]
+}
+
+// protocolFilter matches the packets of a protocol given alone, like "udp"
+func protocolFilter(proto string) (filterNode, error) {
+	if etherType, ok := filterEtherTypes[proto]; ok {
+		return &filterEtherType{etherType}, nil
+	}
+	if ipProto, ok := filterIPProtos[proto]; ok {
+		return ipProtoFilter(ipProto.proto, ipProto.ipv4, ipProto.ipv6), nil
+	}
+	return nil, fmt.Errorf("%s needs a value", proto)
+}
+
+func ipProtoFilter(proto uint8, ipv4, ipv6 bool) filterNode {
+	switch {
+	case ipv4 && ipv6:
+		return &filterOr{&filterIPProto{false, proto}, &filterIPProto{true, proto}}
+	case ipv6:
+		return &filterIPProto{true, proto}
+	}
+	return &filterIPProto{false, proto}
+}
+
+// qualified builds the test of an ID with its qualifiers
+func (p *filterParser) qualified(q filterQualifiers, id string) (filterNode, error) {
+	switch q.kind {
+	case "proto":
+		return protoValueFilter(q.proto, id)
+	case "port", "portrange":
+		return portFilter(q, id)
+	}
+
+	// host and net
+	if q.proto == "ether" {
+		if q.kind != "host" {
+			return nil, fmt.Errorf("ether only supports host")
+		}
+		mac, err := net.ParseMAC(id)
+		if err != nil || len(mac) != 6 {
+			return nil, fmt.Errorf("invalid MAC address")
+		}
+		return &filterEtherAddr{mac, q.dir}, nil
+	}
+	var ip net.IP
+	var mask net.IPMask
+	switch {
+	case strings.Contains(id, "/"):
+		_, network, err := net.ParseCIDR(id)
+		if err != nil {
+			return nil, err
+		}
+		ip, mask = network.IP, network.Mask
+	case q.kind == "net" && p.peek() == "mask":
+		p.pos++
+		ip, mask = net.ParseIP(id), net.IPMask(net.ParseIP(p.next()).To4())
+		if ip.To4() == nil || len(mask) != net.IPv4len {
+			return nil, fmt.Errorf("invalid network")
+		}
+	case q.kind == "net" && !strings.Contains(id, ":"):
+		// a network given by its first bytes, eg 10.1
+		parts := strings.Split(id, ".")
+		for len(parts) < 4 {
+			parts = append(parts, "0")
+		}
+		ip = net.ParseIP(strings.Join(parts, "."))
+		mask = net.CIDRMask(8*len(strings.Split(id, ".")), 32)
+	default:
+		ip = net.ParseIP(id)
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("not an address, host names are not supported")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		if mask == nil {
+			mask = net.CIDRMask(32, 32)
+		}
+		if len(mask) == net.IPv6len {
+			mask = mask[12:]
+		}
+		addr := func(etherType uint16, src, dst uint32) filterNode {
+			return &filterAddr{etherType, src, dst, ip4.Mask(mask), mask, q.dir}
+		}
+		switch q.proto {
+		case "":
+			return &filterOr{&filterOr{addr(0x0800, 12, 16), addr(0x0806, 14, 24)}, addr(0x8035, 14, 24)}, nil
+		case "ip":
+			return addr(0x0800, 12, 16), nil
+		case "arp", "rarp":
+			return addr(filterEtherTypes[q.proto], 14, 24), nil
+		}
+		return nil, fmt.Errorf("an IPv4 address doesn't apply to %s", q.proto)
+	}
+	if q.proto != "" && q.proto != "ip6" {
+		return nil, fmt.Errorf("an IPv6 address doesn't apply to %s", q.proto)
+	}
+	if mask == nil {
+		mask = net.CIDRMask(128, 128)
+	}
+	return &filterAddr{0x86dd, 8, 24, ip.Mask(mask), mask, q.dir}, nil
+}
+
+// protoValueFilter builds "ip proto N", "ip6 proto N", "proto N" and "ether
+// proto N". N can be a name escaped with a backslash, eg \udp.
+func protoValueFilter(proto, id string) (filterNode, error) {
+	name := strings.TrimPrefix(id, "\\")
+	if proto == "ether" {
+		if etherType, ok := filterEtherTypes[name]; ok {
+			return &filterEtherType{etherType}, nil
+		}
+		n, err := strconv.ParseUint(name, 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ethertype")
+		}
+		return &filterEtherType{uint16(n)}, nil
+	}
+	var n uint8
+	if ipProto, ok := filterIPProtos[name]; ok {
+		n = ipProto.proto
+	} else {
+		v, err := strconv.ParseUint(name, 0, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid protocol")
+		}
+		n = uint8(v)
+	}
+	switch proto {
+	case "":
+		return ipProtoFilter(n, true, true), nil
+	case "ip", "ip6":
+		return ipProtoFilter(n, proto == "ip", proto == "ip6"), nil
+	}
+	return nil, fmt.Errorf("proto doesn't apply to %s", proto)
+}
+
+func portFilter(q filterQualifiers, id string) (filterNode, error) {
+	parsePort := func(s string) (uint16, error) {
+		if port, ok := filterPortNames[s]; ok {
+			return port, nil
+		}
+		port, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid port")
+		}
+		return uint16(port), nil
+	}
+	first, last := id, id
+	if q.kind == "portrange" {
+		var ok bool
+		if first, last, ok = strings.Cut(id, "-"); !ok {
+			return nil, fmt.Errorf("a port range is FIRST-LAST")
+		}
+	}
+	lo, err := parsePort(first)
+	if err != nil {
+		return nil, err
+	}
+	hi, err := parsePort(last)
+	if err != nil {
+		return nil, err
+	}
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+
+	ipv4, ipv6 := true, true
+	var protos []uint8
+	switch q.proto {
+	case "", "ip", "ip6":
+		protos = []uint8{6, 17, 132}
+		ipv4, ipv6 = q.proto != "ip6", q.proto != "ip"
+	case "tcp", "udp", "sctp":
+		protos = []uint8{filterIPProtos[q.proto].proto}
+	default:
+		return nil, fmt.Errorf("ports don't apply to %s", q.proto)
+	}
+	v4, v6 := &filterPort{false, protos, lo, hi, q.dir}, &filterPort{true, protos, lo, hi, q.dir}
+	switch {
+	case ipv4 && ipv6:
+		return &filterOr{v4, v6}, nil
+	case ipv6:
+		return v6, nil
+	}
+	return v4, nil
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,237 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+// testFilterPackets returns packets of every kind the filters match on, by
+// name
+func testFilterPackets(t *testing.T) map[string][]byte {
+	serialize := func(toSerialize ...gopacket.SerializableLayer) []byte {
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, toSerialize...); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	eth := func(etherType layers.EthernetType) *layers.Ethernet {
+		return &layers.Ethernet{SrcMAC: net.HardwareAddr{2, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{2, 0, 0, 0, 0, 2}, EthernetType: etherType}
+	}
+	ipv4 := func(protocol layers.IPProtocol, src, dst string) *layers.IPv4 {
+		return &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: protocol, SrcIP: net.ParseIP(src).To4(), DstIP: net.ParseIP(dst).To4()}
+	}
+	ipv6 := func(next layers.IPProtocol) *layers.IPv6 {
+		return &layers.IPv6{Version: 6, NextHeader: next, HopLimit: 64, SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8:1::2")}
+	}
+	udp := func(src, dst layers.UDPPort) *layers.UDP { return &layers.UDP{SrcPort: src, DstPort: dst} }
+	payload := gopacket.Payload("GET / HTTP/1.1")
+
+	withOptions := ipv4(layers.IPProtocolUDP, "10.0.0.1", "10.0.0.2")
+	withOptions.Options = []layers.IPv4Option{{OptionType: 1}, {OptionType: 1}, {OptionType: 1}, {OptionType: 0}}
+	fragment := ipv4(layers.IPProtocolUDP, "10.0.0.1", "10.0.0.2")
+	fragment.FragOffset = 185
+	syn := &layers.TCP{SrcPort: 40000, DstPort: 80, SYN: true}
+	ack := &layers.TCP{SrcPort: 40000, DstPort: 80, ACK: true}
+	arp := &layers.ARP{AddrType: layers.LinkTypeEthernet, Protocol: layers.EthernetTypeIPv4, HwAddressSize: 6, ProtAddressSize: 4, Operation: 1,
+		SourceHwAddress: []byte{2, 0, 0, 0, 0, 1}, SourceProtAddress: []byte{10, 0, 0, 1}, DstHwAddress: make([]byte, 6), DstProtAddress: []byte{10, 0, 0, 9}}
+
+	return map[string][]byte{
+		"dns4":    serialize(eth(layers.EthernetTypeIPv4), ipv4(layers.IPProtocolUDP, "10.0.0.1", "10.0.0.2"), udp(40000, 53), payload),
+		"answer4": serialize(eth(layers.EthernetTypeIPv4), ipv4(layers.IPProtocolUDP, "192.168.1.1", "10.0.0.1"), udp(53, 40000), payload),
+		"mdns4":   serialize(eth(layers.EthernetTypeIPv4), ipv4(layers.IPProtocolUDP, "10.0.0.1", "224.0.0.251"), udp(5353, 5353), payload),
+		"options": serialize(eth(layers.EthernetTypeIPv4), withOptions, udp(40000, 53), payload),
+		"frag":    serialize(eth(layers.EthernetTypeIPv4), fragment, udp(40000, 53), payload),
+		"syn":     serialize(eth(layers.EthernetTypeIPv4), ipv4(layers.IPProtocolTCP, "10.0.0.1", "10.0.0.2"), syn, payload),
+		"http":    serialize(eth(layers.EthernetTypeIPv4), ipv4(layers.IPProtocolTCP, "10.0.0.1", "10.0.0.2"), ack, payload),
+		"dns6":    serialize(eth(layers.EthernetTypeIPv6), ipv6(layers.IPProtocolUDP), udp(40000, 53), payload),
+		"icmp6":   serialize(eth(layers.EthernetTypeIPv6), ipv6(layers.IPProtocolICMPv6), payload),
+		"arp":     serialize(eth(layers.EthernetTypeARP), arp),
+		"vlan": serialize(eth(layers.EthernetTypeDot1Q), &layers.Dot1Q{VLANIdentifier: 10, Type: layers.EthernetTypeIPv4},
+			ipv4(layers.IPProtocolUDP, "10.0.0.1", "10.0.0.2"), udp(40000, 53), payload),
+		"qinq": serialize(eth(layers.EthernetTypeQinQ), &layers.Dot1Q{VLANIdentifier: 20, Type: layers.EthernetTypeDot1Q},
+			&layers.Dot1Q{VLANIdentifier: 30, Type: layers.EthernetTypeIPv4}, ipv4(layers.IPProtocolUDP, "10.0.0.1", "10.0.0.2"), udp(40000, 53), payload),
+	}
+}
+
+// testFilterMatches returns the names of the packets a filter matches
+func testFilterMatches(t *testing.T, filter string, linkType layers.LinkType, packets map[string][]byte) []string {
+	t.Helper()
+	instructions, err := compileFilter(filter, linkType, 262144)
+	if err != nil {
+		t.Fatalf("%q: %v", filter, err)
+	}
+	vm, err := bpf.NewVM(instructions)
+	if err != nil {
+		t.Fatalf("%q: %v", filter, err)
+	}
+	var matches []string
+	for _, name := range []string{"dns4", "answer4", "mdns4", "options", "frag", "syn", "http", "dns6", "icmp6", "arp", "vlan", "qinq"} {
+		packet, ok := packets[name]
+		if !ok {
+			continue
+		}
+		keep, err := vm.Run(packet)
+		if err != nil {
+			t.Fatalf("%q on %s: %v", filter, name, err)
+		}
+		if keep > 0 {
+			matches = append(matches, name)
+		}
+	}
+	return matches
+}
+
+func TestCompileFilter(t *testing.T) {
+	packets := testFilterPackets(t)
+	tests := []struct {
+		filter string
+		want   string
+	}{
+		{"", "dns4 answer4 mdns4 options frag syn http dns6 icmp6 arp vlan qinq"},
+		// the default filter
+		{"((ip and (ip[9] == 6 or ip[9] == 17)) or (ip6 and (ip6[6] == 17 or ip6[6] == 6 or ip6[6] == 44)))", "dns4 answer4 mdns4 options frag syn http dns6"},
+		{"ip", "dns4 answer4 mdns4 options frag syn http"},
+		{"ip6", "dns6 icmp6"},
+		{"arp", "arp"},
+		{"udp", "dns4 answer4 mdns4 options frag dns6"},
+		{"tcp or icmp6", "syn http icmp6"},
+		{"udp port 53", "dns4 answer4 options dns6"},
+		{"port domain", "dns4 answer4 options dns6"},
+		{"ip and udp dst port 53", "dns4 options"},
+		{"udp src port 53", "answer4"},
+		{"port 53 or 5353", "dns4 answer4 mdns4 options dns6"},
+		{"portrange 5000-6000 or tcp port 80", "mdns4 syn http"},
+		{"not port 53", "mdns4 frag syn http icmp6 arp vlan qinq"},
+		{"! udp && ! arp", "syn http icmp6 vlan qinq"},
+		{"host 10.0.0.2", "dns4 options frag syn http"},
+		{"host 10.0.0.9", "arp"},
+		{"ip host 10.0.0.9", ""},
+		{"src host 192.168.1.1", "answer4"},
+		{"dst 10.0.0.1", "answer4"},
+		{"src and dst net 10.0.0.0/8", "dns4 options frag syn http arp"},
+		{"net 192.168", "answer4"},
+		{"net 224.0.0.0 mask 240.0.0.0", "mdns4"},
+		{"host 2001:db8::1", "dns6 icmp6"},
+		{"dst net 2001:db8:1::/48", "dns6 icmp6"},
+		{"ether src 02:00:00:00:00:01", "dns4 answer4 mdns4 options frag syn http dns6 icmp6 arp vlan qinq"},
+		{"ether dst host 02:00:00:00:00:01", ""},
+		{"ip proto \\udp", "dns4 answer4 mdns4 options frag"},
+		{"ip6 proto 58 or ether proto \\arp", "icmp6 arp"},
+		{"ip[9] == 17 and ip[6:2] & 0x1fff != 0", "frag"},
+		{"tcp[13] & 2 != 0", "syn"},
+		{"tcp[tcpflags] & (tcp-syn|tcp-ack) == tcp-ack", "http"},
+		{"udp[2:2] = 53", "dns4 options"},
+		{"tcp[((tcp[12] & 0xf0) >> 2):4] = 0x47455420", "syn http"},
+		{"udp[8 + 4 - 2 * 2] = 0x47", "dns4 answer4 mdns4 options"},
+		{"len > 70 and udp", "dns6"},
+		{"greater 61 and less 70", "syn http icmp6 qinq"},
+		// and and or have the same precedence
+		{"udp or tcp and host 10.0.0.2", "dns4 options frag syn http"},
+		{"vlan", "vlan qinq"},
+		{"vlan 10 and udp port 53", "vlan"},
+		{"vlan 20 and vlan 30 and host 10.0.0.1", "qinq"},
+		{"vlan 20 and vlan 10", ""},
+		{"(vlan or udp) and port 53", "vlan"},
+	}
+	for _, tt := range tests {
+		matches := strings.Join(testFilterMatches(t, tt.filter, layers.LinkTypeEthernet, packets), " ")
+		if matches != tt.want {
+			t.Errorf("%q matches %q, want %q", tt.filter, matches, tt.want)
+		}
+	}
+}
+
+func TestCompileFilterLinkTypes(t *testing.T) {
+	packets := testFilterPackets(t)
+	sll, raw := make(map[string][]byte), make(map[string][]byte)
+	for _, name := range []string{"dns4", "mdns4", "syn", "dns6"} {
+		packet := packets[name]
+		raw[name] = packet[14:]
+		header := make([]byte, 16)
+		copy(header[14:], packet[12:14])
+		sll[name] = append(header, packet[14:]...)
+	}
+	for _, linkType := range []layers.LinkType{layers.LinkTypeRaw, layers.LinkTypeLinuxSLL} {
+		frames := raw
+		if linkType == layers.LinkTypeLinuxSLL {
+			frames = sll
+		}
+		for filter, want := range map[string]string{
+			"udp port 53":       "dns4 dns6",
+			"ip6":               "dns6",
+			"ip and not udp":    "syn",
+			"dst host 10.0.0.2": "dns4 syn",
+			"ip[9] = 17":        "dns4 mdns4",
+		} {
+			if matches := strings.Join(testFilterMatches(t, filter, linkType, frames), " "); matches != want {
+				t.Errorf("%s: %q matches %q, want %q", linkType, filter, matches, want)
+			}
+		}
+	}
+	if _, err := compileFilter("vlan", layers.LinkTypeRaw, 262144); err == nil {
+		t.Error("vlan compiled for raw IP")
+	}
+	if _, err := compileFilter("udp", layers.LinkTypePPP, 262144); err == nil {
+		t.Error("a filter compiled for PPP")
+	}
+}
+
+func TestCompileFilterLongJumps(t *testing.T) {
+	// the jumps of the first hosts to the end are longer than the 255
+	// instructions of a conditional jump
+	hosts := make([]string, 100)
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("ip host 10.1.0.%d", i)
+	}
+	filter := strings.Join(append(hosts, "ip host 10.0.0.2"), " or ")
+	if matches := strings.Join(testFilterMatches(t, "not ("+filter+")", layers.LinkTypeEthernet, testFilterPackets(t)), " "); matches != "answer4 mdns4 dns6 icmp6 arp vlan qinq" {
+		t.Errorf("the long filter matches %q", matches)
+	}
+}
+
+func TestCompileFilterErrors(t *testing.T) {
+	for _, filter := range []string{
+		"host",
+		"port http2",
+		"udp port",
+		"host example.com",
+		"(udp",
+		"udp)",
+		"udp and",
+		"foo",
+		"ip6 host 10.0.0.1",
+		"icmp port 53",
+		"ip[0:3] = 1",
+		"ip[0] / 0 = 1",
+		"udp port 53 $",
+		"tcp[13] &",
+	} {
+		if _, err := compileFilter(filter, layers.LinkTypeEthernet, 262144); err == nil {
+			t.Errorf("%q compiled", filter)
+		}
+	}
+}
+
+// vim: foldmethod=marker
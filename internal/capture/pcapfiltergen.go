@@ -0,0 +1,587 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+// this file generates the classic BPF of the filters parsed by pcapfilter.go.
+// Every test jumps to a true and a false label, like libpcap's code, and the
+// labels are resolved once the whole program is known, with an unconditional
+// jump added where a conditional one would be too long.
+
+import (
+	"fmt"
+
+	"github.com/gopacket/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+// the maximum length of a BPF program in the kernel
+const bpfMaxInstructions = 4096
+
+// filterLink describes where the headers are on a link type
+type filterLink struct {
+	// the offset of the ethertype, or -1 if the IP version has to be read in
+	// the first nibble of the network header
+	etherTypeOff int
+	l3Off        uint32
+	vlan         bool
+}
+
+var filterLinks = map[layers.LinkType]filterLink{
+	layers.LinkTypeEthernet:  {12, 14, true},
+	layers.LinkTypeLinuxSLL:  {14, 16, false},
+	layers.LinkTypeLinuxSLL2: {0, 20, false},
+	layers.LinkTypeRaw:       {-1, 0, false},
+	layers.LinkTypeIPv4:      {-1, 0, false},
+	layers.LinkTypeIPv6:      {-1, 0, false},
+	layers.LinkType(12):      {-1, 0, false}, // raw IP on some BSDs
+	layers.LinkTypeNull:      {-1, 4, false},
+	layers.LinkTypeLoop:      {-1, 4, false},
+}
+
+type filterInsn struct {
+	insn bpf.Instruction
+	// the labels of the instruction
+	labels []int
+	// the targets of the jumps, -1 if the instruction doesn't jump
+	jt, jf int
+}
+
+type filterCompiler struct {
+	link filterLink
+	// the bytes of the VLAN tags matched so far
+	vlan    uint32
+	insns   []filterInsn
+	nlabels int
+	// the labels of the next instruction
+	pending []int
+	// the depth of the scratch memory used by the arithmetic
+	scratch int
+}
+
+// compileFilter compiles a tcpdump filter into BPF for the packets of a link
+// type. The program returns snaplen for the packets that match.
+func compileFilter(filter string, linkType layers.LinkType, snaplen uint32) ([]bpf.Instruction, error) {
+	link, ok := filterLinks[linkType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported link type %s", linkType)
+	}
+	node, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return []bpf.Instruction{bpf.RetConstant{Val: snaplen}}, nil
+	}
+	c := &filterCompiler{link: link}
+	t, f := c.label(), c.label()
+	if err := c.gen(node, t, f); err != nil {
+		return nil, err
+	}
+	c.place(t)
+	c.emit(bpf.RetConstant{Val: snaplen})
+	c.place(f)
+	c.emit(bpf.RetConstant{Val: 0})
+	return c.assemble()
+}
+
+func (c *filterCompiler) label() int {
+	c.nlabels++
+	return c.nlabels - 1
+}
+
+func (c *filterCompiler) place(label int) {
+	c.pending = append(c.pending, label)
+}
+
+func (c *filterCompiler) add(insn filterInsn) {
+	insn.labels, c.pending = c.pending, nil
+	c.insns = append(c.insns, insn)
+}
+
+func (c *filterCompiler) emit(insns ...bpf.Instruction) {
+	for _, insn := range insns {
+		c.add(filterInsn{insn: insn, jt: -1, jf: -1})
+	}
+}
+
+// jump compares A to k
+func (c *filterCompiler) jump(cond bpf.JumpTest, k uint32, t, f int) {
+	c.add(filterInsn{insn: bpf.JumpIf{Cond: cond, Val: k}, jt: t, jf: f})
+}
+
+// jumpX compares A to X
+func (c *filterCompiler) jumpX(cond bpf.JumpTest, t, f int) {
+	c.add(filterInsn{insn: bpf.JumpIfX{Cond: cond}, jt: t, jf: f})
+}
+
+func (c *filterCompiler) goTo(label int) {
+	c.add(filterInsn{insn: bpf.Jump{}, jt: label, jf: -1})
+}
+
+func (c *filterCompiler) l3() uint32 {
+	return c.link.l3Off + c.vlan
+}
+
+// assemble resolves the labels
+func (c *filterCompiler) assemble() ([]bpf.Instruction, error) {
+	for {
+		positions := make(map[int]int)
+		for i, insn := range c.insns {
+			for _, label := range insn.labels {
+				positions[label] = i
+			}
+		}
+		// a conditional jump can only skip 255 instructions, the longer ones
+		// go through a jump right after them
+		var long *int
+		i := 0
+		for ; i < len(c.insns) && long == nil; i++ {
+			insn := &c.insns[i]
+			switch {
+			case insn.jf < 0:
+			case positions[insn.jt]-i-1 > 255:
+				long = &insn.jt
+			case positions[insn.jf]-i-1 > 255:
+				long = &insn.jf
+			}
+		}
+		if long != nil {
+			label := c.label()
+			trampoline := filterInsn{insn: bpf.Jump{}, labels: []int{label}, jt: *long, jf: -1}
+			*long = label
+			c.insns = append(c.insns[:i], append([]filterInsn{trampoline}, c.insns[i:]...)...)
+			continue
+		}
+
+		if len(c.insns) > bpfMaxInstructions {
+			return nil, fmt.Errorf("the filter is too long: %d instructions", len(c.insns))
+		}
+		out := make([]bpf.Instruction, len(c.insns))
+		for i, insn := range c.insns {
+			switch in := insn.insn.(type) {
+			case bpf.Jump:
+				in.Skip = uint32(positions[insn.jt] - i - 1)
+				out[i] = in
+			case bpf.JumpIf:
+				in.SkipTrue, in.SkipFalse = uint8(positions[insn.jt]-i-1), uint8(positions[insn.jf]-i-1)
+				out[i] = in
+			case bpf.JumpIfX:
+				in.SkipTrue, in.SkipFalse = uint8(positions[insn.jt]-i-1), uint8(positions[insn.jf]-i-1)
+				out[i] = in
+			default:
+				out[i] = in
+			}
+		}
+		return out, nil
+	}
+}
+
+// gen generates the code of a test, jumping to t if it matches and to f
+// otherwise
+func (c *filterCompiler) gen(node filterNode, t, f int) error {
+	switch n := node.(type) {
+	case *filterAnd:
+		mid := c.label()
+		if err := c.gen(n.left, mid, f); err != nil {
+			return err
+		}
+		c.place(mid)
+		return c.gen(n.right, t, f)
+	case *filterOr:
+		mid := c.label()
+		if err := c.gen(n.left, t, mid); err != nil {
+			return err
+		}
+		c.place(mid)
+		return c.gen(n.right, t, f)
+	case *filterNot:
+		return c.gen(n.node, f, t)
+	case *filterEtherType:
+		c.etherType(n.etherType, t, f)
+	case *filterIPProto:
+		mid := c.label()
+		if n.ipv6 {
+			c.etherType(0x86dd, mid, f)
+			c.place(mid)
+			c.emit(bpf.LoadAbsolute{Off: c.l3() + 6, Size: 1})
+		} else {
+			c.etherType(0x0800, mid, f)
+			c.place(mid)
+			c.emit(bpf.LoadAbsolute{Off: c.l3() + 9, Size: 1})
+		}
+		c.jump(bpf.JumpEqual, uint32(n.proto), t, f)
+	case *filterAddr:
+		mid := c.label()
+		c.etherType(n.etherType, mid, f)
+		c.place(mid)
+		c.direction(n.dir, t, f, func(src bool, t, f int) {
+			off := n.dst
+			if src {
+				off = n.src
+			}
+			c.addr(c.l3()+off, n.addr, n.mask, t, f)
+		})
+	case *filterEtherAddr:
+		if !c.link.vlan {
+			return fmt.Errorf("ether host is only supported on Ethernet")
+		}
+		c.direction(n.dir, t, f, func(src bool, t, f int) {
+			var off uint32
+			if src {
+				off = 6
+			}
+			c.addr(off, n.mac, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, t, f)
+		})
+	case *filterPort:
+		c.port(n, t, f)
+	case *filterVLAN:
+		if !c.link.vlan {
+			return fmt.Errorf("vlan is only supported on Ethernet")
+		}
+		off, tagged := c.link.etherTypeOff+int(c.vlan), c.label()
+		c.emit(bpf.LoadAbsolute{Off: uint32(off), Size: 2})
+		for i, tpid := range []uint32{0x8100, 0x88a8} {
+			next := c.label()
+			c.jump(bpf.JumpEqual, tpid, tagged, next)
+			c.place(next)
+			if i == 1 {
+				c.jump(bpf.JumpEqual, 0x9100, tagged, f)
+			}
+		}
+		c.place(tagged)
+		if n.id >= 0 {
+			c.emit(bpf.LoadAbsolute{Off: uint32(off) + 2, Size: 2}, bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0x0fff})
+			c.jump(bpf.JumpEqual, uint32(n.id), t, f)
+		} else {
+			c.goTo(t)
+		}
+		c.vlan += 4
+	case *filterRelation:
+		return c.relation(n, t, f)
+	default:
+		return fmt.Errorf("unexpected filter node %T", node)
+	}
+	return nil
+}
+
+// etherType checks the ethertype of the packet, or the IP version on the
+// links without one
+func (c *filterCompiler) etherType(etherType uint16, t, f int) {
+	if c.link.etherTypeOff >= 0 {
+		c.emit(bpf.LoadAbsolute{Off: uint32(c.link.etherTypeOff) + c.vlan, Size: 2})
+		c.jump(bpf.JumpEqual, uint32(etherType), t, f)
+		return
+	}
+	version := map[uint16]uint32{0x0800: 0x40, 0x86dd: 0x60}[etherType]
+	if version == 0 {
+		c.goTo(f)
+		return
+	}
+	c.emit(bpf.LoadAbsolute{Off: c.l3(), Size: 1}, bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xf0})
+	c.jump(bpf.JumpEqual, version, t, f)
+}
+
+// direction generates the tests of the source and the destination as
+// requested by dir
+func (c *filterCompiler) direction(dir string, t, f int, test func(src bool, t, f int)) {
+	switch dir {
+	case "src", "dst":
+		test(dir == "src", t, f)
+	case "src and dst":
+		mid := c.label()
+		test(true, mid, f)
+		c.place(mid)
+		test(false, t, f)
+	default:
+		mid := c.label()
+		test(true, t, mid)
+		c.place(mid)
+		test(false, t, f)
+	}
+}
+
+// addr compares the bytes at off with a masked address, 4 bytes at a time
+func (c *filterCompiler) addr(off uint32, addr, mask []byte, t, f int) {
+	type word struct {
+		off, size, val, mask uint32
+	}
+	var words []word
+	for i := 0; i < len(addr); {
+		size := 4
+		if len(addr)-i < 4 {
+			size = 2
+		}
+		w := word{off: off + uint32(i), size: uint32(size)}
+		for j := 0; j < size; j++ {
+			w.val = w.val<<8 | uint32(addr[i+j])
+			w.mask = w.mask<<8 | uint32(mask[i+j])
+		}
+		if w.mask != 0 {
+			words = append(words, w)
+		}
+		i += size
+	}
+	if len(words) == 0 {
+		c.goTo(t)
+		return
+	}
+	for i, w := range words {
+		c.emit(bpf.LoadAbsolute{Off: w.off, Size: int(w.size)})
+		if full := uint32(1)<<(8*w.size) - 1; w.mask != full {
+			c.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: w.mask})
+		}
+		next := t
+		if i < len(words)-1 {
+			next = c.label()
+		}
+		c.jump(bpf.JumpEqual, w.val, next, f)
+		if next != t {
+			c.place(next)
+		}
+	}
+}
+
+// fragment jumps to f if the IPv4 packet is a fragment other than the first
+func (c *filterCompiler) fragment(t, f int) {
+	c.emit(bpf.LoadAbsolute{Off: c.l3() + 6, Size: 2})
+	c.jump(bpf.JumpBitsSet, 0x1fff, f, t)
+}
+
+func (c *filterCompiler) port(n *filterPort, t, f int) {
+	mid := c.label()
+	protoOff, etherType := c.l3()+9, uint16(0x0800)
+	if n.ipv6 {
+		protoOff, etherType = c.l3()+6, 0x86dd
+	}
+	c.etherType(etherType, mid, f)
+	c.place(mid)
+	c.emit(bpf.LoadAbsolute{Off: protoOff, Size: 1})
+	proto := c.label()
+	for i, p := range n.protos {
+		next := f
+		if i < len(n.protos)-1 {
+			next = c.label()
+		}
+		c.jump(bpf.JumpEqual, uint32(p), proto, next)
+		if next != f {
+			c.place(next)
+		}
+	}
+	c.place(proto)
+	if !n.ipv6 {
+		mid = c.label()
+		c.fragment(mid, f)
+		c.place(mid)
+		c.emit(bpf.LoadMemShift{Off: c.l3()})
+	}
+	c.direction(n.dir, t, f, func(src bool, t, f int) {
+		var off uint32
+		if !src {
+			off = 2
+		}
+		if n.ipv6 {
+			c.emit(bpf.LoadAbsolute{Off: c.l3() + 40 + off, Size: 2})
+		} else {
+			c.emit(bpf.LoadIndirect{Off: c.l3() + off, Size: 2})
+		}
+		if n.lo == n.hi {
+			c.jump(bpf.JumpEqual, uint32(n.lo), t, f)
+			return
+		}
+		above := c.label()
+		c.jump(bpf.JumpGreaterOrEqual, uint32(n.lo), above, f)
+		c.place(above)
+		c.jump(bpf.JumpGreaterThan, uint32(n.hi), f, t)
+	})
+}
+
+// requirement checks that the packet has the header a relation loads from
+func (c *filterCompiler) requirement(proto string, t, f int) error {
+	switch proto {
+	case "ether":
+		if !c.link.vlan {
+			return fmt.Errorf("ether[] is only supported on Ethernet")
+		}
+		c.goTo(t)
+	case "ip", "ip6", "arp", "rarp":
+		c.etherType(filterEtherTypes[proto], t, f)
+	case "icmp6":
+		return c.gen(&filterIPProto{true, 58}, t, f)
+	default:
+		mid := c.label()
+		if err := c.gen(&filterIPProto{false, filterIPProtos[proto].proto}, mid, f); err != nil {
+			return err
+		}
+		c.place(mid)
+		c.fragment(t, f)
+	}
+	return nil
+}
+
+// loads lists the headers the loads of an expression read from
+func filterLoads(a filterArith, protos []string) []string {
+	switch n := a.(type) {
+	case *filterLoad:
+		for _, p := range protos {
+			if p == n.proto {
+				return filterLoads(n.off, protos)
+			}
+		}
+		return filterLoads(n.off, append(protos, n.proto))
+	case *filterBinary:
+		return filterLoads(n.right, filterLoads(n.left, protos))
+	}
+	return protos
+}
+
+func (c *filterCompiler) relation(n *filterRelation, t, f int) error {
+	for _, proto := range filterLoads(n.right, filterLoads(n.left, nil)) {
+		mid := c.label()
+		if err := c.requirement(proto, mid, f); err != nil {
+			return err
+		}
+		c.place(mid)
+	}
+	if k, ok := n.right.(*filterConst); ok {
+		if err := c.arith(n.left); err != nil {
+			return err
+		}
+		c.compare(n.op, func(cond bpf.JumpTest, t, f int) { c.jump(cond, k.k, t, f) }, t, f)
+		return nil
+	}
+	if err := c.arith(n.right); err != nil {
+		return err
+	}
+	slot, err := c.push()
+	if err != nil {
+		return err
+	}
+	if err := c.arith(n.left); err != nil {
+		return err
+	}
+	c.emit(bpf.LoadScratch{Dst: bpf.RegX, N: slot})
+	c.scratch--
+	c.compare(n.op, func(cond bpf.JumpTest, t, f int) { c.jumpX(cond, t, f) }, t, f)
+	return nil
+}
+
+func (c *filterCompiler) compare(op string, jump func(cond bpf.JumpTest, t, f int), t, f int) {
+	switch op {
+	case "=", "==":
+		jump(bpf.JumpEqual, t, f)
+	case "!=":
+		jump(bpf.JumpEqual, f, t)
+	case ">":
+		jump(bpf.JumpGreaterThan, t, f)
+	case ">=":
+		jump(bpf.JumpGreaterOrEqual, t, f)
+	case "<":
+		jump(bpf.JumpGreaterOrEqual, f, t)
+	case "<=":
+		jump(bpf.JumpGreaterThan, f, t)
+	}
+}
+
+// push stores A in the scratch memory
+func (c *filterCompiler) push() (int, error) {
+	if c.scratch >= 16 {
+		return 0, fmt.Errorf("the expression is too deep")
+	}
+	c.emit(bpf.StoreScratch{Src: bpf.RegA, N: c.scratch})
+	c.scratch++
+	return c.scratch - 1, nil
+}
+
+var filterALUOps = map[string]bpf.ALUOp{
+	"+": bpf.ALUOpAdd, "-": bpf.ALUOpSub, "*": bpf.ALUOpMul, "/": bpf.ALUOpDiv, "%": bpf.ALUOpMod,
+	"&": bpf.ALUOpAnd, "|": bpf.ALUOpOr, "^": bpf.ALUOpXor, "<<": bpf.ALUOpShiftLeft, ">>": bpf.ALUOpShiftRight,
+}
+
+// arith generates the code of an expression, leaving its value in A
+func (c *filterCompiler) arith(a filterArith) error {
+	switch n := a.(type) {
+	case *filterConst:
+		c.emit(bpf.LoadConstant{Dst: bpf.RegA, Val: n.k})
+	case *filterLen:
+		c.emit(bpf.LoadExtension{Num: bpf.ExtLen})
+	case *filterLoad:
+		return c.load(n)
+	case *filterBinary:
+		op := filterALUOps[n.op]
+		if k, ok := n.right.(*filterConst); ok {
+			if k.k == 0 && (n.op == "/" || n.op == "%") {
+				return fmt.Errorf("division by zero")
+			}
+			if err := c.arith(n.left); err != nil {
+				return err
+			}
+			c.emit(bpf.ALUOpConstant{Op: op, Val: k.k})
+			return nil
+		}
+		if err := c.arith(n.right); err != nil {
+			return err
+		}
+		slot, err := c.push()
+		if err != nil {
+			return err
+		}
+		if err := c.arith(n.left); err != nil {
+			return err
+		}
+		c.emit(bpf.LoadScratch{Dst: bpf.RegX, N: slot}, bpf.ALUOpX{Op: op})
+		c.scratch--
+	}
+	return nil
+}
+
+// load loads from a header. The transport headers of IPv4 are after the
+// options, at 4*(ip[0]&0xf).
+func (c *filterCompiler) load(n *filterLoad) error {
+	var base uint32
+	transport := false
+	switch n.proto {
+	case "ether":
+	case "ip", "ip6", "arp", "rarp":
+		base = c.l3()
+	case "icmp6":
+		base = c.l3() + 40
+	default:
+		base, transport = c.l3(), true
+	}
+	if k, ok := n.off.(*filterConst); ok {
+		if transport {
+			c.emit(bpf.LoadMemShift{Off: c.l3()}, bpf.LoadIndirect{Off: base + k.k, Size: int(n.size)})
+		} else {
+			c.emit(bpf.LoadAbsolute{Off: base + k.k, Size: int(n.size)})
+		}
+		return nil
+	}
+	if err := c.arith(n.off); err != nil {
+		return err
+	}
+	if transport {
+		slot, err := c.push()
+		if err != nil {
+			return err
+		}
+		c.emit(bpf.LoadMemShift{Off: c.l3()}, bpf.LoadScratch{Dst: bpf.RegA, N: slot}, bpf.ALUOpX{Op: bpf.ALUOpAdd})
+		c.scratch--
+	}
+	c.emit(bpf.TAX{}, bpf.LoadIndirect{Off: base, Size: int(n.size)})
+	return nil
+}
+
+// vim: foldmethod=marker
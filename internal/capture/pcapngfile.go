@@ -19,34 +19,41 @@ import (
 	"io"
 
 	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
 	"github.com/gopacket/gopacket/pcapgo"
-	log "github.com/sirupsen/logrus"
+	"github.com/mosajjal/dnsmonster/internal/util"
 )
 
 type pcapngFileHandle struct {
 	reader   *pcapgo.NgReader
 	file     io.Reader
+	filter   *bpfFilter
 	pktsRead uint
+	// the interfaces seen so far, by index
+	interfaces map[int]*util.CaptureInterface
 }
 
-func initializeOfflinePcapNg(f io.Reader, filter string) *pcapngFileHandle {
+func initializeOfflinePcapNg(f io.Reader, filter string) (*pcapngFileHandle, error) {
 
-	handle, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+	// each interface of a pcapng file can have its own link type
+	options := pcapgo.DefaultNgReaderOptions
+	options.WantMixedLinkType = true
+	handle, err := pcapgo.NewNgReader(f, options)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	// Set Filter
-	log.Warnf("BPF Filter is not supported in offline mode.")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	return &pcapngFileHandle{handle, f, 0}
+	// the filter is run in userspace for the link type of each interface
+	return &pcapngFileHandle{
+		reader:     handle,
+		file:       f,
+		filter:     newBPFFilter(filter),
+		interfaces: make(map[int]*util.CaptureInterface),
+	}, nil
 }
 
 func (h *pcapngFileHandle) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
-	data, ci, err = h.reader.ReadPacketData()
+	data, ci, err = h.filter.read(h.reader.ReadPacketData, h.linkType)
 	if err == nil {
 		h.pktsRead++
 	}
@@ -54,13 +61,34 @@ func (h *pcapngFileHandle) ReadPacketData() (data []byte, ci gopacket.CaptureInf
 }
 
 func (h *pcapngFileHandle) ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
-	data, ci, err = h.reader.ZeroCopyReadPacketData()
+	data, ci, err = h.filter.read(h.reader.ZeroCopyReadPacketData, h.linkType)
 	if err == nil {
 		h.pktsRead++
 	}
 	return
 }
 
+func (h *pcapngFileHandle) linkType(ci gopacket.CaptureInfo) layers.LinkType {
+	iface, err := h.reader.Interface(ci.InterfaceIndex)
+	if err != nil {
+		return h.reader.LinkType()
+	}
+	return iface.LinkType
+}
+
+func (h *pcapngFileHandle) captureInterface(ci gopacket.CaptureInfo) *util.CaptureInterface {
+	if iface, ok := h.interfaces[ci.InterfaceIndex]; ok {
+		return iface
+	}
+	iface := &util.CaptureInterface{Index: ci.InterfaceIndex}
+	if ngIface, err := h.reader.Interface(ci.InterfaceIndex); err == nil {
+		iface.Name = ngIface.Name
+		iface.Comment = ngIface.Comment
+	}
+	h.interfaces[ci.InterfaceIndex] = iface
+	return iface
+}
+
 func (h *pcapngFileHandle) Close() {
 	if c, ok := h.file.(io.Closer); ok {
 		c.Close()
@@ -0,0 +1,141 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// labels given to the well known ports when --port doesn't specify one
+var defaultPortLabels = map[uint16]string{
+	53:   "dns",
+	137:  "nbns",
+	853:  "dot",
+	5353: "mdns",
+	5355: "llmnr",
+}
+
+// portMatcher holds the ports selected by --port. index maps each port to
+// its label in labels, 0 meaning the port is not selected. The table is
+// 64KB and makes the lookup a single array access per packet.
+type portMatcher struct {
+	index  [math.MaxUint16 + 1]uint8
+	labels []string
+}
+
+// parsePorts parses a list of port specs in the form of PORT, PORT:LABEL,
+// FIRST-LAST or FIRST-LAST:LABEL. Each entry can also hold several specs
+// separated by a comma.
+func parsePorts(specs []string) (*portMatcher, error) {
+	p := &portMatcher{labels: []string{""}}
+	labelIndex := make(map[string]uint8)
+	for _, entry := range specs {
+		for _, spec := range strings.Split(entry, ",") {
+			spec = strings.TrimSpace(spec)
+			if spec == "" {
+				continue
+			}
+			portRange, label, _ := strings.Cut(spec, ":")
+			first, last, isRange := strings.Cut(portRange, "-")
+			if !isRange {
+				last = first
+			}
+			from, err := parsePort(first)
+			if err != nil {
+				return nil, err
+			}
+			to, err := parsePort(last)
+			if err != nil {
+				return nil, err
+			}
+			if from > to {
+				return nil, fmt.Errorf("invalid port range %s", portRange)
+			}
+			label = strings.ToLower(strings.TrimSpace(label))
+			if label == "" {
+				label = "dns"
+				if l, ok := defaultPortLabels[from]; ok && from == to {
+					label = l
+				}
+			}
+			idx, ok := labelIndex[label]
+			if !ok {
+				if len(p.labels) > math.MaxUint8 {
+					return nil, fmt.Errorf("too many port labels")
+				}
+				idx = uint8(len(p.labels))
+				p.labels = append(p.labels, label)
+				labelIndex[label] = idx
+			}
+			for port := uint32(from); port <= uint32(to); port++ {
+				p.index[port] = idx
+			}
+		}
+	}
+	if len(p.labels) == 1 {
+		return nil, fmt.Errorf("no port selected")
+	}
+	return p, nil
+}
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+	if err != nil || port == 0 {
+		return 0, fmt.Errorf("invalid port %q, ports must be between 1 and 65535", s)
+	}
+	return uint16(port), nil
+}
+
+// match returns the selected port out of src and dst and its label. If both
+// are selected, the lower one is returned since it's more likely to be the
+// server side of the conversation.
+func (p *portMatcher) match(src, dst uint16) (uint16, string, bool) {
+	srcIdx, dstIdx := p.index[src], p.index[dst]
+	switch {
+	case srcIdx != 0 && dstIdx != 0:
+		if src < dst {
+			return src, p.labels[srcIdx], true
+		}
+		return dst, p.labels[dstIdx], true
+	case dstIdx != 0:
+		return dst, p.labels[dstIdx], true
+	case srcIdx != 0:
+		return src, p.labels[srcIdx], true
+	}
+	return 0, "", false
+}
+
+// ranges returns the selected ports as a sorted list of FIRST-LAST ranges,
+// for the filters that can't use the table
+func (p *portMatcher) ranges() [][2]uint16 {
+	var ranges [][2]uint16
+	for port := 1; port <= math.MaxUint16; port++ {
+		if p.index[port] == 0 {
+			continue
+		}
+		if n := len(ranges); n > 0 && int(ranges[n-1][1]) == port-1 {
+			ranges[n-1][1] = uint16(port)
+			continue
+		}
+		ranges = append(ranges, [2]uint16{uint16(port), uint16(port)})
+	}
+	return ranges
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,73 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"reflect"
+	"testing"
+)
+
+func mustParsePorts(specs ...string) *portMatcher {
+	p, err := parsePorts(specs)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func TestParsePorts(t *testing.T) {
+	p := mustParsePorts("53, 5353", "5355,8000-8100:Internal", "853:dot")
+	tests := []struct {
+		src, dst  uint16
+		wantPort  uint16
+		wantLabel string
+		wantOK    bool
+	}{
+		{40000, 53, 53, "dns", true},
+		{53, 40000, 53, "dns", true},
+		{5353, 5353, 5353, "mdns", true},
+		{40000, 5355, 5355, "llmnr", true},
+		{40000, 8050, 8050, "internal", true},
+		{8100, 8000, 8000, "internal", true},
+		{853, 40000, 853, "dot", true},
+		{40000, 8101, 0, "", false},
+		{40000, 443, 0, "", false},
+	}
+	for _, tt := range tests {
+		port, label, ok := p.match(tt.src, tt.dst)
+		if port != tt.wantPort || label != tt.wantLabel || ok != tt.wantOK {
+			t.Errorf("match(%d, %d) = %d, %q, %v, want %d, %q, %v", tt.src, tt.dst, port, label, ok, tt.wantPort, tt.wantLabel, tt.wantOK)
+		}
+	}
+}
+
+func TestParsePortsErrors(t *testing.T) {
+	for _, spec := range []string{"", "0", "65536", "dns", "100-50", "53-", ","} {
+		if _, err := parsePorts([]string{spec}); err == nil {
+			t.Errorf("expected an error parsing %q", spec)
+		}
+	}
+}
+
+func TestPortRanges(t *testing.T) {
+	got := mustParsePorts("53,54,853", "8000-8100:internal", "8101", "65535").ranges()
+	want := [][2]uint16{{53, 54}, {853, 853}, {8000, 8101}, {65535, 65535}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,385 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+)
+
+// The Initial packets of QUIC are encrypted with keys derived from the
+// destination connection ID and a salt that is public and specific to each
+// version, so anyone on the path can decrypt them and read the ClientHello
+// they carry (RFC 9001 section 5.2).
+type quicVersion struct {
+	salt        []byte
+	initialType byte // long header packet type of the Initial packets
+	keyLabel    string
+	ivLabel     string
+	hpLabel     string
+}
+
+var quicVersions = map[uint32]quicVersion{
+	// QUIC v1, RFC 9001
+	0x00000001: {
+		salt:     []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a},
+		keyLabel: "quic key", ivLabel: "quic iv", hpLabel: "quic hp",
+	},
+	// QUIC v2, RFC 9369
+	0x6b3343cf: {
+		salt:        []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9},
+		initialType: 0x01,
+		keyLabel:    "quicv2 key", ivLabel: "quicv2 iv", hpLabel: "quicv2 hp",
+	},
+	// draft-29, still sent by some older clients
+	0xff00001d: {
+		salt:     []byte{0xaf, 0xbf, 0xec, 0x28, 0x99, 0x93, 0xd2, 0x4c, 0x9e, 0x97, 0x86, 0xf1, 0x9c, 0x61, 0x11, 0xe0, 0x43, 0x90, 0xa8, 0x99},
+		keyLabel: "quic key", ivLabel: "quic iv", hpLabel: "quic hp",
+	},
+}
+
+var errQUICMalformed = errors.New("malformed QUIC packet")
+
+const (
+	quicFramePadding = 0x00
+	quicFramePing    = 0x01
+	quicFrameAck     = 0x02
+	quicFrameAckECN  = 0x03
+	quicFrameCrypto  = 0x06
+)
+
+// hkdfExpandLabel is HKDF-Expand-Label of TLS 1.3 (RFC 8446 section 7.1)
+// with an empty context
+func hkdfExpandLabel(secret []byte, label string, length int) ([]byte, error) {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label))
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+	return hkdf.Expand(sha256.New, secret, string(info), length)
+}
+
+// quicClientInitialKeys derives the key, IV and header protection key the
+// client uses for its Initial packets
+func quicClientInitialKeys(v quicVersion, dcid []byte) (key, iv, hp []byte, err error) {
+	initial, err := hkdf.Extract(sha256.New, dcid, v.salt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	client, err := hkdfExpandLabel(initial, "client in", sha256.Size)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if key, err = hkdfExpandLabel(client, v.keyLabel, 16); err != nil {
+		return nil, nil, nil, err
+	}
+	if iv, err = hkdfExpandLabel(client, v.ivLabel, 12); err != nil {
+		return nil, nil, nil, err
+	}
+	hp, err = hkdfExpandLabel(client, v.hpLabel, 16)
+	return key, iv, hp, err
+}
+
+// quicVarint reads a variable length integer (RFC 9000 section 16)
+func quicVarint(b []byte) (uint64, int, bool) {
+	if len(b) == 0 {
+		return 0, 0, false
+	}
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0, false
+	}
+	v := uint64(b[0] & 0x3f)
+	for _, c := range b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, n, true
+}
+
+// quicInitial is a decrypted client Initial packet
+type quicInitial struct {
+	dcid    []byte
+	payload []byte
+}
+
+// decryptQUICInitial removes the header protection of the Initial packet at
+// the beginning of datagram and decrypts its payload. It returns the packet
+// and the rest of the datagram, since packets can be coalesced.
+func decryptQUICInitial(datagram []byte) (*quicInitial, []byte, error) {
+	// long header with the fixed bit set
+	if len(datagram) < 7 || datagram[0]&0xc0 != 0xc0 {
+		return nil, nil, errQUICMalformed
+	}
+	v, ok := quicVersions[binary.BigEndian.Uint32(datagram[1:])]
+	if !ok || (datagram[0]>>4)&0x03 != v.initialType {
+		return nil, nil, errQUICMalformed
+	}
+	offset := 5
+	dcidLen := int(datagram[offset])
+	if dcidLen > 20 || offset+1+dcidLen >= len(datagram) {
+		return nil, nil, errQUICMalformed
+	}
+	dcid := datagram[offset+1 : offset+1+dcidLen]
+	offset += 1 + dcidLen
+	scidLen := int(datagram[offset])
+	offset += 1 + scidLen
+	if offset >= len(datagram) {
+		return nil, nil, errQUICMalformed
+	}
+	tokenLen, n, ok := quicVarint(datagram[offset:])
+	if !ok || uint64(offset+n)+tokenLen > uint64(len(datagram)) {
+		return nil, nil, errQUICMalformed
+	}
+	offset += n + int(tokenLen)
+	length, n, ok := quicVarint(datagram[offset:])
+	if !ok {
+		return nil, nil, errQUICMalformed
+	}
+	pnOffset := offset + n
+	end := uint64(pnOffset) + length
+	// the header protection sample starts 4 bytes after the packet number
+	if end > uint64(len(datagram)) || pnOffset+4+16 > int(end) {
+		return nil, nil, errQUICMalformed
+	}
+
+	key, iv, hpKey, err := quicClientInitialKeys(v, dcid)
+	if err != nil {
+		return nil, nil, err
+	}
+	hp, err := aes.NewCipher(hpKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	var mask [aes.BlockSize]byte
+	hp.Encrypt(mask[:], datagram[pnOffset+4:pnOffset+4+16])
+
+	// work on a copy, the packet is still needed as is by the other consumers
+	packet := append([]byte{}, datagram[:end]...)
+	packet[0] ^= mask[0] & 0x0f
+	pnLen := int(packet[0]&0x03) + 1
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(packet[pnOffset+i])
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := append([]byte{}, iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	header := packet[:pnOffset+pnLen]
+	payload, err := aead.Open(nil, nonce, packet[pnOffset+pnLen:], header)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &quicInitial{dcid: append([]byte{}, dcid...), payload: payload}, datagram[end:], nil
+}
+
+// quicCryptoFrames returns the CRYPTO frames of a decrypted Initial payload
+// keyed by their offset in the crypto stream
+func quicCryptoFrames(payload []byte) (map[uint64][]byte, error) {
+	frames := make(map[uint64][]byte)
+	for len(payload) > 0 {
+		switch payload[0] {
+		case quicFramePadding, quicFramePing:
+			payload = payload[1:]
+		case quicFrameAck, quicFrameAckECN:
+			// type, largest acknowledged, delay, range count, first range
+			ecn := payload[0] == quicFrameAckECN
+			payload = payload[1:]
+			var fields [4]uint64
+			for i := range fields {
+				v, n, ok := quicVarint(payload)
+				if !ok {
+					return nil, errQUICMalformed
+				}
+				fields[i] = v
+				payload = payload[n:]
+			}
+			skip := 2 * fields[2]
+			if ecn {
+				skip += 3
+			}
+			for ; skip > 0; skip-- {
+				_, n, ok := quicVarint(payload)
+				if !ok {
+					return nil, errQUICMalformed
+				}
+				payload = payload[n:]
+			}
+		case quicFrameCrypto:
+			offset, n, ok := quicVarint(payload[1:])
+			if !ok {
+				return nil, errQUICMalformed
+			}
+			payload = payload[1+n:]
+			length, n, ok := quicVarint(payload)
+			if !ok || uint64(n)+length > uint64(len(payload)) {
+				return nil, errQUICMalformed
+			}
+			frames[offset] = payload[n : n+int(length)]
+			payload = payload[n+int(length):]
+		default:
+			// nothing else is expected in a client Initial before the ClientHello
+			return frames, nil
+		}
+	}
+	return frames, nil
+}
+
+// Initial packets are tracked by the client and the destination connection
+// ID the client picked, which doesn't change until the server answers
+type quicFlowKey struct {
+	src     [16]byte
+	srcPort uint16
+	dcid    string
+}
+
+type quicFlow struct {
+	crypto   map[uint64][]byte
+	size     int
+	lastSeen time.Time
+}
+
+// assemble returns the contiguous beginning of the crypto stream
+func (f *quicFlow) assemble() []byte {
+	var stream []byte
+	for {
+		progress := false
+		for offset, data := range f.crypto {
+			end := offset + uint64(len(data))
+			if offset <= uint64(len(stream)) && end > uint64(len(stream)) {
+				stream = append(stream, data[uint64(len(stream))-offset:]...)
+				progress = true
+			}
+		}
+		if !progress {
+			return stream
+		}
+	}
+}
+
+// quicClientHello parses the ClientHello at the beginning of the crypto
+// stream. Unlike TLS over TCP, there's no record layer in QUIC.
+func quicClientHello(stream []byte) (*clientHello, error) {
+	if len(stream) < 4 {
+		return nil, errTLSIncomplete
+	}
+	if stream[0] != tlsHandshakeClientHello {
+		return nil, errTLSMalformed
+	}
+	msgLen := int(stream[1])<<16 | int(stream[2])<<8 | int(stream[3])
+	if len(stream) < 4+msgLen {
+		return nil, errTLSIncomplete
+	}
+	return parseClientHello(stream[4 : 4+msgLen])
+}
+
+// quicHello feeds a UDP datagram sent to a QUIC server to the detector and
+// returns the ClientHello once it's complete. Large ClientHellos are split
+// over several Initial packets, and the CRYPTO frames can arrive in any order.
+func (e *encryptedDNSDetector) quicHello(udp *layers.UDP, timestamp time.Time, SrcIP net.IP) *clientHello {
+	datagram := udp.Payload
+	for len(datagram) > 0 {
+		initial, rest, err := decryptQUICInitial(datagram)
+		if err != nil {
+			return nil
+		}
+		datagram = rest
+		frames, err := quicCryptoFrames(initial.payload)
+		if err != nil || len(frames) == 0 {
+			continue
+		}
+		if hello := e.quicCrypto(quicFlowKey{src: ipToKey(SrcIP), srcPort: uint16(udp.SrcPort), dcid: string(initial.dcid)}, frames, timestamp); hello != nil {
+			return hello
+		}
+	}
+	return nil
+}
+
+// quicCrypto adds the CRYPTO frames of an Initial packet to its flow
+func (e *encryptedDNSDetector) quicCrypto(key quicFlowKey, frames map[uint64][]byte, timestamp time.Time) *clientHello {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.sweep(timestamp)
+	flow, ok := e.quicFlows[key]
+	if !ok {
+		flow = &quicFlow{crypto: make(map[uint64][]byte)}
+	}
+	for offset, data := range frames {
+		if _, dup := flow.crypto[offset]; !dup && flow.size+len(data) <= maxHelloSize {
+			flow.crypto[offset] = append([]byte{}, data...)
+			flow.size += len(data)
+		}
+	}
+	flow.lastSeen = timestamp
+
+	hello, err := quicClientHello(flow.assemble())
+	if err == errTLSIncomplete && flow.size < maxHelloSize {
+		if !ok {
+			if len(e.quicFlows) >= maxHelloFlows {
+				e.untracked.Inc(1)
+				return nil
+			}
+			e.quicFlows[key] = flow
+		}
+		return nil
+	}
+	delete(e.quicFlows, key)
+	if err != nil {
+		return nil
+	}
+	return hello
+}
+
+// processEncryptedDNSQUIC looks for DoQ and DoH3 connections in a UDP datagram
+func (config *captureConfig) processEncryptedDNSQUIC(udp *layers.UDP, timestamp time.Time, IPVersion uint8, SrcIP, DstIP net.IP, meta *packetMeta) {
+	dstPort := uint16(udp.DstPort)
+	if !isEncryptedDNSPort(dstPort) {
+		return
+	}
+	hello := config.encryptedDNS.quicHello(udp, timestamp, SrcIP)
+	if hello == nil {
+		return
+	}
+	transport, resolver, ok := config.encryptedDNS.classify(hello, DstIP, dstPort, true)
+	if !ok {
+		return
+	}
+	config.encryptedDNS.detected.Inc(1)
+	res := encryptedDNSResult(hello, transport, resolver, timestamp, IPVersion, SrcIP, DstIP, uint16(udp.SrcPort), dstPort, "udp")
+	meta.annotate(&res)
+	config.sendResult(res)
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,218 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/mosajjal/dnsmonster/internal/util"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// the client Initial keys of RFC 9001 appendix A.1
+func TestQUICInitialKeys(t *testing.T) {
+	key, iv, hp, err := quicClientInitialKeys(quicVersions[0x00000001], mustHex(t, "8394c8f03e515708"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(key) != "1f369613dd76d5467730efcbe3b1a22d" ||
+		hex.EncodeToString(iv) != "fa044b2f42a3fd3b46fb255c" ||
+		hex.EncodeToString(hp) != "9f50449e04a0e810283a1e9933adedd2" {
+		t.Errorf("unexpected keys %x %x %x", key, iv, hp)
+	}
+	// header protection mask of appendix A.2
+	block, _ := aes.NewCipher(hp)
+	var mask [aes.BlockSize]byte
+	block.Encrypt(mask[:], mustHex(t, "d1b1c98dd7689fb8ec11d242b123dc9b"))
+	if hex.EncodeToString(mask[:5]) != "437b9aec36" {
+		t.Errorf("unexpected header protection mask %x", mask[:5])
+	}
+}
+
+func appendQUICVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return binary.BigEndian.AppendUint16(b, uint16(v)|0x4000)
+	}
+	return binary.BigEndian.AppendUint32(b, uint32(v)|0x80000000)
+}
+
+// sealQUICInitial builds a protected client Initial packet the way a client
+// does, padded to the minimum size of 1200 bytes
+func sealQUICInitial(t *testing.T, version uint32, dcid []byte, pn uint32, frames []byte) []byte {
+	v := quicVersions[version]
+	key, iv, hpKey, err := quicClientInitialKeys(v, dcid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := []byte{0xc0 | v.initialType<<4 | 0x03}
+	header = binary.BigEndian.AppendUint32(header, version)
+	header = append(header, byte(len(dcid)))
+	header = append(header, dcid...)
+	header = append(header, 0, 0) // no source connection ID, no token
+	frames = append(frames, make([]byte, max(0, 1100-len(frames)))...)
+	header = appendQUICVarint(header, uint64(4+len(frames)+16))
+	pnOffset := len(header)
+	header = binary.BigEndian.AppendUint32(header, pn)
+
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	nonce := append([]byte{}, iv...)
+	for i := 0; i < 4; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	packet := aead.Seal(header, nonce, frames, header)
+
+	hp, _ := aes.NewCipher(hpKey)
+	var mask [aes.BlockSize]byte
+	hp.Encrypt(mask[:], packet[pnOffset+4:pnOffset+20])
+	packet[0] ^= mask[0] & 0x0f
+	for i := 0; i < 4; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+	return packet
+}
+
+func cryptoFrame(offset int, data []byte) []byte {
+	frame := appendQUICVarint([]byte{quicFrameCrypto}, uint64(offset))
+	frame = appendQUICVarint(frame, uint64(len(data)))
+	return append(frame, data...)
+}
+
+// testQUICHandshake returns the ClientHello handshake message of crypto/tls,
+// without the TLS record header
+func testQUICHandshake(t *testing.T, serverName string, alpn ...string) []byte {
+	record := testClientHello(t, serverName, alpn...)
+	return record[5 : 5+int(binary.BigEndian.Uint16(record[3:]))]
+}
+
+func TestDecryptQUICInitial(t *testing.T) {
+	handshake := testQUICHandshake(t, "dns.adguard-dns.com", "doq")
+	dcid := mustHex(t, "0011223344556677")
+	for _, version := range []uint32{0x00000001, 0x6b3343cf, 0xff00001d} {
+		packet := sealQUICInitial(t, version, dcid, 0, cryptoFrame(0, handshake))
+		initial, rest, err := decryptQUICInitial(packet)
+		if err != nil {
+			t.Fatalf("version %x: %v", version, err)
+		}
+		if len(rest) != 0 || !bytes.Equal(initial.dcid, dcid) {
+			t.Errorf("version %x: unexpected dcid %x or trailing data", version, initial.dcid)
+		}
+		frames, err := quicCryptoFrames(initial.payload)
+		if err != nil || !bytes.Equal(frames[0], handshake) {
+			t.Errorf("version %x: CRYPTO frame not recovered: %v", version, err)
+		}
+	}
+
+	// a corrupted packet fails authentication
+	packet := sealQUICInitial(t, 0x00000001, dcid, 0, cryptoFrame(0, handshake))
+	packet[len(packet)-1] ^= 0xff
+	if _, _, err := decryptQUICInitial(packet); err == nil {
+		t.Error("corrupted packet was decrypted")
+	}
+	// short header packets are ignored
+	if _, _, err := decryptQUICInitial([]byte{0x40, 1, 2, 3, 4, 5, 6, 7}); err == nil {
+		t.Error("short header packet was decrypted")
+	}
+}
+
+func TestProcessEncryptedDNSQUIC(t *testing.T) {
+	resolvers, _ := newResolverList(defaultEncryptedDNSResolvers)
+	config := captureConfig{
+		ports:         mustParsePorts("53"),
+		encryptedDNS:  newEncryptedDNSDetector(resolvers),
+		resultChannel: make(chan util.DNSResult, 10),
+		tcpAssembly:   []chan tcpPacket{make(chan tcpPacket, 10)},
+	}
+	srcIP := net.ParseIP("10.0.0.1").To4()
+	dstIP := net.ParseIP("203.0.113.9").To4()
+	flow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(srcIP), layers.NewIPEndpoint(dstIP))
+	foundLayers := []gopacket.LayerType{layers.LayerTypeUDP}
+
+	send := func(handshake []byte, dstPort layers.UDPPort) {
+		// split the ClientHello over two Initial packets, the second half first
+		dcid := mustHex(t, "a1b2c3d4e5f60718")
+		half := len(handshake) / 2
+		for pn, frame := range [][]byte{cryptoFrame(half, handshake[half:]), cryptoFrame(0, handshake[:half])} {
+			udp := &layers.UDP{SrcPort: 50000, DstPort: dstPort}
+			udp.Payload = sealQUICInitial(t, 0x00000001, dcid, uint32(pn), frame)
+			config.processTransport(&foundLayers, udp, &layers.TCP{}, flow, time.Now(), 4, srcIP, dstIP, nil)
+		}
+	}
+
+	send(testQUICHandshake(t, "dns.google", "h3"), httpsPort)
+	select {
+	case result := <-config.resultChannel:
+		e := result.EncryptedDNS
+		if e == nil || e.Transport != "doh3" || e.SNI != "dns.google" || len(e.ALPN) != 1 || e.ALPN[0] != "h3" {
+			t.Fatalf("unexpected encrypted DNS record %+v", e)
+		}
+		if result.Protocol != "udp" || e.JA4[0] != 'q' {
+			t.Errorf("unexpected protocol %s or JA4 %s", result.Protocol, e.JA4)
+		}
+	default:
+		t.Fatal("DoH3 connection was not detected")
+	}
+
+	send(testQUICHandshake(t, "www.example.com", "h3"), httpsPort)
+	if len(config.resultChannel) != 0 {
+		t.Error("HTTP/3 to an unknown server should not be reported")
+	}
+
+	send(testQUICHandshake(t, "resolver.example.net", "doq"), dotPort)
+	select {
+	case result := <-config.resultChannel:
+		if result.EncryptedDNS == nil || result.EncryptedDNS.Transport != "doq" || result.AppProtocol != "doq" {
+			t.Errorf("unexpected DoQ record %+v", result.EncryptedDNS)
+		}
+	default:
+		t.Fatal("DoQ connection was not detected")
+	}
+	if len(config.encryptedDNS.quicFlows) != 0 {
+		t.Errorf("%d QUIC flows left behind", len(config.encryptedDNS.quicFlows))
+	}
+
+	// a SPAN port duplicating the Initial packets reports the connection once
+	config.dedup = newDedupWindow(time.Second, 100)
+	udp := &layers.UDP{SrcPort: 50001, DstPort: dotPort}
+	udp.Payload = sealQUICInitial(t, 0x00000001, mustHex(t, "0102030405060708"), 0, cryptoFrame(0, testQUICHandshake(t, "dns.adguard-dns.com", "doq")))
+	for range 2 {
+		config.processTransport(&foundLayers, udp, &layers.TCP{}, flow, time.Now(), 4, srcIP, dstIP, nil)
+	}
+	if len(config.resultChannel) != 1 {
+		t.Errorf("%d records for a duplicated Initial packet", len(config.resultChannel))
+	}
+}
+
+// vim: foldmethod=marker
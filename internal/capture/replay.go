@@ -0,0 +1,105 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"context"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/mosajjal/dnsmonster/internal/util"
+)
+
+// replayHandle replays the packets of an offline handler at the pace of
+// their capture timestamps, sped up by speed, so the time based features
+// like the dedup window or the output batches behave like on a live
+// capture. A speed of 0 reads the packets as fast as possible. With rebase,
+// the timestamps are moved so the first packet happened when it was read,
+// and scaled by the speed.
+type replayHandle struct {
+	handle genericPacketHandler
+	ctx    context.Context
+	speed  float64
+	rebase bool
+	// the time the first packet was read, and its timestamp
+	start time.Time
+	first time.Time
+}
+
+func newReplayHandle(ctx context.Context, handle genericPacketHandler, speed float64, rebase bool) *replayHandle {
+	return &replayHandle{handle: handle, ctx: ctx, speed: speed, rebase: rebase}
+}
+
+func (h *replayHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return h.pace(h.handle.ReadPacketData())
+}
+
+func (h *replayHandle) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return h.pace(h.handle.ZeroCopyReadPacketData())
+}
+
+// pace waits until the time of a packet comes. The packets older than the
+// previous ones are handed out straight away.
+func (h *replayHandle) pace(data []byte, ci gopacket.CaptureInfo, err error) ([]byte, gopacket.CaptureInfo, error) {
+	if err != nil {
+		return data, ci, err
+	}
+	if h.start.IsZero() {
+		h.start, h.first = time.Now(), ci.Timestamp
+	}
+	offset := ci.Timestamp.Sub(h.first)
+	if h.speed > 0 {
+		offset = time.Duration(float64(offset) / h.speed)
+		if wait := time.Until(h.start.Add(offset)); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-h.ctx.Done():
+				timer.Stop()
+				return nil, ci, h.ctx.Err()
+			case <-timer.C:
+			}
+		}
+	}
+	if h.rebase {
+		ci.Timestamp = h.start.Add(offset)
+	}
+	return data, ci, nil
+}
+
+func (h *replayHandle) linkType(ci gopacket.CaptureInfo) layers.LinkType {
+	if handle, ok := h.handle.(linkTypeHandler); ok {
+		return handle.linkType(ci)
+	}
+	return layers.LinkTypeEthernet
+}
+
+func (h *replayHandle) captureInterface(ci gopacket.CaptureInfo) *util.CaptureInterface {
+	if handle, ok := h.handle.(interfaceHandler); ok {
+		return handle.captureInterface(ci)
+	}
+	return nil
+}
+
+func (h *replayHandle) Close() {
+	h.handle.Close()
+}
+
+func (h *replayHandle) Stat() (uint, uint, error) {
+	return h.handle.Stat()
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,115 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+)
+
+// timestampHandler hands out empty packets with the given timestamps
+type timestampHandler struct {
+	timestamps []time.Time
+	read       uint
+}
+
+func (h *timestampHandler) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if int(h.read) == len(h.timestamps) {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	h.read++
+	return []byte{0}, gopacket.CaptureInfo{Timestamp: h.timestamps[h.read-1]}, nil
+}
+
+func (h *timestampHandler) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return h.ReadPacketData()
+}
+
+func (h *timestampHandler) Close()                    {}
+func (h *timestampHandler) Stat() (uint, uint, error) { return h.read, 0, nil }
+
+func TestReplayHandle(t *testing.T) {
+	captured := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	// the third packet is out of order and doesn't wait
+	timestamps := []time.Time{captured, captured.Add(200 * time.Millisecond), captured.Add(100 * time.Millisecond), captured.Add(400 * time.Millisecond)}
+
+	tests := []struct {
+		name    string
+		speed   float64
+		rebase  bool
+		minTime time.Duration
+		maxTime time.Duration
+	}{
+		{"as fast as possible", 0, false, 0, 50 * time.Millisecond},
+		{"original speed", 1, false, 400 * time.Millisecond, time.Second},
+		{"twice as fast", 2, false, 200 * time.Millisecond, 350 * time.Millisecond},
+		{"rebased", 2, true, 200 * time.Millisecond, 350 * time.Millisecond},
+		{"rebased as fast as possible", 0, true, 0, 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		h := newReplayHandle(context.Background(), &timestampHandler{timestamps: timestamps}, tt.speed, tt.rebase)
+		start := time.Now()
+		var got []time.Time
+		for {
+			_, ci, err := h.ReadPacketData()
+			if err != nil {
+				break
+			}
+			got = append(got, ci.Timestamp)
+		}
+		if elapsed := time.Since(start); elapsed < tt.minTime || elapsed > tt.maxTime {
+			t.Errorf("%s: replayed in %s", tt.name, elapsed)
+		}
+		if len(got) != len(timestamps) {
+			t.Fatalf("%s: %d packets replayed", tt.name, len(got))
+		}
+		if !tt.rebase {
+			for i := range got {
+				if !got[i].Equal(timestamps[i]) {
+					t.Errorf("%s: timestamp %d changed to %s", tt.name, i, got[i])
+				}
+			}
+			continue
+		}
+		if got[0].Before(start) || got[0].Sub(start) > 50*time.Millisecond {
+			t.Errorf("%s: the first packet is rebased to %s, started at %s", tt.name, got[0], start)
+		}
+		speed := tt.speed
+		if speed == 0 {
+			speed = 1
+		}
+		if want := time.Duration(float64(400*time.Millisecond) / speed); got[3].Sub(got[0]) != want {
+			t.Errorf("%s: the last packet is %s after the first, want %s", tt.name, got[3].Sub(got[0]), want)
+		}
+	}
+
+	// a replay waiting for a packet stops with the input
+	ctx, cancel := context.WithCancel(context.Background())
+	h := newReplayHandle(ctx, &timestampHandler{timestamps: []time.Time{captured, captured.Add(time.Hour)}}, 1, false)
+	if _, _, err := h.ReadPacketData(); err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, _, err := h.ReadPacketData(); err != context.Canceled {
+		t.Errorf("the replay returned %v once stopped", err)
+	}
+}
+
+// vim: foldmethod=marker
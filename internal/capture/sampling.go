@@ -0,0 +1,218 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mosajjal/dnsmonster/internal/util"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	cmsDepth = 4
+	cmsWidth = 1 << 16
+)
+
+// countMinSketch is a fixed size frequency estimator. The counters are
+// updated atomically so a single sketch can be shared between all the
+// packet handler workers.
+type countMinSketch struct {
+	rows [cmsDepth][]uint32
+}
+
+func newCountMinSketch() *countMinSketch {
+	c := &countMinSketch{}
+	for i := range c.rows {
+		c.rows[i] = make([]uint32, cmsWidth)
+	}
+	return c
+}
+
+// the row indexes are derived from a single 64bit hash using double hashing
+func cmsIndex(h uint64, row int) uint64 {
+	return (uint64(uint32(h)) + uint64(row)*(h>>32)) % cmsWidth
+}
+
+// add increments the counters of h and returns its new estimated count
+func (c *countMinSketch) add(h uint64) uint32 {
+	estimate := uint32(math.MaxUint32)
+	for i := range c.rows {
+		if v := atomic.AddUint32(&c.rows[i][cmsIndex(h, i)], 1); v < estimate {
+			estimate = v
+		}
+	}
+	return estimate
+}
+
+func (c *countMinSketch) estimate(h uint64) uint32 {
+	estimate := uint32(math.MaxUint32)
+	for i := range c.rows {
+		if v := atomic.LoadUint32(&c.rows[i][cmsIndex(h, i)]); v < estimate {
+			estimate = v
+		}
+	}
+	return estimate
+}
+
+// adaptiveSampler keeps every record of the domains seen less than threshold
+// times in a window, and samples the more frequent ones with a probability
+// of threshold/count. Two sketches are rotated every window so the counts
+// follow the traffic without growing forever.
+type adaptiveSampler struct {
+	mu        sync.RWMutex
+	threshold float64
+	current   *countMinSketch
+	previous  *countMinSketch
+}
+
+func newAdaptiveSampler(threshold uint) *adaptiveSampler {
+	return &adaptiveSampler{
+		threshold: float64(threshold),
+		current:   newCountMinSketch(),
+		previous:  newCountMinSketch(),
+	}
+}
+
+// mix64 is the splitmix64 finalizer. used to turn a hash into a uniformly
+// distributed number for the keep decision
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// sample counts qname and decides whether the record is kept. the returned
+// weight is the inverse of the probability the record was kept with.
+func (a *adaptiveSampler) sample(qname string, id uint16) (bool, float64) {
+	h := FNV1A([]byte(strings.ToLower(qname)))
+	a.mu.RLock()
+	count := a.current.add(h)
+	if prev := a.previous.estimate(h); prev > count {
+		count = prev
+	}
+	a.mu.RUnlock()
+
+	if float64(count) <= a.threshold {
+		return true, 1
+	}
+	probability := a.threshold / float64(count)
+	// the decision is a function of the question and the transaction ID, so
+	// a query and its response are kept or dropped together
+	draw := float64(mix64(h^uint64(id)*0x9e3779b97f4a7c15)>>11) / (1 << 53)
+	if draw < probability {
+		return true, 1 / probability
+	}
+	return false, 0
+}
+
+func (a *adaptiveSampler) rotate() {
+	fresh := newCountMinSketch()
+	a.mu.Lock()
+	a.previous, a.current = a.current, fresh
+	a.mu.Unlock()
+}
+
+func (a *adaptiveSampler) run(ctx context.Context, window time.Duration) error {
+	log.Infof("adaptive sampling is enabled with a threshold of %v per %s", a.threshold, window)
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.rotate()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// flowHash returns a hash of the flow res belongs to. The hash has no seed and
+// only depends on the packet content, so every sensor seeing the same flow
+// comes to the same decision. The client and server are picked based on the
+// QR bit so a query and its response hash the same.
+func flowHash(res *util.DNSResult, clientOnly bool) uint64 {
+	client, server := res.SrcIP, res.DstIP
+	clientPort, serverPort := res.SrcPort, res.DstPort
+	if res.DNS.Response {
+		client, server = server, client
+		clientPort, serverPort = serverPort, clientPort
+	}
+	buf := make([]byte, 0, 48)
+	buf = append(buf, client.To16()...)
+	if !clientOnly {
+		buf = append(buf, server.To16()...)
+		buf = binary.BigEndian.AppendUint16(buf, clientPort)
+		buf = binary.BigEndian.AppendUint16(buf, serverPort)
+		buf = append(buf, res.Protocol...)
+	}
+	return mix64(FNV1A(buf))
+}
+
+// keepRatio advances the packet counter of the a:b ratio sampling and tells
+// if the packet is kept. The first a packets of every b are, so the weight of
+// the kept ones is exactly b/a.
+func keepRatio(count *int, a, b int) bool {
+	*count = *count%b + 1
+	return *count <= a
+}
+
+// scaleSampleWeight multiplies the sample weight of res by weight. The weight
+// of a record kept by the sample ratio of its input is already set, the two
+// samplings stack.
+func scaleSampleWeight(res *util.DNSResult, weight float64) {
+	if res.SampleWeight == 0 {
+		res.SampleWeight = weight
+		return
+	}
+	res.SampleWeight *= weight
+}
+
+// sampleResult applies the record level sampling modes to res and scales its
+// sample weight. returns false if the record should be dropped.
+func (config *captureConfig) sampleResult(res *util.DNSResult) bool {
+	switch {
+	case config.sampler != nil && len(res.DNS.Question) > 0:
+		keep, weight := config.sampler.sample(res.DNS.Question[0].Name, res.DNS.Id)
+		if !keep {
+			config.sampledOut.Inc(1)
+			return false
+		}
+		scaleSampleWeight(res, weight)
+	case config.flowHashA != config.flowHashB:
+		// summary records describe many flows and are never sampled
+		if res.Upstream != nil {
+			return true
+		}
+		if flowHash(res, config.FlowHashKey == "clientip")%config.flowHashB >= config.flowHashA {
+			config.sampledOut.Inc(1)
+			return false
+		}
+		scaleSampleWeight(res, float64(config.flowHashB)/float64(config.flowHashA))
+	}
+	return true
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,224 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/mosajjal/dnsmonster/internal/util"
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestCountMinSketch(t *testing.T) {
+	c := newCountMinSketch()
+	h := FNV1A([]byte("example.com."))
+	for i := 0; i < 42; i++ {
+		c.add(h)
+	}
+	if got := c.estimate(h); got < 42 {
+		t.Errorf("count-min sketch must never under-estimate, got %d want >= 42", got)
+	}
+	if got := c.estimate(FNV1A([]byte("never-seen.example."))); got > 1 {
+		t.Errorf("unexpected estimate for an unseen key: %d", got)
+	}
+}
+
+func TestAdaptiveSamplerKeepsRareDomains(t *testing.T) {
+	a := newAdaptiveSampler(10)
+	for i := 0; i < 1000; i++ {
+		keep, weight := a.sample(fmt.Sprintf("rare-%d.example.", i), uint16(i))
+		if !keep || weight != 1 {
+			t.Fatalf("rare domain %d was sampled out (weight %v)", i, weight)
+		}
+	}
+}
+
+func TestAdaptiveSamplerScalesFrequentDomains(t *testing.T) {
+	a := newAdaptiveSampler(100)
+	const total = 20000
+	kept := 0
+	weighted := 0.0
+	for i := 0; i < total; i++ {
+		if keep, weight := a.sample("Popular.Example.", uint16(i)); keep {
+			kept++
+			weighted += weight
+		}
+	}
+	if kept >= total/10 {
+		t.Errorf("frequent domain was not sampled: kept %d of %d", kept, total)
+	}
+	// the weights should re-scale the kept records back to roughly the total
+	if math.Abs(weighted-total)/total > 0.2 {
+		t.Errorf("re-scaled count %v too far from %d", weighted, total)
+	}
+
+	// the same question and transaction ID always gets the same decision
+	keep1, _ := a.sample("popular.example.", 4242)
+	keep2, _ := a.sample("popular.example.", 4242)
+	if keep1 != keep2 {
+		t.Error("query and response of the same transaction should share the decision")
+	}
+
+	// after two windows the domain is rare again
+	a.rotate()
+	a.rotate()
+	if keep, weight := a.sample("popular.example.", 1); !keep || weight != 1 {
+		t.Error("domain counts should expire after rotating the sketches")
+	}
+}
+
+func flowHashTestResult(client string, port uint16, response bool) util.DNSResult {
+	msg := testQuery("example.com.")
+	msg.Response = response
+	res := util.DNSResult{
+		DNS:       msg,
+		IPVersion: 4,
+		SrcIP:     net.ParseIP(client).To4(),
+		SrcPort:   port,
+		DstIP:     net.ParseIP("10.0.0.53").To4(),
+		DstPort:   53,
+		Protocol:  "udp",
+	}
+	if response {
+		res.SrcIP, res.DstIP = res.DstIP, res.SrcIP
+		res.SrcPort, res.DstPort = res.DstPort, res.SrcPort
+	}
+	return res
+}
+
+func TestFlowHashSampling(t *testing.T) {
+	config := captureConfig{
+		FlowHashKey: "5tuple",
+		flowHashA:   1,
+		flowHashB:   10,
+		sampledOut:  metrics.NewCounter(),
+	}
+	const total = 20000
+	kept := 0
+	for i := 0; i < total; i++ {
+		client := fmt.Sprintf("10.1.%d.%d", i/250, i%250+1)
+		port := uint16(1024 + i%50000)
+		query := flowHashTestResult(client, port, false)
+		response := flowHashTestResult(client, port, true)
+		keepQuery := config.sampleResult(&query)
+		if keepResponse := config.sampleResult(&response); keepQuery != keepResponse {
+			t.Fatalf("query and response of %s:%d got different decisions", client, port)
+		}
+		if keepQuery {
+			kept++
+			if query.SampleWeight != 10 {
+				t.Fatalf("unexpected sample weight %v", query.SampleWeight)
+			}
+		}
+	}
+	if ratio := float64(kept) / total; math.Abs(ratio-0.1) > 0.02 {
+		t.Errorf("kept %.3f of the flows, want about 0.1", ratio)
+	}
+	if got := config.sampledOut.Count(); got != int64(2*(total-kept)) {
+		t.Errorf("sampled out counter is %d, want %d", got, 2*(total-kept))
+	}
+
+	// a second sensor with its own config comes to the same decisions
+	other := captureConfig{
+		FlowHashKey: "5tuple",
+		flowHashA:   1,
+		flowHashB:   10,
+		sampledOut:  metrics.NewCounter(),
+	}
+	for i := 0; i < 100; i++ {
+		a := flowHashTestResult("192.0.2.1", uint16(2000+i), false)
+		b := a
+		if config.sampleResult(&a) != other.sampleResult(&b) {
+			t.Fatal("flow hash sampling is not deterministic across sensors")
+		}
+	}
+}
+
+func TestFlowHashSamplingByClient(t *testing.T) {
+	config := captureConfig{
+		FlowHashKey: "clientip",
+		flowHashA:   1,
+		flowHashB:   2,
+		sampledOut:  metrics.NewCounter(),
+	}
+	for c := 1; c < 20; c++ {
+		client := fmt.Sprintf("10.0.1.%d", c)
+		first := flowHashTestResult(client, 1024, false)
+		want := config.sampleResult(&first)
+		for port := uint16(1025); port < 1100; port++ {
+			res := flowHashTestResult(client, port, port%2 == 0)
+			if config.sampleResult(&res) != want {
+				t.Fatalf("client %s got different decisions for different flows", client)
+			}
+		}
+	}
+}
+
+// the weight of the records kept by --sampleRatio is the share of the
+// packets readPackets actually kept
+func TestRatioSampleWeight(t *testing.T) {
+	packet := testEthernet(0x0800, testIPv4DNSPacket(t, "ratio.example."))
+	for _, ratio := range []string{"1:10", "1:100", "5:10", "3:7", "9:10"} {
+		a, b, err := parseSampleRatio(ratio)
+		if err != nil {
+			t.Fatal(err)
+		}
+		const seen = 2100
+		handler := &sliceHandler{packets: slices.Repeat([][]byte{packet}, seen)}
+		config := captureConfig{}
+		in := &captureInput{target: ratio, ratioA: a, ratioB: b, stats: newInputStats("ratio-test")}
+		out := make(chan *rawPacketBytes, seen)
+		if err := config.readPackets(in, handler, nil, out); err != nil {
+			t.Fatal(err)
+		}
+		// the record of a kept packet, as made by inputHandlerWorker
+		var meta packetMeta
+		first := <-out
+		meta.reset(first.iface, first.input)
+		res := util.DNSResult{}
+		meta.annotate(&res)
+		if !config.sampleResult(&res) {
+			t.Fatalf("%s: the record was dropped", ratio)
+		}
+		if kept := float64(len(out) + 1); res.SampleWeight != seen/kept {
+			t.Errorf("%s: weight %v, %v of %d packets kept", ratio, res.SampleWeight, kept, seen)
+		}
+	}
+
+	// the ratio of an input stacks with the record level sampling
+	config := captureConfig{FlowHashKey: "5tuple", flowHashA: 1, flowHashB: 2, sampledOut: metrics.NewCounter()}
+	var meta packetMeta
+	meta.reset(nil, &captureInput{ratioA: 1, ratioB: 4})
+	for port := uint16(1024); ; port++ {
+		res := flowHashTestResult("10.0.0.1", port, false)
+		meta.annotate(&res)
+		if config.sampleResult(&res) {
+			if res.SampleWeight != 8 {
+				t.Errorf("weight %v of a 1:4 input with a 1:2 flow hash", res.SampleWeight)
+			}
+			break
+		}
+	}
+	if _, _, err := parseSampleRatio("0:10"); err == nil {
+		t.Error("a ratio keeping nothing was accepted")
+	}
+}
+
+// vim: foldmethod=marker
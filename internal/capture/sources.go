@@ -0,0 +1,99 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/mosajjal/dnsmonster/internal/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// captureSource is a kind of input, selected with --input KIND:TARGET. Each
+// source lives in its own file and registers itself at import time with
+// registerCaptureSource, adding its own flag group to util.GlobalParser if it
+// needs options, the same way the outputs do.
+type captureSource interface {
+	// name checks the target of an input and returns the name of the input
+	// in the metrics when it has no label
+	name(target string) (string, error)
+	// start reads the input until it's done or ctx is. The sources reading
+	// packets go through packetSource, the ones reading messages like dnstap
+	// turn them into records and hand them to config.sendResult. The metrics
+	// of the input are in in.stats.
+	start(ctx context.Context, config *captureConfig, in *captureInput) error
+}
+
+var captureSources = make(map[string]captureSource)
+
+// registerCaptureSource makes a source available to --input under kind
+func registerCaptureSource(kind string, source captureSource) {
+	if _, ok := captureSources[kind]; ok {
+		log.Fatalf("capture source %s is registered twice", kind)
+	}
+	captureSources[kind] = source
+}
+
+// captureSourceKinds lists the registered kinds, for the error messages
+func captureSourceKinds() string {
+	kinds := make([]string, 0, len(captureSources))
+	for kind := range captureSources {
+		kinds = append(kinds, kind)
+	}
+	slices.Sort(kinds)
+	return strings.Join(kinds, ", ")
+}
+
+// packetSource is a captureSource delivering raw packets through a
+// genericPacketHandler. The packets go through the decoding pipeline.
+type packetSource struct {
+	open func(ctx context.Context, config *captureConfig, in *captureInput) (genericPacketHandler, error)
+	// live sources capture from the interface named by the target, which is
+	// recorded on every packet
+	live bool
+}
+
+func (s packetSource) name(target string) (string, error) {
+	switch {
+	case s.live:
+		return target, nil
+	case target == "-":
+		return "stdin", nil
+	case strings.ContainsAny(target, pcapPatternChars):
+		// a glob is named after its directory
+		return filepath.Base(filepath.Dir(target)), nil
+	}
+	return filepath.Base(target), nil
+}
+
+func (s packetSource) start(ctx context.Context, config *captureConfig, in *captureInput) error {
+	handler, err := s.open(ctx, config, in)
+	if err != nil {
+		return fmt.Errorf("unable to initialize packet handler for %s: %w", in.target, err)
+	}
+	defer handler.Close() // closes the packet handler and/or capture files. there might be a duplicate of this in pcapfile
+	var iface *util.CaptureInterface
+	if s.live {
+		iface = liveCaptureInterface(in.target)
+	}
+	return config.runPacketHandlers(ctx, in, []genericPacketHandler{handler}, iface)
+}
+
+// vim: foldmethod=marker
@@ -16,109 +16,260 @@
 package capture
 
 import (
+	"context"
 	"encoding/binary"
-	"io"
 	"net"
+	"slices"
 	"time"
 
-	"context"
-
 	"github.com/gopacket/gopacket"
-	"github.com/gopacket/gopacket/tcpassembly"
-	"github.com/gopacket/gopacket/tcpassembly/tcpreader"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/reassembly"
+	"github.com/rcrowley/go-metrics"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/sync/errgroup"
 )
 
-func (ds *dnsStream) processStream(ctx context.Context) error {
-	var data []byte
-	tmp := make([]byte, 4096)
+// the size of the pages the reassembly package buffers the out of order
+// segments in
+const tcpPageBytes = 1900
 
-	for {
-		count, err := ds.reader.Read(tmp)
-
-		if err == io.EOF {
-			return err
-		} else if err != nil {
-			log.Info("Error when reading DNS buf", err)
-		} else if count > 0 {
-			data = append(data, tmp[0:count]...)
-			for curLength := len(data); curLength >= 2; curLength = len(data) {
-				expected := int(binary.BigEndian.Uint16(data[:2])) + 2
-				if curLength >= expected {
-					result := data[2:expected]
-
-					// Send the data to be processed
-					ds.tcpReturnChannel <- tcpData{
-						IPVersion: ds.IPVersion,
-						data:      result,
-						SrcIP:     net.IP(ds.Net.Src().Raw()),
-						DstIP:     net.IP(ds.Net.Dst().Raw()),
-						timestamp: ds.timestamp,
-					}
-					// Save the remaining data for future queries
-					data = data[expected:]
-				} else {
-					break
-				}
+// a connection buffers at most the pages of the largest DNS message, the
+// segments past that are given up on
+const tcpMaxPagesPerConnection = (65535 + 2 + tcpPageBytes - 1) / tcpPageBytes
+
+// tcpShard returns the assembly worker of a TCP segment. Both directions of
+// a connection go to the same worker.
+func tcpShard(flow gopacket.Flow, tcp *layers.TCP, workers int) int {
+	return int((flow.FastHash() ^ tcp.TransportFlow().FastHash()) % uint64(workers))
+}
+
+// tcpAssemblerContext is the packet being assembled. Each packet has its own,
+// since the reassembly package keeps it with the out of order segments.
+type tcpAssemblerContext struct {
+	ci          gopacket.CaptureInfo
+	IPVersion   uint8
+	matchedPort uint16
+	appProtocol string
+	meta        *packetMeta
+}
+
+func (ac *tcpAssemblerContext) GetCaptureInfo() gopacket.CaptureInfo {
+	return ac.ci
+}
+
+func newDNSStreamFactory(ctx context.Context, tcpReturnChannel chan tcpData) *dnsStreamFactory {
+	return &dnsStreamFactory{
+		tcpReturnChannel: tcpReturnChannel,
+		ctx:              ctx,
+		streams:          make(map[*dnsStream]struct{}),
+		active:           metrics.GetOrRegisterCounter("tcpActiveFlows", metrics.DefaultRegistry),
+		evicted:          metrics.GetOrRegisterCounter("tcpFlowsEvicted", metrics.DefaultRegistry),
+		outOfOrder:       metrics.GetOrRegisterCounter("tcpOutOfOrderSegments", metrics.DefaultRegistry),
+	}
+}
+
+func (factory *dnsStreamFactory) New(netFlow, tcpFlow gopacket.Flow, _ *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
+	packet := ac.(*tcpAssemblerContext)
+	stream := &dnsStream{
+		Net:         netFlow,
+		SrcPort:     binary.BigEndian.Uint16(tcpFlow.Src().Raw()),
+		DstPort:     binary.BigEndian.Uint16(tcpFlow.Dst().Raw()),
+		IPVersion:   packet.IPVersion,
+		matchedPort: packet.matchedPort,
+		appProtocol: packet.appProtocol,
+		meta:        packet.meta,
+		factory:     factory,
+		lastSeen:    packet.ci.Timestamp,
+	}
+	factory.streams[stream] = struct{}{}
+	factory.active.Inc(1)
+	return stream
+}
+
+// evict closes the connections that have been idle the longest, keeping keep
+// of them
+func (factory *dnsStreamFactory) evict(assembler *reassembly.Assembler, keep int) {
+	if len(factory.streams) <= keep {
+		return
+	}
+	seen := make([]time.Time, 0, len(factory.streams))
+	for stream := range factory.streams {
+		seen = append(seen, stream.lastSeen)
+	}
+	slices.SortFunc(seen, time.Time.Compare)
+	before := len(factory.streams)
+	// the connections last seen at the same time as the newest one to evict
+	// are evicted too
+	assembler.FlushCloseOlderThan(seen[len(seen)-keep-1].Add(time.Nanosecond))
+	factory.evicted.Inc(int64(before - len(factory.streams)))
+}
+
+// Accept takes every segment, counting the ones arriving before the bytes
+// they follow
+func (ds *dnsStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, _ reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, _ *bool, _ reassembly.AssemblerContext) bool {
+	if ci.Timestamp.After(ds.lastSeen) {
+		ds.lastSeen = ci.Timestamp
+	}
+	// the next sequence is negative until the start of the stream is seen
+	if nextSeq >= 0 && len(tcp.Payload) > 0 && nextSeq.Difference(reassembly.Sequence(tcp.Seq)) > 0 {
+		ds.factory.outOfOrder.Inc(1)
+	}
+	return true
+}
+
+// ReassembledSG splits each direction of the connection into DNS messages,
+// each prefixed by its length. A message gets the timestamp of the packet
+// holding its last byte, so the queries of a long lived connection each have
+// their own timestamp.
+func (ds *dnsStream) ReassembledSG(sg reassembly.ScatterGather, _ reassembly.AssemblerContext) {
+	dir, _, _, skip := sg.Info()
+	srcIP, dstIP := net.IP(ds.Net.Src().Raw()), net.IP(ds.Net.Dst().Raw())
+	srcPort, dstPort := ds.SrcPort, ds.DstPort
+	buffer := &ds.data[0]
+	if dir == reassembly.TCPDirServerToClient {
+		srcIP, dstIP, srcPort, dstPort = dstIP, srcIP, dstPort, srcPort
+		buffer = &ds.data[1]
+	}
+	if skip != 0 {
+		// bytes are missing, the message being reassembled is lost
+		*buffer = nil
+	}
+	available, _ := sg.Lengths()
+	// start is the offset of the buffer in the bytes of sg
+	start := -len(*buffer)
+	*buffer = append(*buffer, sg.Fetch(available)...)
+	for len(*buffer) >= 2 {
+		expected := int(binary.BigEndian.Uint16((*buffer)[:2])) + 2
+		if len(*buffer) < expected {
+			break
+		}
+
+		// Send the data to be processed
+		data := tcpData{
+			IPVersion:   ds.IPVersion,
+			data:        (*buffer)[2:expected:expected],
+			SrcIP:       srcIP,
+			DstIP:       dstIP,
+			SrcPort:     srcPort,
+			DstPort:     dstPort,
+			timestamp:   sg.CaptureInfo(start + expected - 1).Timestamp,
+			matchedPort: ds.matchedPort,
+			appProtocol: ds.appProtocol,
+			meta:        ds.meta,
+		}
+		if ds.factory.ctx.Err() != nil {
+			// shutting down, the messages that fit in the channel are kept
+			select {
+			case ds.factory.tcpReturnChannel <- data:
+			default:
+				return
+			}
+		} else {
+			select {
+			case ds.factory.tcpReturnChannel <- data:
+			case <-ds.factory.ctx.Done():
+				return
 			}
 		}
+		// Save the remaining data for future queries
+		*buffer = (*buffer)[expected:]
+		start += expected
 	}
 }
 
-func (stream *dnsStreamFactory) New(net, transport gopacket.Flow) tcpassembly.Stream {
-	dstream := &dnsStream{
-		Net:              net,
-		reader:           tcpreader.NewReaderStream(),
-		tcpReturnChannel: stream.tcpReturnChannel,
-		IPVersion:        stream.IPVersion,
-		timestamp:        stream.currentTimestamp, // This variable is updated before the assemble call
+// ReassemblyComplete drops what's left of the incomplete messages and lets the
+// connection go
+func (ds *dnsStream) ReassemblyComplete(_ reassembly.AssemblerContext) bool {
+	ds.data = [2][]byte{}
+	delete(ds.factory.streams, ds)
+	ds.factory.active.Dec(1)
+	return true
+}
+
+// tcpWorker reassembles the connections of a shard. Its clock follows the
+// timestamps of the packets, so an offline capture flushes its connections
+// like a live one, whatever the speed it's read at. When no packet comes, the
+// clock goes on with the wall clock from the last one.
+type tcpWorker struct {
+	factory        *dnsStreamFactory
+	assembler      *reassembly.Assembler
+	gcTime         time.Duration
+	maxConnections int
+	clock          time.Time
+	flushed        time.Time
+	// the clock at the last packet, and when it was received
+	packetClock time.Time
+	received    time.Time
+}
+
+func newTCPWorker(ctx context.Context, tcpReturnChannel chan tcpData, gcTime time.Duration, maxConnections, maxBufferedPages uint) *tcpWorker {
+	factory := newDNSStreamFactory(ctx, tcpReturnChannel)
+	assembler := reassembly.NewAssembler(reassembly.NewStreamPool(factory))
+	assembler.MaxBufferedPagesTotal = int(maxBufferedPages)
+	assembler.MaxBufferedPagesPerConnection = tcpMaxPagesPerConnection
+	return &tcpWorker{
+		factory:        factory,
+		assembler:      assembler,
+		gcTime:         gcTime,
+		maxConnections: int(maxConnections),
 	}
+}
 
-	// We must read all the data from the reader or we will have the data standing in memory
-	//todo: re-defining context here and it's not passed on
-	g, gCtx := errgroup.WithContext(stream.ctx)
-	g.Go(func() error { return dstream.processStream(gCtx) })
+func (w *tcpWorker) assemble(packet tcpPacket, now time.Time) {
+	w.assembler.AssembleWithContext(packet.flow, &packet.tcp, &tcpAssemblerContext{
+		ci:          gopacket.CaptureInfo{Timestamp: packet.timestamp},
+		IPVersion:   packet.IPVersion,
+		matchedPort: packet.matchedPort,
+		appProtocol: packet.appProtocol,
+		meta:        packet.meta,
+	})
 
-	return &dstream.reader
+	w.advance(packet.timestamp)
+	w.packetClock, w.received = w.clock, now
+	if w.maxConnections > 0 && len(w.factory.streams) > w.maxConnections {
+		w.factory.evict(w.assembler, w.maxConnections-w.maxConnections/10)
+	}
 }
 
-func tcpAssembler(ctx context.Context, tcpchannel chan tcpPacket, tcpReturnChannel chan tcpData, gcTime time.Duration) error {
-	// TCP reassembly init
-	streamFactoryV4 := &dnsStreamFactory{
-		tcpReturnChannel: tcpReturnChannel,
-		IPVersion:        4,
-		ctx:              ctx,
+// tick moves the clock by the wall clock time since the last packet, so the
+// connections are flushed on a quiet link too
+func (w *tcpWorker) tick(now time.Time) {
+	if w.received.IsZero() {
+		return
 	}
-	streamPoolV4 := tcpassembly.NewStreamPool(streamFactoryV4)
-	assemblerV4 := tcpassembly.NewAssembler(streamPoolV4)
+	w.advance(w.packetClock.Add(now.Sub(w.received)))
+}
 
-	streamFactoryV6 := &dnsStreamFactory{
-		tcpReturnChannel: tcpReturnChannel,
-		IPVersion:        6,
-		ctx:              ctx,
+// advance moves the clock to t if it's later, and flushes the connections
+// idle for GcTime every GcTime
+func (w *tcpWorker) advance(t time.Time) {
+	if t.After(w.clock) {
+		w.clock = t
+	}
+	if w.flushed.IsZero() {
+		w.flushed = w.clock
+	}
+	if w.clock.Sub(w.flushed) >= w.gcTime {
+		// Flush connections that haven't seen activity in the past GcTime.
+		flushed, closed := w.assembler.FlushCloseOlderThan(w.clock.Add(-w.gcTime))
+		log.Debugf("tcp flushed: %d, closed: %d", flushed, closed)
+		w.flushed = w.clock
 	}
-	streamPoolV6 := tcpassembly.NewStreamPool(streamFactoryV6)
-	assemblerV6 := tcpassembly.NewAssembler(streamPoolV6)
+}
+
+func tcpAssembler(ctx context.Context, tcpchannel chan tcpPacket, tcpReturnChannel chan tcpData, gcTime time.Duration, maxConnections, maxBufferedPages uint) error {
+	w := newTCPWorker(ctx, tcpReturnChannel, gcTime, maxConnections, maxBufferedPages)
 	ticker := time.NewTicker(gcTime)
+	defer ticker.Stop()
 	for {
 		select {
 		case packet := <-tcpchannel:
-			switch packet.IPVersion {
-			case 4:
-				streamFactoryV4.currentTimestamp = packet.timestamp
-				assemblerV4.AssembleWithTimestamp(packet.flow, &packet.tcp, time.Now())
-			case 6:
-				streamFactoryV6.currentTimestamp = packet.timestamp
-				assemblerV6.AssembleWithTimestamp(packet.flow, &packet.tcp, time.Now())
-			}
-		case <-ticker.C:
-			// Flush connections that haven't seen activity in the past GcTime.
-			flushed, closed := assemblerV4.FlushOlderThan(time.Now().Add(gcTime * -1))
-			log.Infof("ipv4 flushed: %d, closed: %d", flushed, closed)
-			flushed, closed = assemblerV6.FlushOlderThan(time.Now().Add(gcTime * -1))
-			log.Infof("ipv6 flushed: %d, closed: %d", flushed, closed)
+			w.assemble(packet, time.Now())
+		case now := <-ticker.C:
+			w.tick(now)
 		case <-ctx.Done():
+			// the messages completed by the segments still buffered
+			w.assembler.FlushAll()
 			return nil
 		}
 	}
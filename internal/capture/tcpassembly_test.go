@@ -0,0 +1,216 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	mkdns "github.com/miekg/dns"
+)
+
+// testTCPDNSMessage returns a query prefixed by its length, as sent over TCP
+func testTCPDNSMessage(t *testing.T, name string) []byte {
+	packed := packTestQuery(t, name)
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(packed))), packed...)
+}
+
+// testTCPSegment returns a decoded segment from a client port to 53, like the
+// segments of a capture
+func testTCPSegment(t *testing.T, srcPort layers.TCPPort, seq uint32, syn bool, payload []byte) layers.TCP {
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, &layers.TCP{SrcPort: srcPort, DstPort: 53, Seq: seq, SYN: syn, Window: 1024}, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	var segment layers.TCP
+	if err := segment.DecodeFromBytes(buf.Bytes(), gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	return segment
+}
+
+func TestTCPAssemblerMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in := make(chan tcpPacket)
+	out := make(chan tcpData, 10)
+	go tcpAssembler(ctx, in, out, time.Minute, 100, 100)
+
+	src, dst := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	flow := gopacket.NewFlow(layers.EndpointIPv4, src, dst)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	seq := uint32(1000)
+	send := func(offset time.Duration, payload []byte, syn bool) {
+		in <- tcpPacket{IPVersion: 4, tcp: testTCPSegment(t, 40000, seq, syn, payload), timestamp: start.Add(offset), flow: flow, matchedPort: 53}
+		seq += uint32(len(payload))
+		if syn {
+			seq++
+		}
+	}
+
+	first, second, third := testTCPDNSMessage(t, "first.example."), testTCPDNSMessage(t, "second.example."), testTCPDNSMessage(t, "third.example.")
+	send(0, nil, true)
+	send(time.Second, first, false)
+	// the second message is split, it's complete with the second segment
+	send(2*time.Second, second[:5], false)
+	send(3*time.Second, append(second[5:], third...), false)
+
+	want := []struct {
+		name   string
+		offset time.Duration
+	}{
+		{"first.example.", time.Second},
+		{"second.example.", 3 * time.Second},
+		{"third.example.", 3 * time.Second},
+	}
+	for _, w := range want {
+		select {
+		case data := <-out:
+			msg := mkdns.Msg{}
+			if err := msg.Unpack(data.data); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Question[0].Name != w.name || !data.timestamp.Equal(start.Add(w.offset)) {
+				t.Errorf("got %s at %s, want %s at %s", msg.Question[0].Name, data.timestamp, w.name, start.Add(w.offset))
+			}
+			if data.SrcPort != 40000 || data.DstPort != 53 || !data.SrcIP.Equal(src) || !data.DstIP.Equal(dst) {
+				t.Errorf("%s: wrong addresses %s:%d > %s:%d", w.name, data.SrcIP, data.SrcPort, data.DstIP, data.DstPort)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s wasn't reassembled", w.name)
+		}
+	}
+}
+
+func TestTCPWorker(t *testing.T) {
+	out := make(chan tcpData, 10)
+	w := newTCPWorker(context.Background(), out, 10*time.Second, 2, 100)
+	flow := gopacket.NewFlow(layers.EndpointIPv4, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2})
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	send := func(offset time.Duration, port layers.TCPPort, seq uint32, syn bool, payload []byte) {
+		w.assemble(tcpPacket{IPVersion: 4, tcp: testTCPSegment(t, port, seq, syn, payload), timestamp: start.Add(offset), flow: flow, matchedPort: 53}, time.Now())
+	}
+	received := func() []string {
+		var names []string
+		for len(out) > 0 {
+			msg := mkdns.Msg{}
+			if err := msg.Unpack((<-out).data); err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, msg.Question[0].Name)
+		}
+		return names
+	}
+	outOfOrder := w.factory.outOfOrder.Count()
+	evicted := w.factory.evicted.Count()
+
+	// the segments arriving out of order are reassembled
+	first, second := testTCPDNSMessage(t, "first.example."), testTCPDNSMessage(t, "second.example.")
+	send(0, 40000, 1000, true, nil)
+	send(time.Second, 40000, 1001+uint32(len(first)), false, second)
+	if got := received(); len(got) != 0 {
+		t.Fatalf("reassembled %v before the gap is filled", got)
+	}
+	send(2*time.Second, 40000, 1001, false, first)
+	if got := received(); len(got) != 2 || got[0] != "first.example." || got[1] != "second.example." {
+		t.Errorf("reassembled %v", got)
+	}
+	if got := w.factory.outOfOrder.Count() - outOfOrder; got != 1 {
+		t.Errorf("%d segments counted out of order", got)
+	}
+
+	// over the limit, the connection idle the longest is evicted
+	send(3*time.Second, 40001, 5000, true, nil)
+	send(4*time.Second, 40002, 9000, true, nil)
+	if len(w.factory.streams) != 2 || w.factory.evicted.Count()-evicted != 1 {
+		t.Fatalf("%d connections left, %d evicted", len(w.factory.streams), w.factory.evicted.Count()-evicted)
+	}
+	for stream := range w.factory.streams {
+		if stream.SrcPort == 40000 {
+			t.Error("the oldest connection wasn't evicted")
+		}
+	}
+
+	// a connection whose start was missed is flushed once the packets are
+	// GcTime past it, however fast they're read
+	send(5*time.Second, 40003, 7000, false, testTCPDNSMessage(t, "midstream.example."))
+	if got := received(); len(got) != 0 {
+		t.Fatalf("reassembled %v before the flush", got)
+	}
+	send(20*time.Second, 40002, 9001, false, testTCPDNSMessage(t, "late.example."))
+	// the packet moving the clock is assembled before the flush
+	if got := received(); len(got) != 2 || got[0] != "late.example." || got[1] != "midstream.example." {
+		t.Errorf("reassembled %v", got)
+	}
+	if len(w.factory.streams) != 1 {
+		t.Errorf("%d connections left after the flush", len(w.factory.streams))
+	}
+}
+
+func TestTCPWorkerQuietLink(t *testing.T) {
+	out := make(chan tcpData, 10)
+	w := newTCPWorker(context.Background(), out, 10*time.Second, 100, 100)
+	flow := gopacket.NewFlow(layers.EndpointIPv4, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2})
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	received := time.Now()
+
+	// the start of the connection was missed, nothing comes after it
+	w.assemble(tcpPacket{IPVersion: 4, tcp: testTCPSegment(t, 40000, 7000, false, testTCPDNSMessage(t, "quiet.example.")), timestamp: start, flow: flow, matchedPort: 53}, received)
+	for _, tick := range []time.Duration{5 * time.Second, 10 * time.Second} {
+		w.tick(received.Add(tick))
+		if len(out) != 0 {
+			t.Fatalf("flushed %s after the packet", tick)
+		}
+	}
+	// the flush every GcTime catches the connections idle for GcTime
+	w.tick(received.Add(20 * time.Second))
+	if len(out) != 1 || len(w.factory.streams) != 0 {
+		t.Fatalf("%d messages and %d connections left without packets", len(out), len(w.factory.streams))
+	}
+	if !w.clock.Equal(start.Add(20 * time.Second)) {
+		t.Errorf("the clock is at %s", w.clock)
+	}
+}
+
+func TestTCPAssemblerShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan tcpPacket)
+	out := make(chan tcpData, 10)
+	done := make(chan struct{})
+	go func() {
+		tcpAssembler(ctx, in, out, time.Minute, 100, 100)
+		close(done)
+	}()
+
+	flow := gopacket.NewFlow(layers.EndpointIPv4, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2})
+	in <- tcpPacket{IPVersion: 4, tcp: testTCPSegment(t, 40000, 7000, false, testTCPDNSMessage(t, "last.example.")), timestamp: time.Now(), flow: flow, matchedPort: 53}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the assembler didn't stop")
+	}
+	if len(out) != 1 {
+		t.Errorf("%d messages flushed on shutdown", len(out))
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,298 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	tlsRecordHandshake      = 0x16
+	tlsHandshakeClientHello = 0x01
+
+	tlsExtServerName          = 0x0000
+	tlsExtSupportedGroups     = 0x000a
+	tlsExtECPointFormats      = 0x000b
+	tlsExtSignatureAlgorithms = 0x000d
+	tlsExtALPN                = 0x0010
+	tlsExtSupportedVersions   = 0x002b
+)
+
+var (
+	errTLSIncomplete = errors.New("incomplete TLS ClientHello")
+	errTLSMalformed  = errors.New("malformed TLS ClientHello")
+)
+
+// clientHello holds the fields of a TLS ClientHello needed for the SNI, ALPN
+// and the JA3/JA4 fingerprints. The lists are kept in the order they were
+// sent, GREASE values included.
+type clientHello struct {
+	version           uint16
+	ciphers           []uint16
+	extensions        []uint16
+	sni               string
+	alpn              []string
+	groups            []uint16
+	pointFormats      []uint8
+	sigAlgs           []uint16
+	supportedVersions []uint16
+}
+
+// GREASE values (RFC 8701) are sent by clients to keep the ecosystem honest
+// and are left out of the fingerprints
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// tlsClientHello extracts the ClientHello from the beginning of a TLS
+// stream. The handshake message can span several records, in which case
+// errTLSIncomplete is returned until all of them are available.
+func tlsClientHello(stream []byte) (*clientHello, error) {
+	var handshake []byte
+	for {
+		if len(stream) < 5 {
+			return nil, errTLSIncomplete
+		}
+		if stream[0] != tlsRecordHandshake || stream[1] != 0x03 {
+			return nil, errTLSMalformed
+		}
+		recordLen := int(binary.BigEndian.Uint16(stream[3:]))
+		if len(stream) < 5+recordLen {
+			return nil, errTLSIncomplete
+		}
+		handshake = append(handshake, stream[5:5+recordLen]...)
+		stream = stream[5+recordLen:]
+		if len(handshake) < 4 {
+			continue
+		}
+		if handshake[0] != tlsHandshakeClientHello {
+			return nil, errTLSMalformed
+		}
+		msgLen := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+		if len(handshake) >= 4+msgLen {
+			return parseClientHello(handshake[4 : 4+msgLen])
+		}
+	}
+}
+
+// tlsReader is a tiny cursor over a TLS structure. Once a read goes past the
+// end, every following read returns zero values and err is set.
+type tlsReader struct {
+	b   []byte
+	err bool
+}
+
+func (r *tlsReader) bytes(n int) []byte {
+	if r.err || n > len(r.b) {
+		r.err = true
+		return nil
+	}
+	out := r.b[:n]
+	r.b = r.b[n:]
+	return out
+}
+
+func (r *tlsReader) u8() int {
+	if b := r.bytes(1); b != nil {
+		return int(b[0])
+	}
+	return 0
+}
+
+func (r *tlsReader) u16() int {
+	if b := r.bytes(2); b != nil {
+		return int(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func u16List(b []byte) []uint16 {
+	out := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		out = append(out, binary.BigEndian.Uint16(b[i:]))
+	}
+	return out
+}
+
+// parseClientHello parses the body of a ClientHello handshake message
+func parseClientHello(b []byte) (*clientHello, error) {
+	r := &tlsReader{b: b}
+	ch := &clientHello{}
+	ch.version = uint16(r.u16())
+	r.bytes(32)     // random
+	r.bytes(r.u8()) // session id
+	ch.ciphers = u16List(r.bytes(r.u16()))
+	r.bytes(r.u8()) // compression methods
+	if r.err {
+		return nil, errTLSMalformed
+	}
+	if len(r.b) == 0 {
+		// no extensions
+		return ch, nil
+	}
+	exts := &tlsReader{b: r.bytes(r.u16())}
+	for len(exts.b) > 0 && !exts.err {
+		extType := uint16(exts.u16())
+		ext := &tlsReader{b: exts.bytes(exts.u16())}
+		ch.extensions = append(ch.extensions, extType)
+		switch extType {
+		case tlsExtServerName:
+			names := &tlsReader{b: ext.bytes(ext.u16())}
+			for len(names.b) > 0 && !names.err {
+				nameType := names.u8()
+				name := names.bytes(names.u16())
+				if nameType == 0 && ch.sni == "" {
+					ch.sni = string(name)
+				}
+			}
+		case tlsExtALPN:
+			protocols := &tlsReader{b: ext.bytes(ext.u16())}
+			for len(protocols.b) > 0 && !protocols.err {
+				if p := protocols.bytes(protocols.u8()); p != nil {
+					ch.alpn = append(ch.alpn, string(p))
+				}
+			}
+		case tlsExtSupportedGroups:
+			ch.groups = u16List(ext.bytes(ext.u16()))
+		case tlsExtECPointFormats:
+			ch.pointFormats = ext.bytes(ext.u8())
+		case tlsExtSignatureAlgorithms:
+			ch.sigAlgs = u16List(ext.bytes(ext.u16()))
+		case tlsExtSupportedVersions:
+			ch.supportedVersions = u16List(ext.bytes(ext.u8()))
+		}
+	}
+	if exts.err {
+		return nil, errTLSMalformed
+	}
+	return ch, nil
+}
+
+func joinDecimal[T uint8 | uint16](values []T) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		if isGREASE(uint16(v)) {
+			continue
+		}
+		parts = append(parts, strconv.Itoa(int(v)))
+	}
+	return strings.Join(parts, "-")
+}
+
+// ja3 returns the JA3 string of the ClientHello and its MD5 hash
+func (ch *clientHello) ja3() (string, string) {
+	s := fmt.Sprintf("%d,%s,%s,%s,%s",
+		ch.version,
+		joinDecimal(ch.ciphers),
+		joinDecimal(ch.extensions),
+		joinDecimal(ch.groups),
+		joinDecimal(ch.pointFormats),
+	)
+	sum := md5.Sum([]byte(s))
+	return s, hex.EncodeToString(sum[:])
+}
+
+func ja4Hash(values []string) string {
+	if len(values) == 0 {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(strings.Join(values, ",")))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// ja4 returns the JA4 fingerprint of the ClientHello. transport is 't' for
+// TLS over TCP and 'q' for QUIC.
+func (ch *clientHello) ja4(transport byte) string {
+	version := ch.version
+	for _, v := range ch.supportedVersions {
+		if !isGREASE(v) && v > version {
+			version = v
+		}
+	}
+	versions := map[uint16]string{
+		0x0304: "13", 0x0303: "12", 0x0302: "11", 0x0301: "10",
+		0x0300: "s3", 0x0002: "s2", 0xfeff: "d1", 0xfefd: "d2", 0xfefc: "d3",
+	}
+	ver, ok := versions[version]
+	if !ok {
+		ver = "00"
+	}
+	sni := byte('i')
+	if ch.sni != "" {
+		sni = 'd'
+	}
+	alpn := "00"
+	if len(ch.alpn) > 0 && ch.alpn[0] != "" {
+		first := ch.alpn[0]
+		if isAlnum(first[0]) && isAlnum(first[len(first)-1]) {
+			alpn = string([]byte{first[0], first[len(first)-1]})
+		} else {
+			h := hex.EncodeToString([]byte(first))
+			alpn = string([]byte{h[0], h[len(h)-1]})
+		}
+	}
+
+	var ciphers, extensions, sigAlgs []string
+	for _, c := range ch.ciphers {
+		if !isGREASE(c) {
+			ciphers = append(ciphers, fmt.Sprintf("%04x", c))
+		}
+	}
+	extCount := 0
+	for _, e := range ch.extensions {
+		if isGREASE(e) {
+			continue
+		}
+		extCount++
+		if e != tlsExtServerName && e != tlsExtALPN {
+			extensions = append(extensions, fmt.Sprintf("%04x", e))
+		}
+	}
+	for _, s := range ch.sigAlgs {
+		if !isGREASE(s) {
+			sigAlgs = append(sigAlgs, fmt.Sprintf("%04x", s))
+		}
+	}
+	sort.Strings(ciphers)
+	sort.Strings(extensions)
+
+	extHash := "000000000000"
+	if len(extensions) > 0 {
+		extInput := strings.Join(extensions, ",")
+		if len(sigAlgs) > 0 {
+			extInput += "_" + strings.Join(sigAlgs, ",")
+		}
+		sum := sha256.Sum256([]byte(extInput))
+		extHash = hex.EncodeToString(sum[:])[:12]
+	}
+	return fmt.Sprintf("%c%s%c%02d%02d%s_%s_%s",
+		transport, ver, sni, min(len(ciphers), 99), min(extCount, 99), alpn,
+		ja4Hash(ciphers), extHash)
+}
+
+// vim: foldmethod=marker
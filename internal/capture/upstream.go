@@ -0,0 +1,290 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	mkdns "github.com/miekg/dns"
+	"github.com/mosajjal/dnsmonster/internal/util"
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// upper bound on the number of unanswered queries the monitor keeps track of.
+// anything above this is counted in upstreamPendingOverflow and ignored
+const upstreamMaxPending = 1 << 20
+
+// upstreamKey identifies a single query/response transaction from the
+// point of view of the client (the resolver) talking to an upstream server
+type upstreamKey struct {
+	client     [16]byte
+	server     [16]byte
+	clientPort uint16
+	serverPort uint16
+	id         uint16
+}
+
+// upstreamCounters are the per-interval figures for a single upstream. they
+// are reset every time a summary is generated
+type upstreamCounters struct {
+	ip        net.IP
+	ipVersion uint8
+	queries   int64
+	responses int64
+	timeouts  int64
+	servFails int64
+	latency   metrics.Histogram // microseconds
+}
+
+// upstreamMetrics are the long-lived metrics registered for each upstream
+type upstreamMetrics struct {
+	queries   metrics.Counter
+	timeouts  metrics.Counter
+	servFails metrics.Counter
+	latency   metrics.Histogram // microseconds
+}
+
+// upstreamMonitor pairs queries with their responses and keeps latency,
+// timeout and SERVFAIL figures per destination IP. It is fed with every
+// DNSResult produced by capture, so it works for all input types.
+type upstreamMonitor struct {
+	mu       sync.Mutex
+	timeout  time.Duration
+	pending  map[upstreamKey]time.Time
+	counters map[[16]byte]*upstreamCounters
+	metrics  map[[16]byte]*upstreamMetrics
+	// the upstreams past the first maxTracked share the metrics of other,
+	// since the registered metrics are never let go
+	maxTracked int
+	other      *upstreamMetrics
+	lastSeen   time.Time // latest packet timestamp, used as the clock for timeouts
+	lastExpire time.Time
+	overflow   metrics.Counter
+}
+
+func newUpstreamMonitor(timeout time.Duration, maxTracked int) *upstreamMonitor {
+	return &upstreamMonitor{
+		timeout:    timeout,
+		pending:    make(map[upstreamKey]time.Time),
+		counters:   make(map[[16]byte]*upstreamCounters),
+		metrics:    make(map[[16]byte]*upstreamMetrics),
+		maxTracked: maxTracked,
+		overflow:   metrics.GetOrRegisterCounter("upstreamPendingOverflow", metrics.DefaultRegistry),
+	}
+}
+
+func newUpstreamMetrics(name string) *upstreamMetrics {
+	return &upstreamMetrics{
+		queries:   metrics.GetOrRegisterCounter("upstreamQueries."+name, metrics.DefaultRegistry),
+		timeouts:  metrics.GetOrRegisterCounter("upstreamTimeouts."+name, metrics.DefaultRegistry),
+		servFails: metrics.GetOrRegisterCounter("upstreamServFails."+name, metrics.DefaultRegistry),
+		latency:   metrics.GetOrRegisterHistogram("upstreamLatencyUs."+name, metrics.DefaultRegistry, metrics.NewExpDecaySample(1028, 0.015)),
+	}
+}
+
+// the dots and colons of the IP would be taken as separators by the metric
+// endpoints
+var upstreamMetricReplacer = strings.NewReplacer(".", "_", ":", "_")
+
+func ipToKey(ip net.IP) (k [16]byte) {
+	copy(k[:], ip.To16())
+	return
+}
+
+// the caller must hold u.mu
+func (u *upstreamMonitor) getCounters(k [16]byte, ip net.IP, ipVersion uint8) (*upstreamCounters, *upstreamMetrics) {
+	c, ok := u.counters[k]
+	if !ok {
+		c = &upstreamCounters{
+			ip:        append(net.IP(nil), ip...),
+			ipVersion: ipVersion,
+			latency:   metrics.NewHistogram(metrics.NewUniformSample(1028)),
+		}
+		u.counters[k] = c
+	}
+	m, ok := u.metrics[k]
+	switch {
+	case ok:
+	case len(u.metrics) < u.maxTracked:
+		m = newUpstreamMetrics(upstreamMetricReplacer.Replace(ip.String()))
+		u.metrics[k] = m
+	default:
+		if u.other == nil {
+			u.other = newUpstreamMetrics("other")
+		}
+		m = u.other
+	}
+	return c, m
+}
+
+// observe registers a query or pairs a response with its query
+func (u *upstreamMonitor) observe(res *util.DNSResult) {
+	if res.Upstream != nil || res.EncryptedDNS != nil || res.Malformed != nil || res.SrcIP == nil || res.DstIP == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if res.Timestamp.After(u.lastSeen) {
+		u.lastSeen = res.Timestamp
+	}
+	// expire as the packet clock goes, so the timeouts don't wait for the
+	// next summary
+	if u.lastSeen.Sub(u.lastExpire) >= u.timeout {
+		u.expire()
+	}
+
+	if !res.DNS.Response {
+		key := upstreamKey{
+			client:     ipToKey(res.SrcIP),
+			server:     ipToKey(res.DstIP),
+			clientPort: res.SrcPort,
+			serverPort: res.DstPort,
+			id:         res.DNS.Id,
+		}
+		if _, ok := u.pending[key]; !ok && len(u.pending) >= upstreamMaxPending {
+			u.overflow.Inc(1)
+			return
+		}
+		u.pending[key] = res.Timestamp
+		c, m := u.getCounters(key.server, res.DstIP, res.IPVersion)
+		c.queries++
+		m.queries.Inc(1)
+		return
+	}
+
+	key := upstreamKey{
+		client:     ipToKey(res.DstIP),
+		server:     ipToKey(res.SrcIP),
+		clientPort: res.DstPort,
+		serverPort: res.SrcPort,
+		id:         res.DNS.Id,
+	}
+	c, m := u.getCounters(key.server, res.SrcIP, res.IPVersion)
+	if res.DNS.Rcode == mkdns.RcodeServerFailure {
+		c.servFails++
+		m.servFails.Inc(1)
+	}
+	queryTime, ok := u.pending[key]
+	if !ok {
+		return
+	}
+	delete(u.pending, key)
+	latency := res.Timestamp.Sub(queryTime)
+	if latency < 0 {
+		latency = 0
+	}
+	c.responses++
+	c.latency.Update(latency.Microseconds())
+	m.latency.Update(latency.Microseconds())
+}
+
+// expire counts every query older than the timeout as a timeout against its
+// upstream. the clock is the packet time, so offline captures work as well.
+// the caller must hold u.mu
+func (u *upstreamMonitor) expire() {
+	u.lastExpire = u.lastSeen
+	for key, queryTime := range u.pending {
+		if u.lastSeen.Sub(queryTime) <= u.timeout {
+			continue
+		}
+		delete(u.pending, key)
+		ip := net.IP(append([]byte(nil), key.server[:]...))
+		ipVersion := uint8(6)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, ipVersion = ip4, 4
+		}
+		c, m := u.getCounters(key.server, ip, ipVersion)
+		c.timeouts++
+		m.timeouts.Inc(1)
+	}
+}
+
+// summarize expires stale queries and returns one summary record per
+// upstream seen since the previous call
+func (u *upstreamMonitor) summarize(interval time.Duration) []util.DNSResult {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.expire()
+
+	timestamp := u.lastSeen
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	results := make([]util.DNSResult, 0, len(u.counters))
+	for _, c := range u.counters {
+		summary := util.UpstreamSummary{
+			Interval:  interval,
+			Queries:   c.queries,
+			Responses: c.responses,
+			Timeouts:  c.timeouts,
+			ServFails: c.servFails,
+		}
+		if c.latency.Count() > 0 {
+			ps := c.latency.Percentiles([]float64{0.5, 0.95, 0.99})
+			summary.LatencyMinMs = float64(c.latency.Min()) / 1000
+			summary.LatencyMeanMs = c.latency.Mean() / 1000
+			summary.LatencyP50Ms = ps[0] / 1000
+			summary.LatencyP95Ms = ps[1] / 1000
+			summary.LatencyP99Ms = ps[2] / 1000
+			summary.LatencyMaxMs = float64(c.latency.Max()) / 1000
+		}
+		// the reverse name of the upstream acts as the question, so the record
+		// goes through the outputs and their skip/allow logic like any other
+		msg := mkdns.Msg{}
+		if reverse, err := mkdns.ReverseAddr(c.ip.String()); err == nil {
+			msg.SetQuestion(reverse, mkdns.TypePTR)
+		}
+		// there is no single client behind a summary
+		srcIP := net.IPv6zero
+		if c.ipVersion == 4 {
+			srcIP = net.IPv4zero.To4()
+		}
+		results = append(results, util.DNSResult{
+			Timestamp: timestamp,
+			DNS:       msg,
+			IPVersion: c.ipVersion,
+			SrcIP:     srcIP,
+			DstIP:     c.ip,
+			Upstream:  &summary,
+		})
+	}
+	u.counters = make(map[[16]byte]*upstreamCounters)
+	return results
+}
+
+// run periodically sends the upstream summaries to the result channel
+func (u *upstreamMonitor) run(ctx context.Context, interval time.Duration, resultChannel chan util.DNSResult) error {
+	log.Infof("upstream monitor is enabled, sending summaries every %s", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, res := range u.summarize(interval) {
+				resultChannel <- res
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,150 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	mkdns "github.com/miekg/dns"
+	"github.com/mosajjal/dnsmonster/internal/util"
+	"github.com/rcrowley/go-metrics"
+)
+
+func upstreamTestResult(id uint16, response bool, rcode int, ts time.Time) util.DNSResult {
+	msg := testQuery("example.com.")
+	msg.Id = id
+	msg.Response = response
+	msg.Rcode = rcode
+	res := util.DNSResult{
+		Timestamp: ts,
+		DNS:       msg,
+		IPVersion: 4,
+		SrcIP:     net.ParseIP("10.0.0.1").To4(),
+		SrcPort:   40000,
+		DstIP:     net.ParseIP("192.0.2.53").To4(),
+		DstPort:   53,
+		Protocol:  "udp",
+	}
+	if response {
+		res.SrcIP, res.DstIP = res.DstIP, res.SrcIP
+		res.SrcPort, res.DstPort = res.DstPort, res.SrcPort
+	}
+	return res
+}
+
+func TestUpstreamMonitorPairing(t *testing.T) {
+	u := newUpstreamMonitor(5*time.Second, 1000)
+	start := time.Unix(1700000000, 0)
+
+	q := upstreamTestResult(1, false, 0, start)
+	r := upstreamTestResult(1, true, mkdns.RcodeSuccess, start.Add(20*time.Millisecond))
+	u.observe(&q)
+	u.observe(&r)
+
+	q2 := upstreamTestResult(2, false, 0, start.Add(time.Second))
+	r2 := upstreamTestResult(2, true, mkdns.RcodeServerFailure, start.Add(time.Second+40*time.Millisecond))
+	u.observe(&q2)
+	u.observe(&r2)
+
+	summaries := u.summarize(time.Minute)
+	if len(summaries) != 1 {
+		t.Fatalf("expected 1 summary, got %d", len(summaries))
+	}
+	s := summaries[0]
+	if !s.DstIP.Equal(net.ParseIP("192.0.2.53")) {
+		t.Errorf("summary is for %s, want 192.0.2.53", s.DstIP)
+	}
+	if s.Upstream.Queries != 2 || s.Upstream.Responses != 2 || s.Upstream.ServFails != 1 || s.Upstream.Timeouts != 0 {
+		t.Errorf("unexpected counters: %+v", *s.Upstream)
+	}
+	if s.Upstream.LatencyMinMs != 20 || s.Upstream.LatencyMaxMs != 40 {
+		t.Errorf("unexpected latency min/max: %v/%v", s.Upstream.LatencyMinMs, s.Upstream.LatencyMaxMs)
+	}
+	if len(s.DNS.Question) != 1 || s.DNS.Question[0].Name != "53.2.0.192.in-addr.arpa." {
+		t.Errorf("unexpected summary question: %v", s.DNS.Question)
+	}
+
+	// counters are per interval
+	if summaries := u.summarize(time.Minute); len(summaries) != 0 {
+		t.Errorf("expected no summaries after reset, got %d", len(summaries))
+	}
+}
+
+func TestUpstreamMonitorTimeout(t *testing.T) {
+	u := newUpstreamMonitor(2*time.Second, 1000)
+	start := time.Unix(1700000000, 0)
+
+	q := upstreamTestResult(7, false, 0, start)
+	u.observe(&q)
+	timeouts := u.metrics[ipToKey(q.DstIP)].timeouts
+	before := timeouts.Count()
+
+	// an unrelated packet moves the packet clock past the timeout, which is
+	// counted right away rather than on the next summary
+	later := upstreamTestResult(8, false, 0, start.Add(3*time.Second))
+	u.observe(&later)
+	if got := timeouts.Count() - before; got != 1 {
+		t.Errorf("expected 1 timeout before the summary, got %d", got)
+	}
+	if metrics.DefaultRegistry.Get("upstreamTimeouts.192_0_2_53") != timeouts {
+		t.Error("upstream metrics should be named after the IP with underscores")
+	}
+
+	summaries := u.summarize(time.Minute)
+	if len(summaries) != 1 {
+		t.Fatalf("expected 1 summary, got %d", len(summaries))
+	}
+	if summaries[0].Upstream.Timeouts != 1 {
+		t.Errorf("expected 1 timeout, got %d", summaries[0].Upstream.Timeouts)
+	}
+	if len(u.pending) != 1 {
+		t.Errorf("expected the recent query to stay pending, got %d pending", len(u.pending))
+	}
+
+	// a late response for an expired query must not be paired
+	r := upstreamTestResult(7, true, mkdns.RcodeSuccess, start.Add(4*time.Second))
+	u.observe(&r)
+	summaries = u.summarize(time.Minute)
+	if len(summaries) != 1 || summaries[0].Upstream.Responses != 0 {
+		t.Errorf("late response should not be counted as answered")
+	}
+}
+
+func TestUpstreamMonitorMaxTracked(t *testing.T) {
+	u := newUpstreamMonitor(5*time.Second, 2)
+	start := time.Unix(1700000000, 0)
+	other := newUpstreamMetrics("other").queries.Count()
+
+	for i, server := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.1"} {
+		q := upstreamTestResult(uint16(i), false, 0, start)
+		q.DstIP = net.ParseIP(server).To4()
+		u.observe(&q)
+	}
+	if len(u.metrics) != 2 || u.other == nil {
+		t.Fatalf("%d upstreams with their own metrics", len(u.metrics))
+	}
+	if got := u.other.queries.Count() - other; got != 2 {
+		t.Errorf("%d queries counted in the other metrics", got)
+	}
+	// the summaries are still per upstream
+	if summaries := u.summarize(time.Minute); len(summaries) != 4 {
+		t.Errorf("%d summaries", len(summaries))
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,422 @@
+//go:build linux && !android
+
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package capture
+
+// this file builds and loads the XDP program of the afxdp input. There's no
+// eBPF library in our dependencies and the program is small, so it's
+// assembled by hand and loaded with the bpf syscall directly.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// the eBPF opcodes used by the program
+const (
+	ebpfLdxW     = 0x61 // BPF_LDX | BPF_MEM | BPF_W
+	ebpfLdxH     = 0x69 // BPF_LDX | BPF_MEM | BPF_H
+	ebpfLdxB     = 0x71 // BPF_LDX | BPF_MEM | BPF_B
+	ebpfLdImm64  = 0x18 // BPF_LD | BPF_IMM | BPF_DW
+	ebpfAddK     = 0x07 // BPF_ALU64 | BPF_ADD | BPF_K
+	ebpfAddX     = 0x0f // BPF_ALU64 | BPF_ADD | BPF_X
+	ebpfAndK     = 0x57 // BPF_ALU64 | BPF_AND | BPF_K
+	ebpfLshK     = 0x67 // BPF_ALU64 | BPF_LSH | BPF_K
+	ebpfMovK     = 0xb7 // BPF_ALU64 | BPF_MOV | BPF_K
+	ebpfMovX     = 0xbf // BPF_ALU64 | BPF_MOV | BPF_X
+	ebpfToBE     = 0xdc // BPF_ALU | BPF_END | BPF_TO_BE
+	ebpfJa       = 0x05 // BPF_JMP | BPF_JA
+	ebpfJeqK     = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	ebpfJneK     = 0x55 // BPF_JMP | BPF_JNE | BPF_K
+	ebpfJgtX     = 0x2d // BPF_JMP | BPF_JGT | BPF_X
+	ebpfJltK     = 0xa5 // BPF_JMP | BPF_JLT | BPF_K
+	ebpfJleK     = 0xb5 // BPF_JMP | BPF_JLE | BPF_K
+	ebpfCall     = 0x85 // BPF_JMP | BPF_CALL
+	ebpfExit     = 0x95 // BPF_JMP | BPF_EXIT
+	ebpfLabel    = 0xff // not an opcode, marks the target of the jumps
+	ebpfPseudoFD = 1    // BPF_PSEUDO_MAP_FD, the imm of a ld_imm64 is a map fd
+
+	bpfFuncRedirectMap = 51 // bpf_redirect_map
+	xdpActionPass      = 2  // XDP_PASS
+
+	// the offsets of data, data_end and rx_queue_index in struct xdp_md
+	xdpMdData         = 0
+	xdpMdDataEnd      = 4
+	xdpMdRxQueueIndex = 16
+
+	// more port ranges than this and the program only filters on the protocol
+	xdpMaxPortRanges = 64
+	// the IPv6 extension headers skipped before giving up on finding the
+	// transport header
+	xdpMaxIPv6Extensions = 4
+)
+
+// bpfInsn is an eBPF instruction. The offset of the jumps is given as the
+// label of their target and resolved by assembleBPF.
+type bpfInsn struct {
+	code     uint8
+	dst, src uint8
+	off      int16
+	imm      int32
+	label    string
+}
+
+func bpfLdx(code, dst, src uint8, off int16) bpfInsn {
+	return bpfInsn{code: code, dst: dst, src: src, off: off}
+}
+func bpfALU(code, dst uint8, imm int32) bpfInsn { return bpfInsn{code: code, dst: dst, imm: imm} }
+func bpfMovX(dst, src uint8) bpfInsn            { return bpfInsn{code: ebpfMovX, dst: dst, src: src} }
+func bpfToBE16(dst uint8) bpfInsn               { return bpfInsn{code: ebpfToBE, dst: dst, imm: 16} }
+func bpfJmp(code, dst uint8, imm int32, label string) bpfInsn {
+	return bpfInsn{code: code, dst: dst, imm: imm, label: label}
+}
+func bpfLabel(name string) bpfInsn { return bpfInsn{code: ebpfLabel, label: name} }
+
+// bpfBounds jumps to pass unless size bytes after the packet pointer in reg are
+// in the packet. r3 holds data_end. The verifier refuses any packet access
+// not preceded by such a check.
+func bpfBounds(reg uint8, size int32) []bpfInsn {
+	return []bpfInsn{
+		bpfMovX(5, reg),
+		bpfALU(ebpfAddK, 5, size),
+		{code: ebpfJgtX, dst: 5, src: 3, label: "pass"},
+	}
+}
+
+// xdpFilterProgram builds the XDP program redirecting the DNS packets to the
+// AF_XDP socket of their rx queue, through the XSKMAP in mapFD. The packets
+// left are passed to the kernel as usual. Up to two VLAN tags and
+// xdpMaxIPv6Extensions IPv6 extension headers are skipped. IP fragments, and
+// the IPv6 packets with more extension headers or an authentication header,
+// are always redirected so dnsmonster can decode them, and TCP and UDP
+// packets are redirected if one of their ports is in ranges. A nil ranges
+// redirects all TCP and UDP packets, redirectAll every packet.
+func xdpFilterProgram(ranges [][2]uint16, redirectAll bool, mapFD int) []bpfInsn {
+	p := []bpfInsn{
+		bpfMovX(6, 1), // r6 = ctx, r1 is used by the helper call
+	}
+	if !redirectAll {
+		p = append(p,
+			bpfLdx(ebpfLdxW, 2, 1, xdpMdData),
+			bpfLdx(ebpfLdxW, 3, 1, xdpMdDataEnd),
+			// r7 points to the ethertype
+			bpfMovX(7, 2),
+			bpfALU(ebpfAddK, 7, 12),
+		)
+		for i := range 3 {
+			p = append(p, bpfBounds(7, 2)...)
+			p = append(p, bpfLdx(ebpfLdxH, 0, 7, 0), bpfToBE16(0))
+			if i < 2 {
+				vlan := fmt.Sprintf("vlan%d", i)
+				p = append(p,
+					bpfJmp(ebpfJeqK, 0, 0x8100, vlan),
+					bpfJmp(ebpfJneK, 0, 0x88a8, "l3"),
+					bpfLabel(vlan),
+					bpfALU(ebpfAddK, 7, 4),
+				)
+			}
+		}
+		p = append(p,
+			bpfLabel("l3"),
+			bpfALU(ebpfAddK, 7, 2), // r7 points to the IP header
+			bpfJmp(ebpfJeqK, 0, 0x0800, "ipv4"),
+			bpfJmp(ebpfJneK, 0, 0x86dd, "pass"),
+		)
+		// IPv6, r0 = next header
+		p = append(p, bpfBounds(7, 40)...)
+		p = append(p,
+			bpfLdx(ebpfLdxB, 0, 7, 6),
+			bpfALU(ebpfAddK, 7, 40),
+		)
+		for i := range xdpMaxIPv6Extensions {
+			ext := fmt.Sprintf("ext%d", i)
+			p = append(p,
+				bpfJmp(ebpfJeqK, 0, 17, "l4"),
+				bpfJmp(ebpfJeqK, 0, 6, "l4"),
+				bpfJmp(ebpfJeqK, 0, 0, ext),          // hop-by-hop options
+				bpfJmp(ebpfJeqK, 0, 43, ext),         // routing header
+				bpfJmp(ebpfJneK, 0, 60, "ipv6other"), // destination options
+				bpfLabel(ext),
+			)
+			// the length is in 8 bytes units, not counting the first 8
+			p = append(p, bpfBounds(7, 2)...)
+			p = append(p,
+				bpfLdx(ebpfLdxB, 1, 7, 1),
+				bpfLdx(ebpfLdxB, 0, 7, 0),
+				bpfALU(ebpfLshK, 1, 3),
+				bpfALU(ebpfAddK, 1, 8),
+				bpfInsn{code: ebpfAddX, dst: 7, src: 1},
+			)
+		}
+		p = append(p,
+			bpfJmp(ebpfJeqK, 0, 17, "l4"),
+			bpfJmp(ebpfJeqK, 0, 6, "l4"),
+			// too many extension headers, leave them to the decoder
+			bpfJmp(ebpfJa, 0, 0, "redirect"),
+			bpfLabel("ipv6other"),
+			bpfJmp(ebpfJeqK, 0, 44, "redirect"), // fragment header
+			bpfJmp(ebpfJeqK, 0, 51, "redirect"), // authentication header
+			bpfJmp(ebpfJa, 0, 0, "pass"),
+			bpfLabel("ipv4"),
+		)
+		// IPv4, r0 = protocol
+		p = append(p, bpfBounds(7, 20)...)
+		p = append(p,
+			bpfLdx(ebpfLdxH, 1, 7, 6),
+			bpfToBE16(1),
+			bpfALU(ebpfAndK, 1, 0x3fff), // more fragments flag and fragment offset
+			bpfJmp(ebpfJneK, 1, 0, "redirect"),
+			bpfLdx(ebpfLdxB, 0, 7, 9),
+			bpfLdx(ebpfLdxB, 1, 7, 0),
+			bpfALU(ebpfAndK, 1, 0xf),
+			bpfALU(ebpfLshK, 1, 2),
+			bpfInsn{code: ebpfAddX, dst: 7, src: 1},
+			bpfJmp(ebpfJeqK, 0, 17, "l4"),
+			bpfJmp(ebpfJneK, 0, 6, "pass"),
+			bpfLabel("l4"),
+		)
+		if ranges == nil {
+			p = append(p, bpfJmp(ebpfJa, 0, 0, "redirect"))
+		} else {
+			// r0 = source port, r1 = destination port
+			p = append(p, bpfBounds(7, 4)...)
+			p = append(p,
+				bpfLdx(ebpfLdxH, 0, 7, 0),
+				bpfToBE16(0),
+				bpfLdx(ebpfLdxH, 1, 7, 2),
+				bpfToBE16(1),
+			)
+			for reg := uint8(0); reg < 2; reg++ {
+				for i, r := range ranges {
+					if r[0] == r[1] {
+						p = append(p, bpfJmp(ebpfJeqK, reg, int32(r[0]), "redirect"))
+						continue
+					}
+					next := fmt.Sprintf("port%d.%d", reg, i)
+					p = append(p,
+						bpfJmp(ebpfJltK, reg, int32(r[0]), next),
+						bpfJmp(ebpfJleK, reg, int32(r[1]), "redirect"),
+						bpfLabel(next),
+					)
+				}
+			}
+			p = append(p, bpfJmp(ebpfJa, 0, 0, "pass"))
+		}
+	}
+	p = append(p,
+		bpfLabel("redirect"),
+		bpfLdx(ebpfLdxW, 2, 6, xdpMdRxQueueIndex),
+		bpfInsn{code: ebpfLdImm64, dst: 1, src: ebpfPseudoFD, imm: int32(mapFD)},
+		// packets of the queues without a socket are passed to the kernel
+		bpfALU(ebpfMovK, 3, xdpActionPass),
+		bpfInsn{code: ebpfCall, imm: bpfFuncRedirectMap},
+		bpfInsn{code: ebpfExit},
+	)
+	if !redirectAll {
+		p = append(p,
+			bpfLabel("pass"),
+			bpfALU(ebpfMovK, 0, xdpActionPass),
+			bpfInsn{code: ebpfExit},
+		)
+	}
+	return p
+}
+
+// assembleBPF encodes the program as struct bpf_insn, resolving the labels
+func assembleBPF(insns []bpfInsn) ([]byte, error) {
+	// the index of every label. ld_imm64 takes two instructions
+	labels := make(map[string]int)
+	n := 0
+	for _, insn := range insns {
+		switch insn.code {
+		case ebpfLabel:
+			labels[insn.label] = n
+		case ebpfLdImm64:
+			n += 2
+		default:
+			n++
+		}
+	}
+
+	code := make([]byte, 0, n*8)
+	bigEndian := binary.NativeEndian.Uint16([]byte{0, 1}) == 1
+	emit := func(insn bpfInsn) {
+		regs := insn.dst&0xf | insn.src<<4
+		if bigEndian {
+			regs = insn.dst<<4 | insn.src&0xf
+		}
+		code = append(code, insn.code, regs)
+		code = binary.NativeEndian.AppendUint16(code, uint16(insn.off))
+		code = binary.NativeEndian.AppendUint32(code, uint32(insn.imm))
+	}
+	for _, insn := range insns {
+		switch {
+		case insn.code == ebpfLabel:
+			continue
+		case insn.code == ebpfLdImm64:
+			emit(insn)
+			emit(bpfInsn{})
+			continue
+		case insn.label != "":
+			target, ok := labels[insn.label]
+			if !ok {
+				return nil, fmt.Errorf("unknown label %s", insn.label)
+			}
+			insn.off = int16(target - len(code)/8 - 1)
+		}
+		emit(insn)
+	}
+	return code, nil
+}
+
+// bpfSyscall calls the bpf syscall with attr
+func bpfSyscall(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// xdpProgram is the XDP program attached to an interface with its XSKMAP
+type xdpProgram struct {
+	mapFD  int
+	progFD int
+	linkFD int
+	// generic is set if the program is attached in SKB mode, which doesn't
+	// allow zero-copy sockets
+	generic bool
+}
+
+// loadXDPProgram creates a XSKMAP for queues rx queues and loads the filter
+// program using it
+func loadXDPProgram(queues int, ranges [][2]uint16, redirectAll bool) (*xdpProgram, error) {
+	mapAttr := struct {
+		mapType    uint32
+		keySize    uint32
+		valueSize  uint32
+		maxEntries uint32
+	}{unix.BPF_MAP_TYPE_XSKMAP, 4, 4, uint32(queues)}
+	mapFD, err := bpfSyscall(unix.BPF_MAP_CREATE, unsafe.Pointer(&mapAttr), unsafe.Sizeof(mapAttr))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the XSKMAP: %w", err)
+	}
+	prog := &xdpProgram{mapFD: mapFD, progFD: -1, linkFD: -1}
+
+	code, err := assembleBPF(xdpFilterProgram(ranges, redirectAll, mapFD))
+	if err != nil {
+		prog.Close()
+		return nil, err
+	}
+	license := []byte("GPL\x00")
+	attr := struct {
+		progType           uint32
+		insnCnt            uint32
+		insns              uint64
+		license            uint64
+		logLevel           uint32
+		logSize            uint32
+		logBuf             uint64
+		kernVersion        uint32
+		progFlags          uint32
+		progName           [16]byte
+		progIfindex        uint32
+		expectedAttachType uint32
+	}{
+		progType:           unix.BPF_PROG_TYPE_XDP,
+		insnCnt:            uint32(len(code) / 8),
+		insns:              uint64(uintptr(unsafe.Pointer(&code[0]))),
+		license:            uint64(uintptr(unsafe.Pointer(&license[0]))),
+		expectedAttachType: unix.BPF_XDP,
+	}
+	copy(attr.progName[:], "dnsmonster")
+	prog.progFD, err = bpfSyscall(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		// load it again with the verifier log to tell why
+		verifierLog := make([]byte, 1<<16)
+		attr.logLevel, attr.logSize = 1, uint32(len(verifierLog))
+		attr.logBuf = uint64(uintptr(unsafe.Pointer(&verifierLog[0])))
+		if fd, logErr := bpfSyscall(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); logErr == nil {
+			unix.Close(fd)
+		}
+		runtime.KeepAlive(verifierLog)
+		prog.Close()
+		return nil, fmt.Errorf("failed to load the XDP program: %w: %s", err, unix.ByteSliceToString(verifierLog))
+	}
+	runtime.KeepAlive(code)
+	runtime.KeepAlive(license)
+	return prog, nil
+}
+
+// attach attaches the program to the interface through a bpf_link, so it's
+// detached when the link is closed or dnsmonster exits. The driver mode is
+// tried first unless generic is set, falling back to SKB mode if allowed.
+func (p *xdpProgram) attach(ifindex int, generic, fallback bool) error {
+	link := func(flags uint32) error {
+		attr := struct {
+			progFD      uint32
+			targetIfidx uint32
+			attachType  uint32
+			flags       uint32
+		}{uint32(p.progFD), uint32(ifindex), unix.BPF_XDP, flags}
+		var err error
+		p.linkFD, err = bpfSyscall(unix.BPF_LINK_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		return err
+	}
+	if !generic {
+		err := link(unix.XDP_FLAGS_DRV_MODE)
+		if err == nil || !fallback {
+			return err
+		}
+	}
+	p.generic = true
+	return link(unix.XDP_FLAGS_SKB_MODE)
+}
+
+// register sends the packets of an rx queue to an AF_XDP socket
+func (p *xdpProgram) register(queue, socketFD int) error {
+	key, value := uint32(queue), uint32(socketFD)
+	attr := struct {
+		mapFD uint32
+		_     uint32
+		key   uint64
+		value uint64
+		flags uint64
+	}{
+		mapFD: uint32(p.mapFD),
+		key:   uint64(uintptr(unsafe.Pointer(&key))),
+		value: uint64(uintptr(unsafe.Pointer(&value))),
+	}
+	_, err := bpfSyscall(unix.BPF_MAP_UPDATE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(&key)
+	runtime.KeepAlive(&value)
+	return err
+}
+
+func (p *xdpProgram) Close() {
+	for _, fd := range []int{p.linkFD, p.progFD, p.mapFD} {
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+	}
+}
+
+// vim: foldmethod=marker
@@ -245,6 +245,10 @@ func (chConfig clickhouseConfig) clickhouseOutputWorker(ctx context.Context) err
 	for {
 		select {
 		case data := <-chConfig.outputChannel:
+			if !data.HasDNSMessage() {
+				clickhouseSkipped.Inc(1)
+				continue
+			}
 			for _, dnsQuery := range data.DNS.Question {
 				c++
 				if util.CheckIfWeSkip(chConfig.ClickhouseOutputType, dnsQuery.Name) {
@@ -121,6 +121,10 @@ func (c influxConfig) InfluxWorker(ctx context.Context) {
 	writeAPI := client.WriteAPI(c.InfluxOutputOrg, c.InfluxOutputBucket)
 
 	for data := range c.outputChannel { // channel close handles exit
+		if !data.HasDNSMessage() {
+			influxSkipped.Inc(1)
+			continue
+		}
 		for _, dnsQuery := range data.DNS.Question {
 			if util.CheckIfWeSkip(c.InfluxOutputType, dnsQuery.Name) {
 				influxSkipped.Inc(1)
@@ -150,6 +150,10 @@ func (nc natsConfig) Output(ctx context.Context) {
 	for {
 		select {
 		case data := <-nc.outputChannel:
+			if !data.HasDNSMessage() {
+				natsSkipped.Inc(1)
+				continue
+			}
 			for _, dnsQuery := range data.DNS.Question {
 				if util.CheckIfWeSkip(nc.NatsOutputType, dnsQuery.Name) {
 					natsSkipped.Inc(1)
@@ -170,7 +170,7 @@ func (config *parquetConfig) OutputWorker(ctx context.Context) {
 		case data := <-config.outputChannel:
 			cnt++
 
-			if len(data.DNS.Question) == 0 {
+			if len(data.DNS.Question) == 0 || !data.HasDNSMessage() {
 				config.parquetSkipped.Inc(1)
 				continue
 			}
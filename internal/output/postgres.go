@@ -151,6 +151,10 @@ func (psqConf psqlConfig) OutputWorker(ctx context.Context) {
 	for {
 		select {
 		case data := <-psqConf.outputChannel:
+			if !data.HasDNSMessage() {
+				psqlSkipped.Inc(1)
+				continue
+			}
 			for _, dnsQuery := range data.DNS.Question {
 
 				c++
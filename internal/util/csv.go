@@ -21,7 +21,11 @@ import (
 	"reflect"
 )
 
-type csvOutput struct{}
+// csvOutput writes a csvRow per record, followed by a csvCaptureRow if
+// captureMetadata is set
+type csvOutput struct {
+	captureMetadata bool
+}
 
 type csvRow struct {
 	Year         int
@@ -48,6 +52,15 @@ type csvRow struct {
 	ID           uint16
 }
 
+// csvCaptureRow are the columns added by --csvCaptureMetadata. They're
+// optional so the rows keep the columns the existing parsers expect.
+type csvCaptureRow struct {
+	VLAN      uint16 // outermost VLAN ID, 0 if untagged
+	SrcMAC    string
+	DstMAC    string
+	Interface string
+}
+
 // currently there's not a better way to do this unless you sacrifice performance by 10x
 func formatCsvRow(csvrow csvRow) []byte {
 	return []byte(fmt.Sprintf("%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v",
@@ -76,8 +89,12 @@ func formatCsvRow(csvrow csvRow) []byte {
 	))
 }
 
+func formatCsvCaptureRow(row csvCaptureRow) []byte {
+	return []byte(fmt.Sprintf(",%v,%v,%v,%v", row.VLAN, row.SrcMAC, row.DstMAC, row.Interface))
+}
+
 func (c csvOutput) Marshal(d DNSResult) []byte {
-	if len(d.DNS.Question) == 0 {
+	if len(d.DNS.Question) == 0 || !d.HasDNSMessage() {
 		return nil
 	}
 	// the integer version of the IP is much more useful in Machine learning than the string
@@ -136,19 +153,36 @@ func (c csvOutput) Marshal(d DNSResult) []byte {
 		DoBit:        dobit,
 		ID:           d.DNS.Id,
 	}
-	return formatCsvRow(s)
+	if !c.captureMetadata {
+		return formatCsvRow(s)
+	}
+	capture := csvCaptureRow{SrcMAC: d.SrcMAC, DstMAC: d.DstMAC}
+	if len(d.VLANs) > 0 {
+		capture.VLAN = d.VLANs[0]
+	}
+	if d.Interface != nil {
+		capture.Interface = d.Interface.Name
+	}
+	return append(formatCsvRow(s), formatCsvCaptureRow(capture)...)
 }
 
 // return headers for above csv
 func (c csvOutput) Init() (string, error) {
-	v := reflect.ValueOf(csvRow{})
-	typeOfV := v.Type()
+	rows := []any{csvRow{}}
+	if c.captureMetadata {
+		rows = append(rows, csvCaptureRow{})
+	}
 	csvHeader := ""
-	for i := 0; i < v.NumField(); i++ {
-		// Get the field, returns https://golang.org/pkg/reflect/#StructField
-		csvHeader += typeOfV.Field(i).Name + "," // todo: do we need to lowercase the headers
+	for _, row := range rows {
+		v := reflect.ValueOf(row)
+		typeOfV := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			// Get the field, returns https://golang.org/pkg/reflect/#StructField
+			csvHeader += typeOfV.Field(i).Name + "," // todo: do we need to lowercase the headers
+		}
 	}
 	// remove trailing comma
 	return csvHeader[:len(csvHeader)-1], nil
 }
+
 // vim: foldmethod=marker
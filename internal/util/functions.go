@@ -209,11 +209,11 @@ func OutputFormatToMarshaller(outputFormat string, t string) (OutputMarshaller,
 	case "json-ocsf":
 		return OCSFMarshaler{}, "", nil
 	case "csv":
-		csvOut := csvOutput{}
+		csvOut := csvOutput{captureMetadata: GeneralFlags.CsvCaptureMetadata}
 		header, _ := csvOut.Init()
 		return csvOut, header, nil
 	case "csv_no_header":
-		return csvOutput{}, "", nil
+		return csvOutput{captureMetadata: GeneralFlags.CsvCaptureMetadata}, "", nil
 	case "gotemplate":
 		goOut := goTemplateOutput{RawTemplate: t}
 		_, err := goOut.Init()
@@ -35,6 +35,16 @@ type DNSResultBinary struct {
 	PacketLength uint16
 	Identity     string `json:",omitempty"`
 	Version      string `json:",omitempty"`
+	VLANs        []uint16
+	SrcMAC       string
+	DstMAC       string
+	Interface    *CaptureInterface
+	Input        string
+	SampleWeight float64
+	Upstream     *UpstreamSummary
+	RateLimit    *RateLimitSummary
+	EncryptedDNS *EncryptedDNSConnection
+	Malformed    *MalformedDNS
 }
 
 func (g gobOutput) Marshal(d DNSResult) []byte {
@@ -52,6 +62,16 @@ func (g gobOutput) Marshal(d DNSResult) []byte {
 		PacketLength: d.PacketLength,
 		Identity:     d.Identity,
 		Version:      d.Version,
+		VLANs:        d.VLANs,
+		SrcMAC:       d.SrcMAC,
+		DstMAC:       d.DstMAC,
+		Interface:    d.Interface,
+		Input:        d.Input,
+		SampleWeight: d.SampleWeight,
+		Upstream:     d.Upstream,
+		RateLimit:    d.RateLimit,
+		EncryptedDNS: d.EncryptedDNS,
+		Malformed:    d.Malformed,
 	}
 	// convert to gob
 	var b bytes.Buffer
@@ -16,9 +16,14 @@
 package util
 
 import (
+	"bytes"
+	"encoding/gob"
 	"encoding/json"
 	"net"
+	"reflect"
+	"strings"
 	"testing"
+	"text/template"
 	"time"
 
 	mkdns "github.com/miekg/dns"
@@ -106,6 +111,51 @@ func TestCSVMarshaller(t *testing.T) {
 	}
 }
 
+func TestSyntheticRecordMarshallers(t *testing.T) {
+	msg := mkdns.Msg{}
+	msg.SetQuestion("53.0.0.10.in-addr.arpa.", mkdns.TypePTR)
+	summary := DNSResult{
+		Timestamp: time.Unix(1700000000, 0),
+		DNS:       msg,
+		IPVersion: 4,
+		SrcIP:     net.IPv4zero.To4(),
+		DstIP:     net.ParseIP("10.0.0.53").To4(),
+		Protocol:  "udp",
+		Upstream:  &UpstreamSummary{Interval: time.Minute, Queries: 10, Timeouts: 2},
+	}
+	if summary.HasDNSMessage() {
+		t.Error("upstream summary should not hold a DNS message")
+	}
+	if row := (csvOutput{}).Marshal(summary); row != nil {
+		t.Errorf("upstream summary should not be a CSV row: %s", row)
+	}
+
+	var decoded DNSResultBinary
+	if err := gob.NewDecoder(bytes.NewReader(gobOutput{}.Marshal(summary))).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Upstream == nil || *decoded.Upstream != *summary.Upstream {
+		t.Errorf("gob record lost the upstream summary: %+v", decoded.Upstream)
+	}
+
+	conn := summary
+	conn.Upstream = nil
+	conn.EncryptedDNS = &EncryptedDNSConnection{Transport: "dot", SNI: "dns.example", JA3: "771,4865"}
+	if conn.HasDNSMessage() {
+		t.Error("encrypted DNS connection should not hold a DNS message")
+	}
+	if row := (csvOutput{}).Marshal(conn); row != nil {
+		t.Errorf("encrypted DNS connection should not be a CSV row: %s", row)
+	}
+	decoded = DNSResultBinary{}
+	if err := gob.NewDecoder(bytes.NewReader(gobOutput{}.Marshal(conn))).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.EncryptedDNS == nil || decoded.EncryptedDNS.SNI != "dns.example" {
+		t.Errorf("gob record lost the encrypted DNS connection: %+v", decoded.EncryptedDNS)
+	}
+}
+
 func TestOutputFormatToMarshaller(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -154,6 +204,60 @@ func TestOutputFormatToMarshaller(t *testing.T) {
 }
 
 // Benchmark tests
+func TestL2MetadataMarshallers(t *testing.T) {
+	msg := mkdns.Msg{}
+	msg.SetQuestion("example.com.", mkdns.TypeA)
+	result := DNSResult{
+		Timestamp: time.Now(),
+		DNS:       msg,
+		IPVersion: 4,
+		SrcIP:     net.ParseIP("192.168.1.1").To4(),
+		DstIP:     net.ParseIP("8.8.8.8").To4(),
+		Protocol:  "udp",
+		VLANs:     []uint16{100, 200},
+		SrcMAC:    "02:00:00:00:00:01",
+		DstMAC:    "02:00:00:00:00:02",
+		Interface: &CaptureInterface{Name: "span0", Index: 3, Comment: "tenant port"},
+	}
+
+	// the capture columns are opt-in, the rows keep their 22 columns
+	if row := string(csvOutput{}.Marshal(result)); strings.Count(row, ",") != 21 {
+		t.Errorf("unexpected CSV row %s", row)
+	}
+	withMetadata := csvOutput{captureMetadata: true}
+	if row := string(withMetadata.Marshal(result)); !strings.HasSuffix(row, ",100,02:00:00:00:00:01,02:00:00:00:00:02,span0") {
+		t.Errorf("unexpected CSV row %s", row)
+	}
+	if header, _ := withMetadata.Init(); !strings.HasSuffix(header, ",ID,VLAN,SrcMAC,DstMAC,Interface") {
+		t.Errorf("unexpected CSV header %s", header)
+	}
+
+	var activity OCSFDNSActivity
+	if err := json.Unmarshal(OCSFMarshaler{}.Marshal(result), &activity); err != nil {
+		t.Fatal(err)
+	}
+	if activity.SrcEndpoint.MAC != result.SrcMAC || activity.DstEndpoint.MAC != result.DstMAC || activity.SrcEndpoint.VLANUID != "100" {
+		t.Errorf("unexpected OCSF endpoints %+v %+v", activity.SrcEndpoint, activity.DstEndpoint)
+	}
+	if activity.Device == nil || activity.Device.InterfaceName != "span0" || activity.Device.InterfaceUID != "3" {
+		t.Errorf("unexpected OCSF device %+v", activity.Device)
+	}
+
+	var decoded DNSResultBinary
+	if err := gob.NewDecoder(bytes.NewReader(gobOutput{}.Marshal(result))).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.VLANs, result.VLANs) || decoded.SrcMAC != result.SrcMAC || *decoded.Interface != *result.Interface {
+		t.Errorf("unexpected gob record %+v", decoded)
+	}
+
+	var out bytes.Buffer
+	tmpl := template.Must(template.New("").Parse("{{.SrcMAC}} {{.VLANs}} {{.Interface.Name}}"))
+	if err := tmpl.Execute(&out, result); err != nil || out.String() != "02:00:00:00:00:01 [100 200] span0" {
+		t.Errorf("unexpected template output %q %v", out.String(), err)
+	}
+}
+
 func BenchmarkJSONMarshal(b *testing.B) {
 	marshaller := jsonOutput{}
 	marshaller.Init()
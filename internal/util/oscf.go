@@ -2,6 +2,8 @@ package util
 
 import (
 	"encoding/json"
+	"strconv"
+
 	"github.com/miekg/dns"
 )
 
@@ -23,6 +25,8 @@ type OCSFDNSActivity struct {
 	// Network endpoints
 	SrcEndpoint *OCSFNetworkEndpoint `json:"src_endpoint,omitempty"`
 	DstEndpoint *OCSFNetworkEndpoint `json:"dst_endpoint,omitempty"`
+	// Device is the capture interface
+	Device *OCSFDevice `json:"device,omitempty"`
 
 	Metadata struct {
 		Product struct {
@@ -40,6 +44,14 @@ type OCSFNetworkEndpoint struct {
 	Hostname string `json:"hostname,omitempty"`
 	Domain   string `json:"domain,omitempty"`
 	Protocol string `json:"protocol,omitempty"`
+	MAC      string `json:"mac,omitempty"`
+	VLANUID  string `json:"vlan_uid,omitempty"`
+}
+
+// OCSFDevice represents the device that saw the traffic in OCSF format
+type OCSFDevice struct {
+	InterfaceName string `json:"interface_name,omitempty"`
+	InterfaceUID  string `json:"interface_uid,omitempty"`
 }
 
 // OCSFDNSQuery matches OCSF DNS query schema
@@ -112,16 +124,31 @@ func ToOCSF(result *DNSResult) *OCSFDNSActivity {
 	activity.RCodeID = result.DNS.Rcode
 
 	// Add network endpoints
+	var vlan string
+	if len(result.VLANs) > 0 {
+		vlan = strconv.Itoa(int(result.VLANs[0]))
+	}
 	activity.SrcEndpoint = &OCSFNetworkEndpoint{
 		IP:       result.SrcIP.String(),
 		Port:     int(result.SrcPort),
 		Protocol: result.Protocol,
+		MAC:      result.SrcMAC,
+		VLANUID:  vlan,
 	}
 
 	activity.DstEndpoint = &OCSFNetworkEndpoint{
 		IP:       result.DstIP.String(),
 		Port:     int(result.DstPort),
 		Protocol: result.Protocol,
+		MAC:      result.DstMAC,
+		VLANUID:  vlan,
+	}
+
+	if result.Interface != nil {
+		activity.Device = &OCSFDevice{
+			InterfaceName: result.Interface.Name,
+			InterfaceUID:  strconv.Itoa(result.Interface.Index),
+		}
 	}
 
 	return activity
@@ -0,0 +1,268 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package util
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mkdns "github.com/miekg/dns"
+	"github.com/rcrowley/go-metrics"
+)
+
+// rate limiting happens in the dispatcher, before the results are fanned out
+// to the outputs, so every output sees the same capped stream
+type rateLimitConfig struct {
+	RateLimitPerClient       float64       `long:"ratelimitperclient"       ini-name:"ratelimitperclient"       env:"DNSMONSTER_RATELIMITPERCLIENT"       default:"0"      description:"Maximum number of records per second per client IP that reach the outputs. 0 disables the rate limiter"`
+	RateLimitBurst           uint          `long:"ratelimitburst"           ini-name:"ratelimitburst"           env:"DNSMONSTER_RATELIMITBURST"           default:"0"      description:"Token bucket size of each client. 0 means the same as --rateLimitPerClient"`
+	RateLimitByQname         bool          `long:"ratelimitbyqname"         ini-name:"ratelimitbyqname"         env:"DNSMONSTER_RATELIMITBYQNAME"         description:"Key the rate limiter on client IP and question name instead of client IP only"`
+	RateLimitSummaryInterval time.Duration `long:"ratelimitsummaryinterval" ini-name:"ratelimitsummaryinterval" env:"DNSMONSTER_RATELIMITSUMMARYINTERVAL" default:"60s"    description:"Interval between summary records carrying the suppressed count of each rate limited client"`
+	RateLimitMaxClients      uint          `long:"ratelimitmaxclients"      ini-name:"ratelimitmaxclients"      env:"DNSMONSTER_RATELIMITMAXCLIENTS"      default:"100000" description:"Maximum number of clients tracked by the rate limiter. Records from untracked clients are not limited"`
+	RateLimitTopClients      uint          `long:"ratelimittopclients"      ini-name:"ratelimittopclients"      env:"DNSMONSTER_RATELIMITTOPCLIENTS"      default:"10"     description:"Number of most suppressed clients exposed in metrics"`
+}
+
+func (c rateLimitConfig) validate() error {
+	if c.RateLimitPerClient < 0 {
+		return fmt.Errorf("--rateLimitPerClient must be equal or greater than 0")
+	}
+	if c.RateLimitPerClient > 0 && c.RateLimitSummaryInterval <= 0 {
+		return fmt.Errorf("--rateLimitSummaryInterval must be greater than 0")
+	}
+	return nil
+}
+
+// RateLimitSummary is set on the records generated by the rate limiter in
+// place of the records it dropped
+type RateLimitSummary struct {
+	Interval   time.Duration
+	Suppressed uint64
+}
+
+type tokenBucket struct {
+	tokens     float64
+	last       time.Time
+	suppressed uint64
+	// the first suppressed record of the interval, used to build the summary
+	sample DNSResult
+}
+
+// the dots and colons of the IPs would be taken as separators by the metric
+// endpoints
+var rateLimitMetricReplacer = strings.NewReplacer(".", "_", ":", "_")
+
+// RateLimiter is a token bucket limiter keyed by client IP (the destination of a response), and optionally
+// the question name. The packet timestamps are used as the clock so it
+// behaves the same on live and offline captures.
+type RateLimiter struct {
+	mu          sync.Mutex
+	rate        float64
+	burst       float64
+	byQname     bool
+	maxClients  int
+	topClients  int
+	interval    time.Duration
+	buckets     map[string]*tokenBucket
+	topGauges   map[string]metrics.Gauge
+	suppressed  metrics.Counter
+	untracked   metrics.Counter
+	bucketCount metrics.Gauge
+}
+
+// NewRateLimiter returns a RateLimiter based on the ratelimit flags, or nil
+// if rate limiting is disabled
+func NewRateLimiter() *RateLimiter {
+	c := globalRateLimitConfig
+	if c.RateLimitPerClient <= 0 {
+		return nil
+	}
+	return newRateLimiter(c)
+}
+
+func newRateLimiter(c rateLimitConfig) *RateLimiter {
+	burst := float64(c.RateLimitBurst)
+	if burst == 0 {
+		burst = c.RateLimitPerClient
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:        c.RateLimitPerClient,
+		burst:       burst,
+		byQname:     c.RateLimitByQname,
+		maxClients:  int(c.RateLimitMaxClients),
+		topClients:  int(c.RateLimitTopClients),
+		interval:    c.RateLimitSummaryInterval,
+		buckets:     make(map[string]*tokenBucket),
+		topGauges:   make(map[string]metrics.Gauge),
+		suppressed:  metrics.GetOrRegisterCounter("rateLimitSuppressed", metrics.DefaultRegistry),
+		untracked:   metrics.GetOrRegisterCounter("rateLimitUntracked", metrics.DefaultRegistry),
+		bucketCount: metrics.GetOrRegisterGauge("rateLimitClients", metrics.DefaultRegistry),
+	}
+}
+
+// SummaryInterval returns how often Summaries should be called
+func (r *RateLimiter) SummaryInterval() time.Duration {
+	return r.interval
+}
+
+// clientServer returns the client and the server IPs of the record, the
+// client being the destination of a response
+func clientServer(d *DNSResult) (net.IP, net.IP) {
+	if d.DNS.Response {
+		return d.DstIP, d.SrcIP
+	}
+	return d.SrcIP, d.DstIP
+}
+
+func (r *RateLimiter) key(d *DNSResult) string {
+	client, _ := clientServer(d)
+	if !r.byQname || len(d.DNS.Question) == 0 {
+		return string(client)
+	}
+	return string(client) + "|" + strings.ToLower(d.DNS.Question[0].Name)
+}
+
+// Allow reports whether the record should be sent to the outputs
+func (r *RateLimiter) Allow(d *DNSResult) bool {
+	// generated summary records are never limited
+	if d.RateLimit != nil || d.Upstream != nil {
+		return true
+	}
+	now := d.Timestamp
+	if now.IsZero() {
+		now = time.Now()
+	}
+	key := r.key(d)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.buckets[key]
+	if !ok {
+		if len(r.buckets) >= r.maxClients {
+			r.untracked.Inc(1)
+			return true
+		}
+		b = &tokenBucket{tokens: r.burst, last: now}
+		r.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * r.rate
+		if b.tokens > r.burst {
+			b.tokens = r.burst
+		}
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true
+	}
+	if b.suppressed == 0 {
+		b.sample = *d
+	}
+	b.suppressed++
+	r.suppressed.Inc(1)
+	return false
+}
+
+// Summaries returns one record per client that had records suppressed since
+// the previous call, updates the top suppressed client metrics and forgets
+// about the clients whose bucket has been refilled.
+func (r *RateLimiter) Summaries() []DNSResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	type clientCount struct {
+		client string
+		count  uint64
+	}
+	var top []clientCount
+	var results []DNSResult
+	var latest time.Time
+	for _, b := range r.buckets {
+		if b.last.After(latest) {
+			latest = b.last
+		}
+	}
+	for key, b := range r.buckets {
+		if b.suppressed == 0 {
+			// an idle client with a full bucket is indistinguishable from a new one
+			if b.tokens+latest.Sub(b.last).Seconds()*r.rate >= r.burst {
+				delete(r.buckets, key)
+			}
+			continue
+		}
+		s := b.sample
+		// the summary reads as a query of the client, whatever the direction
+		// of the suppressed record
+		client, server := clientServer(&s)
+		msg := mkdns.Msg{}
+		if len(s.DNS.Question) > 0 {
+			msg.Question = []mkdns.Question{s.DNS.Question[0]}
+		}
+		results = append(results, DNSResult{
+			Timestamp: s.Timestamp,
+			DNS:       msg,
+			IPVersion: s.IPVersion,
+			SrcIP:     client,
+			DstIP:     server,
+			Protocol:  s.Protocol,
+			RateLimit: &RateLimitSummary{Interval: r.interval, Suppressed: b.suppressed},
+		})
+		top = append(top, clientCount{client.String(), b.suppressed})
+		b.suppressed = 0
+		b.sample = DNSResult{}
+	}
+	r.bucketCount.Update(int64(len(r.buckets)))
+
+	// several qnames of the same client are aggregated for the metrics
+	perClient := make(map[string]uint64)
+	for _, t := range top {
+		perClient[t.client] += t.count
+	}
+	top = top[:0]
+	for client, count := range perClient {
+		top = append(top, clientCount{client, count})
+	}
+	sort.Slice(top, func(i, j int) bool { return top[i].count > top[j].count })
+	if len(top) > r.topClients {
+		top = top[:r.topClients]
+	}
+	current := make(map[string]bool, len(top))
+	for _, t := range top {
+		name := "rateLimitTopSuppressed." + rateLimitMetricReplacer.Replace(t.client)
+		current[name] = true
+		g, ok := r.topGauges[name]
+		if !ok {
+			g = metrics.GetOrRegisterGauge(name, metrics.DefaultRegistry)
+			r.topGauges[name] = g
+		}
+		g.Update(int64(t.count))
+	}
+	for name := range r.topGauges {
+		if !current[name] {
+			metrics.DefaultRegistry.Unregister(name)
+			delete(r.topGauges, name)
+		}
+	}
+	return results
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,182 @@
+/* {{{ Copyright (C) 2022 Ali Mosajjal
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>. }}} */
+
+package util
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net"
+	"testing"
+	"time"
+
+	mkdns "github.com/miekg/dns"
+	"github.com/rcrowley/go-metrics"
+)
+
+func rateLimitTestResult(src, qname string, ts time.Time) DNSResult {
+	msg := mkdns.Msg{}
+	msg.SetQuestion(qname, mkdns.TypeA)
+	return DNSResult{
+		Timestamp: ts,
+		DNS:       msg,
+		IPVersion: 4,
+		SrcIP:     net.ParseIP(src).To4(),
+		DstIP:     net.ParseIP("10.0.0.53").To4(),
+		Protocol:  "udp",
+	}
+}
+
+func TestRateLimiterPerClient(t *testing.T) {
+	r := newRateLimiter(rateLimitConfig{
+		RateLimitPerClient:       2,
+		RateLimitSummaryInterval: time.Minute,
+		RateLimitMaxClients:      100,
+		RateLimitTopClients:      5,
+	})
+	start := time.Unix(1700000000, 0)
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		d := rateLimitTestResult("10.0.0.1", "noisy.example.", start)
+		if r.Allow(&d) {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("noisy client got %d records through, want 2", allowed)
+	}
+
+	// another client has its own bucket
+	quiet := rateLimitTestResult("10.0.0.2", "quiet.example.", start)
+	if !r.Allow(&quiet) {
+		t.Error("quiet client should not be limited")
+	}
+
+	// a second later the bucket has been refilled by the rate
+	later := rateLimitTestResult("10.0.0.1", "noisy.example.", start.Add(time.Second))
+	if !r.Allow(&later) {
+		t.Error("noisy client should be allowed after the bucket refilled")
+	}
+
+	summaries := r.Summaries()
+	if len(summaries) != 1 {
+		t.Fatalf("expected 1 summary, got %d", len(summaries))
+	}
+	s := summaries[0]
+	if s.RateLimit == nil || s.RateLimit.Suppressed != 8 {
+		t.Fatalf("expected 8 suppressed records, got %+v", s.RateLimit)
+	}
+	if !s.SrcIP.Equal(net.ParseIP("10.0.0.1")) || s.DNS.Question[0].Name != "noisy.example." {
+		t.Errorf("summary does not describe the suppressed client: %s %v", s.SrcIP, s.DNS.Question)
+	}
+	if metrics.DefaultRegistry.Get("rateLimitTopSuppressed.10_0_0_1") == nil {
+		t.Error("top suppressed client metric should be named after the IP with underscores")
+	}
+	var decoded DNSResultBinary
+	if err := gob.NewDecoder(bytes.NewReader(gobOutput{}.Marshal(s))).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.RateLimit == nil || *decoded.RateLimit != *s.RateLimit {
+		t.Errorf("gob record lost the rate limit summary: %+v", decoded.RateLimit)
+	}
+	if !r.Allow(&s) {
+		t.Error("summary records must never be limited")
+	}
+	if len(r.Summaries()) != 0 {
+		t.Error("suppressed counters should reset after a summary")
+	}
+}
+
+func TestRateLimiterByQname(t *testing.T) {
+	r := newRateLimiter(rateLimitConfig{
+		RateLimitPerClient:       1,
+		RateLimitByQname:         true,
+		RateLimitSummaryInterval: time.Minute,
+		RateLimitMaxClients:      100,
+	})
+	start := time.Unix(1700000000, 0)
+
+	a := rateLimitTestResult("10.0.0.1", "a.example.", start)
+	b := rateLimitTestResult("10.0.0.1", "b.example.", start)
+	if !r.Allow(&a) || !r.Allow(&b) {
+		t.Fatal("different qnames of the same client should have separate buckets")
+	}
+	if r.Allow(&a) {
+		t.Error("second record for the same client and qname should be limited")
+	}
+}
+
+func TestRateLimiterResponses(t *testing.T) {
+	r := newRateLimiter(rateLimitConfig{
+		RateLimitPerClient:       1,
+		RateLimitSummaryInterval: time.Minute,
+		RateLimitMaxClients:      100,
+	})
+	start := time.Unix(1700000000, 0)
+
+	// responses of the same resolver to two clients
+	for _, client := range []string{"10.0.0.1", "10.0.0.2"} {
+		d := rateLimitTestResult("10.0.0.53", "example.", start)
+		d.DNS.Response = true
+		d.DstIP = net.ParseIP(client).To4()
+		if !r.Allow(&d) {
+			t.Fatalf("response to %s should not share the bucket of another client", client)
+		}
+	}
+
+	// the response to a query shares the bucket of its client
+	q := rateLimitTestResult("10.0.0.3", "example.", start)
+	resp := rateLimitTestResult("10.0.0.53", "example.", start)
+	resp.DNS.Response = true
+	resp.DstIP = net.ParseIP("10.0.0.3").To4()
+	if !r.Allow(&q) {
+		t.Fatal("first query of a client should not be limited")
+	}
+	if r.Allow(&resp) {
+		t.Error("response should be limited with the queries of its client")
+	}
+
+	summaries := r.Summaries()
+	if len(summaries) != 1 {
+		t.Fatalf("expected 1 summary, got %d", len(summaries))
+	}
+	if s := summaries[0]; !s.SrcIP.Equal(net.ParseIP("10.0.0.3")) || !s.DstIP.Equal(net.ParseIP("10.0.0.53")) {
+		t.Errorf("summary of a response should describe its client: %s -> %s", s.SrcIP, s.DstIP)
+	}
+}
+
+func TestRateLimiterMaxClients(t *testing.T) {
+	r := newRateLimiter(rateLimitConfig{
+		RateLimitPerClient:       1,
+		RateLimitSummaryInterval: time.Minute,
+		RateLimitMaxClients:      1,
+	})
+	start := time.Unix(1700000000, 0)
+
+	first := rateLimitTestResult("10.0.0.1", "example.", start)
+	r.Allow(&first)
+	for i := 0; i < 5; i++ {
+		d := rateLimitTestResult("10.0.0.2", "example.", start)
+		if !r.Allow(&d) {
+			t.Fatal("clients over the tracking limit should not be limited")
+		}
+	}
+	if len(r.buckets) != 1 {
+		t.Errorf("expected 1 tracked client, got %d", len(r.buckets))
+	}
+}
+
+// vim: foldmethod=marker
@@ -37,6 +37,121 @@ type DNSResult struct {
 	PacketLength uint16
 	Identity     string `json:",omitempty"`
 	Version      string `json:",omitempty"`
+	// MatchedPort is the port that matched --port, and AppProtocol the label
+	// of that port, eg dns, mdns or llmnr
+	MatchedPort uint16 `json:",omitempty"`
+	AppProtocol string `json:",omitempty"`
+	// Tags holds the labels attached to a record by the capture heuristics
+	Tags []string `json:",omitempty"`
+	// SampleWeight is the number of records this record stands for when
+	// sampling is in use. Aggregates can be re-scaled by summing it up.
+	SampleWeight float64 `json:",omitempty"`
+	// Upstream is only set on the periodic summary records generated by the
+	// upstream monitor. DstIP holds the upstream the summary belongs to.
+	Upstream *UpstreamSummary `json:",omitempty"`
+	// RateLimit is only set on the summary records that replace the records
+	// dropped by the rate limiter
+	RateLimit *RateLimitSummary `json:",omitempty"`
+	// EncryptedDNS is only set on the connection records of encrypted DNS
+	// transports. DNS holds a synthetic question for the server name.
+	EncryptedDNS *EncryptedDNSConnection `json:",omitempty"`
+	// Malformed is only set on the records of the DNS payloads that failed to
+	// decode. DNS holds what could be recovered from the payload.
+	Malformed *MalformedDNS `json:",omitempty"`
+	// Encapsulation lists the VLAN tags and tunnels the packet was carried
+	// in, outermost first
+	Encapsulation []Encapsulation `json:",omitempty"`
+	// VLANs lists the VLAN IDs of the Encapsulation, outermost first. SrcMAC
+	// and DstMAC are the addresses of the innermost Ethernet frame, or of the
+	// Linux cooked capture header which only has the source address.
+	VLANs  []uint16 `json:",omitempty"`
+	SrcMAC string   `json:",omitempty"`
+	DstMAC string   `json:",omitempty"`
+	// Interface is the capture interface the packet was read from, not set
+	// for the pcap files which don't name it
+	Interface *CaptureInterface `json:",omitempty"`
+	// Input is the label of the input the record comes from, if one was
+	// given with --input
+	Input string `json:",omitempty"`
+}
+
+// HasDNSMessage tells if DNS holds a message seen on the wire. It doesn't on
+// the upstream summaries and the encrypted DNS connection records, which only
+// carry a synthetic question for the domain filters, so the outputs storing a
+// row per question skip them.
+func (d *DNSResult) HasDNSMessage() bool {
+	return d.Upstream == nil && d.EncryptedDNS == nil
+}
+
+// CaptureInterface describes the interface a packet was captured on. Index
+// is the position of the interface in a pcapng file, or the index of the
+// network interface of the host in a live capture.
+type CaptureInterface struct {
+	Name    string `json:",omitempty"`
+	Index   int
+	Comment string `json:",omitempty"`
+}
+
+// Encapsulation is a VLAN tag or a tunnel header found in front of the IP
+// layer of a packet. ID is the identifier of that header: the VLAN ID, MPLS
+// label, PPPoE session ID, GRE key, ERSPAN session ID, VXLAN or GENEVE VNI,
+// or GTP-U TEID. It is 0 if the header doesn't carry one.
+type Encapsulation struct {
+	Type string // vlan, mpls, pppoe, gre, erspan, vxlan, geneve or gtpu
+	ID   uint32
+}
+
+// EncryptedDNSConnection describes a connection to a DNS-over-TLS, HTTPS or
+// QUIC resolver, as seen in the TLS ClientHello of the client
+type EncryptedDNSConnection struct {
+	Transport string   // dot, doh, doq or doh3
+	SNI       string   `json:",omitempty"`
+	ALPN      []string `json:",omitempty"`
+	JA3       string
+	JA3Hash   string
+	JA4       string
+	// Resolver is the entry of the resolver list the connection matched
+	Resolver string `json:",omitempty"`
+}
+
+// MalformedDNS is a DNS payload that failed to decode, and the error it
+// failed with. The counts are the ones of its header, if it's long enough to
+// have one. Payload is base64 encoded in JSON.
+type MalformedDNS struct {
+	Payload []byte
+	Error   string
+	QDCount uint16 `json:",omitempty"`
+	ANCount uint16 `json:",omitempty"`
+	NSCount uint16 `json:",omitempty"`
+	ARCount uint16 `json:",omitempty"`
+}
+
+// TagNonstandardPort is set on the records detected as DNS on a port not
+// selected by --port
+const TagNonstandardPort = "nonstandard_port"
+
+// TagPoisoningSuspect is set on the LLMNR and NBNS responses coming from a
+// host that answers for more names than a legitimate host would
+const TagPoisoningSuspect = "poisoning_suspect"
+
+// TagMalformed is set on the records of the DNS payloads that failed to
+// decode
+const TagMalformed = "malformed"
+
+// UpstreamSummary holds the aggregated latency and error figures for a
+// single upstream server over one summary interval.
+type UpstreamSummary struct {
+	Interval      time.Duration
+	Queries       int64
+	Responses     int64
+	Timeouts      int64
+	ServFails     int64
+	LatencyMinMs  float64
+	LatencyMeanMs float64
+	LatencyP50Ms  float64
+	LatencyP95Ms  float64
+	LatencyP99Ms  float64
+	LatencyMaxMs  float64
 }
 
 // GenericOutput is an interface to speficy the behaviour of output modules
@@ -30,7 +30,8 @@ import (
 )
 
 var (
-	globalMetricConfig metricConfig
+	globalMetricConfig    metricConfig
+	globalRateLimitConfig rateLimitConfig
 	// GlobalParser is the top-level argument parser. each output, capture, metric etc flag is registered
 	// under Globalparser. This makes it easier for output modules to incorporate their own flags
 	GlobalParser = flags.NewNamedParser("dnsmonster", flags.PassDoubleDash|flags.PrintErrors)
@@ -60,6 +61,7 @@ type generalConfig struct {
 	AllowDomainsFile            string         `long:"allowdomainsfile"            ini-name:"allowdomainsfile"            env:"DNSMONSTER_ALLOWDOMAINSFILE"            default:""                                                        description:"Allow Domains logic input file. Can accept a URL (http:// or https://) or path"`
 	AllowDomainsRefreshInterval time.Duration  `long:"allowdomainsrefreshinterval" ini-name:"allowdomainsrefreshinterval" env:"DNSMONSTER_ALLOWDOMAINSREFRESHINTERVAL" default:"60s"                                                     description:"Hot-Reload allowdomainsfile file interval"`
 	AllowDomainsFileType        string         `long:"allowdomainsfiletype"        ini-name:"allowdomainsfiletype"        env:"DNSMONSTER_ALLOWDOMAINSFILETYPE"        default:""                                                        hidden:"true"`
+	CsvCaptureMetadata          bool           `long:"csvcapturemetadata"          ini-name:"csvcapturemetadata"          env:"DNSMONSTER_CSVCAPTUREMETADATA"          description:"Add the VLAN, SrcMAC, DstMAC and Interface columns to the csv output formats"`
 	SkipTLSVerification         bool           `long:"skiptlsverification"         ini-name:"skiptlsverification"         env:"DNSMONSTER_SKIPTLSVERIFICATION"         description:"Skip TLS verification when making HTTPS connections"`
 	Version                     bool           `long:"version"                     ini-name:"version"                     env:"DNSMONSTER_VERSION"                     description:"show version and quit."                              no-ini:"true"`
 	// used to implement allowdomains logic
@@ -141,6 +143,7 @@ func ProcessFlags(ctx context.Context) {
 	GlobalParser.AddGroup("general", "General Options", &GeneralFlags)
 	GlobalParser.AddGroup("help", "Help Options", &helpOptions)
 	GlobalParser.AddGroup("metric", "Metrics", &globalMetricConfig)
+	GlobalParser.AddGroup("ratelimit", "Per-client rate limiting applied before the outputs", &globalRateLimitConfig)
 	f, err := GlobalParser.Parse()
 	if err != nil {
 		log.Fatalf("Error parsing flags %v with error %s", f, err)
@@ -252,6 +255,10 @@ func ProcessFlags(ctx context.Context) {
 	if GeneralFlags.PacketLimit < 0 {
 		log.Fatal("--packetLimit must be equal or greather than 0")
 	}
+
+	if err := globalRateLimitConfig.validate(); err != nil {
+		log.Fatal(err)
+	}
 }
 
 // vim: foldmethod=marker